@@ -0,0 +1,176 @@
+package app
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/config"
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/proxy"
+)
+
+// proxyKeyHeader carries the proxy token for clients that already use
+// Authorization for something else.
+const proxyKeyHeader = "X-RiftRelay-Key"
+
+// proxyClient is what a token resolves to. The shared PROXY_AUTH_TOKEN is a
+// client with neither a priority nor a quota.
+type proxyClient struct {
+	digest [sha256.Size]byte
+	// Without fixedPriority, X-Priority stays up to the client.
+	fixedPriority bool
+	priority      limiter.Priority
+	quota         *clientQuota
+}
+
+func newProxyClients(token string, clients []config.ProxyClient) []proxyClient {
+	var out []proxyClient
+	if token != "" {
+		out = append(out, proxyClient{digest: sha256.Sum256([]byte(token))})
+	}
+	for _, c := range clients {
+		client := proxyClient{digest: sha256.Sum256([]byte(c.Token))}
+		switch c.Priority {
+		case "high":
+			client.fixedPriority, client.priority = true, limiter.PriorityHigh
+		case "normal":
+			client.fixedPriority, client.priority = true, limiter.PriorityNormal
+		}
+		if c.RateLimit != "" {
+			client.quota = newClientQuota(c.RateLimit)
+		}
+		out = append(out, client)
+	}
+	return out
+}
+
+// requireToken answers 401 unless a request carries one of the clients'
+// tokens as a bearer Authorization or in X-RiftRelay-Key, so that an exposed
+// relay does not spend its Riot key on strangers. The client's priority then
+// replaces X-Priority, and a client over its quota gets 429 before admission.
+// Paths in exempt, matched exactly, are served without a token, and so are
+// CORS preflights when allowPreflight is set, since browsers send those
+// without credentials and the CORS middleware answers them without reaching
+// admission. The token headers are removed before next so the secret is never
+// forwarded upstream.
+func requireToken(clients []proxyClient, exempt []string, allowPreflight bool) func(http.Handler) http.Handler {
+	lookup := func(got string) *proxyClient {
+		if got == "" {
+			return nil
+		}
+		// Comparing digests keeps the comparison constant-time in the token
+		// length, and every client is compared so the match position does
+		// not leak either.
+		sum := sha256.Sum256([]byte(got))
+		var match *proxyClient
+		for i := range clients {
+			if subtle.ConstantTimeCompare(sum[:], clients[i].digest[:]) == 1 {
+				match = &clients[i]
+			}
+		}
+		return match
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.Contains(exempt, r.URL.Path) ||
+				(allowPreflight && r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			scheme, bearer, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+			var client *proxyClient
+			if strings.EqualFold(scheme, "Bearer") {
+				if client = lookup(strings.TrimSpace(bearer)); client != nil {
+					r.Header.Del("Authorization")
+				}
+			}
+			if client == nil {
+				client = lookup(r.Header.Get(proxyKeyHeader))
+			}
+			if client == nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="riftrelay"`)
+				http.Error(w, "missing or invalid proxy token", http.StatusUnauthorized)
+				return
+			}
+			r.Header.Del(proxyKeyHeader)
+
+			if client.quota != nil {
+				if wait, ok := client.quota.take(time.Now()); !ok {
+					w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+					http.Error(w, "client rate limit exceeded", http.StatusTooManyRequests)
+					return
+				}
+			}
+			if client.fixedPriority {
+				r = r.WithContext(proxy.WithPriority(r.Context(), client.priority))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// clientQuota counts a client's requests in fixed windows, the way Riot
+// counts app limits.
+type clientQuota struct {
+	mu      sync.Mutex
+	windows []quotaWindow
+}
+
+type quotaWindow struct {
+	limit  int
+	length time.Duration
+	start  time.Time
+	count  int
+}
+
+// newClientQuota parses "limit:seconds,..." as validated by config.
+func newClientQuota(spec string) *clientQuota {
+	q := &clientQuota{}
+	for part := range strings.SplitSeq(spec, ",") {
+		limit, seconds, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			continue
+		}
+		n, err1 := strconv.Atoi(strings.TrimSpace(limit))
+		s, err2 := strconv.Atoi(strings.TrimSpace(seconds))
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		q.windows = append(q.windows, quotaWindow{limit: n, length: time.Duration(s) * time.Second})
+	}
+	return q
+}
+
+// take counts a request at now if every window has room, and otherwise
+// reports how long until all the full ones have reset.
+func (q *clientQuota) take(now time.Time) (time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var wait time.Duration
+	for i := range q.windows {
+		w := &q.windows[i]
+		if now.Sub(w.start) >= w.length {
+			w.start, w.count = now, 0
+		}
+		if w.count >= w.limit {
+			wait = max(wait, w.start.Add(w.length).Sub(now))
+		}
+	}
+	if wait > 0 {
+		return wait, false
+	}
+	for i := range q.windows {
+		q.windows[i].count++
+	}
+	return 0, true
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/router"
+)
+
+// limiterPlanHandler serves the admission plan for ?region=...&pattern=...,
+// where pattern may be a route template or a concrete Riot API path.
+func limiterPlanHandler(l *limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := strings.TrimSpace(r.URL.Query().Get("region"))
+		pattern := strings.TrimSpace(r.URL.Query().Get("pattern"))
+		if region == "" || pattern == "" {
+			http.Error(w, "region and pattern query parameters are required", http.StatusBadRequest)
+			return
+		}
+
+		info, err := router.ParsePath("/" + region + "/" + strings.TrimPrefix(pattern, "/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		plan, err := l.Plan(r.Context(), info.Region, info.Bucket)
+		if err != nil {
+			http.Error(w, "limiter unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(plan); err != nil {
+			http.Error(w, "cannot encode plan", http.StatusInternalServerError)
+		}
+	})
+}
+
+// limiterQueuesHandler lists the buckets with waiting admissions.
+func limiterQueuesHandler(l *limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queues, err := l.Queues(r.Context())
+		if err != nil {
+			http.Error(w, "limiter unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(queues); err != nil {
+			http.Error(w, "cannot encode queues", http.StatusInternalServerError)
+		}
+	})
+}
+
+// limiterResetHandler clears learned limits, optionally scoped by ?region= or
+// ?bucket=, and reports how many rate states were removed.
+func limiterResetHandler(l *limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		region := strings.TrimSpace(r.URL.Query().Get("region"))
+		bucket := strings.TrimSpace(r.URL.Query().Get("bucket"))
+
+		cleared, err := l.Reset(r.Context(), region, bucket)
+		if err != nil {
+			http.Error(w, "limiter unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(map[string]int{"cleared": cleared})
+	})
+}
+
+// limiterConfigRequest is the body of POST /debug/limiter/config. Durations
+// use Go syntax ("250ms"); omitted fields keep their value.
+type limiterConfigRequest struct {
+	QueueCapacity    *int    `json:"queue_capacity"`
+	AdditionalWindow *string `json:"additional_window"`
+	MinSpacing       *string `json:"min_spacing"`
+}
+
+type limiterConfigResponse struct {
+	QueueCapacity    int    `json:"queue_capacity"`
+	AdditionalWindow string `json:"additional_window"`
+	MinSpacing       string `json:"min_spacing"`
+}
+
+// limiterConfigHandler changes mutable limiter settings until the next
+// restart and reports the settings in effect.
+func limiterConfigHandler(l *limiter.Limiter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body limiterConfigRequest
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&body); err != nil {
+			http.Error(w, "invalid JSON body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		tuning := limiter.Tuning{QueueCapacity: body.QueueCapacity}
+		var err error
+		if tuning.AdditionalWindow, err = parseOptionalDuration("additional_window", body.AdditionalWindow); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if tuning.MinSpacing, err = parseOptionalDuration("min_spacing", body.MinSpacing); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := tuning.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		settings, err := l.Tune(r.Context(), tuning)
+		if err != nil {
+			http.Error(w, "limiter unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(limiterConfigResponse{
+			QueueCapacity:    settings.QueueCapacity,
+			AdditionalWindow: settings.AdditionalWindow.String(),
+			MinSpacing:       settings.MinSpacing.String(),
+		})
+	})
+}
+
+func parseOptionalDuration(name string, value *string) (*time.Duration, error) {
+	if value == nil {
+		return nil, nil
+	}
+	d, err := time.ParseDuration(strings.TrimSpace(*value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return &d, nil
+}
@@ -0,0 +1,46 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// keyValidationPath is a cheap authenticated platform endpoint.
+const keyValidationPath = "/lol/status/v4/platform-data"
+
+// validateKeys calls keyValidationPath once per key and fails if Riot answers
+// 401 or 403 for any of them. Other failures are only logged so that a Riot
+// outage does not keep the relay from starting.
+func validateKeys(ctx context.Context, client *http.Client, region string, tokens []string) error {
+	var errs []error
+	for i, token := range tokens {
+		status, err := probeKey(ctx, client, region, token)
+		switch {
+		case err != nil:
+			log.Printf("key validation: key %d: %v", i, err)
+		case status == http.StatusUnauthorized || status == http.StatusForbidden:
+			errs = append(errs, fmt.Errorf("key %d rejected by Riot with status %d", i, status))
+		case status < 200 || status > 299:
+			log.Printf("key validation: key %d: unexpected status %d", i, status)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func probeKey(ctx context.Context, client *http.Client, region, token string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+region+".api.riotgames.com"+keyValidationPath, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("X-Riot-Token", token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode, nil
+}
@@ -7,17 +7,25 @@ import (
 	"log"
 	"net/http"
 	"net/http/pprof"
+	"sync"
+	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
 	"github.com/renja-g/RiftRelay/internal/config"
 	"github.com/renja-g/RiftRelay/internal/limiter"
 	"github.com/renja-g/RiftRelay/internal/metrics"
 	"github.com/renja-g/RiftRelay/internal/proxy"
+	"github.com/renja-g/RiftRelay/internal/router"
 	"github.com/renja-g/RiftRelay/internal/swagger"
+	"github.com/renja-g/RiftRelay/internal/transport"
 )
 
+const routesFromSpecTimeout = 15 * time.Second
+
 type options struct {
-	proxyOptions   []proxy.Option
-	swaggerHandler http.Handler
+	proxyOptions        []proxy.Option
+	swaggerHandler      http.Handler
+	keyValidationClient *http.Client
 }
 
 type Option func(*options)
@@ -34,10 +42,20 @@ func WithSwaggerHandler(handler http.Handler) Option {
 	}
 }
 
+// WithKeyValidationClient sets the HTTP client used by the startup key check.
+func WithKeyValidationClient(client *http.Client) Option {
+	return func(o *options) {
+		o.keyValidationClient = client
+	}
+}
+
 type Server struct {
 	cfg     config.Config
 	server  *http.Server
 	limiter *limiter.Limiter
+	keys    *proxy.Keys
+	// reloadMu serializes ReloadKeys.
+	reloadMu sync.Mutex
 }
 
 func New(cfg config.Config, opts ...Option) (*Server, error) {
@@ -46,17 +64,64 @@ func New(cfg config.Config, opts ...Option) (*Server, error) {
 		opt(&o)
 	}
 
+	// The key check and the proxy share one transport so the check goes out
+	// the same way, egress proxy included, as proxied traffic.
+	base := transport.New(cfg.Upstream)
+	if cfg.EgressProxyURL != "" {
+		if err := transport.WithEgressProxy(base, cfg.EgressProxyURL); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.ValidateKeyOnStart {
+		client := o.keyValidationClient
+		if client == nil {
+			client = &http.Client{Transport: base}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.KeyValidationTimeout)
+		err := validateKeys(ctx, client, cfg.KeyValidationRegion, cfg.Tokens)
+		cancel()
+		if err != nil {
+			return nil, fmt.Errorf("validate API keys: %w", err)
+		}
+	}
+
+	trustedProxies, err := clientip.ParseTrusted(cfg.TrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+
 	var collector *metrics.Collector
 	if cfg.MetricsEnabled {
-		collector = metrics.NewCollector()
+		collector = metrics.NewCollector(metrics.WithDurationBuckets(cfg.MetricsBuckets))
 	}
 
 	limiterCfg := limiter.Config{
-		KeyCount:         len(cfg.Tokens),
-		QueueCapacity:    cfg.QueueCapacity,
-		AdditionalWindow: cfg.AdditionalWindow,
-		DefaultAppLimits: cfg.DefaultAppLimits,
-		RateBudgets:      limiterRateBudgets(cfg.RateBudgets),
+		KeyCount:                 len(cfg.Tokens),
+		QueueCapacity:            cfg.QueueCapacity,
+		QueueFullPolicy:          limiter.QueueFullPolicy(cfg.QueueFullPolicy),
+		ColdStartPolicy:          limiter.ColdStartPolicy(cfg.ColdStartPolicy),
+		QueueOrder:               limiter.QueueOrder(cfg.QueueOrder),
+		AdditionalWindow:         cfg.AdditionalWindow,
+		DefaultAppLimits:         cfg.DefaultAppLimits,
+		DefaultMethodLimits:      cfg.DefaultMethodLimits,
+		RateBudgets:              limiterRateBudgets(cfg.RateBudgets),
+		ObserveBufferSize:        cfg.ObserveBufferSize,
+		DisablePacing:            cfg.DisablePacing,
+		LimitHeadroomFraction:    cfg.LimitHeadroom,
+		RejectWhenAllBlocked:     cfg.RejectWhenAllBlocked,
+		RejectPastDeadline:       cfg.RejectPastTimeout,
+		KeyWeights:               cfg.KeyWeights,
+		PriorityWeights:          limiter.PriorityWeights{High: cfg.PriorityWeightHigh, Normal: cfg.PriorityWeightNormal},
+		QueueDepthInterval:       cfg.QueueDepthInterval,
+		MaxEstimatedWait:         cfg.MaxEstimatedWait,
+		KeyAffinity:              cfg.KeyAffinity,
+		KeyAffinityFallback:      cfg.KeyAffinityFallback,
+		DisableKeyAfterForbidden: cfg.DisableKeyAfter403,
+		PacingJitterFraction:     cfg.PacingJitterFraction,
+		MinSpacing:               cfg.MinSpacing,
+		MinSpacingOverrides:      cfg.MinSpacingOverrides,
+		DefaultRetryAfter:        cfg.DefaultRetryAfter,
 	}
 	if collector != nil {
 		limiterCfg.Metrics = collector
@@ -67,20 +132,83 @@ func New(cfg config.Config, opts ...Option) (*Server, error) {
 		return nil, fmt.Errorf("create limiter: %w", err)
 	}
 
+	keys := proxy.NewKeys(cfg.Tokens)
 	proxyOptions := []proxy.Option{
+		proxy.WithKeys(keys),
 		proxy.WithLimiter(l),
 	}
+	if cfg.EgressProxyURL != "" {
+		proxyOptions = append(proxyOptions, proxy.WithBaseTransport(base))
+	}
 	if collector != nil {
 		proxyOptions = append(proxyOptions, proxy.WithMetrics(collector))
 	}
+	if len(cfg.CORSOrigins) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithCORS(proxy.CORSConfig{AllowedOrigins: cfg.CORSOrigins}))
+	}
+	if len(cfg.StripRequestHeaders) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithStrippedHeaders(cfg.StripRequestHeaders...))
+	}
+	if len(cfg.AllowResponseHeaders) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithAllowedResponseHeaders(cfg.AllowResponseHeaders...))
+	} else if len(cfg.StripResponseHeaders) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithStrippedResponseHeaders(cfg.StripResponseHeaders...))
+	}
+	if len(cfg.AdmissionBypassPrefixes) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithAdmissionBypass(cfg.AdmissionBypassPrefixes...))
+	}
+	if len(cfg.ResponseCacheTTLs) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithResponseCache(cfg.ResponseCacheTTLs, int64(cfg.ResponseCacheMaxBytes)))
+		proxyOptions = append(proxyOptions, proxy.WithStaleOnError(cfg.ResponseCacheStaleOnError...))
+	}
+	if cfg.PacingHeaders {
+		proxyOptions = append(proxyOptions, proxy.WithPacingHeaders())
+	}
+	if cfg.CircuitBreakerThreshold > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithCircuitBreaker(cfg.CircuitBreakerThreshold, cfg.CircuitBreakerWindow, cfg.CircuitBreakerCooldown))
+	}
+	if cfg.MaxConcurrentPerIP > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithClientConcurrencyLimit(cfg.MaxConcurrentPerIP))
+	}
+	if len(trustedProxies) > 0 {
+		proxyOptions = append(proxyOptions, proxy.WithTrustedProxies(trustedProxies))
+	}
+	if cfg.ForwardClientIP {
+		proxyOptions = append(proxyOptions, proxy.WithClientIPForwarding())
+	}
+	if cfg.CoalesceRequests {
+		proxyOptions = append(proxyOptions, proxy.WithRequestCoalescing())
+	}
+	if cfg.CoalesceColdStart {
+		proxyOptions = append(proxyOptions, proxy.WithColdStartCoalescing())
+	}
 	proxyOptions = append(proxyOptions, o.proxyOptions...)
 
+	spec := swagger.NewHandler(cfg.SwaggerSpecURL, cfg.SwaggerCacheTTL)
+	spec.SetTrustedProxies(trustedProxies)
+	spec.AddSpecURLs(cfg.SwaggerExtraSpecURLs...)
+	spec.SetBasePath(cfg.BasePath)
+	if cfg.RoutesFromSpec || cfg.ValidateMethods {
+		loadFromSpec(spec, cfg.RoutesFromSpec, cfg.ValidateMethods)
+	}
+	for _, pattern := range cfg.ExtraPatterns {
+		if err := router.RegisterPattern(pattern); err != nil {
+			return nil, fmt.Errorf("EXTRA_PATH_PATTERNS: %w", err)
+		}
+	}
+
 	handler := proxy.New(cfg, proxyOptions...)
+	if len(cfg.WarmupPatterns) > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.WarmupTimeout)
+		warmupLimits(ctx, handler, cfg.WarmupPatterns, len(cfg.Tokens), cfg.WarmupConcurrency)
+		cancel()
+	}
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
 		w.WriteHeader(http.StatusNoContent)
 	})
+	mux.Handle("GET /version", versionHandler())
 	mux.Handle("/", handler)
 	if collector != nil {
 		mux.Handle("/metrics", collector)
@@ -92,17 +220,40 @@ func New(cfg config.Config, opts ...Option) (*Server, error) {
 		mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
 		mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
 	}
+	if cfg.DebugEnabled {
+		mux.Handle("GET /debug/routes", router.RoutesHandler())
+		mux.Handle("GET /debug/limiter/plan", limiterPlanHandler(l))
+		mux.Handle("POST /debug/limiter/reset", limiterResetHandler(l))
+		mux.Handle("POST /debug/limiter/config", limiterConfigHandler(l))
+		mux.Handle("GET /debug/queues", limiterQueuesHandler(l))
+	}
 	if cfg.SwaggerEnabled {
 		swaggerHandler := o.swaggerHandler
 		if swaggerHandler == nil {
-			swaggerHandler = swagger.NewHandler()
+			swaggerHandler = spec
 		}
 		mux.Handle("/swagger/", swaggerHandler)
+	} else {
+		// Keep /swagger/ from being proxied to a "swagger" region.
+		mux.Handle("/swagger/", http.NotFoundHandler())
+	}
+
+	root := http.Handler(mux)
+	if cfg.ProxyAuthToken != "" || len(cfg.ProxyClients) > 0 {
+		clients := newProxyClients(cfg.ProxyAuthToken, cfg.ProxyClients)
+		root = requireToken(clients, cfg.ProxyAuthExempt, len(cfg.CORSOrigins) > 0)(mux)
+	}
+	if cfg.BasePath != "" {
+		// Every route moves under the prefix, which is gone by the time the
+		// router reads the region, and anything outside it is a 404.
+		mounted := http.NewServeMux()
+		mounted.Handle(cfg.BasePath+"/", http.StripPrefix(cfg.BasePath, root))
+		root = mounted
 	}
 
 	srv := &http.Server{
 		Addr:              fmt.Sprintf(":%d", cfg.Port),
-		Handler:           mux,
+		Handler:           root,
 		ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
 		ReadTimeout:       cfg.Server.ReadTimeout,
 		WriteTimeout:      cfg.Server.WriteTimeout,
@@ -113,9 +264,43 @@ func New(cfg config.Config, opts ...Option) (*Server, error) {
 		cfg:     cfg,
 		server:  srv,
 		limiter: l,
+		keys:    keys,
 	}, nil
 }
 
+// loadFromSpec fetches the OpenAPI spec once and installs its path patterns
+// and per-pattern methods as requested. Failures are logged and leave the
+// built-in patterns, and no method validation, in place.
+func loadFromSpec(spec *swagger.Handler, patterns, methods bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), routesFromSpecTimeout)
+	defer cancel()
+
+	// Only Riot's own document describes routes; added ones are other APIs.
+	raw, err := spec.PrimarySpec(ctx)
+	if err != nil {
+		log.Printf("routes from spec: %v; using built-in patterns without method validation", err)
+		return
+	}
+	if patterns {
+		loaded, err := router.PatternsFromSpec(raw)
+		if err != nil {
+			log.Printf("routes from spec: %v; using built-in patterns", err)
+		} else {
+			router.UsePathPatterns(loaded)
+			log.Printf("routes from spec: loaded %d path patterns", len(loaded))
+		}
+	}
+	if methods {
+		loaded, err := router.MethodsFromSpec(raw)
+		if err != nil {
+			log.Printf("methods from spec: %v; methods are not validated", err)
+		} else {
+			router.UsePathMethods(loaded)
+			log.Printf("methods from spec: loaded methods for %d path patterns", len(loaded))
+		}
+	}
+}
+
 func limiterRateBudgets(budgets map[string]config.RateBudget) map[string]limiter.BudgetConfig {
 	if len(budgets) == 0 {
 		return nil
@@ -135,6 +320,42 @@ func limiterRateBudgets(budgets map[string]config.RateBudget) map[string]limiter
 	return out
 }
 
+// ReloadKeys replaces the Riot API keys without a restart. Key i keeps the
+// limiter state of the old key i only if its token is unchanged; a new token
+// starts over on the default limits. Requests admitted on a removed key are
+// re-admitted before they are sent.
+func (s *Server) ReloadKeys(ctx context.Context, tokens []string) error {
+	if len(tokens) == 0 {
+		return errors.New("no API keys")
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	old := s.keys.Load()
+	var replaced []int
+	for i := range min(len(old), len(tokens)) {
+		if old[i] != tokens[i] {
+			replaced = append(replaced, i)
+		}
+	}
+	if len(tokens) < len(old) {
+		// Stop granting the removed keys before their tokens go.
+		if err := s.limiter.SetKeyCount(ctx, len(tokens), replaced...); err != nil {
+			return err
+		}
+		s.keys.Store(tokens)
+	} else {
+		// New keys need their tokens before the limiter grants them.
+		s.keys.Store(tokens)
+		if err := s.limiter.SetKeyCount(ctx, len(tokens), replaced...); err != nil {
+			s.keys.Store(old)
+			return err
+		}
+	}
+	log.Printf("RiftRelay reloaded %d API key(s)", len(tokens))
+	return nil
+}
+
 func (s *Server) Handler() http.Handler {
 	return s.server.Handler
 }
@@ -156,7 +377,7 @@ func (s *Server) Start(ctx context.Context) error {
 
 	select {
 	case <-ctx.Done():
-		stopCtx, cancel := context.WithTimeout(context.Background(), s.cfg.ShutdownTimeout)
+		stopCtx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout())
 		defer cancel()
 		return s.Shutdown(stopCtx)
 	case err := <-errCh:
@@ -167,6 +388,15 @@ func (s *Server) Start(ctx context.Context) error {
 	}
 }
 
+// shutdownTimeout guards against a Config built without config.Load, whose
+// zero ShutdownTimeout would cut off in-flight requests immediately.
+func (s *Server) shutdownTimeout() time.Duration {
+	if s.cfg.ShutdownTimeout <= 0 {
+		return config.DefaultShutdownTimeout
+	}
+	return s.cfg.ShutdownTimeout
+}
+
 func (s *Server) Shutdown(ctx context.Context) error {
 	var errs []error
 	if err := s.server.Shutdown(ctx); err != nil {
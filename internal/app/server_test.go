@@ -1,12 +1,24 @@
 package app
 
 import (
+	"context"
+	"encoding/json"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/synctest"
+	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
+	"github.com/renja-g/RiftRelay/internal/config"
 	"github.com/renja-g/RiftRelay/internal/proxy"
+	"github.com/renja-g/RiftRelay/internal/router"
+	"github.com/renja-g/RiftRelay/internal/swagger"
 	"github.com/renja-g/RiftRelay/internal/testutil"
 )
 
@@ -66,6 +78,597 @@ func TestServerHandlerOfflineEndpoints(t *testing.T) {
 	}
 }
 
+func TestServerProxyAuthToken(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.ProxyAuthToken = "relay-secret"
+	cfg.ProxyAuthExempt = []string{"/healthz", "/metrics", "/version"}
+	var (
+		mu       sync.Mutex
+		upstream []http.Header
+	)
+	server, err := New(
+		cfg,
+		WithSwaggerHandler(http.NotFoundHandler()),
+		WithProxyOptions(proxy.WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			upstream = append(upstream, r.Header.Clone())
+			mu.Unlock()
+			resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+			resp.Request = r
+			return resp, nil
+		}))),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	tests := []struct {
+		name       string
+		path       string
+		header     http.Header
+		wantStatus int
+	}{
+		{name: "missing token", path: "/europe/riot/account/v1/accounts/me", wantStatus: http.StatusUnauthorized},
+		{name: "wrong bearer", path: "/europe/riot/account/v1/accounts/me", header: http.Header{"Authorization": {"Bearer guess"}}, wantStatus: http.StatusUnauthorized},
+		{name: "wrong key header", path: "/europe/riot/account/v1/accounts/me", header: http.Header{"X-Riftrelay-Key": {"relay-secret-2"}}, wantStatus: http.StatusUnauthorized},
+		{name: "correct bearer", path: "/europe/riot/account/v1/accounts/me", header: http.Header{"Authorization": {"Bearer relay-secret"}}, wantStatus: http.StatusNoContent},
+		{name: "correct key header", path: "/europe/riot/account/v1/accounts/me", header: http.Header{"X-Riftrelay-Key": {"relay-secret"}}, wantStatus: http.StatusNoContent},
+		{name: "exempt healthz", path: "/healthz", wantStatus: http.StatusNoContent},
+		{name: "exempt metrics", path: "/metrics", wantStatus: http.StatusOK},
+		{name: "exempt version", path: "/version", wantStatus: http.StatusOK},
+		{name: "debug is not exempt", path: "/debug/routes", wantStatus: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		for name, values := range tt.header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		if got, want := rec.Code, tt.wantStatus; got != want {
+			t.Fatalf("%s: status = %d, want %d", tt.name, got, want)
+		}
+		if tt.wantStatus == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+			t.Fatalf("%s: 401 without WWW-Authenticate", tt.name)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := len(upstream), 2; got != want {
+		t.Fatalf("upstream requests = %d, want %d", got, want)
+	}
+	for _, header := range upstream {
+		if header.Get("Authorization") != "" || header.Get("X-RiftRelay-Key") != "" {
+			t.Fatalf("proxy token forwarded upstream: %v", header)
+		}
+	}
+}
+
+func TestServerProxyClients(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		cfg := testutil.DummyConfig()
+		cfg.PacingHeaders = true
+		// Client priorities hold even where X-Priority is not trusted.
+		cfg.AllowPriorityBypass = false
+		cfg.ProxyClients = []config.ProxyClient{
+			{Name: "dashboard", Token: "dash-secret", Priority: "high"},
+			{Name: "batch", Token: "batch-secret", Priority: "normal", RateLimit: "2:10"},
+		}
+		server, err := New(
+			cfg,
+			WithSwaggerHandler(http.NotFoundHandler()),
+			WithProxyOptions(proxy.WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				resp.Request = r
+				return resp, nil
+			}))),
+		)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = server.Shutdown(context.Background()) }()
+
+		serve := func(token, priority string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			req.Header.Set("X-Priority", priority)
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, req)
+			return rec
+		}
+
+		for i := range 3 {
+			rec := serve("dash-secret", "")
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Fatalf("dashboard request %d status = %d, want %d", i, got, want)
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Priority"), "high"; got != want {
+				t.Fatalf("dashboard priority = %q, want %q", got, want)
+			}
+		}
+
+		windowStart := time.Now()
+		for i := range 2 {
+			rec := serve("batch-secret", "high")
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Fatalf("batch request %d status = %d, want %d", i, got, want)
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Priority"), "normal"; got != want {
+				t.Fatalf("batch priority = %q, want %q", got, want)
+			}
+		}
+		rec := serve("batch-secret", "high")
+		if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+			t.Fatalf("batch over quota status = %d, want %d", got, want)
+		}
+		// The window opened with the first batch request, before pacing
+		// spread out the second.
+		remaining := 10*time.Second - time.Since(windowStart)
+		if got, want := rec.Header().Get("Retry-After"), strconv.Itoa(int(math.Ceil(remaining.Seconds()))); got != want {
+			t.Fatalf("batch over quota Retry-After = %q, want %q", got, want)
+		}
+
+		// One client's quota leaves the others alone.
+		if got, want := serve("dash-secret", "").Code, http.StatusNoContent; got != want {
+			t.Fatalf("dashboard after batch quota status = %d, want %d", got, want)
+		}
+	})
+}
+
+func TestServerReloadKeys(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.Tokens = []string{"key-a"}
+	var (
+		mu     sync.Mutex
+		tokens []string
+	)
+	server, err := New(
+		cfg,
+		WithSwaggerHandler(http.NotFoundHandler()),
+		WithProxyOptions(proxy.WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			tokens = append(tokens, r.Header.Get("X-Riot-Token"))
+			mu.Unlock()
+			resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+			resp.Request = r
+			return resp, nil
+		}))),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	serveOnKey := func(index string) int {
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("X-Riot-Token-Index", index)
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if got, want := serveOnKey("1"), http.StatusBadRequest; got != want {
+		t.Fatalf("status on key 1 before reload = %d, want %d", got, want)
+	}
+
+	if err := server.ReloadKeys(t.Context(), []string{"key-a", "key-b"}); err != nil {
+		t.Fatalf("ReloadKeys() error = %v", err)
+	}
+	if got, want := serveOnKey("1"), http.StatusNoContent; got != want {
+		t.Fatalf("status on added key 1 = %d, want %d", got, want)
+	}
+
+	if err := server.ReloadKeys(t.Context(), []string{"key-c"}); err != nil {
+		t.Fatalf("ReloadKeys() error = %v", err)
+	}
+	if got, want := serveOnKey("1"), http.StatusBadRequest; got != want {
+		t.Fatalf("status on removed key 1 = %d, want %d", got, want)
+	}
+	if got, want := serveOnKey("0"), http.StatusNoContent; got != want {
+		t.Fatalf("status on rotated key 0 = %d, want %d", got, want)
+	}
+
+	if err := server.ReloadKeys(t.Context(), nil); err == nil {
+		t.Fatal("ReloadKeys(nil) error = nil, want error")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"key-b", "key-c"}; !slices.Equal(tokens, want) {
+		t.Fatalf("upstream tokens = %v, want %v", tokens, want)
+	}
+}
+
+func TestServerDebugRoutes(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.DebugEnabled = true
+	server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/debug/routes", nil))
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	var table router.RouteTable
+	if err := json.NewDecoder(rec.Body).Decode(&table); err != nil {
+		t.Fatalf("decode routes: %v", err)
+	}
+	if !hasRoute(table, "lol/match", "/lol/match/v5/matches/{matchId}") {
+		t.Fatalf("routes = %+v, want lol/match pattern /lol/match/v5/matches/{matchId}", table.Groups)
+	}
+}
+
+func TestServerDebugLimiterConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.DebugEnabled = true
+	server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/debug/limiter/config", strings.NewReader(body)))
+		return rec
+	}
+
+	rec := post(`{"queue_capacity": 8, "min_spacing": "250ms"}`)
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d: %s", got, want, rec.Body)
+	}
+	if got, want := rec.Body.String(), `{"queue_capacity":8,"additional_window":"`+cfg.AdditionalWindow.String()+`","min_spacing":"250ms"}`+"\n"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+
+	for _, body := range []string{
+		`{"queue_capacity": 0}`,
+		`{"additional_window": "-1s"}`,
+		`{"min_spacing": "soon"}`,
+		`{"observe_buffer_size": 1}`,
+	} {
+		if rec := post(body); rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: status = %d, want %d", body, rec.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestServerSwagger(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, enabled bool) *Server {
+		t.Helper()
+		cfg := testutil.DummyConfig()
+		cfg.SwaggerEnabled = enabled
+		spec := swagger.NewHandlerWithClient("https://example.invalid/openapi.json", 0, &http.Client{
+			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return testutil.HTTPResponse(http.StatusOK, `{"openapi":"3.0.0","paths":{}}`, nil), nil
+			}),
+		})
+		trusted, err := clientip.ParseTrusted([]string{"192.0.2.0/24"})
+		if err != nil {
+			t.Fatalf("ParseTrusted() error = %v", err)
+		}
+		spec.SetTrustedProxies(trusted)
+		server, err := New(cfg, WithSwaggerHandler(spec))
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		t.Cleanup(func() {
+			_ = server.Shutdown(t.Context())
+		})
+		return server
+	}
+
+	t.Run("enabled", func(t *testing.T) {
+		t.Parallel()
+		server := newServer(t, true)
+
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger/", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("/swagger/ status = %d, want %d", got, want)
+		}
+		if got := rec.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/html") {
+			t.Fatalf("/swagger/ Content-Type = %q, want text/html", got)
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/swagger/openapi.json", nil)
+		req.Host = "10.0.0.5:8985"
+		req.Header.Set("X-Forwarded-Proto", "https, http")
+		req.Header.Set("X-Forwarded-Host", "relay.example.com")
+		rec = httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, req)
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("/swagger/openapi.json status = %d, want %d", got, want)
+		}
+		var doc struct {
+			Servers []struct {
+				URL string `json:"url"`
+			} `json:"servers"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&doc); err != nil {
+			t.Fatalf("decode spec: %v", err)
+		}
+		if len(doc.Servers) != 1 || doc.Servers[0].URL != "https://relay.example.com/{region}" {
+			t.Fatalf("servers = %+v, want https://relay.example.com/{region}", doc.Servers)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		t.Parallel()
+		server := newServer(t, false)
+
+		for _, path := range []string{"/swagger/", "/swagger/openapi.json"} {
+			rec := httptest.NewRecorder()
+			server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			if got, want := rec.Code, http.StatusNotFound; got != want {
+				t.Fatalf("%s status = %d, want %d", path, got, want)
+			}
+		}
+	})
+}
+
+func TestServerBasePath(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.BasePath = "/riot"
+	var (
+		mu       sync.Mutex
+		upstream []string
+	)
+	server, err := New(
+		cfg,
+		WithSwaggerHandler(http.NotFoundHandler()),
+		WithProxyOptions(proxy.WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			upstream = append(upstream, r.URL.Host+r.URL.Path)
+			mu.Unlock()
+			resp := testutil.HTTPResponse(http.StatusOK, "{}", nil)
+			resp.Request = r
+			return resp, nil
+		}))),
+	)
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	tests := []struct {
+		path       string
+		wantStatus int
+	}{
+		{path: "/riot/na1/lol/status/v4/platform-data", wantStatus: http.StatusOK},
+		{path: "/riot/healthz", wantStatus: http.StatusNoContent},
+		{path: "/riot/metrics", wantStatus: http.StatusOK},
+		{path: "/na1/lol/status/v4/platform-data", wantStatus: http.StatusNotFound},
+		{path: "/healthz", wantStatus: http.StatusNotFound},
+		{path: "/riotna1/lol/status/v4/platform-data", wantStatus: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if got, want := rec.Code, tt.wantStatus; got != want {
+			t.Fatalf("%s: status = %d, want %d", tt.path, got, want)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := upstream, []string{"na1.api.riotgames.com/lol/status/v4/platform-data"}; !slices.Equal(got, want) {
+		t.Fatalf("upstream requests = %v, want %v", got, want)
+	}
+}
+
+func TestServerVersion(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Shutdown(t.Context())
+	})
+
+	rec := httptest.NewRecorder()
+	server.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/version", nil))
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	var got map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+		t.Fatalf("decode version: %v", err)
+	}
+	for _, field := range []string{"version", "commit", "build_date"} {
+		if got[field] != "dev" {
+			t.Fatalf("%s = %q, want %q", field, got[field], "dev")
+		}
+	}
+}
+
+func TestServerValidateKeyOnStart(t *testing.T) {
+	t.Parallel()
+
+	newServer := func(t *testing.T, status map[string]int) (*Server, []string, error) {
+		t.Helper()
+		cfg := testutil.DummyConfig()
+		cfg.ValidateKeyOnStart = true
+		cfg.KeyValidationRegion = "euw1"
+		cfg.KeyValidationTimeout = time.Second
+
+		var mu sync.Mutex
+		var urls []string
+		client := &http.Client{Transport: testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			urls = append(urls, r.URL.String())
+			mu.Unlock()
+			code, ok := status[r.Header.Get("X-Riot-Token")]
+			if !ok {
+				code = http.StatusOK
+			}
+			return testutil.HTTPResponse(code, "{}", nil), nil
+		})}
+		server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()), WithKeyValidationClient(client))
+		if server != nil {
+			t.Cleanup(func() {
+				_ = server.Shutdown(t.Context())
+			})
+		}
+		return server, urls, err
+	}
+
+	t.Run("rejected key fails startup", func(t *testing.T) {
+		t.Parallel()
+		_, _, err := newServer(t, map[string]int{"test-token-b": http.StatusForbidden})
+		if err == nil {
+			t.Fatal("New() error = nil, want rejected key error")
+		}
+		if !strings.Contains(err.Error(), "key 1 rejected by Riot with status 403") {
+			t.Fatalf("New() error = %q, want key 1 rejection", err)
+		}
+		if strings.Contains(err.Error(), "test-token-b") {
+			t.Fatalf("New() error = %q, must not contain the key", err)
+		}
+	})
+
+	t.Run("valid keys start", func(t *testing.T) {
+		t.Parallel()
+		_, urls, err := newServer(t, nil)
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		want := "https://euw1.api.riotgames.com/lol/status/v4/platform-data"
+		if len(urls) != 2 || urls[0] != want || urls[1] != want {
+			t.Fatalf("probe URLs = %v, want two calls to %s", urls, want)
+		}
+	})
+}
+
+func TestServerWarmup(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		cfg := testutil.DummyConfig()
+		cfg.WarmupPatterns = []string{"/euw1/lol/status/v4/platform-data", "americas/riot/account/v1/accounts/by-riot-id/a/b"}
+		cfg.WarmupConcurrency = 1
+		cfg.WarmupTimeout = time.Second
+
+		var mu sync.Mutex
+		var probes []string
+		upstream := testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			mu.Lock()
+			probes = append(probes, r.Header.Get("X-Riot-Token")+" "+r.URL.String())
+			mu.Unlock()
+			resp := testutil.HTTPResponse(http.StatusOK, "{}", http.Header{
+				"X-App-Rate-Limit":          []string{"20:1"},
+				"X-App-Rate-Limit-Count":    []string{"1:1"},
+				"X-Method-Rate-Limit":       []string{"50:10"},
+				"X-Method-Rate-Limit-Count": []string{"1:10"},
+			})
+			resp.Request = r
+			return resp, nil
+		})
+		server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()), WithProxyOptions(proxy.WithBaseTransport(upstream)))
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = server.Shutdown(context.Background()) }()
+		synctest.Wait()
+
+		want := []string{
+			"test-token-a https://euw1.api.riotgames.com/lol/status/v4/platform-data",
+			"test-token-b https://euw1.api.riotgames.com/lol/status/v4/platform-data",
+			"test-token-a https://americas.api.riotgames.com/riot/account/v1/accounts/by-riot-id/a/b",
+			"test-token-b https://americas.api.riotgames.com/riot/account/v1/accounts/by-riot-id/a/b",
+		}
+		slices.Sort(probes)
+		slices.Sort(want)
+		if !slices.Equal(probes, want) {
+			t.Fatalf("probes = %v, want %v", probes, want)
+		}
+		for _, bucket := range []string{
+			"euw1:lol/status/v4/platform-data",
+			"americas:riot/account/v1/accounts/by-riot-id/{gameName}/{tagLine}",
+		} {
+			if server.limiter.ColdStart(bucket) {
+				t.Fatalf("ColdStart(%q) = true after warmup", bucket)
+			}
+		}
+	})
+}
+
+func hasRoute(table router.RouteTable, service, pattern string) bool {
+	for _, group := range table.Groups {
+		if group.Service != service {
+			continue
+		}
+		for _, p := range group.Patterns {
+			if p == pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestServerShutdownTimeout(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		name       string
+		configured time.Duration
+		want       time.Duration
+	}{
+		{name: "configured", configured: 3 * time.Second, want: 3 * time.Second},
+		{name: "zero uses default", configured: 0, want: config.DefaultShutdownTimeout},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testutil.DummyConfig()
+			cfg.ShutdownTimeout = tc.configured
+			server, err := New(cfg, WithSwaggerHandler(http.NotFoundHandler()))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			t.Cleanup(func() {
+				_ = server.Shutdown(t.Context())
+			})
+
+			if got := server.shutdownTimeout(); got != tc.want {
+				t.Fatalf("shutdownTimeout() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestServerShutdownWithoutStart(t *testing.T) {
 	t.Parallel()
 
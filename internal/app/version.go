@@ -0,0 +1,29 @@
+package app
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Build information, set at link time:
+//
+//	go build -ldflags "-X github.com/renja-g/RiftRelay/internal/app.Version=v1.2.3 ..."
+var (
+	Version   = "dev"
+	Commit    = "dev"
+	BuildDate = "dev"
+)
+
+type versionInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+}
+
+func versionHandler() http.Handler {
+	body, _ := json.Marshal(versionInfo{Version: Version, Commit: Commit, BuildDate: BuildDate})
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write(body)
+	})
+}
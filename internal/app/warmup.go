@@ -0,0 +1,69 @@
+package app
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// warmupLimits sends one GET per probe path and key through handler before
+// the server accepts traffic, so the limiter learns those buckets' app and
+// method limits from Riot instead of pacing their first requests on defaults.
+// Limits are learned per key, hence a probe on every key. At most concurrency
+// probes run at once. Failures are only logged so that a Riot outage does not
+// keep the relay from starting.
+func warmupLimits(ctx context.Context, handler http.Handler, paths []string, keys, concurrency int) {
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, path := range paths {
+		for key := range keys {
+			wg.Go(func() {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if status := probeWarmup(ctx, handler, path, key); status < 200 || status > 299 {
+					log.Printf("warmup: %s key %d: status %d", path, key, status)
+				}
+			})
+		}
+	}
+	wg.Wait()
+}
+
+func probeWarmup(ctx context.Context, handler http.Handler, path string, key int) int {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return http.StatusBadRequest
+	}
+	req.Header.Set("X-Riot-Token-Index", strconv.Itoa(key))
+
+	w := &discardWriter{header: make(http.Header)}
+	handler.ServeHTTP(w, req)
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// discardWriter records a probe's status and drops its body.
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return len(p), nil
+}
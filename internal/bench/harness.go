@@ -70,6 +70,8 @@ func benchConfig() config.Config {
 	cfg := testutil.DummyConfig()
 	cfg.QueueCapacity = 65536
 	cfg.AdmissionTimeout = 0
+	cfg.AdmissionTimeoutHigh = 0
+	cfg.AdmissionTimeoutNormal = 0
 	cfg.AdditionalWindow = 150 * time.Millisecond
 	cfg.DefaultAppLimits = AppRateLimitAssumption
 	cfg.MetricsEnabled = false
@@ -0,0 +1,97 @@
+// Package clientip resolves the client address of a request, believing
+// X-Forwarded-* headers only from trusted proxies.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Trusted is the set of peers whose X-Forwarded-* headers are believed.
+// The zero value trusts no one.
+type Trusted []netip.Prefix
+
+// ParseTrusted accepts CIDRs ("10.0.0.0/8") and bare addresses.
+func ParseTrusted(values []string) (Trusted, error) {
+	trusted := make(Trusted, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+			}
+			trusted = append(trusted, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", value, err)
+		}
+		trusted = append(trusted, prefix.Masked())
+	}
+	return trusted, nil
+}
+
+func (t Trusted) contains(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, prefix := range t {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// TrustsPeer reports whether the immediate peer of r is a trusted proxy.
+func (t Trusted) TrustsPeer(r *http.Request) bool {
+	return len(t) > 0 && t.contains(peerIP(r))
+}
+
+// FromRequest returns the address of the client behind r. X-Forwarded-For is only
+// consulted when the peer is trusted; it is then walked from the right,
+// skipping trusted hops, so a client cannot spoof its address by prepending
+// entries.
+func FromRequest(r *http.Request, trusted Trusted) string {
+	peer := peerIP(r)
+	if !trusted.TrustsPeer(r) {
+		return peer
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if !trusted.contains(hop) {
+			return hop
+		}
+		peer = hop
+	}
+	return peer
+}
+
+// ForwardedValue returns the first value of the X-Forwarded-* header name
+// when the peer of r is trusted, and "" otherwise.
+func ForwardedValue(r *http.Request, name string, trusted Trusted) string {
+	if !trusted.TrustsPeer(r) {
+		return ""
+	}
+	first, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(first)
+}
+
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
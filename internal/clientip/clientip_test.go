@@ -0,0 +1,93 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFromRequest(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := ParseTrusted([]string{"10.0.0.0/8", "192.0.2.1"})
+	if err != nil {
+		t.Fatalf("ParseTrusted() error = %v", err)
+	}
+
+	tests := []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		trusted       Trusted
+		want          string
+		wantForwarded string
+	}{
+		{
+			name:         "no trusted proxies ignores header",
+			remoteAddr:   "10.0.0.1:5000",
+			forwardedFor: []string{"203.0.113.7"},
+			want:         "10.0.0.1",
+		},
+		{
+			name:         "untrusted peer ignores header",
+			remoteAddr:   "198.51.100.4:5000",
+			forwardedFor: []string{"203.0.113.7"},
+			trusted:      trusted,
+			want:         "198.51.100.4",
+		},
+		{
+			name:          "trusted peer uses header",
+			remoteAddr:    "10.0.0.1:5000",
+			forwardedFor:  []string{"203.0.113.7"},
+			trusted:       trusted,
+			want:          "203.0.113.7",
+			wantForwarded: "https",
+		},
+		{
+			name:          "skips trusted hops from the right",
+			remoteAddr:    "192.0.2.1:5000",
+			forwardedFor:  []string{"198.51.100.9, 203.0.113.7", "10.1.2.3"},
+			trusted:       trusted,
+			want:          "203.0.113.7",
+			wantForwarded: "https",
+		},
+		{
+			name:          "all hops trusted falls back to left-most",
+			remoteAddr:    "10.0.0.1:5000",
+			forwardedFor:  []string{"10.0.0.2, 10.0.0.3"},
+			trusted:       trusted,
+			want:          "10.0.0.2",
+			wantForwarded: "https",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			for _, value := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			req.Header.Set("X-Forwarded-Proto", "https")
+
+			if got := FromRequest(req, tt.trusted); got != tt.want {
+				t.Fatalf("FromRequest() = %q, want %q", got, tt.want)
+			}
+			if got := ForwardedValue(req, "X-Forwarded-Proto", tt.trusted); got != tt.wantForwarded {
+				t.Fatalf("ForwardedValue() = %q, want %q", got, tt.wantForwarded)
+			}
+		})
+	}
+}
+
+func TestParseTrustedRejectsInvalid(t *testing.T) {
+	t.Parallel()
+
+	for _, value := range []string{"10.0.0.0/33", "not-an-ip", ""} {
+		if _, err := ParseTrusted([]string{value}); err == nil {
+			t.Fatalf("ParseTrusted(%q) error = nil, want non-nil", value)
+		}
+	}
+}
@@ -1,27 +1,69 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"math"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/renja-g/RiftRelay/internal/clientip"
+	"github.com/renja-g/RiftRelay/internal/router"
+	"github.com/renja-g/RiftRelay/internal/transport"
 )
 
+// defaultStripResponseHeaders are Riot's rate-limit bookkeeping headers,
+// which describe the relay's keys rather than anything a client can act on.
+var defaultStripResponseHeaders = []string{
+	"X-App-Rate-Limit",
+	"X-App-Rate-Limit-Count",
+	"X-Method-Rate-Limit",
+	"X-Method-Rate-Limit-Count",
+}
+
+// DefaultShutdownTimeout is the graceful drain deadline used when
+// SHUTDOWN_TIMEOUT is unset or zero.
+const DefaultShutdownTimeout = 20 * time.Second
+
 const (
 	// User-facing defaults (env-configurable)
-	defaultPort                 = 8985
-	defaultQueueCapacity        = 2048
-	defaultAdmissionTimeout     = 5 * time.Minute
-	defaultAdditionalWindowSize = 150 * time.Millisecond
-	defaultShutdownTimeout      = 20 * time.Second
-	defaultEnableMetrics        = true
-	defaultEnablePprof          = false
-	defaultEnableSwagger        = true
-	defaultUpstreamTimeout      = 0
-	defaultAppRateLimit         = "20:1,100:120"
+	defaultPort                   = 8985
+	defaultQueueCapacity          = 2048
+	defaultAdmissionTimeout       = 5 * time.Minute
+	defaultAdditionalWindowSize   = 150 * time.Millisecond
+	defaultEnableMetrics          = true
+	defaultEnablePprof            = false
+	defaultEnableSwagger          = true
+	defaultAllowPriorityBypass    = true
+	defaultEnableDebug            = false
+	defaultUpstreamTimeout        = 0
+	defaultAppRateLimit           = "20:1,100:120"
+	defaultObserveBufferSize      = 4096
+	defaultMatchRegionPolicy      = "off"
+	defaultQueueFullPolicy        = "reject"
+	defaultColdStartPolicy        = "burst"
+	defaultQueueOrder             = "fifo"
+	defaultMaxRequestBodyBytes    = 1 << 20
+	defaultMaxPathBytes           = 2048
+	defaultMaxPathSegments        = 32
+	defaultQueueDepthInterval     = 5 * time.Second
+	defaultSwaggerCacheTTL        = time.Hour
+	defaultResponseCacheMaxBytes  = 16 << 20
+	defaultKeyValidationRegion    = "na1"
+	defaultKeyValidationTimeout   = 5 * time.Second
+	defaultCircuitBreakerWindow   = 30 * time.Second
+	defaultCircuitBreakerCooldown = 30 * time.Second
+	defaultRetryAfter             = time.Second
+	defaultWarmupConcurrency      = 4
+	defaultWarmupTimeout          = 10 * time.Second
+
+	// Upstream connection pool
+	defaultUpstreamHTTP2 = "auto"
 
 	// HTTP server tuning (internal)
 	defaultReadHeaderTimeout = 10 * time.Second
@@ -30,19 +72,104 @@ const (
 )
 
 type Config struct {
-	Tokens           []string
-	Port             int
-	QueueCapacity    int
-	AdmissionTimeout time.Duration
-	AdditionalWindow time.Duration
-	ShutdownTimeout  time.Duration
-	MetricsEnabled   bool
-	PprofEnabled     bool
-	SwaggerEnabled   bool
-	UpstreamTimeout  time.Duration
-	DefaultAppLimits string
-	RateBudgets      map[string]RateBudget
-	Server           ServerConfig
+	Tokens                    []string
+	Port                      int
+	QueueCapacity             int
+	QueueFullPolicy           string
+	ColdStartPolicy           string
+	QueueOrder                string
+	AdmissionTimeout          time.Duration
+	AdmissionTimeoutHigh      time.Duration
+	AdmissionTimeoutNormal    time.Duration
+	AdditionalWindow          time.Duration
+	ShutdownTimeout           time.Duration
+	MetricsEnabled            bool
+	MetricsBuckets            []float64
+	PprofEnabled              bool
+	SwaggerEnabled            bool
+	DebugEnabled              bool
+	UpstreamTimeout           time.Duration
+	DefaultAppLimits          string
+	DefaultMethodLimits       map[string]string
+	RateBudgets               map[string]RateBudget
+	Server                    ServerConfig
+	Upstream                  transport.Options
+	ObserveBufferSize         int
+	MatchRegionPolicy         string
+	DisablePacing             bool
+	CORSOrigins               []string
+	LimitHeadroom             float64
+	CoalesceColdStart         bool
+	CoalesceRequests          bool
+	PacingHeaders             bool
+	RejectWhenAllBlocked      bool
+	RejectPastTimeout         bool
+	KeyWeights                []int
+	AllowPriorityBypass       bool
+	PriorityWeightHigh        int
+	PriorityWeightNormal      int
+	StripRequestHeaders       []string
+	StripResponseHeaders      []string
+	AllowResponseHeaders      []string
+	DisabledPatterns          []string
+	ExtraPatterns             []string
+	AdmissionBypassPrefixes   []string
+	MaxRequestBodyBytes       int
+	MaxPathBytes              int
+	MaxPathSegments           int
+	QueueDepthInterval        time.Duration
+	ValidateRoutingGroup      bool
+	SwaggerSpecURL            string
+	SwaggerExtraSpecURLs      []string
+	EgressProxyURL            string
+	SwaggerCacheTTL           time.Duration
+	RoutesFromSpec            bool
+	ValidateMethods           bool
+	ResponseCacheTTLs         map[string]time.Duration
+	ResponseCacheMaxBytes     int
+	ResponseCacheStaleOnError []string
+	ValidateKeyOnStart        bool
+	KeyValidationRegion       string
+	KeyValidationTimeout      time.Duration
+	CircuitBreakerThreshold   int
+	CircuitBreakerWindow      time.Duration
+	CircuitBreakerCooldown    time.Duration
+	DefaultRegion             string
+	BasePath                  string
+	ProxyAuthToken            string
+	ProxyAuthExempt           []string
+	ProxyClients              []ProxyClient
+	MaxEstimatedWait          time.Duration
+	KeyAffinity               map[string]int
+	KeyAffinityFallback       bool
+	RegionHostOverrides       map[string]string
+	DisableKeyAfter403        int
+	PacingJitterFraction      float64
+	MinSpacing                time.Duration
+	DefaultRetryAfter         time.Duration
+	MinRetryDelay             time.Duration
+	WarmupPatterns            []string
+	WarmupConcurrency         int
+	WarmupTimeout             time.Duration
+	MaxTotalLatency           time.Duration
+	MinSpacingOverrides       map[string]time.Duration
+	MaxConcurrentPerIP        int
+	TrustedProxies            []string
+	ForwardClientIP           bool
+	ForwardOptions            bool
+}
+
+// ProxyClient is one entry of PROXY_CLIENTS_FILE, a JSON array of objects
+// with these fields.
+type ProxyClient struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
+	// Priority, "high" or "normal", replaces the client's X-Priority. Empty
+	// leaves X-Priority to the client.
+	Priority string `json:"priority"`
+	// RateLimit caps the client's requests in the DEFAULT_APP_RATE_LIMIT
+	// format, e.g. "10:1,300:60". Empty means no cap.
+	RateLimit string `json:"rate_limit"`
 }
 
 type RateBudget struct {
@@ -61,43 +188,201 @@ func Load() (Config, error) {
 	var errs []error
 
 	cfg := Config{
-		Port:             defaultPort,
-		QueueCapacity:    defaultQueueCapacity,
-		AdmissionTimeout: defaultAdmissionTimeout,
-		AdditionalWindow: defaultAdditionalWindowSize,
-		ShutdownTimeout:  defaultShutdownTimeout,
-		MetricsEnabled:   defaultEnableMetrics,
-		PprofEnabled:     defaultEnablePprof,
-		SwaggerEnabled:   defaultEnableSwagger,
-		UpstreamTimeout:  defaultUpstreamTimeout,
-		DefaultAppLimits: defaultAppRateLimit,
+		Port:                   defaultPort,
+		QueueCapacity:          defaultQueueCapacity,
+		QueueFullPolicy:        defaultQueueFullPolicy,
+		ColdStartPolicy:        defaultColdStartPolicy,
+		QueueOrder:             defaultQueueOrder,
+		AdmissionTimeout:       defaultAdmissionTimeout,
+		AdditionalWindow:       defaultAdditionalWindowSize,
+		ShutdownTimeout:        DefaultShutdownTimeout,
+		MetricsEnabled:         defaultEnableMetrics,
+		PprofEnabled:           defaultEnablePprof,
+		SwaggerEnabled:         defaultEnableSwagger,
+		AllowPriorityBypass:    defaultAllowPriorityBypass,
+		ProxyAuthExempt:        []string{"/healthz", "/metrics", "/version"},
+		StripResponseHeaders:   slices.Clone(defaultStripResponseHeaders),
+		DebugEnabled:           defaultEnableDebug,
+		UpstreamTimeout:        defaultUpstreamTimeout,
+		DefaultAppLimits:       defaultAppRateLimit,
+		ObserveBufferSize:      defaultObserveBufferSize,
+		MaxRequestBodyBytes:    defaultMaxRequestBodyBytes,
+		MaxPathBytes:           defaultMaxPathBytes,
+		MaxPathSegments:        defaultMaxPathSegments,
+		QueueDepthInterval:     defaultQueueDepthInterval,
+		SwaggerCacheTTL:        defaultSwaggerCacheTTL,
+		ResponseCacheMaxBytes:  defaultResponseCacheMaxBytes,
+		KeyValidationRegion:    defaultKeyValidationRegion,
+		KeyValidationTimeout:   defaultKeyValidationTimeout,
+		CircuitBreakerWindow:   defaultCircuitBreakerWindow,
+		CircuitBreakerCooldown: defaultCircuitBreakerCooldown,
+		DefaultRetryAfter:      defaultRetryAfter,
+		WarmupConcurrency:      defaultWarmupConcurrency,
+		WarmupTimeout:          defaultWarmupTimeout,
+		MatchRegionPolicy:      defaultMatchRegionPolicy,
 		Server: ServerConfig{
 			ReadHeaderTimeout: defaultReadHeaderTimeout,
 			ReadTimeout:       defaultReadTimeout,
 			IdleTimeout:       defaultIdleTimeout,
 		},
+		Upstream: transport.Options{
+			MaxIdleConns:        transport.DefaultMaxIdleConns,
+			MaxIdleConnsPerHost: transport.DefaultMaxIdleConnsPerHost,
+			IdleConnTimeout:     transport.DefaultIdleConnTimeout,
+			HTTP2:               defaultUpstreamHTTP2,
+		},
 	}
 
-	tokens := splitCSVEnv("RIOT_TOKEN")
-	if len(tokens) == 0 {
-		errs = append(errs, fmt.Errorf("RIOT_TOKEN env var is required"))
+	cfg.CORSOrigins = splitCSVEnv("CORS_ALLOWED_ORIGINS")
+
+	if tokens, err := LoadTokens(); err != nil {
+		errs = append(errs, err)
 	} else {
 		cfg.Tokens = tokens
 	}
 
 	mustParseInt("PORT", &cfg.Port, 1, &errs)
 	mustParseInt("QUEUE_CAPACITY", &cfg.QueueCapacity, 1, &errs)
+	mustParseInt("OBSERVE_BUFFER_SIZE", &cfg.ObserveBufferSize, 1, &errs)
+	mustParseInt("MAX_REQUEST_BODY_BYTES", &cfg.MaxRequestBodyBytes, 0, &errs)
+	mustParseInt("MAX_PATH_BYTES", &cfg.MaxPathBytes, 0, &errs)
+	mustParseInt("MAX_PATH_SEGMENTS", &cfg.MaxPathSegments, 0, &errs)
+	mustParseInt("RESPONSE_CACHE_MAX_BYTES", &cfg.ResponseCacheMaxBytes, 0, &errs)
+	mustParseInt("CIRCUIT_BREAKER_THRESHOLD", &cfg.CircuitBreakerThreshold, 0, &errs)
+	mustParseInt("MAX_CONCURRENT_PER_IP", &cfg.MaxConcurrentPerIP, 0, &errs)
+	mustParseInt("DISABLE_KEY_AFTER_403", &cfg.DisableKeyAfter403, 0, &errs)
+	mustParseInt("WARMUP_CONCURRENCY", &cfg.WarmupConcurrency, 1, &errs)
+	mustParseInt("UPSTREAM_MAX_IDLE_CONNS", &cfg.Upstream.MaxIdleConns, 1, &errs)
+	mustParseInt("UPSTREAM_MAX_IDLE_CONNS_PER_HOST", &cfg.Upstream.MaxIdleConnsPerHost, 1, &errs)
+	mustParseInt("UPSTREAM_MAX_CONNS_PER_HOST", &cfg.Upstream.MaxConnsPerHost, 0, &errs)
 	mustParseDuration("ADMISSION_TIMEOUT", &cfg.AdmissionTimeout, &errs)
+	cfg.AdmissionTimeoutHigh = cfg.AdmissionTimeout
+	cfg.AdmissionTimeoutNormal = cfg.AdmissionTimeout
+	mustParseDuration("ADMISSION_TIMEOUT_HIGH", &cfg.AdmissionTimeoutHigh, &errs)
+	mustParseDuration("ADMISSION_TIMEOUT_NORMAL", &cfg.AdmissionTimeoutNormal, &errs)
+	if cfg.AdmissionTimeoutHigh == 0 && cfg.AdmissionTimeoutNormal == 0 {
+		// Keep "no timeout for either" from falling back to ADMISSION_TIMEOUT.
+		cfg.AdmissionTimeout = 0
+	}
 	mustParseDuration("ADDITIONAL_WINDOW_SIZE", &cfg.AdditionalWindow, &errs)
 	mustParseDuration("SHUTDOWN_TIMEOUT", &cfg.ShutdownTimeout, &errs)
+	if cfg.ShutdownTimeout == 0 {
+		// A zero deadline would cancel the drain before it starts.
+		cfg.ShutdownTimeout = DefaultShutdownTimeout
+	}
 	mustParseDuration("UPSTREAM_TIMEOUT", &cfg.UpstreamTimeout, &errs)
+	mustParseDuration("QUEUE_DEPTH_INTERVAL", &cfg.QueueDepthInterval, &errs)
+	mustParseDuration("MAX_ESTIMATED_WAIT", &cfg.MaxEstimatedWait, &errs)
+	mustParseDuration("MIN_SPACING", &cfg.MinSpacing, &errs)
+	mustParseDuration("DEFAULT_RETRY_AFTER", &cfg.DefaultRetryAfter, &errs)
+	mustParseDuration("MIN_RETRY_DELAY", &cfg.MinRetryDelay, &errs)
+	mustParseDuration("WARMUP_TIMEOUT", &cfg.WarmupTimeout, &errs)
+	mustParseDuration("MAX_TOTAL_LATENCY", &cfg.MaxTotalLatency, &errs)
+	mustParseDuration("SWAGGER_CACHE_TTL", &cfg.SwaggerCacheTTL, &errs)
+	mustParseDuration("KEY_VALIDATION_TIMEOUT", &cfg.KeyValidationTimeout, &errs)
+	mustParseDuration("CIRCUIT_BREAKER_WINDOW", &cfg.CircuitBreakerWindow, &errs)
+	mustParseDuration("CIRCUIT_BREAKER_COOLDOWN", &cfg.CircuitBreakerCooldown, &errs)
+	mustParseDuration("UPSTREAM_IDLE_CONN_TIMEOUT", &cfg.Upstream.IdleConnTimeout, &errs)
+	mustParseDuration("SERVER_READ_HEADER_TIMEOUT", &cfg.Server.ReadHeaderTimeout, &errs)
+	mustParseDuration("SERVER_READ_TIMEOUT", &cfg.Server.ReadTimeout, &errs)
+	mustParseDuration("SERVER_IDLE_TIMEOUT", &cfg.Server.IdleTimeout, &errs)
+	writeTimeout := time.Duration(-1)
+	mustParseDuration("SERVER_WRITE_TIMEOUT", &writeTimeout, &errs)
 
 	mustParseBool("ENABLE_METRICS", &cfg.MetricsEnabled, &errs)
+	cfg.MetricsBuckets = parseMetricsBuckets("METRICS_BUCKETS", &errs)
 	mustParseBool("ENABLE_PPROF", &cfg.PprofEnabled, &errs)
 	mustParseBool("ENABLE_SWAGGER", &cfg.SwaggerEnabled, &errs)
+	mustParseBool("ENABLE_DEBUG", &cfg.DebugEnabled, &errs)
+	mustParseBool("ROUTES_FROM_SPEC", &cfg.RoutesFromSpec, &errs)
+	mustParseBool("VALIDATE_METHODS", &cfg.ValidateMethods, &errs)
+	mustParseBool("KEY_AFFINITY_FALLBACK", &cfg.KeyAffinityFallback, &errs)
+	mustParseBool("DISABLE_PACING", &cfg.DisablePacing, &errs)
+	// Off, X-Priority is ignored and every request is admitted as normal.
+	mustParseBool("ALLOW_PRIORITY_BYPASS", &cfg.AllowPriorityBypass, &errs)
+	mustParseBool("COALESCE_COLD_START", &cfg.CoalesceColdStart, &errs)
+	mustParseBool("COALESCE_REQUESTS", &cfg.CoalesceRequests, &errs)
+	mustParseBool("EXPOSE_PACING_HEADERS", &cfg.PacingHeaders, &errs)
+	mustParseBool("VALIDATE_ROUTING_GROUP", &cfg.ValidateRoutingGroup, &errs)
+	mustParseBool("REJECT_WHEN_ALL_BLOCKED", &cfg.RejectWhenAllBlocked, &errs)
+	mustParseBool("REJECT_PAST_TIMEOUT", &cfg.RejectPastTimeout, &errs)
+	mustParseBool("VALIDATE_KEY_ON_START", &cfg.ValidateKeyOnStart, &errs)
+	mustParseBool("FORWARD_CLIENT_IP", &cfg.ForwardClientIP, &errs)
+	mustParseBool("FORWARD_OPTIONS", &cfg.ForwardOptions, &errs)
 
 	mustParseRateLimit("DEFAULT_APP_RATE_LIMIT", &cfg.DefaultAppLimits, &errs)
+	cfg.DefaultMethodLimits = parseDefaultMethodLimits("DEFAULT_METHOD_RATE_LIMIT", &errs)
+	mustParseFraction("LIMIT_HEADROOM_FRACTION", &cfg.LimitHeadroom, &errs)
+	mustParseFraction("PACING_JITTER_FRACTION", &cfg.PacingJitterFraction, &errs)
+	mustParseURL("SWAGGER_SPEC_URL", &cfg.SwaggerSpecURL, &errs)
+	cfg.SwaggerExtraSpecURLs = parseURLList("SWAGGER_EXTRA_SPEC_URLS", &errs)
+	mustParseProxyURL("EGRESS_PROXY_URL", &cfg.EgressProxyURL, &errs)
+	mustParseChoice("UPSTREAM_HTTP2", &cfg.Upstream.HTTP2, []string{"auto", "force", "disable"}, &errs)
+	mustParseChoice("QUEUE_FULL_POLICY", &cfg.QueueFullPolicy, []string{"reject", "block"}, &errs)
+	mustParseChoice("COLD_START_POLICY", &cfg.ColdStartPolicy, []string{"burst", "serialize"}, &errs)
+	mustParseChoice("QUEUE_ORDER", &cfg.QueueOrder, []string{"fifo", "deadline"}, &errs)
+	mustParseChoice("MATCH_REGION_POLICY", &cfg.MatchRegionPolicy, []string{"off", "reject", "correct"}, &errs)
 	cfg.RateBudgets = parseRateBudgets(&errs)
+	cfg.ResponseCacheTTLs = parsePatternDurations("RESPONSE_CACHE_TTLS", &errs)
+	cfg.MinSpacingOverrides = parsePatternDurations("MIN_SPACING_OVERRIDES", &errs)
+
+	cfg.StripRequestHeaders = splitCSVEnv("STRIP_REQUEST_HEADERS")
+	// Response headers to strip default to Riot's rate-limit bookkeeping
+	// headers, and "none" strips nothing. ALLOW_RESPONSE_HEADERS, when set, is
+	// used instead.
+	if strip := splitCSVEnv("STRIP_RESPONSE_HEADERS"); len(strip) == 1 && strings.EqualFold(strip[0], "none") {
+		cfg.StripResponseHeaders = nil
+	} else if strip != nil {
+		cfg.StripResponseHeaders = strip
+	}
+	cfg.AllowResponseHeaders = splitCSVEnv("ALLOW_RESPONSE_HEADERS")
+	cfg.DisabledPatterns = splitCSVEnv("DISABLED_PATTERNS")
+	cfg.ExtraPatterns = splitCSVEnv("EXTRA_PATH_PATTERNS")
+	cfg.AdmissionBypassPrefixes = splitCSVEnv("ADMISSION_BYPASS_PREFIXES")
+	cfg.ResponseCacheStaleOnError = splitCSVEnv("RESPONSE_CACHE_STALE_ON_ERROR")
+	for _, pattern := range cfg.ResponseCacheStaleOnError {
+		if _, ok := cfg.ResponseCacheTTLs[strings.TrimPrefix(pattern, "/")]; !ok {
+			errs = append(errs, fmt.Errorf("RESPONSE_CACHE_STALE_ON_ERROR pattern %q has no RESPONSE_CACHE_TTLS entry", pattern))
+		}
+	}
+	cfg.WarmupPatterns = splitCSVEnv("WARMUP_PATTERNS")
+	for _, probe := range cfg.WarmupPatterns {
+		if strings.ContainsAny(probe, "{}") || !strings.Contains(strings.Trim(probe, "/"), "/") {
+			errs = append(errs, fmt.Errorf("WARMUP_PATTERNS entry %q must be a concrete /{region}/path without placeholders", probe))
+		}
+	}
+	cfg.TrustedProxies = splitCSVEnv("TRUSTED_PROXIES")
+	if _, err := clientip.ParseTrusted(cfg.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("TRUSTED_PROXIES must be CIDRs or IP addresses: %w", err))
+	}
+	cfg.KeyWeights = parseKeyWeights("KEY_WEIGHTS", len(cfg.Tokens), &errs)
+	cfg.PriorityWeightHigh, cfg.PriorityWeightNormal = parsePriorityWeights("PRIORITY_WEIGHTS", &errs)
+	cfg.KeyAffinity = parseKeyAffinity("KEY_AFFINITY", len(cfg.Tokens), &errs)
+	cfg.RegionHostOverrides = parseRegionHosts("REGION_HOST_OVERRIDES", &errs)
+	if region := strings.ToLower(strings.TrimSpace(os.Getenv("KEY_VALIDATION_REGION"))); region != "" {
+		cfg.KeyValidationRegion = region
+		if !router.PlatformRegion(region) {
+			errs = append(errs, fmt.Errorf("KEY_VALIDATION_REGION must be a platform such as na1 or euw1"))
+		}
+	}
+	if cfg.KeyValidationTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("KEY_VALIDATION_TIMEOUT must be > 0"))
+	}
+	if cfg.WarmupTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("WARMUP_TIMEOUT must be > 0"))
+	}
+
+	cfg.DefaultRegion = strings.ToLower(strings.TrimSpace(os.Getenv("DEFAULT_REGION")))
+	if cfg.DefaultRegion != "" && !router.KnownRegion(cfg.DefaultRegion) {
+		errs = append(errs, fmt.Errorf("DEFAULT_REGION must be a known region such as euw1 or europe"))
+	}
+	cfg.BasePath = parseBasePath("BASE_PATH", &errs)
+	// The token is required from clients on every path but ProxyAuthExempt.
+	cfg.ProxyAuthToken = strings.TrimSpace(os.Getenv("PROXY_AUTH_TOKEN"))
+	cfg.ProxyClients = loadProxyClients("PROXY_CLIENTS_FILE", &errs)
+	if exempt := splitCSVEnv("PROXY_AUTH_EXEMPT"); exempt != nil {
+		cfg.ProxyAuthExempt = exempt
+	}
 
 	if cfg.Port > 65535 {
 		errs = append(errs, fmt.Errorf("PORT must be <= 65535"))
@@ -107,12 +392,16 @@ func Load() (Config, error) {
 		return Config{}, errors.Join(errs...)
 	}
 
-	// WriteTimeout must allow: queue wait (AdmissionTimeout) + upstream request + buffer
+	// WriteTimeout must allow: longest queue wait + upstream request + buffer
 	upstreamBudget := cfg.UpstreamTimeout
 	if upstreamBudget <= 0 {
 		upstreamBudget = 5 * time.Minute
 	}
-	cfg.Server.WriteTimeout = cfg.AdmissionTimeout + upstreamBudget + 30*time.Second
+	admissionBudget := max(cfg.AdmissionTimeoutHigh, cfg.AdmissionTimeoutNormal)
+	cfg.Server.WriteTimeout = admissionBudget + upstreamBudget + 30*time.Second
+	if writeTimeout >= 0 {
+		cfg.Server.WriteTimeout = writeTimeout
+	}
 
 	return cfg, nil
 }
@@ -140,6 +429,137 @@ func (c Config) RateBudgetShare(id, bucket string) (float64, bool) {
 	return budget.Share, true
 }
 
+// parseKeyWeights reads one positive integer weight per RIOT_TOKEN entry.
+func parseKeyWeights(key string, tokenCount int, errs *[]error) []int {
+	parts := splitCSVEnv(key)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	weights := make([]int, 0, len(parts))
+	for _, part := range parts {
+		weight, err := strconv.Atoi(part)
+		if err != nil || weight <= 0 {
+			*errs = append(*errs, fmt.Errorf("%s must be a comma-separated list of positive integers", key))
+			return nil
+		}
+		weights = append(weights, weight)
+	}
+	if len(weights) != tokenCount {
+		*errs = append(*errs, fmt.Errorf("%s must have one weight per RIOT_TOKEN entry", key))
+		return nil
+	}
+	return weights
+}
+
+// parseMetricsBuckets reads histogram boundaries in seconds, e.g.
+// "0.05,0.1,0.5,1,5". They must be positive and strictly ascending.
+func parseMetricsBuckets(key string, errs *[]error) []float64 {
+	parts := splitCSVEnv(key)
+	if len(parts) == 0 {
+		return nil
+	}
+
+	buckets := make([]float64, 0, len(parts))
+	for _, part := range parts {
+		bucket, err := strconv.ParseFloat(part, 64)
+		if err != nil || bucket <= 0 || math.IsInf(bucket, 0) || len(buckets) > 0 && bucket <= buckets[len(buckets)-1] {
+			*errs = append(*errs, fmt.Errorf("%s must be a comma-separated list of positive, ascending seconds", key))
+			return nil
+		}
+		buckets = append(buckets, bucket)
+	}
+	return buckets
+}
+
+// parsePriorityWeights reads "high:normal", e.g. "3:1". Unset, both are zero,
+// which means strict priority.
+func parsePriorityWeights(key string, errs *[]error) (int, int) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return 0, 0
+	}
+
+	rawHigh, rawNormal, ok := strings.Cut(value, ":")
+	high, errHigh := strconv.Atoi(strings.TrimSpace(rawHigh))
+	normal, errNormal := strconv.Atoi(strings.TrimSpace(rawNormal))
+	if !ok || errHigh != nil || errNormal != nil || high <= 0 || normal <= 0 {
+		*errs = append(*errs, fmt.Errorf("%s must be in format high:normal with positive integers (example: 3:1)", key))
+		return 0, 0
+	}
+	return high, normal
+}
+
+// parseKeyAffinity reads "pattern=index" entries; patterns are limiter
+// buckets or route patterns without region.
+func parseKeyAffinity(key string, tokenCount int, errs *[]error) map[string]int {
+	entries := splitCSVEnv(key)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	out := make(map[string]int, len(entries))
+	for _, entry := range entries {
+		pattern, rawIndex, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "/")
+		index, err := strconv.Atoi(strings.TrimSpace(rawIndex))
+		if !ok || pattern == "" || err != nil || index < 0 || index >= tokenCount {
+			*errs = append(*errs, fmt.Errorf("%s entries must be in format 'pattern=index' with an index into RIOT_TOKEN: %s", key, entry))
+			return nil
+		}
+		out[pattern] = index
+	}
+	return out
+}
+
+// parseRegionHosts reads "region=host[:port]" entries, keyed by lowercase
+// region.
+func parseRegionHosts(key string, errs *[]error) map[string]string {
+	entries := splitCSVEnv(key)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	out := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		region, host, ok := strings.Cut(entry, "=")
+		region = strings.ToLower(strings.TrimSpace(region))
+		host = strings.TrimSpace(host)
+		if !ok || region == "" || !validHostPort(host) {
+			*errs = append(*errs, fmt.Errorf("%s entries must be in format 'region=host[:port]': %s", key, entry))
+			return nil
+		}
+		out[region] = host
+	}
+	return out
+}
+
+func validHostPort(value string) bool {
+	u, err := url.Parse("//" + value)
+	if err != nil || u.Host != value || u.Hostname() == "" {
+		return false
+	}
+	if port := u.Port(); port != "" {
+		n, err := strconv.Atoi(port)
+		return err == nil && n > 0 && n <= math.MaxUint16
+	}
+	return !strings.HasSuffix(value, ":")
+}
+
+// parseBasePath normalizes key to a leading slash and no trailing one, so
+// "riot/" and "/riot" both become "/riot". "/" means no prefix.
+func parseBasePath(key string, errs *[]error) string {
+	raw := strings.Trim(strings.TrimSpace(os.Getenv(key)), "/")
+	if raw == "" {
+		return ""
+	}
+	if strings.ContainsAny(raw, "?#{} ") || strings.Contains("/"+raw+"/", "/../") {
+		*errs = append(*errs, fmt.Errorf("%s must be a plain path such as /riot", key))
+		return ""
+	}
+	return "/" + raw
+}
+
 func splitCSVEnv(key string) []string {
 	raw := strings.TrimSpace(os.Getenv(key))
 	if raw == "" {
@@ -207,12 +627,89 @@ func mustParseBool(key string, dst *bool, errs *[]error) {
 	*dst = parsed
 }
 
+func mustParseFraction(key string, dst *float64, errs *[]error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return
+	}
+
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil || parsed < 0 || parsed >= 1 || math.IsNaN(parsed) {
+		*errs = append(*errs, fmt.Errorf("%s must be a number >= 0 and < 1", key))
+		return
+	}
+	*dst = parsed
+}
+
+func mustParseChoice(key string, dst *string, choices []string, errs *[]error) {
+	value := strings.ToLower(strings.TrimSpace(os.Getenv(key)))
+	if value == "" {
+		return
+	}
+
+	for _, choice := range choices {
+		if value == choice {
+			*dst = value
+			return
+		}
+	}
+	*errs = append(*errs, fmt.Errorf("%s must be one of %s", key, strings.Join(choices, ", ")))
+}
+
+func mustParseURL(key string, dst *string, errs *[]error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		*errs = append(*errs, fmt.Errorf("%s must be an absolute http(s) URL", key))
+		return
+	}
+	*dst = value
+}
+
+func parseURLList(key string, errs *[]error) []string {
+	values := splitCSVEnv(key)
+	for _, value := range values {
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			*errs = append(*errs, fmt.Errorf("%s must be a comma-separated list of absolute http(s) URLs", key))
+			return nil
+		}
+	}
+	return values
+}
+
+func mustParseProxyURL(key string, dst *string, errs *[]error) {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return
+	}
+
+	u, err := url.Parse(value)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "socks5", "socks5h"}, u.Scheme) {
+		*errs = append(*errs, fmt.Errorf("%s must be an http, https or socks5 URL", key))
+		return
+	}
+	*dst = value
+}
+
 func mustParseRateLimit(key string, dst *string, errs *[]error) {
 	value := strings.TrimSpace(os.Getenv(key))
 	if value == "" {
 		return
 	}
 
+	if err := validateRateLimit(key, value); err != nil {
+		*errs = append(*errs, err)
+		return
+	}
+	*dst = value
+}
+
+func validateRateLimit(key, value string) error {
 	parts := strings.Split(value, ",")
 	for _, part := range parts {
 		part = strings.TrimSpace(part)
@@ -221,17 +718,144 @@ func mustParseRateLimit(key string, dst *string, errs *[]error) {
 		}
 		pair := strings.SplitN(part, ":", 2)
 		if len(pair) != 2 {
-			*errs = append(*errs, fmt.Errorf("%s must be in format 'limit:window,limit:window' (e.g., '20:1,100:120'): %s", key, part))
-			return
+			return fmt.Errorf("%s must be in format 'limit:window,limit:window' (e.g., '20:1,100:120'): %s", key, part)
 		}
 		limit, err1 := strconv.Atoi(strings.TrimSpace(pair[0]))
 		window, err2 := strconv.Atoi(strings.TrimSpace(pair[1]))
 		if err1 != nil || err2 != nil || limit <= 0 || window <= 0 {
-			*errs = append(*errs, fmt.Errorf("%s contains invalid values (must be positive integers): %s", key, part))
-			return
+			return fmt.Errorf("%s contains invalid values (must be positive integers): %s", key, part)
 		}
 	}
-	*dst = value
+	return nil
+}
+
+// LoadTokens reads the Riot API keys from the file named by RIOT_TOKEN_FILE,
+// or else from RIOT_TOKEN. The file holds keys separated by commas or
+// newlines. It is called again on SIGHUP to pick up rotated keys.
+func LoadTokens() ([]string, error) {
+	path := strings.TrimSpace(os.Getenv("RIOT_TOKEN_FILE"))
+	if path == "" {
+		tokens := splitCSVEnv("RIOT_TOKEN")
+		if len(tokens) == 0 {
+			return nil, fmt.Errorf("RIOT_TOKEN env var is required")
+		}
+		return tokens, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("RIOT_TOKEN_FILE: %w", err)
+	}
+	tokens := strings.FieldsFunc(string(raw), func(r rune) bool {
+		return r == ',' || r == '\n' || r == '\r'
+	})
+	out := tokens[:0]
+	for _, token := range tokens {
+		if token = strings.TrimSpace(token); token != "" {
+			out = append(out, token)
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("RIOT_TOKEN_FILE %s holds no keys", path)
+	}
+	return out, nil
+}
+
+// loadProxyClients reads the JSON client list from the file named by key.
+func loadProxyClients(key string, errs *[]error) []ProxyClient {
+	path := strings.TrimSpace(os.Getenv(key))
+	if path == "" {
+		return nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		*errs = append(*errs, fmt.Errorf("%s: %w", key, err))
+		return nil
+	}
+	var clients []ProxyClient
+	if err := json.Unmarshal(raw, &clients); err != nil {
+		*errs = append(*errs, fmt.Errorf("%s must hold a JSON array of clients: %w", key, err))
+		return nil
+	}
+
+	tokens := make(map[string]struct{}, len(clients))
+	for i, client := range clients {
+		name := client.Name
+		if name == "" {
+			name = strconv.Itoa(i)
+		}
+		if client.Token == "" {
+			*errs = append(*errs, fmt.Errorf("%s: client %s has no token", key, name))
+		} else if _, dup := tokens[client.Token]; dup {
+			*errs = append(*errs, fmt.Errorf("%s: client %s reuses another client's token", key, name))
+		}
+		tokens[client.Token] = struct{}{}
+		if client.Priority != "" && client.Priority != "high" && client.Priority != "normal" {
+			*errs = append(*errs, fmt.Errorf("%s: client %s priority must be high or normal", key, name))
+		}
+		if client.RateLimit != "" {
+			if err := validateRateLimit(key+": client "+name+" rate_limit", client.RateLimit); err != nil {
+				*errs = append(*errs, err)
+			}
+		}
+	}
+	return clients
+}
+
+// parseDefaultMethodLimits reads "pattern=>limit:window,...;..." entries.
+// An entry without a pattern applies to every bucket ("*").
+func parseDefaultMethodLimits(key string, errs *[]error) map[string]string {
+	value := strings.TrimSpace(os.Getenv(key))
+	if value == "" {
+		return nil
+	}
+
+	out := make(map[string]string)
+	for _, entry := range strings.Split(value, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		pattern, limits, ok := strings.Cut(entry, "=>")
+		if !ok {
+			pattern, limits = "*", entry
+		}
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "/")
+		limits = strings.TrimSpace(limits)
+		if pattern == "" || limits == "" {
+			*errs = append(*errs, fmt.Errorf("%s entries must be in format 'pattern=>limit:window': %s", key, entry))
+			return nil
+		}
+		if err := validateRateLimit(key, limits); err != nil {
+			*errs = append(*errs, err)
+			return nil
+		}
+		out[pattern] = limits
+	}
+	return out
+}
+
+// parsePatternDurations reads "pattern=duration,pattern=duration" entries,
+// with patterns written without the leading slash.
+func parsePatternDurations(key string, errs *[]error) map[string]time.Duration {
+	entries := splitCSVEnv(key)
+	if len(entries) == 0 {
+		return nil
+	}
+
+	out := make(map[string]time.Duration, len(entries))
+	for _, entry := range entries {
+		pattern, rawTTL, ok := strings.Cut(entry, "=")
+		pattern = strings.TrimPrefix(strings.TrimSpace(pattern), "/")
+		ttl, err := time.ParseDuration(strings.TrimSpace(rawTTL))
+		if !ok || pattern == "" || err != nil || ttl <= 0 {
+			*errs = append(*errs, fmt.Errorf("%s entries must be in format 'pattern=duration' with a positive duration: %s", key, entry))
+			return nil
+		}
+		out[pattern] = ttl
+	}
+	return out
 }
 
 func parseRateBudgets(errs *[]error) map[string]RateBudget {
@@ -0,0 +1,91 @@
+package limiter
+
+import (
+	"sync"
+	"time"
+)
+
+// ManualClock is a Clock whose time only moves when Advance is called. Used as
+// Config.Clock it makes pacing and Retry-After blocks deterministic: the
+// limiter's timers fire from Advance rather than from wall-clock time.
+type ManualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*manualTimer
+}
+
+// NewManualClock returns a ManualClock reading start until advanced.
+func NewManualClock(start time.Time) *ManualClock {
+	return &ManualClock{now: start}
+}
+
+func (c *ManualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d and fires every timer that is due.
+func (c *ManualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	for _, timer := range c.timers {
+		timer.fireIfDueLocked(c.now)
+	}
+}
+
+// NewTimer returns a Timer that fires once Advance reaches now+d.
+func (c *ManualClock) NewTimer(d time.Duration) Timer {
+	timer := &manualTimer{clock: c, c: make(chan time.Time, 1)}
+	c.mu.Lock()
+	c.timers = append(c.timers, timer)
+	c.mu.Unlock()
+	timer.Reset(d)
+	return timer
+}
+
+type manualTimer struct {
+	clock  *ManualClock
+	c      chan time.Time
+	at     time.Time
+	active bool
+}
+
+func (t *manualTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *manualTimer) Reset(d time.Duration) {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.drainLocked()
+	t.at = t.clock.now.Add(d)
+	t.active = true
+	t.fireIfDueLocked(t.clock.now)
+}
+
+func (t *manualTimer) Stop() {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	t.active = false
+	t.drainLocked()
+}
+
+func (t *manualTimer) fireIfDueLocked(now time.Time) {
+	if !t.active || t.at.After(now) {
+		return
+	}
+	t.active = false
+	select {
+	case t.c <- now:
+	default:
+	}
+}
+
+func (t *manualTimer) drainLocked() {
+	select {
+	case <-t.c:
+	default:
+	}
+}
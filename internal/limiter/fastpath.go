@@ -0,0 +1,242 @@
+package limiter
+
+import (
+	"math"
+	"math/rand/v2"
+	"sync/atomic"
+	"time"
+)
+
+// fastLaneCredits caps the grants the loop reserves for one key of a lane.
+// Reserved slots count as used until the lane is closed, so a small number
+// keeps other buckets of the region from waiting on them.
+const fastLaneCredits = 16
+
+// fastLane lets Admit grant admissions for one bucket without a round trip to
+// the loop. The loop opens it once the bucket's queue is empty, reserving up to
+// fastLaneCredits slots per key in the key's app and method windows, and
+// closes it before it next decides anything for the region: unused slots go
+// back to the windows and later admissions take the loop again.
+type fastLane struct {
+	region     string
+	reservedAt time.Time
+	keys       []fastKey
+}
+
+type fastKey struct {
+	// credits is the number of grants left. Closing the lane swaps it to zero,
+	// which fails every later take.
+	credits atomic.Int64
+	// windowed is set when the credits are slots reserved in windows. Without
+	// windows nothing is counted, so takes only check that credits is nonzero.
+	windowed bool
+	// nextSlot is the earliest paced grant and interval the spacing between
+	// paced grants, both as the loop computed them when opening the lane.
+	nextSlot atomic.Int64
+	interval time.Duration
+	// lastGrant is the time of the latest grant of a windowed key, for the
+	// pacing anchors once the lane is closed. Times are Unix nanoseconds of the
+	// limiter's Clock.
+	lastGrant atomic.Int64
+}
+
+// fastPathEligible reports whether cfg allows fast lanes at all. Key weights
+// and affinity pick keys from loop state, and pacing jitter is drawn per grant.
+func fastPathEligible(cfg Config) bool {
+	return len(cfg.KeyWeights) == 0 &&
+		len(cfg.KeyAffinity) == 0 &&
+		cfg.PacingJitterFraction == 0
+}
+
+// admitFast grants admission from the bucket's fast lane. It reports false
+// when there is no open lane or it has nothing left for admission, and the
+// loop has to decide.
+//
+// A take that races the loop closing the lane either wins, and is ordered
+// before the close as if it had reached the loop first, or finds no credits.
+func (l *Limiter) admitFast(admission Admission) (Ticket, bool) {
+	if admission.BudgetID != defaultBudgetID {
+		return Ticket{}, false
+	}
+	value, ok := l.lanes.Load(admission.Bucket)
+	if !ok {
+		return Ticket{}, false
+	}
+	lane := value.(*fastLane)
+	if lane.region != admission.Region {
+		return Ticket{}, false
+	}
+
+	paced := admission.Priority != PriorityHigh && !l.cfg.DisablePacing
+	var now int64
+	// A random first key spreads grants without a counter every Admit writes.
+	first := 0
+	if len(lane.keys) > 1 {
+		first = rand.IntN(len(lane.keys))
+	}
+	for j := range lane.keys {
+		i := (first + j) % len(lane.keys)
+		if admission.TokenIndex != nil && i != *admission.TokenIndex {
+			continue
+		}
+		key := &lane.keys[i]
+		if key.windowed && now == 0 {
+			now = l.cfg.Clock.Now().UnixNano()
+		}
+		if !key.take(now, paced) {
+			continue
+		}
+		if metrics := l.cfg.Metrics; metrics != nil && l.ColdStart(admission.Bucket) {
+			metrics.ObserveBucketUsingDefaults(admission.Bucket)
+		}
+		ticket := Ticket{KeyIndex: i, Paced: paced}
+		if key.windowed {
+			ticket.grant = &grant{budgetID: defaultBudgetID, at: lane.reservedAt, priority: admission.Priority, fast: true}
+		}
+		return ticket, true
+	}
+	return Ticket{}, false
+}
+
+// take spends one credit of k at now, and for a paced grant also the next
+// paced slot. A key without windows has nothing to pace or count, and now is
+// unused.
+func (k *fastKey) take(now int64, paced bool) bool {
+	if !k.windowed {
+		return k.credits.Load() > 0
+	}
+	if paced {
+		for {
+			slot := k.nextSlot.Load()
+			if now < slot {
+				return false
+			}
+			if k.interval == 0 || k.nextSlot.CompareAndSwap(slot, now+int64(k.interval)) {
+				break
+			}
+		}
+	}
+	for {
+		credits := k.credits.Load()
+		if credits <= 0 {
+			return false
+		}
+		if k.credits.CompareAndSwap(credits, credits-1) {
+			break
+		}
+	}
+	for {
+		last := k.lastGrant.Load()
+		if last >= now || k.lastGrant.CompareAndSwap(last, now) {
+			return true
+		}
+	}
+}
+
+// openLane gives bucket a fast lane if it has an empty queue and at least one
+// key could grant right now. Only the loop goroutine calls it.
+func (l *Limiter) openLane(bucket *bucketQueue, keys []keyState) {
+	if !l.fastEligible || bucket.lane != nil || bucket.depth() > 0 || len(bucket.parked) > 0 {
+		return
+	}
+	if l.minSpacing(bucket.bucket) > 0 || l.cfg.ColdStartPolicy == ColdStartSerialize && l.ColdStart(bucket.bucket) {
+		return
+	}
+
+	now := l.cfg.Clock.Now()
+	lane := &fastLane{region: bucket.region, reservedAt: now, keys: make([]fastKey, len(keys))}
+	open := false
+	for i := range keys {
+		key := &keys[i]
+		if key.disabled {
+			continue
+		}
+		app := key.app(bucket.region, now, l.cfg.AdditionalWindow)
+		method := key.method(bucket.bucket, now, l.cfg.AdditionalWindow)
+		if app.blockedUntil.After(now) || method.blockedUntil.After(now) {
+			continue
+		}
+		// Both read the windows before the reservation below fills them.
+		nextSlot := later(app.nextAllowed(now, defaultBudgetID, 1, false), method.nextAllowed(now, defaultBudgetID, 1, false))
+		interval := max(app.pacingInterval(now, defaultBudgetID, 1), method.pacingInterval(now, defaultBudgetID, 1))
+
+		room := app.room(now)
+		if methodRoom := method.room(now); room < 0 || methodRoom >= 0 && methodRoom < room {
+			room = methodRoom
+		}
+		credits := int64(math.MaxInt64)
+		if room >= 0 {
+			credits = int64(min(room, fastLaneCredits))
+			if credits == 0 {
+				continue
+			}
+			app.reserve(int(credits), now)
+			method.reserve(int(credits), now)
+			lane.keys[i].windowed = true
+		}
+		lane.keys[i].credits.Store(credits)
+		lane.keys[i].nextSlot.Store(nextSlot.UnixNano())
+		lane.keys[i].interval = interval
+		open = true
+	}
+	if !open {
+		return
+	}
+	bucket.lane = lane
+	l.lanes.Store(bucket.bucket, lane)
+}
+
+// closeLane closes bucket's fast lane, returns its unused slots to the
+// windows and moves the pacing anchors to the lane's latest grant. Only the
+// loop goroutine calls it.
+func (l *Limiter) closeLane(bucket *bucketQueue, keys []keyState) {
+	lane := bucket.lane
+	if lane == nil {
+		return
+	}
+	bucket.lane = nil
+	l.lanes.Delete(bucket.bucket)
+
+	now := l.cfg.Clock.Now()
+	for i := range lane.keys {
+		unused := lane.keys[i].credits.Swap(0)
+		if i >= len(keys) {
+			continue
+		}
+		app := keys[i].app(bucket.region, now, l.cfg.AdditionalWindow)
+		method := keys[i].method(bucket.bucket, now, l.cfg.AdditionalWindow)
+		if lane.keys[i].windowed {
+			for range unused {
+				app.release(lane.reservedAt, defaultBudgetID)
+				method.release(lane.reservedAt, defaultBudgetID)
+			}
+		}
+		if last := lane.keys[i].lastGrant.Load(); last > 0 {
+			at := time.Unix(0, last)
+			app.anchor(at)
+			method.anchor(at)
+		}
+	}
+}
+
+// closeLanes closes the fast lanes of buckets.
+func (l *Limiter) closeLanes(buckets []*bucketQueue, keys []keyState) {
+	for _, bucket := range buckets {
+		l.closeLane(bucket, keys)
+	}
+}
+
+// closeAllLanes closes every fast lane, before a change that may affect any
+// bucket.
+func (l *Limiter) closeAllLanes(regionIndex map[string][]*bucketQueue, keys []keyState) {
+	for _, buckets := range regionIndex {
+		l.closeLanes(buckets, keys)
+	}
+}
+
+func later(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
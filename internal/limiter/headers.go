@@ -1,6 +1,7 @@
 package limiter
 
 import (
+	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -56,3 +57,18 @@ func parseRateHeader(limitHeader, countHeader string) []parsedWindow {
 
 	return out
 }
+
+// withHeadroom lowers each window's limit by fraction, keeping at least one request.
+func withHeadroom(windows []parsedWindow, fraction float64) []parsedWindow {
+	if fraction <= 0 {
+		return windows
+	}
+	for i := range windows {
+		limit := int(math.Floor(float64(windows[i].limit) * (1 - fraction)))
+		if limit < 1 {
+			limit = 1
+		}
+		windows[i].limit = limit
+	}
+	return windows
+}
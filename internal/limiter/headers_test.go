@@ -59,3 +59,22 @@ func TestParseRateHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestWithHeadroom(t *testing.T) {
+	t.Parallel()
+
+	got := withHeadroom([]parsedWindow{
+		{limit: 100, count: 5, window: 120 * time.Second},
+		{limit: 1, window: time.Second},
+	}, 0.1)
+
+	if got, want := got[0].limit, 90; got != want {
+		t.Fatalf("limit = %d, want %d", got, want)
+	}
+	if got, want := got[0].count, 5; got != want {
+		t.Fatalf("count = %d, want %d", got, want)
+	}
+	if got, want := got[1].limit, 1; got != want {
+		t.Fatalf("limit floor = %d, want %d", got, want)
+	}
+}
@@ -2,28 +2,68 @@ package limiter
 
 import (
 	"container/heap"
+	"slices"
 	"time"
 )
 
 type bucketQueue struct {
-	region    string
-	bucket    string
-	high      []*admitRequest
-	normal    []*admitRequest
+	region string
+	bucket string
+	high   []*admitRequest
+	normal []*admitRequest
+	// byDeadline keeps each priority queue ordered by context deadline
+	// (QueueOrderDeadline) instead of arrival.
+	byDeadline bool
+	// parked holds admissions waiting for room under QueueFullBlock. They are
+	// not part of depth.
+	parked    []*admitRequest
 	wakeAt    time.Time
 	heapIndex int
+	// lastServed is the grant sequence number of this bucket's latest grant,
+	// used to rotate buckets that compete for one app limit.
+	lastServed uint64
+	// coldInFlight is set under ColdStartSerialize while a grant made before
+	// the bucket's limits were learned has been neither observed nor released.
+	coldInFlight bool
+	// servedHigh and servedNormal count the grants of the current weighted
+	// round; see PriorityWeights.
+	servedHigh   int
+	servedNormal int
+	// lane is the bucket's open fast lane, if any; see fastLane.
+	lane *fastLane
 }
 
 func (b *bucketQueue) depth() int {
 	return len(b.high) + len(b.normal)
 }
 
+// enqueue adds req to its priority queue and records its position there.
 func (b *bucketQueue) enqueue(req *admitRequest) {
+	queue := &b.normal
 	if req.admission.Priority == PriorityHigh {
-		b.high = append(b.high, req)
-		return
+		queue = &b.high
+	}
+	req.queuePosition = len(*queue)
+	if b.byDeadline {
+		req.queuePosition = deadlineIndex(*queue, req)
+	}
+	*queue = slices.Insert(*queue, req.queuePosition, req)
+}
+
+// deadlineIndex returns where req goes in a deadline-ordered queue: behind
+// every request due no later than it, so equal deadlines and requests
+// without one stay in arrival order. Requests without a deadline sort last.
+func deadlineIndex(queue []*admitRequest, req *admitRequest) int {
+	deadline, ok := req.ctx.Deadline()
+	if !ok {
+		return len(queue)
 	}
-	b.normal = append(b.normal, req)
+	for i, queued := range queue {
+		if other, ok := queued.ctx.Deadline(); !ok || other.After(deadline) {
+			return i
+		}
+	}
+	return len(queue)
 }
 
 // prepend returns req to the front of its priority queue without consuming.
@@ -35,28 +75,113 @@ func (b *bucketQueue) prepend(req *admitRequest) {
 	}
 }
 
-func (b *bucketQueue) dequeueValid() *admitRequest {
-	for len(b.high) > 0 {
-		req := b.high[0]
-		b.high[0] = nil
-		b.high = b.high[1:]
+// park holds req until the queue has room, dropping parked requests whose
+// context already ended. It reports false when limit requests are parked.
+func (b *bucketQueue) park(req *admitRequest, limit int) bool {
+	live := b.parked[:0]
+	for _, parked := range b.parked {
+		if parked.ctx.Err() == nil {
+			live = append(live, parked)
+		}
+	}
+	clear(b.parked[len(live):])
+	b.parked = live
+	if len(b.parked) >= limit {
+		return false
+	}
+	b.parked = append(b.parked, req)
+	return true
+}
+
+// unpark moves parked requests into the queue, oldest first, while depth is
+// below capacity.
+func (b *bucketQueue) unpark(capacity int) {
+	for len(b.parked) > 0 && b.depth() < capacity {
+		req := b.parked[0]
+		b.parked[0] = nil
+		b.parked = b.parked[1:]
 		if req.ctx.Err() == nil {
-			return req
+			b.enqueue(req)
+		}
+	}
+}
+
+// remove drops req from the queue, reporting whether it was still queued.
+func (b *bucketQueue) remove(req *admitRequest) bool {
+	queue := &b.normal
+	if req.admission.Priority == PriorityHigh {
+		queue = &b.high
+	}
+	for i, queued := range *queue {
+		if queued == req {
+			*queue = slices.Delete(*queue, i, i+1)
+			return true
 		}
 	}
+	return false
+}
 
-	for len(b.normal) > 0 {
-		req := b.normal[0]
-		b.normal[0] = nil
-		b.normal = b.normal[1:]
+// dequeueValid pops the first live request, taking high priority first
+// unless normalFirst.
+func (b *bucketQueue) dequeueValid(normalFirst bool) *admitRequest {
+	first, second := &b.high, &b.normal
+	if normalFirst {
+		first, second = second, first
+	}
+	if req := popValid(first); req != nil {
+		return req
+	}
+	return popValid(second)
+}
+
+func popValid(queue *[]*admitRequest) *admitRequest {
+	for len(*queue) > 0 {
+		req := (*queue)[0]
+		(*queue)[0] = nil
+		*queue = (*queue)[1:]
 		if req.ctx.Err() == nil {
 			return req
 		}
 	}
-
 	return nil
 }
 
+// normalTurn reports whether the weighted round owes normal priority its
+// grants: w.High high grants were made while normals waited.
+func (b *bucketQueue) normalTurn(w PriorityWeights) bool {
+	return w.High > 0 && b.servedHigh >= w.High
+}
+
+// recordGrant advances the weighted round. A round only counts grants made
+// while the other priority was waiting, so an idle priority builds up no
+// credit to burst with later.
+func (b *bucketQueue) recordGrant(priority Priority, w PriorityWeights) {
+	if w.High <= 0 {
+		return
+	}
+	if priority == PriorityHigh {
+		if len(b.normal) == 0 {
+			b.servedHigh = 0
+			return
+		}
+		b.servedHigh++
+		return
+	}
+	b.servedNormal++
+	if b.servedNormal >= w.Normal || len(b.high) == 0 {
+		b.servedHigh, b.servedNormal = 0, 0
+	}
+}
+
+// unrecordGrant takes a released grant back out of the weighted round.
+func (b *bucketQueue) unrecordGrant(priority Priority) {
+	if priority == PriorityHigh {
+		b.servedHigh = max(b.servedHigh-1, 0)
+		return
+	}
+	b.servedNormal = max(b.servedNormal-1, 0)
+}
+
 type wakeHeap []*bucketQueue
 
 func (h wakeHeap) Len() int { return len(h) }
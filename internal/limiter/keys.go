@@ -0,0 +1,88 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+)
+
+type keyCountRequest struct {
+	count    int
+	replaced []int
+	done     chan struct{}
+}
+
+// SetKeyCount grows or shrinks the set of keys while the limiter runs, e.g.
+// after a key rotation. Keys that remain keep what was learned about them; new
+// keys start on the default limits until Riot reports theirs. Queued
+// admissions pinned to a removed key are rejected with reason
+// "no_available_key", and observations for it are ignored. A count that
+// KeyWeights or KeyAffinity does not fit is refused.
+//
+// Keys listed in replaced got a new token at the same index. They start over
+// like new keys: their learned limits, blocks, window usage and disabled
+// state are dropped.
+func (l *Limiter) SetKeyCount(ctx context.Context, n int, replaced ...int) error {
+	if n <= 0 {
+		return fmt.Errorf("KeyCount must be > 0")
+	}
+	for _, index := range replaced {
+		if index < 0 || index >= n {
+			return fmt.Errorf("replaced key %d out of range [0, %d)", index, n)
+		}
+	}
+	if len(l.cfg.KeyWeights) > 0 && n != len(l.cfg.KeyWeights) {
+		return fmt.Errorf("KeyCount must stay %d, one per KeyWeights entry", len(l.cfg.KeyWeights))
+	}
+	for pattern, index := range l.cfg.KeyAffinity {
+		if index >= n {
+			return fmt.Errorf("KeyCount must stay above %d for KeyAffinity[%q]", index, pattern)
+		}
+	}
+	req := keyCountRequest{count: n, replaced: replaced, done: make(chan struct{})}
+
+	select {
+	case l.keyCountCh <- req:
+	case <-l.stopped:
+		return &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-req.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) handleKeyCount(
+	req keyCountRequest,
+	keys []keyState,
+	newKey func() keyState,
+	regionIndex map[string][]*bucketQueue,
+	wakeups *wakeHeap,
+) []keyState {
+	l.closeAllLanes(regionIndex, keys)
+	if req.count < len(keys) {
+		keys = keys[:req.count:req.count]
+	}
+	for len(keys) < req.count {
+		keys = append(keys, newKey())
+	}
+	for _, index := range req.replaced {
+		keys[index] = newKey()
+	}
+	l.keyCount.Store(int64(req.count))
+	if metrics := l.cfg.Metrics; metrics != nil {
+		metrics.ObserveActiveKeys(len(keys))
+	}
+	close(req.done)
+
+	// New and replaced keys may serve waiting admissions now, and those
+	// pinned to a removed key are turned away.
+	for _, buckets := range regionIndex {
+		l.dispatchRegion(buckets, keys, wakeups)
+	}
+	return keys
+}
@@ -1,24 +1,60 @@
 package limiter
 
 import (
+	"cmp"
 	"container/heap"
 	"context"
 	"fmt"
+	"log"
 	"math"
+	"math/rand/v2"
 	"net/http"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/renja-g/RiftRelay/internal/httputil"
 )
 
-const idleTimerWindow = 24 * time.Hour
+const (
+	idleTimerWindow          = 24 * time.Hour
+	defaultObserveBufferSize = 4096
+)
 
 type Limiter struct {
 	cfg       Config
 	admitCh   chan *admitRequest
 	observeCh chan Observation
-	closeCh   chan chan struct{}
+	closeCh   chan struct{}
+	planCh    chan planRequest
+	resetCh   chan resetRequest
+	queuesCh  chan queuesRequest
+	tuneCh    chan tuneRequest
+	releaseCh chan releaseRequest
+	// keyCountCh resizes keys; keyCount mirrors len(keys) for Admit.
+	keyCountCh chan keyCountRequest
+	keyCount   atomic.Int64
+	// closed is set by the first Close; stopped is closed once the loop has
+	// rejected the remaining queue and returned.
+	closed  atomic.Bool
+	stopped chan struct{}
+	// learned holds buckets whose method limits have been observed at least once.
+	learned sync.Map
+	// grantSeq counts grants; only the loop goroutine touches it.
+	grantSeq uint64
+	// lanes holds the open fast lane of each bucket, keyed by bucket;
+	// fastEligible is whether the configuration allows them at all. See
+	// admitFast.
+	lanes        sync.Map
+	fastEligible bool
+	// jitter draws pacing jitter; nil when PacingJitterFraction is zero.
+	// Only the loop goroutine touches it.
+	jitter *rand.Rand
+	// unknownLimitTypes holds the X-Rate-Limit-Type values already logged by
+	// retryScopeIsMethod. Only the loop goroutine touches it.
+	unknownLimitTypes map[string]struct{}
 }
 
 func New(cfg Config) (*Limiter, error) {
@@ -28,18 +64,104 @@ func New(cfg Config) (*Limiter, error) {
 	if cfg.QueueCapacity <= 0 {
 		return nil, fmt.Errorf("QueueCapacity must be > 0")
 	}
+	if cfg.ObserveBufferSize < 0 {
+		return nil, fmt.Errorf("ObserveBufferSize must be >= 0")
+	}
+	if cfg.ObserveBufferSize == 0 {
+		cfg.ObserveBufferSize = defaultObserveBufferSize
+	}
+	if cfg.LimitHeadroomFraction < 0 || cfg.LimitHeadroomFraction >= 1 || math.IsNaN(cfg.LimitHeadroomFraction) {
+		return nil, fmt.Errorf("LimitHeadroomFraction must be >= 0 and < 1")
+	}
+	if cfg.PacingJitterFraction < 0 || cfg.PacingJitterFraction >= 1 || math.IsNaN(cfg.PacingJitterFraction) {
+		return nil, fmt.Errorf("PacingJitterFraction must be >= 0 and < 1")
+	}
 	if cfg.Clock == nil {
 		cfg.Clock = realClock{}
 	}
+	switch cfg.ColdStartPolicy {
+	case "":
+		cfg.ColdStartPolicy = ColdStartBurst
+	case ColdStartBurst, ColdStartSerialize:
+	default:
+		return nil, fmt.Errorf("ColdStartPolicy must be %q or %q", ColdStartBurst, ColdStartSerialize)
+	}
+	if cfg.PriorityWeights.High < 0 || cfg.PriorityWeights.Normal < 0 || (cfg.PriorityWeights.High > 0) != (cfg.PriorityWeights.Normal > 0) {
+		return nil, fmt.Errorf("PriorityWeights must both be positive, or both zero for strict priority")
+	}
+	switch cfg.QueueOrder {
+	case "":
+		cfg.QueueOrder = QueueOrderFIFO
+	case QueueOrderFIFO, QueueOrderDeadline:
+	default:
+		return nil, fmt.Errorf("QueueOrder must be %q or %q", QueueOrderFIFO, QueueOrderDeadline)
+	}
+	switch cfg.QueueFullPolicy {
+	case "":
+		cfg.QueueFullPolicy = QueueFullReject
+	case QueueFullReject, QueueFullBlock:
+	default:
+		return nil, fmt.Errorf("QueueFullPolicy must be %q or %q", QueueFullReject, QueueFullBlock)
+	}
 	if err := validateRateBudgets(cfg.RateBudgets); err != nil {
 		return nil, err
 	}
+	if err := validateKeyWeights(cfg.KeyWeights, cfg.KeyCount); err != nil {
+		return nil, err
+	}
+	if len(cfg.KeyAffinity) > 0 {
+		affinity := make(map[string]int, len(cfg.KeyAffinity))
+		for pattern, index := range cfg.KeyAffinity {
+			if index < 0 || index >= cfg.KeyCount {
+				return nil, fmt.Errorf("KeyAffinity[%q] must be a key index below %d", pattern, cfg.KeyCount)
+			}
+			affinity[strings.TrimPrefix(pattern, "/")] = index
+		}
+		cfg.KeyAffinity = affinity
+	}
+	if cfg.DisableKeyAfterForbidden < 0 {
+		return nil, fmt.Errorf("DisableKeyAfterForbidden must be >= 0")
+	}
+	if cfg.MinSpacing < 0 {
+		return nil, fmt.Errorf("MinSpacing must be >= 0")
+	}
+	if cfg.DefaultRetryAfter < 0 {
+		return nil, fmt.Errorf("DefaultRetryAfter must be >= 0")
+	}
+	if len(cfg.MinSpacingOverrides) > 0 {
+		overrides := make(map[string]time.Duration, len(cfg.MinSpacingOverrides))
+		for pattern, spacing := range cfg.MinSpacingOverrides {
+			if spacing < 0 {
+				return nil, fmt.Errorf("MinSpacingOverrides[%q] must be >= 0", pattern)
+			}
+			overrides[strings.TrimPrefix(pattern, "/")] = spacing
+		}
+		cfg.MinSpacingOverrides = overrides
+	}
+	for pattern, limits := range cfg.DefaultMethodLimits {
+		if len(parseRateHeader(limits, "")) == 0 {
+			return nil, fmt.Errorf("DefaultMethodLimits[%q] must be in format limit:window,limit:window", pattern)
+		}
+	}
 
 	l := &Limiter{
-		cfg:       cfg,
-		admitCh:   make(chan *admitRequest),
-		observeCh: make(chan Observation, 4096),
-		closeCh:   make(chan chan struct{}),
+		cfg:        cfg,
+		admitCh:    make(chan *admitRequest),
+		observeCh:  make(chan Observation, cfg.ObserveBufferSize),
+		closeCh:    make(chan struct{}),
+		planCh:     make(chan planRequest),
+		resetCh:    make(chan resetRequest),
+		queuesCh:   make(chan queuesRequest),
+		tuneCh:     make(chan tuneRequest),
+		releaseCh:  make(chan releaseRequest),
+		keyCountCh: make(chan keyCountRequest),
+		stopped:    make(chan struct{}),
+	}
+	l.keyCount.Store(int64(cfg.KeyCount))
+	l.fastEligible = fastPathEligible(cfg)
+	if cfg.PacingJitterFraction > 0 {
+		seed := cmp.Or(cfg.PacingJitterSeed, rand.Uint64())
+		l.jitter = rand.New(rand.NewPCG(seed, seed))
 	}
 	go l.loop()
 
@@ -51,13 +173,22 @@ func (l *Limiter) Admit(ctx context.Context, admission Admission) (Ticket, error
 	if admission.Region == "" || admission.Bucket == "" {
 		return Ticket{}, &RejectedError{Reason: "invalid_route"}
 	}
-	if admission.TokenIndex != nil && (*admission.TokenIndex < 0 || *admission.TokenIndex >= l.cfg.KeyCount) {
+	if admission.TokenIndex != nil && (*admission.TokenIndex < 0 || int64(*admission.TokenIndex) >= l.keyCount.Load()) {
 		return Ticket{}, &RejectedError{Reason: "invalid_token_index"}
 	}
 	budgetShare, ok := l.cfg.budgetShare(admission.BudgetID, admission.Bucket)
 	if !ok {
 		return Ticket{}, &RejectedError{Reason: "invalid_budget"}
 	}
+	if l.closed.Load() {
+		return Ticket{}, &RejectedError{Reason: "shutting_down"}
+	}
+	if err := ctx.Err(); err != nil {
+		return Ticket{}, err
+	}
+	if ticket, ok := l.admitFast(admission); ok {
+		return ticket, nil
+	}
 
 	req := &admitRequest{
 		ctx:         ctx,
@@ -69,6 +200,8 @@ func (l *Limiter) Admit(ctx context.Context, admission Admission) (Ticket, error
 
 	select {
 	case l.admitCh <- req:
+	case <-l.stopped:
+		return Ticket{}, &RejectedError{Reason: "shutting_down"}
 	case <-ctx.Done():
 		return Ticket{}, ctx.Err()
 	}
@@ -77,36 +210,103 @@ func (l *Limiter) Admit(ctx context.Context, admission Admission) (Ticket, error
 	case out := <-req.resp:
 		return out.ticket, out.err
 	case <-ctx.Done():
+		// A grant may already be waiting, or be sent before the loop sees
+		// abandoned; either way it must not keep its slots.
+		req.abandoned.Store(true)
+		select {
+		case out := <-req.resp:
+			if out.err == nil {
+				l.Release(out.ticket, admission.Region, admission.Bucket)
+			}
+		default:
+		}
 		return Ticket{}, ctx.Err()
 	}
 }
 
+// ColdStart reports whether no method limits have been learned for bucket yet.
+func (l *Limiter) ColdStart(bucket string) bool {
+	_, ok := l.learned.Load(bucket)
+	return !ok
+}
+
+// Observe drops observations that arrive after Close.
 func (l *Limiter) Observe(observation Observation) {
-	l.observeCh <- observation
+	select {
+	case l.observeCh <- observation:
+	case <-l.stopped:
+	}
 }
 
+// ObserveSync is Observe, but returns only once the loop has applied the
+// observation, so an Admit made afterwards already sees it. It gives up when ctx
+// is done or the limiter is closed.
+func (l *Limiter) ObserveSync(ctx context.Context, observation Observation) {
+	observation.applied = make(chan struct{})
+	select {
+	case l.observeCh <- observation:
+	case <-l.stopped:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-observation.applied:
+	case <-l.stopped:
+	case <-ctx.Done():
+	}
+}
+
+// Close rejects queued admissions with reason "shutting_down" and stops the
+// limiter. Later Admit calls are rejected the same way. Close is idempotent.
 func (l *Limiter) Close() error {
-	done := make(chan struct{})
-	l.closeCh <- done
-	<-done
+	if l.closed.CompareAndSwap(false, true) {
+		close(l.closeCh)
+	}
+	<-l.stopped
 	return nil
 }
 
 func (l *Limiter) loop() {
 	keys := make([]keyState, l.cfg.KeyCount)
-	defaultApp := parseRateHeader(l.cfg.DefaultAppLimits, "")
+	defaultApp := withHeadroom(parseRateHeader(l.cfg.DefaultAppLimits, ""), l.cfg.LimitHeadroomFraction)
+	defaultMethod := make(map[string][]parsedWindow, len(l.cfg.DefaultMethodLimits))
+	for pattern, limits := range l.cfg.DefaultMethodLimits {
+		defaultMethod[strings.TrimPrefix(pattern, "/")] = withHeadroom(parseRateHeader(limits, ""), l.cfg.LimitHeadroomFraction)
+	}
+	newKey := func() keyState {
+		key := newKeyState(defaultApp, defaultMethod)
+		if l.cfg.MinSpacing > 0 || len(l.cfg.MinSpacingOverrides) > 0 {
+			key.minSpacing = l.minSpacing
+		}
+		return key
+	}
 	for i := range keys {
-		keys[i] = newKeyState(defaultApp)
+		keys[i] = newKey()
 	}
 
 	buckets := make(map[string]*bucketQueue)
 	regionIndex := make(map[string][]*bucketQueue)
+	if metrics := l.cfg.Metrics; metrics != nil {
+		metrics.ObserveActiveBuckets(0)
+		metrics.ObserveActiveKeys(len(keys))
+	}
 	wakeups := make(wakeHeap, 0)
 	heap.Init(&wakeups)
 
-	timer := time.NewTimer(idleTimerWindow)
+	timer := l.cfg.Clock.NewTimer(idleTimerWindow)
 	defer timer.Stop()
 
+	// The depth timer is rearmed after each republish, so a fake Clock drives
+	// it like the wakeup timer.
+	var depthTimer Timer
+	var depthTick <-chan time.Time
+	if l.cfg.QueueDepthInterval > 0 && l.cfg.Metrics != nil {
+		depthTimer = l.cfg.Clock.NewTimer(l.cfg.QueueDepthInterval)
+		defer depthTimer.Stop()
+		depthTick = depthTimer.C()
+	}
+
 	for {
 		nextWake := idleTimerWindow
 		if len(wakeups) > 0 {
@@ -116,40 +316,71 @@ func (l *Limiter) loop() {
 				nextWake = 0
 			}
 		}
-		resetTimer(timer, nextWake)
+		timer.Reset(nextWake)
 
 		select {
 		case req := <-l.admitCh:
 			l.handleAdmit(req, keys, buckets, regionIndex, &wakeups)
 		case obs := <-l.observeCh:
-			l.handleObservation(obs, keys, regionIndex, &wakeups)
-			// Drain all pending observations before re-entering select.
-			l.drainObservations(keys, regionIndex, &wakeups)
-		case <-timer.C:
+			if metrics := l.cfg.Metrics; metrics != nil {
+				// Count the observation just received so a full buffer reports 100%.
+				metrics.ObserveObservationBuffer(len(l.observeCh)+1, cap(l.observeCh))
+			}
+			l.handleObservations(obs, keys, regionIndex, &wakeups)
+		case req := <-l.planCh:
+			l.handlePlan(req, keys)
+		case req := <-l.resetCh:
+			l.handleReset(req, keys, regionIndex, &wakeups)
+		case req := <-l.queuesCh:
+			l.handleQueues(req, buckets)
+		case req := <-l.tuneCh:
+			l.handleTune(req, keys, regionIndex, &wakeups)
+		case req := <-l.releaseCh:
+			l.handleRelease(req, keys, regionIndex, &wakeups)
+		case req := <-l.keyCountCh:
+			keys = l.handleKeyCount(req, keys, newKey, regionIndex, &wakeups)
+		case <-depthTick:
+			l.publishQueueDepths(buckets)
+			depthTimer.Reset(l.cfg.QueueDepthInterval)
+		case <-timer.C():
 			now := l.cfg.Clock.Now()
+			var due []string
 			for len(wakeups) > 0 {
 				next := wakeups[0]
 				if next.wakeAt.After(now) {
 					break
 				}
 				heap.Pop(&wakeups)
-				l.dispatch(next, keys, &wakeups)
+				if !slices.Contains(due, next.region) {
+					due = append(due, next.region)
+				}
 			}
-		case done := <-l.closeCh:
+			for _, region := range due {
+				l.dispatchRegion(regionIndex[region], keys, &wakeups)
+			}
+		case <-l.closeCh:
 			for _, bucket := range buckets {
-				for req := bucket.dequeueValid(); req != nil; req = bucket.dequeueValid() {
+				bucket.unpark(math.MaxInt)
+				for req := bucket.dequeueValid(false); req != nil; req = bucket.dequeueValid(false) {
 					select {
 					case req.resp <- admitResponse{err: &RejectedError{Reason: "shutting_down"}}:
 					default:
 					}
 				}
 			}
-			close(done)
+			close(l.stopped)
 			return
 		}
 	}
 }
 
+func (l *Limiter) publishQueueDepths(buckets map[string]*bucketQueue) {
+	for _, bucket := range buckets {
+		l.cfg.Metrics.ObserveQueueDepth(bucket.bucket, PriorityHigh, len(bucket.high))
+		l.cfg.Metrics.ObserveQueueDepth(bucket.bucket, PriorityNormal, len(bucket.normal))
+	}
+}
+
 func (l *Limiter) handleAdmit(
 	req *admitRequest,
 	keys []keyState,
@@ -168,44 +399,159 @@ func (l *Limiter) handleAdmit(
 	bucket := buckets[req.admission.Bucket]
 	if bucket == nil {
 		bucket = &bucketQueue{
-			region:    req.admission.Region,
-			bucket:    req.admission.Bucket,
-			heapIndex: -1,
+			region:     req.admission.Region,
+			bucket:     req.admission.Bucket,
+			byDeadline: l.cfg.QueueOrder == QueueOrderDeadline,
+			heapIndex:  -1,
 		}
 		buckets[req.admission.Bucket] = bucket
 		regionIndex[bucket.region] = append(regionIndex[bucket.region], bucket)
+		if metrics := l.cfg.Metrics; metrics != nil {
+			metrics.ObserveActiveBuckets(len(buckets))
+		}
 	}
+	// Whatever is decided below must see the slots the region's lanes hold.
+	l.closeLanes(regionIndex[bucket.region], keys)
+	defer l.openLane(bucket, keys)
 
 	if bucket.depth() >= l.cfg.QueueCapacity {
+		// NoWait callers asked not to wait, so they are not parked either.
+		if l.cfg.QueueFullPolicy == QueueFullBlock && !req.admission.NoWait && bucket.park(req, l.cfg.QueueCapacity) {
+			return
+		}
 		now := l.cfg.Clock.Now()
 		_, earliest := l.pickKey(now, keys, bucket.region, bucket.bucket, req.admission.Priority, req.admission.TokenIndex, req.admission.BudgetID, req.budgetShare)
 		req.resp <- admitResponse{
 			err: &RejectedError{
 				Reason:     "queue_full",
 				RetryAfter: maxDuration(earliest.Sub(now), time.Second),
+				QueueDepth: bucket.depth(),
 			},
 		}
 		return
 	}
 
+	deadline, hasDeadline := req.ctx.Deadline()
+	checkDeadline := l.cfg.RejectPastDeadline && hasDeadline
+	if l.cfg.MaxEstimatedWait > 0 || checkDeadline {
+		now := l.cfg.Clock.Now()
+		_, earliest := l.pickKey(now, keys, bucket.region, bucket.bucket, req.admission.Priority, req.admission.TokenIndex, req.admission.BudgetID, req.budgetShare)
+		wait := earliest.Sub(now)
+		if l.cfg.MaxEstimatedWait > 0 && wait > l.cfg.MaxEstimatedWait {
+			req.resp <- admitResponse{
+				err: &RejectedError{
+					Reason:     "estimated_wait_exceeded",
+					RetryAfter: wait,
+				},
+			}
+			return
+		}
+		// Context deadlines are wall-clock times, whatever Clock says.
+		if checkDeadline && time.Now().Add(wait).After(deadline) {
+			req.resp <- admitResponse{
+				err: &RejectedError{
+					Reason:     "wait_exceeds_deadline",
+					RetryAfter: wait,
+				},
+			}
+			return
+		}
+	}
+
 	bucket.enqueue(req)
 	if metrics := l.cfg.Metrics; metrics != nil {
 		metrics.ObserveQueueDepth(bucket.bucket, req.admission.Priority, bucket.depth())
 	}
-	l.dispatch(bucket, keys, wakeups)
+	l.dispatchRegion(regionIndex[bucket.region], keys, wakeups)
+
+	if req.admission.NoWait && bucket.remove(req) {
+		if metrics := l.cfg.Metrics; metrics != nil {
+			metrics.ObserveQueueDepth(bucket.bucket, req.admission.Priority, bucket.depth())
+		}
+		now := l.cfg.Clock.Now()
+		_, earliest := l.pickKey(now, keys, bucket.region, bucket.bucket, req.admission.Priority, req.admission.TokenIndex, req.admission.BudgetID, req.budgetShare)
+		req.resp <- admitResponse{
+			err: &RejectedError{
+				Reason:     "would_wait",
+				RetryAfter: maxDuration(earliest.Sub(now), time.Second),
+			},
+		}
+	}
 }
 
-func (l *Limiter) handleObservation(
+// handleObservations applies obs and every observation already buffered
+// behind it, then dispatches each affected region once. Under load this keeps
+// the region-wide dispatch per batch instead of per response.
+func (l *Limiter) handleObservations(
 	obs Observation,
 	keys []keyState,
 	regionIndex map[string][]*bucketQueue,
 	wakeups *wakeHeap,
 ) {
+	var regions []string
+	for more := true; more; {
+		if l.applyObservation(obs, keys, regionIndex) {
+			if l.cfg.ColdStartPolicy == ColdStartSerialize {
+				for _, bucket := range regionIndex[obs.Region] {
+					if bucket.bucket == obs.Bucket {
+						bucket.coldInFlight = false
+					}
+				}
+			}
+			if !slices.Contains(regions, obs.Region) {
+				regions = append(regions, obs.Region)
+			}
+		}
+		if obs.applied != nil {
+			close(obs.applied)
+		}
+		select {
+		case obs = <-l.observeCh:
+		default:
+			more = false
+		}
+	}
+
+	// An app-limit update can unblock or block multiple buckets in the same
+	// region. Other routing values have their own app state and are unaffected.
+	for _, region := range regions {
+		l.dispatchRegion(regionIndex[region], keys, wakeups)
+	}
+}
+
+// retryScopeIsMethod reports whether a 429 with this X-Rate-Limit-Type blocks
+// only its bucket rather than the whole routing value. Service limits are
+// enforced per endpoint, so they block the bucket like method limits. Riot
+// sends "application" for app limits and some responses omit the header.
+// Values it has not documented also block the routing value, as the wider
+// block is the one that cannot cause another 429, and each is logged once so
+// a new limit type does not go unnoticed. Only the loop goroutine calls it.
+func (l *Limiter) retryScopeIsMethod(limitType string) bool {
+	switch value := strings.ToLower(strings.TrimSpace(limitType)); value {
+	case "method", "service":
+		return true
+	case "application", "app", "":
+		return false
+	default:
+		if _, seen := l.unknownLimitTypes[value]; !seen {
+			if l.unknownLimitTypes == nil {
+				l.unknownLimitTypes = make(map[string]struct{})
+			}
+			l.unknownLimitTypes[value] = struct{}{}
+			log.Printf("unknown X-Rate-Limit-Type %q; blocking the routing value", limitType)
+		}
+		return false
+	}
+}
+
+// applyObservation updates the key's app and method state from one response.
+// It reports false for observations it ignores.
+func (l *Limiter) applyObservation(obs Observation, keys []keyState, regionIndex map[string][]*bucketQueue) bool {
 	if obs.KeyIndex < 0 || obs.KeyIndex >= len(keys) {
-		return
+		return false
 	}
 	if obs.Region == "" || obs.Bucket == "" {
-		return
+		return false
 	}
 
 	now := l.cfg.Clock.Now()
@@ -213,44 +559,110 @@ func (l *Limiter) handleObservation(
 	if d, ok := httputil.ParseRetryAfter(obs.Header.Get("Retry-After")); ok {
 		t := now.Add(d)
 		retryAfter = &t
+	} else if obs.StatusCode == http.StatusTooManyRequests && l.cfg.DefaultRetryAfter > 0 {
+		t := now.Add(l.cfg.DefaultRetryAfter)
+		retryAfter = &t
 	}
 
-	limitType := strings.ToLower(strings.TrimSpace(obs.Header.Get("X-Rate-Limit-Type")))
-	applyMethodRetry := obs.StatusCode == http.StatusTooManyRequests && limitType == "method"
-	applyAppRetry := obs.StatusCode == http.StatusTooManyRequests && !applyMethodRetry
+	methodScoped := l.retryScopeIsMethod(obs.Header.Get("X-Rate-Limit-Type"))
+	applyMethodRetry := obs.StatusCode == http.StatusTooManyRequests && methodScoped
+	applyAppRetry := obs.StatusCode == http.StatusTooManyRequests && !methodScoped
 
 	key := &keys[obs.KeyIndex]
+	if l.trackForbidden(obs, key) {
+		l.closeAllLanes(regionIndex, keys)
+	}
+
+	appLimits := withHeadroom(parseRateHeader(obs.Header.Get("X-App-Rate-Limit"), obs.Header.Get("X-App-Rate-Limit-Count")), l.cfg.LimitHeadroomFraction)
+	methodLimits := withHeadroom(parseRateHeader(obs.Header.Get("X-Method-Rate-Limit"), obs.Header.Get("X-Method-Rate-Limit-Count")), l.cfg.LimitHeadroomFraction)
+
+	// Every game on this routing value (LoL, TFT, ...) feeds one app state.
+	// apply keeps the highest count seen in a window, so responses arriving
+	// out of order converge instead of lowering it.
+	app := key.app(obs.Region, now, l.cfg.AdditionalWindow)
+	method := key.method(obs.Bucket, now, l.cfg.AdditionalWindow)
+	// Fast lanes were opened for the old windows and without the block.
+	if obs.StatusCode == http.StatusTooManyRequests || !app.sameWindows(appLimits, l.cfg.AdditionalWindow) {
+		l.closeLanes(regionIndex[obs.Region], keys)
+	} else if !method.sameWindows(methodLimits, l.cfg.AdditionalWindow) {
+		for _, bucket := range regionIndex[obs.Region] {
+			if bucket.bucket == obs.Bucket {
+				l.closeLane(bucket, keys)
+			}
+		}
+	}
+	app.apply(appLimits, retryAfter, applyAppRetry, now, l.cfg.AdditionalWindow)
+	method.apply(methodLimits, retryAfter, applyMethodRetry, now, l.cfg.AdditionalWindow)
+	if len(methodLimits) > 0 {
+		if _, loaded := l.learned.LoadOrStore(obs.Bucket, struct{}{}); !loaded && l.cfg.Metrics != nil {
+			l.cfg.Metrics.ObserveBucketLearned(obs.Bucket, now)
+		}
+	}
+	return true
+}
 
-	appLimits := parseRateHeader(obs.Header.Get("X-App-Rate-Limit"), obs.Header.Get("X-App-Rate-Limit-Count"))
-	methodLimits := parseRateHeader(obs.Header.Get("X-Method-Rate-Limit"), obs.Header.Get("X-Method-Rate-Limit-Count"))
-
-	key.app(obs.Region, now, l.cfg.AdditionalWindow).apply(appLimits, retryAfter, applyAppRetry, now, l.cfg.AdditionalWindow)
-	key.method(obs.Bucket).apply(methodLimits, retryAfter, applyMethodRetry, now, l.cfg.AdditionalWindow)
-
-	// An app-limit update can unblock or block multiple buckets in the same region.
-	for _, bucket := range regionIndex[obs.Region] {
-		l.dispatch(bucket, keys, wakeups)
+// trackForbidden disables a key after DisableKeyAfterForbidden consecutive
+// 403s, which Riot answers for every request of a revoked or expired key. It
+// reports whether it disabled the key just now.
+func (l *Limiter) trackForbidden(obs Observation, key *keyState) bool {
+	if l.cfg.DisableKeyAfterForbidden <= 0 {
+		return false
+	}
+	if obs.StatusCode != http.StatusForbidden {
+		key.forbiddenStreak = 0
+		return false
+	}
+	key.forbiddenStreak++
+	if key.forbiddenStreak >= l.cfg.DisableKeyAfterForbidden && !key.disabled {
+		key.disabled = true
+		log.Printf("key_disabled key_index=%d consecutive_403=%d; a full limiter reset re-enables it", obs.KeyIndex, key.forbiddenStreak)
+		return true
 	}
+	return false
 }
 
-func (l *Limiter) drainObservations(
-	keys []keyState,
-	regionIndex map[string][]*bucketQueue,
-	wakeups *wakeHeap,
-) {
+// dispatchRegion serves the queued buckets of one region, which all share its
+// app limit, round-robin: one grant per bucket per round, starting with the
+// bucket served least recently, so a hot bucket cannot take the whole app
+// budget while others starve.
+func (l *Limiter) dispatchRegion(buckets []*bucketQueue, keys []keyState, wakeups *wakeHeap) {
+	var active []*bucketQueue
+	for _, bucket := range buckets {
+		if bucket.depth() > 0 {
+			active = append(active, bucket)
+		} else {
+			removeWake(wakeups, bucket)
+		}
+	}
+	if len(active) > 0 {
+		// Slots held by fast lanes are free for the queued requests.
+		l.closeLanes(buckets, keys)
+	}
+	if len(active) <= 1 {
+		for _, bucket := range active {
+			l.dispatch(bucket, keys, wakeups, 0)
+		}
+		return
+	}
+
+	slices.SortFunc(active, func(a, b *bucketQueue) int { return cmp.Compare(a.lastServed, b.lastServed) })
 	for {
-		select {
-		case obs := <-l.observeCh:
-			l.handleObservation(obs, keys, regionIndex, wakeups)
-		default:
+		granted := 0
+		for _, bucket := range active {
+			granted += l.dispatch(bucket, keys, wakeups, 1)
+		}
+		if granted == 0 {
 			return
 		}
 	}
 }
 
-func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHeap) {
+// dispatch grants queued requests of bucket until one has to wait, or until
+// maxGrants requests were granted when maxGrants > 0. It returns the number
+// of grants.
+func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHeap, maxGrants int) int {
 	if bucket == nil {
-		return
+		return 0
 	}
 
 	var skippedHigh []*admitRequest
@@ -270,8 +682,18 @@ func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHe
 		}
 	}
 
-	for {
-		req := bucket.dequeueValid()
+	granted := 0
+	// normalBlocked is set once a normal request had to wait in this pass, so
+	// high priority, which bypasses pacing, is not held back behind it.
+	normalBlocked := false
+	for maxGrants <= 0 || granted < maxGrants {
+		bucket.unpark(l.cfg.QueueCapacity)
+		if bucket.coldInFlight && l.ColdStart(bucket.bucket) {
+			// The next grant waits for the observation of the previous one,
+			// which triggers dispatch again.
+			break
+		}
+		req := bucket.dequeueValid(!normalBlocked && bucket.normalTurn(l.cfg.PriorityWeights))
 		if req == nil {
 			break
 		}
@@ -283,18 +705,30 @@ func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHe
 			continue
 		}
 
+		if earliest.After(now) && l.rejectBlocked(now, keys, bucket, req) {
+			req.resp <- admitResponse{err: &RejectedError{Reason: "all_keys_blocked", RetryAfter: earliest.Sub(now)}}
+			continue
+		}
+
 		var cannotServe bool
 		var wakeAt time.Time
+		var appBefore, methodBefore anchors
 
 		if earliest.After(now) {
 			cannotServe = true
 			wakeAt = earliest
 		} else {
 			key := &keys[keyIndex]
-			if !key.app(bucket.region, now, l.cfg.AdditionalWindow).consume(now, req.admission.BudgetID) ||
-				!key.method(bucket.bucket).consume(now, req.admission.BudgetID) {
+			app := key.app(bucket.region, now, l.cfg.AdditionalWindow)
+			method := key.method(bucket.bucket, now, l.cfg.AdditionalWindow)
+			appBefore, methodBefore = app.anchors(req.admission.BudgetID), method.anchors(req.admission.BudgetID)
+			if !app.consume(now, req.admission.BudgetID) || !method.consume(now, req.admission.BudgetID) {
 				cannotServe = true
 				wakeAt = now.Add(5 * time.Millisecond)
+			} else if l.jitter != nil {
+				jitter := l.jitter.Float64() * l.cfg.PacingJitterFraction
+				app.setJitter(req.admission.BudgetID, jitter)
+				method.setJitter(req.admission.BudgetID, jitter)
 			}
 		}
 
@@ -305,12 +739,50 @@ func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHe
 				continue
 			}
 			bucket.prepend(req)
+			if req.admission.Priority == PriorityNormal && !normalBlocked && len(bucket.high) > 0 {
+				normalBlocked = true
+				continue
+			}
 			break
 		}
 
-		req.resp <- admitResponse{ticket: Ticket{KeyIndex: keyIndex}}
+		paced := req.admission.Priority != PriorityHigh && !l.cfg.DisablePacing
+		ticket := Ticket{
+			KeyIndex:      keyIndex,
+			Paced:         paced,
+			QueuePosition: req.queuePosition,
+			grant: &grant{
+				budgetID: req.admission.BudgetID,
+				at:       now,
+				priority: req.admission.Priority,
+				app:      appBefore,
+				method:   methodBefore,
+			},
+		}
+		if l.cfg.ColdStartPolicy == ColdStartSerialize && l.ColdStart(bucket.bucket) {
+			bucket.coldInFlight = true
+			ticket.grant.cold = true
+		}
+		req.resp <- admitResponse{ticket: ticket}
+		bucket.recordGrant(req.admission.Priority, l.cfg.PriorityWeights)
+		keys[keyIndex].recordGrant(now)
+		if req.abandoned.Load() && ticket.grant.released.CompareAndSwap(false, true) {
+			l.undoGrant(ticket, keys, bucket)
+		}
+		granted++
+		l.grantSeq++
+		bucket.lastServed = l.grantSeq
 		if metrics := l.cfg.Metrics; metrics != nil {
 			metrics.ObserveQueueDepth(bucket.bucket, req.admission.Priority, bucket.depth()+len(skippedHigh)+len(skippedNormal))
+			if l.ColdStart(bucket.bucket) {
+				metrics.ObserveBucketUsingDefaults(bucket.bucket)
+			}
+			if paced {
+				key := &keys[keyIndex]
+				app := key.app(bucket.region, now, l.cfg.AdditionalWindow).pacingInterval(now, req.admission.BudgetID, req.budgetShare)
+				method := key.method(bucket.bucket, now, l.cfg.AdditionalWindow).pacingInterval(now, req.admission.BudgetID, req.budgetShare)
+				metrics.ObservePacingInterval(bucket.bucket, max(app, method))
+			}
 		}
 	}
 
@@ -327,6 +799,26 @@ func (l *Limiter) dispatch(bucket *bucketQueue, keys []keyState, wakeups *wakeHe
 	} else if !earliestWake.IsZero() {
 		upsertWake(wakeups, bucket, earliestWake)
 	}
+	return granted
+}
+
+// rejectBlocked reports whether req should be shed because every key it may
+// use is blocked by a Retry-After.
+func (l *Limiter) rejectBlocked(now time.Time, keys []keyState, bucket *bucketQueue, req *admitRequest) bool {
+	if !l.cfg.RejectWhenAllBlocked {
+		return false
+	}
+	for i := range keys {
+		if forced := req.admission.TokenIndex; forced != nil && i != *forced {
+			continue
+		}
+		key := &keys[i]
+		if !key.app(bucket.region, now, l.cfg.AdditionalWindow).blockedUntil.After(now) &&
+			!key.method(bucket.bucket, now, l.cfg.AdditionalWindow).blockedUntil.After(now) {
+			return false
+		}
+	}
+	return true
 }
 
 func (l *Limiter) pickKey(
@@ -339,18 +831,31 @@ func (l *Limiter) pickKey(
 	budgetID string,
 	budgetShare float64,
 ) (int, time.Time) {
+	if forcedTokenIndex == nil {
+		if index, ok := l.affineKey(bucket); ok {
+			keyIndex, readyAt := l.pickKey(now, keys, region, bucket, priority, &index, budgetID, budgetShare)
+			if !l.cfg.KeyAffinityFallback || !readyAt.After(now) {
+				return keyIndex, readyAt
+			}
+		}
+	}
+
 	bestIndex := -1
 	bestAt := time.Time{}
-	bypassPacing := priority == PriorityHigh
+	readyIndex := -1
+	bypassPacing := priority == PriorityHigh || l.cfg.DisablePacing
 
 	for i := range keys {
 		if forcedTokenIndex != nil && i != *forcedTokenIndex {
 			continue
 		}
+		if keys[i].disabled {
+			continue
+		}
 
 		key := &keys[i]
 		appAt := key.app(region, now, l.cfg.AdditionalWindow).nextAllowed(now, budgetID, budgetShare, bypassPacing)
-		methodAt := key.method(bucket).nextAllowed(now, budgetID, budgetShare, bypassPacing)
+		methodAt := key.method(bucket, now, l.cfg.AdditionalWindow).nextAllowed(now, budgetID, budgetShare, bypassPacing)
 		readyAt := appAt
 		if methodAt.After(readyAt) {
 			readyAt = methodAt
@@ -360,14 +865,70 @@ func (l *Limiter) pickKey(
 			bestIndex = i
 			bestAt = readyAt
 		}
+		if !readyAt.After(now) && (readyIndex < 0 || l.preferWeighted(keys, i, readyIndex, now)) {
+			readyIndex = i
+		}
 	}
 
 	if bestIndex < 0 {
 		return -1, now.Add(time.Second)
 	}
+	if len(l.cfg.KeyWeights) > 0 && readyIndex >= 0 {
+		return readyIndex, now
+	}
 	return bestIndex, bestAt
 }
 
+// affineKey returns the key bucket is pinned to by KeyAffinity.
+func (l *Limiter) affineKey(bucket string) (int, bool) {
+	if len(l.cfg.KeyAffinity) == 0 {
+		return 0, false
+	}
+	if index, ok := l.cfg.KeyAffinity[bucket]; ok {
+		return index, true
+	}
+	_, pattern, _ := strings.Cut(bucket, ":")
+	index, ok := l.cfg.KeyAffinity[pattern]
+	return index, ok
+}
+
+// minSpacing returns the MinSpacing floor for bucket, preferring an exact
+// bucket override over a route pattern override.
+func (l *Limiter) minSpacing(bucket string) time.Duration {
+	if spacing, ok := l.cfg.MinSpacingOverrides[bucket]; ok {
+		return spacing
+	}
+	_, pattern, _ := strings.Cut(bucket, ":")
+	if spacing, ok := l.cfg.MinSpacingOverrides[pattern]; ok {
+		return spacing
+	}
+	return l.cfg.MinSpacing
+}
+
+// preferWeighted reports whether key a has had fewer recent grants per weight
+// than key b.
+func (l *Limiter) preferWeighted(keys []keyState, a, b int, now time.Time) bool {
+	if len(l.cfg.KeyWeights) == 0 {
+		return false
+	}
+	return keys[a].grants(now)*l.cfg.KeyWeights[b] < keys[b].grants(now)*l.cfg.KeyWeights[a]
+}
+
+func validateKeyWeights(weights []int, keyCount int) error {
+	if len(weights) == 0 {
+		return nil
+	}
+	if len(weights) != keyCount {
+		return fmt.Errorf("KeyWeights must have one entry per key")
+	}
+	for _, weight := range weights {
+		if weight <= 0 {
+			return fmt.Errorf("KeyWeights must be > 0")
+		}
+	}
+	return nil
+}
+
 func (cfg Config) budgetShare(id, bucket string) (float64, bool) {
 	id = normalizeBudgetID(id)
 	if id == defaultBudgetID {
@@ -3,7 +3,12 @@ package limiter
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math"
 	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -30,6 +35,38 @@ func TestNewValidation(t *testing.T) {
 				QueueCapacity: 0,
 			},
 		},
+		{
+			name: "key weights length mismatch",
+			cfg: Config{
+				KeyCount:      2,
+				QueueCapacity: 1,
+				KeyWeights:    []int{1},
+			},
+		},
+		{
+			name: "invalid default method limits",
+			cfg: Config{
+				KeyCount:            1,
+				QueueCapacity:       1,
+				DefaultMethodLimits: map[string]string{"*": "bad"},
+			},
+		},
+		{
+			name: "invalid cold start policy",
+			cfg: Config{
+				KeyCount:        1,
+				QueueCapacity:   1,
+				ColdStartPolicy: "careful",
+			},
+		},
+		{
+			name: "invalid headroom fraction",
+			cfg: Config{
+				KeyCount:              1,
+				QueueCapacity:         1,
+				LimitHeadroomFraction: 1,
+			},
+		},
 	}
 
 	for _, tt := range tests {
@@ -183,58 +220,82 @@ func TestLimiterQueueFull(t *testing.T) {
 	})
 }
 
-func TestLimiterHighPriorityBypassesQueuedNormal(t *testing.T) {
+func TestLimiterAdmitAfterClose(t *testing.T) {
+	l, err := New(Config{
+		KeyCount:         1,
+		QueueCapacity:    1,
+		DefaultAppLimits: "20:1",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := l.Close(); err != nil {
+		t.Fatalf("second Close() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	start := time.Now()
+	_, err = l.Admit(ctx, Admission{
+		Region: "europe",
+		Bucket: "europe:riot/account/v1/accounts/me",
+	})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) || rejected.Reason != "shutting_down" {
+		t.Fatalf("Admit() after Close() error = %v, want shutting_down RejectedError", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("Admit() after Close() took %v, want an immediate rejection", elapsed)
+	}
+
+	// Observations after Close are dropped instead of blocking.
+	for range defaultObserveBufferSize + 1 {
+		l.Observe(Observation{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", StatusCode: http.StatusOK})
+	}
+}
+
+func TestLimiterNoWaitRejectsInsteadOfQueueing(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		l, err := New(Config{
 			KeyCount:         1,
 			QueueCapacity:    4,
-			DefaultAppLimits: "1:1",
+			DefaultAppLimits: "1:60",
 		})
 		if err != nil {
 			t.Fatalf("New() error = %v", err)
 		}
 		defer func() { _ = l.Close() }()
 
-		bucket := "europe:riot/account/v1/accounts/me"
-		if _, err := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal}); err != nil {
-			t.Fatalf("initial Admit() error = %v", err)
+		admission := Admission{
+			Region: "europe",
+			Bucket: "europe:riot/account/v1/accounts/me",
+			NoWait: true,
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
 		}
 
-		order := make(chan string, 2)
-		go func() {
-			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
-			if admitErr == nil {
-				order <- "normal"
-			}
-		}()
-		go func() {
-			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh})
-			if admitErr == nil {
-				order <- "high"
-			}
-		}()
-
-		synctest.Wait()
-
-		time.Sleep(time.Second)
-		synctest.Wait()
-
-		first := <-order
-		if first != "high" {
-			t.Fatalf("first granted priority = %q, want high", first)
+		_, err = l.Admit(context.Background(), admission)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "would_wait" {
+			t.Fatalf("second Admit() error = %v, want would_wait RejectedError", err)
+		}
+		if rejected.RetryAfter < 59*time.Second {
+			t.Fatalf("RetryAfter = %v, want about 60s", rejected.RetryAfter)
 		}
 	})
 }
 
-func TestLimiterBudgetPacing(t *testing.T) {
+func TestLimiterMaxEstimatedWait(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		l, err := New(Config{
 			KeyCount:         1,
 			QueueCapacity:    4,
-			DefaultAppLimits: "10:10",
-			RateBudgets: map[string]BudgetConfig{
-				"worker": {Share: 0.8},
-			},
+			DefaultAppLimits: "2:3600",
+			MaxEstimatedWait: time.Minute,
 		})
 		if err != nil {
 			t.Fatalf("New() error = %v", err)
@@ -244,181 +305,2278 @@ func TestLimiterBudgetPacing(t *testing.T) {
 		admission := Admission{
 			Region:   "europe",
 			Bucket:   "europe:riot/account/v1/accounts/me",
-			BudgetID: "worker",
-			Priority: PriorityNormal,
+			Priority: PriorityHigh,
 		}
-		if _, err := l.Admit(context.Background(), admission); err != nil {
-			t.Fatalf("first Admit() error = %v", err)
+		for range 2 {
+			if _, err := l.Admit(context.Background(), admission); err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
 		}
 
-		done := make(chan error, 1)
-		go func() {
-			_, admitErr := l.Admit(context.Background(), admission)
-			done <- admitErr
-		}()
+		start := time.Now()
+		_, err = l.Admit(context.Background(), admission)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "estimated_wait_exceeded" {
+			t.Fatalf("exhausted Admit() error = %v, want estimated_wait_exceeded RejectedError", err)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("rejection took %v, want immediate", elapsed)
+		}
+		if rejected.RetryAfter < 59*time.Minute || rejected.RetryAfter > time.Hour+time.Second {
+			t.Fatalf("RetryAfter = %v, want about an hour", rejected.RetryAfter)
+		}
+	})
+}
 
-		synctest.Wait()
+func TestLimiterKeyAffinity(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         3,
+			QueueCapacity:    8,
+			DefaultAppLimits: "2:1",
+			KeyAffinity:      map[string]int{"/lol/match/v5/matches/{matchId}": 2},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
 
-		time.Sleep(1249 * time.Millisecond)
-		synctest.Wait()
-		select {
-		case err := <-done:
-			t.Fatalf("second Admit() finished too early with %v", err)
-		default:
+		pinned := Admission{
+			Region:   "europe",
+			Bucket:   "europe:lol/match/v5/matches/{matchId}",
+			Priority: PriorityHigh,
+		}
+		// Four grants need two windows of key 2 even though keys 0 and 1
+		// are idle.
+		for i := range 4 {
+			ticket, err := l.Admit(context.Background(), pinned)
+			if err != nil {
+				t.Fatalf("Admit() #%d error = %v", i, err)
+			}
+			if ticket.KeyIndex != 2 {
+				t.Fatalf("Admit() #%d KeyIndex = %d, want 2", i, ticket.KeyIndex)
+			}
 		}
 
-		time.Sleep(time.Millisecond)
-		synctest.Wait()
-		if err := <-done; err != nil {
-			t.Fatalf("second Admit() error = %v", err)
+		other, err := l.Admit(context.Background(), Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityHigh,
+		})
+		if err != nil {
+			t.Fatalf("unpinned Admit() error = %v", err)
+		}
+		if other.KeyIndex == 2 {
+			t.Fatal("unpinned Admit() used key 2, want a free key")
 		}
 	})
 }
 
-func TestLimiterBudgetFIFOInterleave(t *testing.T) {
-	t.Parallel()
-
-	now := time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC)
-	clock := &mutableClock{now: now}
-	l := &Limiter{
-		cfg: Config{
-			AdditionalWindow: 0,
-			Clock:            clock,
-			RateBudgets: map[string]BudgetConfig{
-				"worker": {Share: 0.8},
-			},
-		},
-	}
-
-	region := "europe"
-	bucketName := "europe:riot/account/v1/accounts/me"
-	keys := []keyState{newKeyState(parseRateHeader("10:10", ""))}
-	if !keys[0].app(region, now, 0).consume(now, defaultBudgetID) {
-		t.Fatal("initial consume() = false, want true")
-	}
+func TestLimiterKeyAffinityFallback(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:            2,
+			QueueCapacity:       8,
+			DefaultAppLimits:    "1:60",
+			KeyAffinity:         map[string]int{"europe:lol/match/v5/matches/{matchId}": 0},
+			KeyAffinityFallback: true,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
 
-	defaultReq := &admitRequest{
-		ctx:         context.Background(),
-		admission:   Admission{Region: region, Bucket: bucketName, BudgetID: defaultBudgetID, Priority: PriorityNormal},
-		budgetShare: 1,
-		resp:        make(chan admitResponse, 1),
-	}
-	workerReq := &admitRequest{
-		ctx:         context.Background(),
-		admission:   Admission{Region: region, Bucket: bucketName, BudgetID: "worker", Priority: PriorityNormal},
-		budgetShare: 0.8,
-		resp:        make(chan admitResponse, 1),
-	}
-	bucket := &bucketQueue{
-		region:    region,
-		bucket:    bucketName,
-		heapIndex: -1,
-	}
-	bucket.enqueue(defaultReq)
-	bucket.enqueue(workerReq)
+		pinned := Admission{
+			Region:   "europe",
+			Bucket:   "europe:lol/match/v5/matches/{matchId}",
+			Priority: PriorityHigh,
+		}
+		for i, want := range []int{0, 1} {
+			ticket, err := l.Admit(context.Background(), pinned)
+			if err != nil {
+				t.Fatalf("Admit() #%d error = %v", i, err)
+			}
+			if ticket.KeyIndex != want {
+				t.Fatalf("Admit() #%d KeyIndex = %d, want %d", i, ticket.KeyIndex, want)
+			}
+		}
+	})
+}
 
-	wakeups := make(wakeHeap, 0)
-	l.dispatch(bucket, keys, &wakeups)
+func TestLimiterPacingJitter(t *testing.T) {
+	schedule := func(t *testing.T, fraction float64, seed uint64) []time.Duration {
+		var gaps []time.Duration
+		synctest.Test(t, func(t *testing.T) {
+			l, err := New(Config{
+				KeyCount:             1,
+				QueueCapacity:        32,
+				DefaultAppLimits:     "10:10",
+				PacingJitterFraction: fraction,
+				PacingJitterSeed:     seed,
+			})
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			defer func() { _ = l.Close() }()
 
-	select {
-	case out := <-workerReq.resp:
-		t.Fatalf("worker admitted before earlier default request: %#v", out)
-	default:
-	}
-	select {
-	case out := <-defaultReq.resp:
-		t.Fatalf("default admitted too early: %#v", out)
-	default:
+			start := time.Now()
+			last := start
+			for i := range 20 {
+				if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"}); err != nil {
+					t.Fatalf("Admit() #%d error = %v", i, err)
+				}
+				now := time.Now()
+				if i == 10 && now.Before(start.Add(10*time.Second)) {
+					t.Fatalf("11th grant at %v, want no more than 10 grants in the first window", now.Sub(start))
+				}
+				gaps = append(gaps, now.Sub(last))
+				last = now
+			}
+		})
+		return gaps
 	}
 
-	clock.now = now.Add(time.Second)
-	l.dispatch(bucket, keys, &wakeups)
-
-	if out := <-defaultReq.resp; out.err != nil {
-		t.Fatalf("default response error = %v", out.err)
+	plain := schedule(t, 0, 0)
+	jittered := schedule(t, 0.5, 42)
+	if slices.Equal(plain, jittered) {
+		t.Fatal("jittered schedule equals the unjittered one")
 	}
-	if out := <-workerReq.resp; out.err != nil {
-		t.Fatalf("worker response error = %v", out.err)
+	if again := schedule(t, 0.5, 42); !slices.Equal(jittered, again) {
+		t.Fatalf("schedule with the same seed = %v, want %v", again, jittered)
 	}
 }
 
-func TestLimiterRejectsUnknownBudget(t *testing.T) {
-	t.Parallel()
+func TestLimiterMinSpacing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    16,
+			DefaultAppLimits: "1000000:600",
+			MinSpacing:       100 * time.Millisecond,
+			MinSpacingOverrides: map[string]time.Duration{
+				"lol/match/v5/matches/{matchId}": 250 * time.Millisecond,
+			},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
 
-	l, err := New(Config{
-		KeyCount:         1,
-		QueueCapacity:    1,
-		DefaultAppLimits: "20:1",
-	})
-	if err != nil {
-		t.Fatalf("New() error = %v", err)
-	}
-	defer func() { _ = l.Close() }()
+		spacing := func(bucket string, priority Priority) time.Duration {
+			t.Helper()
+			admission := Admission{Region: "europe", Bucket: bucket, Priority: priority}
+			if _, err := l.Admit(context.Background(), admission); err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			minGap := time.Duration(math.MaxInt64)
+			last := time.Now()
+			for range 5 {
+				if _, err := l.Admit(context.Background(), admission); err != nil {
+					t.Fatalf("Admit() error = %v", err)
+				}
+				minGap = min(minGap, time.Since(last))
+				last = time.Now()
+			}
+			return minGap
+		}
 
-	_, err = l.Admit(context.Background(), Admission{
-		Region:   "europe",
-		Bucket:   "europe:riot/account/v1/accounts/me",
-		BudgetID: "worker",
-		Priority: PriorityNormal,
+		// The window alone would pace these 600µs apart.
+		if got, want := spacing("europe:riot/account/v1/accounts/me", PriorityNormal), 100*time.Millisecond; got < want {
+			t.Fatalf("normal grants %v apart, want at least %v", got, want)
+		}
+		if got, want := spacing("europe:lol/match/v5/matches/{matchId}", PriorityNormal), 250*time.Millisecond; got < want {
+			t.Fatalf("override grants %v apart, want at least %v", got, want)
+		}
+		if got := spacing("europe:lol/match/v5/matches/by-puuid/{puuid}/ids", PriorityHigh); got != 0 {
+			t.Fatalf("high priority grants %v apart, want no spacing", got)
+		}
 	})
-	var rejected *RejectedError
-	if !errors.As(err, &rejected) {
-		t.Fatalf("Admit() error = %v, want RejectedError", err)
-	}
-	if got, want := rejected.Reason, "invalid_budget"; got != want {
-		t.Fatalf("RejectedError.Reason = %q, want %q", got, want)
-	}
 }
 
-func TestLimiterObserveRetryAfterBlocksUntilWindow(t *testing.T) {
+func TestLimiterPriorityWeightsPreventStarvation(t *testing.T) {
 	synctest.Test(t, func(t *testing.T) {
 		l, err := New(Config{
 			KeyCount:         1,
-			QueueCapacity:    2,
-			DefaultAppLimits: "20:1",
+			QueueCapacity:    64,
+			DefaultAppLimits: "1:1",
+			PriorityWeights:  PriorityWeights{High: 3, Normal: 1},
 		})
 		if err != nil {
 			t.Fatalf("New() error = %v", err)
 		}
 		defer func() { _ = l.Close() }()
 
-		bucket := "europe:riot/account/v1/accounts/me"
-		l.Observe(Observation{
-			Region:     "europe",
-			Bucket:     bucket,
-			KeyIndex:   0,
-			StatusCode: http.StatusTooManyRequests,
-			Header: http.Header{
-				"Retry-After":       []string{"2"},
-				"X-Rate-Limit-Type": []string{"application"},
-			},
-		})
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		admission := func(priority Priority) Admission {
+			return Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", Priority: priority}
+		}
 
+		// Eight clients keep high-priority requests queued at all times.
+		for range 8 {
+			go func() {
+				for ctx.Err() == nil {
+					_, _ = l.Admit(ctx, admission(PriorityHigh))
+				}
+			}()
+		}
 		synctest.Wait()
 
-		done := make(chan error, 1)
-		go func() {
-			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
-			done <- admitErr
-		}()
+		start := time.Now()
+		for i := range 3 {
+			if _, err := l.Admit(context.Background(), admission(PriorityNormal)); err != nil {
+				t.Fatalf("Admit() normal #%d error = %v", i, err)
+			}
+			// One grant per second: each normal is at most three high
+			// grants plus its own pacing slot away.
+			if got, limit := time.Since(start), time.Duration(i+1)*5*time.Second; got > limit {
+				t.Fatalf("normal #%d granted after %v, want within %v", i, got, limit)
+			}
+		}
+		stop()
+	})
+}
 
-		synctest.Wait()
+func TestLimiterQueuePosition(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    3,
+			DefaultAppLimits: "1:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", Priority: PriorityHigh}
+		first, err := l.Admit(context.Background(), admission)
+		if err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+		if first.QueuePosition != 0 {
+			t.Fatalf("first QueuePosition = %d, want 0", first.QueuePosition)
+		}
+
+		// The window is spent, so these queue in arrival order.
+		positions := make([]int, 3)
+		var wg sync.WaitGroup
+		for i := range positions {
+			wg.Go(func() {
+				ticket, err := l.Admit(context.Background(), admission)
+				if err != nil {
+					t.Errorf("queued Admit() error = %v", err)
+					return
+				}
+				positions[i] = ticket.QueuePosition
+			})
+			synctest.Wait()
+		}
+
+		_, err = l.Admit(context.Background(), admission)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "queue_full" {
+			t.Fatalf("Admit() on a full queue error = %v, want queue_full RejectedError", err)
+		}
+		if rejected.QueueDepth != 3 {
+			t.Fatalf("QueueDepth = %d, want 3", rejected.QueueDepth)
+		}
+
+		wg.Wait()
+		if want := []int{0, 1, 2}; !slices.Equal(positions, want) {
+			t.Fatalf("QueuePosition = %v, want %v", positions, want)
+		}
+	})
+}
+
+func TestLimiterQueueFullBlock(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1:60",
+			QueueFullPolicy:  QueueFullBlock,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityNormal,
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+
+		queued := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			queued <- admitErr
+		}()
+		synctest.Wait()
+
+		noWait := admission
+		noWait.NoWait = true
+		_, err = l.Admit(context.Background(), noWait)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "queue_full" {
+			t.Fatalf("NoWait Admit() error = %v, want queue_full RejectedError instead of parking", err)
+		}
+
+		parked := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			parked <- admitErr
+		}()
+		synctest.Wait()
+
+		// One request already waits for room; the next one is rejected so
+		// parked requests stay bounded.
+		_, err = l.Admit(context.Background(), admission)
+		if !errors.As(err, &rejected) || rejected.Reason != "queue_full" {
+			t.Fatalf("overflow Admit() error = %v, want queue_full RejectedError", err)
+		}
+
+		time.Sleep(61 * time.Second)
+		synctest.Wait()
+		if err := <-queued; err != nil {
+			t.Fatalf("queued Admit() error = %v", err)
+		}
+		select {
+		case err := <-parked:
+			t.Fatalf("parked Admit() finished early with %v", err)
+		default:
+		}
+
+		time.Sleep(61 * time.Second)
+		synctest.Wait()
+		if err := <-parked; err != nil {
+			t.Fatalf("parked Admit() error = %v", err)
+		}
+	})
+}
+
+func TestLimiterQueueFullBlockHonorsContext(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1:60",
+			QueueFullPolicy:  QueueFullBlock,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityNormal,
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+		go func() { _, _ = l.Admit(context.Background(), admission) }()
+		synctest.Wait()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, admission); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("parked Admit() error = %v, want context.DeadlineExceeded", err)
+		}
+
+		// The expired request no longer holds a parking slot.
+		parked := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			parked <- admitErr
+		}()
+		synctest.Wait()
+		select {
+		case err := <-parked:
+			t.Fatalf("second parked Admit() finished early with %v", err)
+		default:
+		}
+	})
+}
+
+func TestLimiterHighPriorityBypassesQueuedNormal(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		if _, err := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal}); err != nil {
+			t.Fatalf("initial Admit() error = %v", err)
+		}
+
+		order := make(chan string, 2)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
+			if admitErr == nil {
+				order <- "normal"
+			}
+		}()
+		go func() {
+			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh})
+			if admitErr == nil {
+				order <- "high"
+			}
+		}()
+
+		synctest.Wait()
+
+		time.Sleep(time.Second)
+		synctest.Wait()
+
+		first := <-order
+		if first != "high" {
+			t.Fatalf("first granted priority = %q, want high", first)
+		}
+	})
+}
+
+func TestLimiterBudgetPacing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "10:10",
+			RateBudgets: map[string]BudgetConfig{
+				"worker": {Share: 0.8},
+			},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			BudgetID: "worker",
+			Priority: PriorityNormal,
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			done <- admitErr
+		}()
+
+		synctest.Wait()
+
+		time.Sleep(1249 * time.Millisecond)
+		synctest.Wait()
+		select {
+		case err := <-done:
+			t.Fatalf("second Admit() finished too early with %v", err)
+		default:
+		}
+
+		time.Sleep(time.Millisecond)
+		synctest.Wait()
+		if err := <-done; err != nil {
+			t.Fatalf("second Admit() error = %v", err)
+		}
+	})
+}
+
+func TestLimiterManualClockReleasesPacedRequest(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		start := time.Now()
+		clock := NewManualClock(time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC))
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "10:10",
+			Clock:            clock,
+			RateBudgets: map[string]BudgetConfig{
+				"worker": {Share: 0.8},
+			},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			BudgetID: "worker",
+			Priority: PriorityNormal,
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+
+		done := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			done <- admitErr
+		}()
+		synctest.Wait()
+
+		clock.Advance(1249 * time.Millisecond)
+		synctest.Wait()
+		select {
+		case err := <-done:
+			t.Fatalf("second Admit() finished too early with %v", err)
+		default:
+		}
+
+		clock.Advance(time.Millisecond)
+		synctest.Wait()
+		if err := <-done; err != nil {
+			t.Fatalf("second Admit() error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("elapsed = %v, want paced grant without waiting", elapsed)
+		}
+	})
+}
+
+func TestLimiterDisablePacing(t *testing.T) {
+	tests := []struct {
+		name          string
+		disablePacing bool
+		wantImmediate bool
+	}{
+		{name: "pacing enabled spaces requests", disablePacing: false, wantImmediate: false},
+		{name: "pacing disabled grants spare budget immediately", disablePacing: true, wantImmediate: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := New(Config{
+					KeyCount:         1,
+					QueueCapacity:    4,
+					DefaultAppLimits: "10:10",
+					DisablePacing:    tt.disablePacing,
+				})
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				admission := Admission{
+					Region:   "europe",
+					Bucket:   "europe:riot/account/v1/accounts/me",
+					Priority: PriorityNormal,
+				}
+				if _, err := l.Admit(context.Background(), admission); err != nil {
+					t.Fatalf("first Admit() error = %v", err)
+				}
+
+				start := time.Now()
+				if _, err := l.Admit(context.Background(), admission); err != nil {
+					t.Fatalf("second Admit() error = %v", err)
+				}
+				waited := time.Since(start)
+
+				if tt.wantImmediate && waited != 0 {
+					t.Fatalf("second Admit() waited %v, want immediate", waited)
+				}
+				if !tt.wantImmediate && waited < time.Second {
+					t.Fatalf("second Admit() waited %v, want paced >= 1s", waited)
+				}
+			})
+		})
+	}
+}
+
+func TestLimiterDefaultMethodLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		bucket     string
+		wantSecond time.Duration
+	}{
+		{name: "pattern override", bucket: "europe:lol/match/v5/matches/{matchId}", wantSecond: 5 * time.Second},
+		{name: "catch-all", bucket: "europe:riot/account/v1/accounts/me", wantSecond: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := New(Config{
+					KeyCount:         1,
+					QueueCapacity:    2,
+					DefaultAppLimits: "100:1",
+					DefaultMethodLimits: map[string]string{
+						"lol/match/v5/matches/{matchId}": "2:10",
+						"*":                              "1:10",
+					},
+				})
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				admission := Admission{Region: "europe", Bucket: tt.bucket, Priority: PriorityNormal}
+				start := time.Now()
+				for i := range 2 {
+					if _, err := l.Admit(context.Background(), admission); err != nil {
+						t.Fatalf("Admit() #%d error = %v", i+1, err)
+					}
+				}
+				if got, want := time.Since(start), tt.wantSecond; got != want {
+					t.Fatalf("second admission after %v, want %v", got, want)
+				}
+			})
+		})
+	}
+}
+
+func TestLimiterHeadroomStopsAtReducedLimit(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:              1,
+			QueueCapacity:         4,
+			DefaultAppLimits:      "10:60",
+			LimitHeadroomFraction: 0.2,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityHigh,
+		}
+		for i := range 8 {
+			if _, err := l.Admit(context.Background(), admission); err != nil {
+				t.Fatalf("Admit() #%d error = %v", i+1, err)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, admission); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("ninth Admit() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestLimiterBudgetFIFOInterleave(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC)
+	clock := &mutableClock{now: now}
+	l := &Limiter{
+		cfg: Config{
+			AdditionalWindow: 0,
+			Clock:            clock,
+			RateBudgets: map[string]BudgetConfig{
+				"worker": {Share: 0.8},
+			},
+		},
+	}
+
+	region := "europe"
+	bucketName := "europe:riot/account/v1/accounts/me"
+	keys := []keyState{newKeyState(parseRateHeader("10:10", ""), nil)}
+	if !keys[0].app(region, now, 0).consume(now, defaultBudgetID) {
+		t.Fatal("initial consume() = false, want true")
+	}
+
+	defaultReq := &admitRequest{
+		ctx:         context.Background(),
+		admission:   Admission{Region: region, Bucket: bucketName, BudgetID: defaultBudgetID, Priority: PriorityNormal},
+		budgetShare: 1,
+		resp:        make(chan admitResponse, 1),
+	}
+	workerReq := &admitRequest{
+		ctx:         context.Background(),
+		admission:   Admission{Region: region, Bucket: bucketName, BudgetID: "worker", Priority: PriorityNormal},
+		budgetShare: 0.8,
+		resp:        make(chan admitResponse, 1),
+	}
+	bucket := &bucketQueue{
+		region:    region,
+		bucket:    bucketName,
+		heapIndex: -1,
+	}
+	bucket.enqueue(defaultReq)
+	bucket.enqueue(workerReq)
+
+	wakeups := make(wakeHeap, 0)
+	l.dispatch(bucket, keys, &wakeups, 0)
+
+	select {
+	case out := <-workerReq.resp:
+		t.Fatalf("worker admitted before earlier default request: %#v", out)
+	default:
+	}
+	select {
+	case out := <-defaultReq.resp:
+		t.Fatalf("default admitted too early: %#v", out)
+	default:
+	}
+
+	clock.now = now.Add(time.Second)
+	l.dispatch(bucket, keys, &wakeups, 0)
+
+	if out := <-defaultReq.resp; out.err != nil {
+		t.Fatalf("default response error = %v", out.err)
+	}
+	if out := <-workerReq.resp; out.err != nil {
+		t.Fatalf("worker response error = %v", out.err)
+	}
+}
+
+func TestLimiterSharesAppLimitAcrossBuckets(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    8,
+			DefaultAppLimits: "1:1",
+			DisablePacing:    true,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var mu sync.Mutex
+		var order []string
+		admit := func(name string) {
+			_, err := l.Admit(context.Background(), Admission{
+				Region:   "europe",
+				Bucket:   "europe:" + name,
+				Priority: PriorityNormal,
+			})
+			if err != nil {
+				t.Errorf("Admit(%s) error = %v", name, err)
+				return
+			}
+			mu.Lock()
+			order = append(order, name)
+			mu.Unlock()
+		}
+
+		// The hot bucket queues first; the second bucket arrives behind it.
+		var wg sync.WaitGroup
+		for _, name := range []string{"hot", "hot", "hot", "hot", "cold", "cold"} {
+			wg.Go(func() { admit(name) })
+			synctest.Wait()
+		}
+		wg.Wait()
+
+		want := []string{"hot", "cold", "hot", "cold", "hot", "hot"}
+		if !slices.Equal(order, want) {
+			t.Fatalf("grant order = %v, want %v", order, want)
+		}
+	})
+}
+
+func TestLimiterRejectsUnknownBudget(t *testing.T) {
+	t.Parallel()
+
+	l, err := New(Config{
+		KeyCount:         1,
+		QueueCapacity:    1,
+		DefaultAppLimits: "20:1",
+	})
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	_, err = l.Admit(context.Background(), Admission{
+		Region:   "europe",
+		Bucket:   "europe:riot/account/v1/accounts/me",
+		BudgetID: "worker",
+		Priority: PriorityNormal,
+	})
+	var rejected *RejectedError
+	if !errors.As(err, &rejected) {
+		t.Fatalf("Admit() error = %v, want RejectedError", err)
+	}
+	if got, want := rejected.Reason, "invalid_budget"; got != want {
+		t.Fatalf("RejectedError.Reason = %q, want %q", got, want)
+	}
+}
+
+func TestLimiterObserveRetryAfterBlocksUntilWindow(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		start := time.Now()
+		clock := NewManualClock(time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC))
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "20:1",
+			Clock:            clock,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		l.Observe(Observation{
+			Region:     "europe",
+			Bucket:     bucket,
+			KeyIndex:   0,
+			StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{
+				"Retry-After":       []string{"2"},
+				"X-Rate-Limit-Type": []string{"application"},
+			},
+		})
+
+		synctest.Wait()
+
+		done := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
+			done <- admitErr
+		}()
+
+		synctest.Wait()
+
+		select {
+		case err := <-done:
+			t.Fatalf("Admit() finished too early with %v", err)
+		default:
+		}
+
+		clock.Advance(2 * time.Second)
+		synctest.Wait()
+
+		if err := <-done; err != nil {
+			t.Fatalf("Admit() after Retry-After error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("elapsed = %v, want the Retry-After block to lift without waiting", elapsed)
+		}
+	})
+}
+
+func TestLimiterKeyWeights(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1000:1",
+			KeyWeights:       []int{1, 10},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityHigh,
+		}
+		var counts [2]int
+		for range 110 {
+			ticket, err := l.Admit(context.Background(), admission)
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			counts[ticket.KeyIndex]++
+		}
+
+		if got, want := counts, [2]int{10, 100}; got != want {
+			t.Fatalf("admissions per key = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestLimiterKeyWeightsForgetOldGrants(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1000:1",
+			KeyWeights:       []int{1, 1},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: PriorityHigh,
+		}
+		first := 0
+		pinned := admission
+		pinned.TokenIndex = &first
+		for range 20 {
+			if _, err := l.Admit(context.Background(), pinned); err != nil {
+				t.Fatalf("pinned Admit() error = %v", err)
+			}
+		}
+
+		// Key 0's burst is in the past, so it must not keep key 1 busy.
+		time.Sleep(keyWeightWindow)
+		var counts [2]int
+		for range 10 {
+			ticket, err := l.Admit(context.Background(), admission)
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			counts[ticket.KeyIndex]++
+		}
+		if got, want := counts, [2]int{5, 5}; got != want {
+			t.Fatalf("admissions per key = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestLimiterAppLimitsPerRoutingValue(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		platform := Admission{Region: "na1", Bucket: "na1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}", Priority: PriorityNormal}
+		regional := Admission{Region: "americas", Bucket: "americas:riot/account/v1/accounts/by-puuid/{puuid}", Priority: PriorityNormal}
+
+		if _, err := l.Admit(context.Background(), platform); err != nil {
+			t.Fatalf("platform Admit() error = %v", err)
+		}
+		// na1 used its whole app limit; americas still has its own.
+		if _, err := l.Admit(context.Background(), regional); err != nil {
+			t.Fatalf("regional Admit() error = %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, platform); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("second platform Admit() error = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		// A 429 against americas leaves na1 alone once its window resets.
+		l.Observe(Observation{
+			Region:     "americas",
+			Bucket:     regional.Bucket,
+			StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{
+				"Retry-After":       []string{"120"},
+				"X-Rate-Limit-Type": []string{"application"},
+			},
+		})
+		synctest.Wait()
+		time.Sleep(time.Minute)
+
+		if _, err := l.Admit(context.Background(), platform); err != nil {
+			t.Fatalf("platform Admit() after window error = %v", err)
+		}
+		ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, regional); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("regional Admit() during Retry-After error = %v, want %v", err, context.DeadlineExceeded)
+		}
+	})
+}
+
+func TestLimiterLoLAndTFTShareAppLimitOnly(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		const (
+			lol = "na1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"
+			tft = "na1:tft/summoner/v1/summoners/by-puuid/{encryptedPUUID}"
+		)
+		observe := func(bucket string, status int, header http.Header) {
+			l.Observe(Observation{Region: "na1", Bucket: bucket, StatusCode: status, Header: header})
+		}
+		counts := func(app, method, methodCount string) http.Header {
+			return http.Header{
+				"X-App-Rate-Limit":          []string{"100:120"},
+				"X-App-Rate-Limit-Count":    []string{app},
+				"X-Method-Rate-Limit":       []string{method},
+				"X-Method-Rate-Limit-Count": []string{methodCount},
+			}
+		}
+
+		observe(lol, http.StatusOK, counts("10:120", "2000:10", "1:10"))
+		observe(tft, http.StatusOK, counts("12:120", "200:10", "3:10"))
+		// A LoL response that left Riot before the TFT one must not lower the
+		// shared app count.
+		observe(lol, http.StatusOK, counts("11:120", "2000:10", "2:10"))
+		observe(tft, http.StatusTooManyRequests, http.Header{
+			"Retry-After":       []string{"5"},
+			"X-Rate-Limit-Type": []string{"method"},
+		})
+		synctest.Wait()
+
+		plan := func(bucket string) KeyPlan {
+			p, err := l.Plan(context.Background(), "na1", bucket)
+			if err != nil {
+				t.Fatalf("Plan(%q) error = %v", bucket, err)
+			}
+			return p.Keys[0]
+		}
+		lolPlan, tftPlan := plan(lol), plan(tft)
+
+		for name, app := range map[string]StatePlan{"lol": lolPlan.App, "tft": tftPlan.App} {
+			if len(app.Windows) != 1 || app.Windows[0].Limit != 100 || app.Windows[0].Used != 12 {
+				t.Fatalf("%s app windows = %+v, want shared 12/100", name, app.Windows)
+			}
+			if !app.BlockedUntil.IsZero() {
+				t.Fatalf("%s app BlockedUntil = %v, want zero after a method 429", name, app.BlockedUntil)
+			}
+		}
+		if w := lolPlan.Method.Windows; len(w) != 1 || w[0].Limit != 2000 || w[0].Used != 2 {
+			t.Fatalf("lol method windows = %+v, want 2/2000", w)
+		}
+		if !lolPlan.Method.BlockedUntil.IsZero() {
+			t.Fatalf("lol method BlockedUntil = %v, want zero", lolPlan.Method.BlockedUntil)
+		}
+		if w := tftPlan.Method.Windows; len(w) != 1 || w[0].Limit != 200 || w[0].Used != 3 {
+			t.Fatalf("tft method windows = %+v, want 3/200", w)
+		}
+		if got, want := tftPlan.Method.BlockedUntil, time.Now().Add(5*time.Second); !got.Equal(want) {
+			t.Fatalf("tft method BlockedUntil = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestLimiterResetForgetsLearnedLimits(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityNormal}
+		l.Observe(Observation{
+			Region:     admission.Region,
+			Bucket:     admission.Bucket,
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Method-Rate-Limit":       []string{"1:60"},
+				"X-Method-Rate-Limit-Count": []string{"1:60"},
+			},
+		})
+		synctest.Wait()
+		if l.ColdStart(admission.Bucket) {
+			t.Fatal("ColdStart() = true after observation, want false")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, admission); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Admit() with exhausted method limit error = %v, want %v", err, context.DeadlineExceeded)
+		}
+
+		cleared, err := l.Reset(context.Background(), "", admission.Bucket)
+		if err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		if cleared != 1 {
+			t.Fatalf("Reset() cleared = %d, want 1", cleared)
+		}
+		if !l.ColdStart(admission.Bucket) {
+			t.Fatal("ColdStart() = false after Reset(), want true")
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() after Reset() error = %v", err)
+		}
+
+		cleared, err = l.Reset(context.Background(), "", "")
+		if err != nil {
+			t.Fatalf("Reset() all error = %v", err)
+		}
+		if cleared != 2 {
+			t.Fatalf("Reset() all cleared = %d, want app and method state", cleared)
+		}
+
+		_ = l.Close()
+		_, err = l.Reset(context.Background(), "", "")
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "shutting_down" {
+			t.Fatalf("Reset() after Close error = %v, want shutting_down", err)
+		}
+	})
+}
+
+func TestLimiterRejectWhenAllBlocked(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:             1,
+			QueueCapacity:        2,
+			DefaultAppLimits:     "20:1",
+			RejectWhenAllBlocked: true,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		l.Observe(Observation{
+			Region:     "europe",
+			Bucket:     bucket,
+			StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{
+				"Retry-After":       []string{"10"},
+				"X-Rate-Limit-Type": []string{"application"},
+			},
+		})
+		synctest.Wait()
+
+		start := time.Now()
+		_, err = l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "all_keys_blocked" {
+			t.Fatalf("Admit() error = %v, want all_keys_blocked rejection", err)
+		}
+		if got, want := rejected.RetryAfter, 10*time.Second; got != want {
+			t.Fatalf("RetryAfter = %v, want %v", got, want)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("rejection took %v, want immediate", elapsed)
+		}
+	})
+}
+
+func TestLimiterObserveSyncAppliesBeforeReturning(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{KeyCount: 2, QueueCapacity: 2, DefaultAppLimits: "20:1"})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		for range 20 {
+			l.ObserveSync(context.Background(), Observation{
+				Region:     "europe",
+				Bucket:     bucket,
+				KeyIndex:   0,
+				StatusCode: http.StatusTooManyRequests,
+				Header: http.Header{
+					"Retry-After":       []string{"10"},
+					"X-Rate-Limit-Type": []string{"application"},
+				},
+			})
+			// No synctest.Wait: the admission must already see the block.
+			ticket, err := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			if ticket.KeyIndex != 1 {
+				t.Fatalf("Admit() key = %d, want 1 while key 0 is blocked", ticket.KeyIndex)
+			}
+		}
+	})
+}
+
+func TestLimiterObserveServiceRetryAfterBlocksOnlyBucket(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		blocked := "euw1:lol/spectator/v5/active-games/by-summoner/{encryptedPUUID}"
+		other := "euw1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"
+		l.Observe(Observation{
+			Region:     "euw1",
+			Bucket:     blocked,
+			KeyIndex:   0,
+			StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{
+				"Retry-After":       []string{"10"},
+				"X-Rate-Limit-Type": []string{"service"},
+			},
+		})
+		synctest.Wait()
+
+		start := time.Now()
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: other, Priority: PriorityNormal}); err != nil {
+			t.Fatalf("Admit() other bucket error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("other bucket waited %v, want 0", elapsed)
+		}
+
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: blocked, Priority: PriorityNormal}); err != nil {
+			t.Fatalf("Admit() blocked bucket error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < 10*time.Second {
+			t.Fatalf("blocked bucket admitted after %v, want >= 10s", elapsed)
+		}
+	})
+}
+
+func TestLimiterDefaultRetryAfterBlocksBare429(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:          1,
+			QueueCapacity:     2,
+			DefaultAppLimits:  "20:1",
+			DefaultRetryAfter: 3 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "euw1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"
+		l.Observe(Observation{
+			Region:     "euw1",
+			Bucket:     bucket,
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{},
+		})
+		synctest.Wait()
+
+		_, err = l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, NoWait: true})
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "would_wait" {
+			t.Fatalf("Admit() after bare 429 error = %v, want would_wait RejectedError", err)
+		}
+		if rejected.RetryAfter != 3*time.Second {
+			t.Fatalf("RetryAfter = %v, want 3s", rejected.RetryAfter)
+		}
+
+		start := time.Now()
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket}); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed != 3*time.Second {
+			t.Fatalf("Admit() waited %v, want 3s", elapsed)
+		}
+	})
+}
+
+func TestLimiterRetryScopeByLimitType(t *testing.T) {
+	tests := []struct {
+		limitType   string
+		blocksOther bool
+	}{
+		{limitType: "application", blocksOther: true},
+		{limitType: "Application", blocksOther: true},
+		{limitType: "app", blocksOther: true},
+		{limitType: "", blocksOther: true},
+		{limitType: "method", blocksOther: false},
+		{limitType: " METHOD ", blocksOther: false},
+		{limitType: "service", blocksOther: false},
+		{limitType: "galaxy", blocksOther: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.limitType), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := New(Config{
+					KeyCount:         1,
+					QueueCapacity:    2,
+					DefaultAppLimits: "20:1",
+				})
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				blocked := "euw1:lol/spectator/v5/active-games/by-summoner/{encryptedPUUID}"
+				other := "euw1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"
+				header := http.Header{"Retry-After": []string{"10"}}
+				if tt.limitType != "" {
+					header.Set("X-Rate-Limit-Type", tt.limitType)
+				}
+				l.Observe(Observation{
+					Region:     "euw1",
+					Bucket:     blocked,
+					StatusCode: http.StatusTooManyRequests,
+					Header:     header,
+				})
+				synctest.Wait()
+
+				_, err = l.Admit(context.Background(), Admission{Region: "euw1", Bucket: blocked, NoWait: true})
+				var rejected *RejectedError
+				if !errors.As(err, &rejected) || rejected.Reason != "would_wait" {
+					t.Fatalf("Admit() blocked bucket error = %v, want would_wait RejectedError", err)
+				}
+
+				_, err = l.Admit(context.Background(), Admission{Region: "euw1", Bucket: other, NoWait: true})
+				if gotBlocked := err != nil; gotBlocked != tt.blocksOther {
+					t.Fatalf("Admit() other bucket error = %v, want blocked %t", err, tt.blocksOther)
+				}
+			})
+		})
+	}
+}
+
+func TestLimiterPlanReflectsObservation(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "euw1:lol/match/v5/matches/{matchId}"
+		l.Observe(Observation{
+			Region:     "euw1",
+			Bucket:     bucket,
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Method-Rate-Limit":       []string{"10:10"},
+				"X-Method-Rate-Limit-Count": []string{"2:10"},
+			},
+		})
+		synctest.Wait()
+
+		plan, err := l.Plan(context.Background(), "euw1", bucket)
+		if err != nil {
+			t.Fatalf("Plan() error = %v", err)
+		}
+		if got, want := len(plan.Keys), 1; got != want {
+			t.Fatalf("len(Keys) = %d, want %d", got, want)
+		}
+		method := plan.Keys[0].Method
+		if got, want := len(method.Windows), 1; got != want {
+			t.Fatalf("len(Method.Windows) = %d, want %d", got, want)
+		}
+		window := method.Windows[0]
+		if window.Limit != 10 || window.Used != 2 || window.Window != 10*time.Second {
+			t.Fatalf("Method.Windows[0] = %+v, want limit 10 used 2 window 10s", window)
+		}
+		// 8 requests left over 10s are spaced 10s/9 apart.
+		if got, want := method.PacingInterval, 10*time.Second/9; got != want {
+			t.Fatalf("Method.PacingInterval = %v, want %v", got, want)
+		}
+		if got, want := method.NextAllowed, time.Now().Add(10*time.Second/9); !got.Equal(want) {
+			t.Fatalf("Method.NextAllowed = %v, want %v", got, want)
+		}
+		if got, want := len(plan.Keys[0].App.Windows), 1; got != want {
+			t.Fatalf("len(App.Windows) = %d, want %d", got, want)
+		}
+
+		unseen, err := l.Plan(context.Background(), "kr", "kr:lol/status/v4/platform-data")
+		if err != nil {
+			t.Fatalf("Plan(unseen) error = %v", err)
+		}
+		if got, want := len(unseen.Keys[0].App.Windows), 1; got != want {
+			t.Fatalf("unseen len(App.Windows) = %d, want %d defaults", got, want)
+		}
+		if cleared, err := l.Reset(context.Background(), "kr", ""); err != nil || cleared != 0 {
+			t.Fatalf("Reset(kr) = (%d, %v), want nothing created by Plan", cleared, err)
+		}
+
+		_ = l.Close()
+		_, err = l.Plan(context.Background(), "euw1", bucket)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "shutting_down" {
+			t.Fatalf("Plan() after Close error = %v, want shutting_down", err)
+		}
+	})
+}
+
+func TestLimiterObservationBatchStillDispatchesLimitChange(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:60",
+			DisablePacing:    true,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		queued := make(chan error, 1)
+		go func() {
+			_, admitErr := l.Admit(context.Background(), admission)
+			queued <- admitErr
+		}()
+		synctest.Wait()
+
+		// Repeating the current limits changes nothing for the queue.
+		for range 100 {
+			l.Observe(Observation{
+				Region:     admission.Region,
+				Bucket:     admission.Bucket,
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"X-App-Rate-Limit":       []string{"1:60"},
+					"X-App-Rate-Limit-Count": []string{"1:60"},
+				},
+			})
+		}
+		synctest.Wait()
+		select {
+		case err := <-queued:
+			t.Fatalf("queued Admit() returned %v before the limit changed", err)
+		default:
+		}
+
+		l.Observe(Observation{
+			Region:     admission.Region,
+			Bucket:     admission.Bucket,
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-App-Rate-Limit":       []string{"10:60"},
+				"X-App-Rate-Limit-Count": []string{"1:60"},
+			},
+		})
+		synctest.Wait()
+		select {
+		case err := <-queued:
+			if err != nil {
+				t.Fatalf("queued Admit() error = %v", err)
+			}
+		default:
+			t.Fatal("queued Admit() still waiting after the app limit was raised")
+		}
+	})
+}
+
+// BenchmarkLimiterObserveFlood measures observation throughput while many
+// buckets of the same region are queued behind an exhausted app limit.
+func BenchmarkLimiterObserveFlood(b *testing.B) {
+	l, err := New(Config{
+		KeyCount:         1,
+		QueueCapacity:    1,
+		DefaultAppLimits: "1:3600",
+	})
+	if err != nil {
+		b.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := l.Admit(ctx, Admission{Region: "euw1", Bucket: "euw1:warmup"}); err != nil {
+		b.Fatalf("Admit() error = %v", err)
+	}
+	for i := range 200 {
+		go func() { _, _ = l.Admit(ctx, Admission{Region: "euw1", Bucket: fmt.Sprintf("euw1:bucket-%d", i)}) }()
+	}
+
+	obs := Observation{
+		Region:     "euw1",
+		Bucket:     "euw1:bucket-0",
+		StatusCode: http.StatusOK,
+		Header: http.Header{
+			"X-App-Rate-Limit":       []string{"1:3600"},
+			"X-App-Rate-Limit-Count": []string{"1:3600"},
+		},
+	}
+	for b.Loop() {
+		l.Observe(obs)
+	}
+}
+
+// BenchmarkLimiterAdmitNoLimits measures admissions to one bucket with room,
+// which the bucket's fast lane grants without a round trip to the loop.
+func BenchmarkLimiterAdmitNoLimits(b *testing.B) {
+	l, err := New(Config{
+		KeyCount:      1,
+		QueueCapacity: 1024,
+	})
+	if err != nil {
+		b.Fatalf("New() error = %v", err)
+	}
+	defer func() { _ = l.Close() }()
+
+	ctx := context.Background()
+	admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"}
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := l.Admit(ctx, admission); err != nil {
+				b.Errorf("Admit() error = %v", err)
+				return
+			}
+		}
+	})
+}
+
+func TestLimiterQueuesReportsWaitingAdmissions(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    8,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		start := time.Now()
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		enqueue := func(priority Priority) {
+			a := admission
+			a.Priority = priority
+			go func() { _, _ = l.Admit(ctx, a) }()
+			synctest.Wait()
+		}
+		enqueue(PriorityNormal)
+		time.Sleep(time.Second)
+		enqueue(PriorityHigh)
+		enqueue(PriorityNormal)
+
+		queues, err := l.Queues(context.Background())
+		if err != nil {
+			t.Fatalf("Queues() error = %v", err)
+		}
+		if got, want := len(queues), 1; got != want {
+			t.Fatalf("len(Queues()) = %d, want %d", got, want)
+		}
+		queue := queues[0]
+		if queue.Bucket != admission.Bucket || queue.High != 1 || queue.Normal != 2 || queue.Parked != 0 {
+			t.Fatalf("Queues()[0] = %+v, want 1 high and 2 normal for %s", queue, admission.Bucket)
+		}
+		if !queue.OldestEnqueuedAt.Equal(start) {
+			t.Fatalf("OldestEnqueuedAt = %v, want %v", queue.OldestEnqueuedAt, start)
+		}
+		if want := start.Add(60 * time.Second); queue.WakeAt.Before(want) {
+			t.Fatalf("WakeAt = %v, want at or after window reset %v", queue.WakeAt, want)
+		}
+
+		cancel()
+		if queues, err = l.Queues(context.Background()); err != nil || len(queues) != 0 {
+			t.Fatalf("Queues() after cancel = %+v, %v, want none", queues, err)
+		}
+
+		_ = l.Close()
+		_, err = l.Queues(context.Background())
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "shutting_down" {
+			t.Fatalf("Queues() after Close error = %v, want shutting_down", err)
+		}
+	})
+}
+
+func TestLimiterReportsPacingInterval(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "5:1",
+			Metrics:          sink,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "euw1:lol/status/v4/platform-data"
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh}); err != nil {
+			t.Fatalf("high Admit() error = %v", err)
+		}
+		if _, ok := sink.pacingInterval(bucket); ok {
+			t.Fatal("pacing interval reported for an unpaced grant")
+		}
+
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket}); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		// The paced grant waits 1s/5; the 3 requests left in the remaining
+		// 800ms are then spaced 800ms/4 apart.
+		interval, ok := sink.pacingInterval(bucket)
+		if !ok {
+			t.Fatal("no pacing interval reported")
+		}
+		if want := 200 * time.Millisecond; interval != want {
+			t.Fatalf("pacing interval = %v, want %v", interval, want)
+		}
+	})
+}
+
+func TestLimiterColdStartSerialize(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    16,
+			DefaultAppLimits: "100:1",
+			ColdStartPolicy:  ColdStartSerialize,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		var admitted atomic.Int32
+		for range 10 {
+			go func() {
+				// High priority bypasses pacing, so only serialization holds
+				// these back.
+				if _, err := l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh}); err == nil {
+					admitted.Add(1)
+				}
+			}()
+		}
+		synctest.Wait()
+		if got := admitted.Load(); got != 1 {
+			t.Fatalf("cold admissions before any observation = %d, want 1", got)
+		}
+
+		// A response without method limits frees the slot but the bucket
+		// stays cold.
+		l.Observe(Observation{Region: "europe", Bucket: bucket, StatusCode: http.StatusBadGateway, Header: http.Header{}})
+		synctest.Wait()
+		if got := admitted.Load(); got != 2 {
+			t.Fatalf("cold admissions after one observation = %d, want 2", got)
+		}
+
+		l.Observe(Observation{
+			Region:     "europe",
+			Bucket:     bucket,
+			StatusCode: http.StatusOK,
+			Header: http.Header{
+				"X-Method-Rate-Limit":       []string{"100:10"},
+				"X-Method-Rate-Limit-Count": []string{"2:10"},
+			},
+		})
+		synctest.Wait()
+		if got := admitted.Load(); got != 10 {
+			t.Fatalf("admissions after limits were learned = %d, want 10", got)
+		}
+	})
+}
+
+func TestLimiterColdStartSerializeUnusedGrant(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    16,
+			DefaultAppLimits: "100:1",
+			ColdStartPolicy:  ColdStartSerialize,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityHigh}
+		ticket, err := l.Admit(context.Background(), admission)
+		if err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+		next := make(chan Ticket, 1)
+		go func() {
+			ticket, _ := l.Admit(context.Background(), admission)
+			next <- ticket
+		}()
+		synctest.Wait()
+
+		// The first grant never reached upstream, so no observation will
+		// come to let the next one through.
+		l.Release(ticket, admission.Region, admission.Bucket)
+		synctest.Wait()
+		var second Ticket
+		select {
+		case second = <-next:
+		default:
+			t.Fatal("Admit() still waiting after the cold grant was released")
+		}
+		l.Release(second, admission.Region, admission.Bucket)
+
+		// A grant sent after Admit gave up waiting is undone by the loop.
+		abandoned := &admitRequest{
+			ctx:         context.Background(),
+			admission:   admission,
+			budgetShare: 1,
+			received:    time.Now(),
+			resp:        make(chan admitResponse, 1),
+		}
+		abandoned.admission.BudgetID = normalizeBudgetID("")
+		abandoned.abandoned.Store(true)
+		l.admitCh <- abandoned
+		synctest.Wait()
+		if out := <-abandoned.resp; out.err != nil {
+			t.Fatalf("abandoned admission error = %v, want a grant", out.err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if _, err := l.Admit(ctx, admission); err != nil {
+			t.Fatalf("Admit() after an abandoned cold grant error = %v", err)
+		}
+	})
+}
+
+func TestLimiterFastLaneCountsAgainstLimits(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    8,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		admission := Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh}
+		perKey := make([]int, 2)
+		for i := range 40 {
+			ticket, err := l.Admit(context.Background(), admission)
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			perKey[ticket.KeyIndex]++
+			if _, ok := l.lanes.Load(bucket); i == 0 && !ok {
+				t.Fatal("no fast lane under the default app limit")
+			}
+		}
+		if !slices.Equal(perKey, []int{20, 20}) {
+			t.Fatalf("grants per key = %v, want both keys filled", perKey)
+		}
+
+		// Both app windows are spent, fast grants included.
+		start := time.Now()
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() after limits error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < time.Second {
+			t.Fatalf("Admit() with spent windows returned after %v, want the window reset", elapsed)
+		}
+	})
+}
+
+func TestLimiterFastLaneClosesOnRetryAfter(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:      2,
+			QueueCapacity: 8,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		admission := Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		if _, ok := l.lanes.Load(bucket); !ok {
+			t.Fatal("no fast lane without limits")
+		}
+
+		l.ObserveSync(context.Background(), Observation{
+			Region:     "europe",
+			Bucket:     bucket,
+			KeyIndex:   0,
+			StatusCode: http.StatusTooManyRequests,
+			Header: http.Header{
+				"Retry-After":       []string{"10"},
+				"X-Rate-Limit-Type": []string{"application"},
+			},
+		})
+		for range 10 {
+			ticket, err := l.Admit(context.Background(), admission)
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			if ticket.KeyIndex != 1 {
+				t.Fatalf("Admit() key = %d, want 1 while key 0 is blocked", ticket.KeyIndex)
+			}
+		}
+	})
+}
+
+func TestLimiterFastLanePacesNormalPriority(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    8,
+			DefaultAppLimits: "9:10",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityNormal}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+		last := time.Now()
+		for range 5 {
+			if _, err := l.Admit(context.Background(), admission); err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			// 8 requests left over 10s are spaced at least 10s/9 apart.
+			if gap := time.Since(last); gap < 10*time.Second/9 {
+				t.Fatalf("paced grants %v apart, want at least %v", gap, 10*time.Second/9)
+			}
+			last = time.Now()
+		}
+	})
+}
+
+func TestLimiterReleaseFreesSlot(t *testing.T) {
+	for _, policy := range []ColdStartPolicy{ColdStartBurst, ColdStartSerialize} {
+		t.Run(string(policy), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := New(Config{
+					KeyCount:         1,
+					QueueCapacity:    2,
+					DefaultAppLimits: "1:10",
+					ColdStartPolicy:  policy,
+				})
+				if err != nil {
+					t.Fatalf("New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", Priority: PriorityHigh, NoWait: true}
+				admitNow := func() (Ticket, bool) {
+					t.Helper()
+					ticket, err := l.Admit(context.Background(), admission)
+					var rejected *RejectedError
+					if err != nil && (!errors.As(err, &rejected) || rejected.Reason != "would_wait") {
+						t.Fatalf("Admit() error = %v, want nil or would_wait", err)
+					}
+					return ticket, err == nil
+				}
+
+				ticket, ok := admitNow()
+				if !ok {
+					t.Fatal("first Admit() was not granted")
+				}
+				if _, ok := admitNow(); ok {
+					t.Fatal("second Admit() granted with the window spent")
+				}
+
+				// Under serialize the release must also let the next cold grant go.
+				l.Release(ticket, admission.Region, admission.Bucket)
+				synctest.Wait()
+				reused, ok := admitNow()
+				if !ok {
+					t.Fatal("Admit() after Release() was not granted")
+				}
+
+				// A second release of the same ticket must not free another slot.
+				l.Release(ticket, admission.Region, admission.Bucket)
+				l.Release(Ticket{}, admission.Region, admission.Bucket)
+				synctest.Wait()
+				if _, ok := admitNow(); ok {
+					t.Fatal("Admit() granted after releasing a ticket twice")
+				}
+
+				l.Release(reused, admission.Region, admission.Bucket)
+				synctest.Wait()
+				if _, ok := admitNow(); !ok {
+					t.Fatal("Admit() after releasing the reused ticket was not granted")
+				}
+			})
+		})
+	}
+}
+
+func TestLimiterReleaseForgetsKeyWeightGrant(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    2,
+			DefaultAppLimits: "100:1",
+			KeyWeights:       []int{1, 1},
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", Priority: PriorityHigh}
+		ticket, err := l.Admit(context.Background(), admission)
+		if err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		l.Release(ticket, admission.Region, admission.Bucket)
+		synctest.Wait()
+
+		// The released grant no longer counts, so the weights tie again.
+		again, err := l.Admit(context.Background(), admission)
+		if err != nil {
+			t.Fatalf("Admit() after Release() error = %v", err)
+		}
+		if again.KeyIndex != ticket.KeyIndex {
+			t.Fatalf("Admit() after Release() key = %d, want %d", again.KeyIndex, ticket.KeyIndex)
+		}
+	})
+}
+
+func TestLimiterTuneQueueCapacity(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:10",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		capacity := 1
+		settings, err := l.Tune(context.Background(), Tuning{QueueCapacity: &capacity})
+		if err != nil {
+			t.Fatalf("Tune() error = %v", err)
+		}
+		if settings.QueueCapacity != 1 {
+			t.Fatalf("QueueCapacity = %d, want 1", settings.QueueCapacity)
+		}
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityHigh}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+		go func() { _, _ = l.Admit(context.Background(), admission) }()
+		synctest.Wait()
+
+		_, err = l.Admit(context.Background(), admission)
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "queue_full" {
+			t.Fatalf("over-capacity Admit() error = %v, want queue_full", err)
+		}
+
+		negative := -time.Second
+		if _, err := l.Tune(context.Background(), Tuning{MinSpacing: &negative}); err == nil {
+			t.Fatal("Tune() with negative MinSpacing error = nil, want error")
+		}
+	})
+}
 
-		select {
-		case err := <-done:
-			t.Fatalf("Admit() finished too early with %v", err)
-		default:
+func TestLimiterTuneMinSpacingExistingBucket(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1000000:600",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityNormal}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+
+		spacing := 100 * time.Millisecond
+		if _, err := l.Tune(context.Background(), Tuning{MinSpacing: &spacing}); err != nil {
+			t.Fatalf("Tune() error = %v", err)
+		}
+		start := time.Now()
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("second Admit() error = %v", err)
+		}
+		if elapsed := time.Since(start); elapsed < spacing {
+			t.Fatalf("second grant after %v, want at least the tuned %v", elapsed, spacing)
+		}
+
+		_ = l.Close()
+		_, err = l.Tune(context.Background(), Tuning{})
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "shutting_down" {
+			t.Fatalf("Tune() after Close error = %v, want shutting_down", err)
+		}
+	})
+}
+
+func TestLimiterQueueOrderDeadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    8,
+			DefaultAppLimits: "1:10",
+			QueueOrder:       QueueOrderDeadline,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "europe", Bucket: "europe:riot/account/v1/accounts/me", Priority: PriorityHigh}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("first Admit() error = %v", err)
+		}
+
+		order := make(chan string, 2)
+		for _, waiter := range []struct {
+			name    string
+			timeout time.Duration
+		}{
+			{"far", time.Minute},
+			{"near", 30 * time.Second},
+		} {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), waiter.timeout)
+				defer cancel()
+				if _, err := l.Admit(ctx, admission); err == nil {
+					order <- waiter.name
+				}
+			}()
+			synctest.Wait()
+		}
+
+		if got := <-order; got != "near" {
+			t.Fatalf("first granted = %q, want near", got)
+		}
+		if got := <-order; got != "far" {
+			t.Fatalf("second granted = %q, want far", got)
+		}
+	})
+}
+
+func TestLimiterDisablesKeyAfterForbidden(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:                 2,
+			QueueCapacity:            8,
+			DefaultAppLimits:         "100:1",
+			DisableKeyAfterForbidden: 3,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "euw1:lol/status/v4/platform-data"
+		forbidden := func(status int) {
+			l.Observe(Observation{Region: "euw1", Bucket: bucket, KeyIndex: 0, StatusCode: status, Header: http.Header{}})
+			synctest.Wait()
+		}
+		// A success in between restarts the streak.
+		forbidden(http.StatusForbidden)
+		forbidden(http.StatusForbidden)
+		forbidden(http.StatusOK)
+		forbidden(http.StatusForbidden)
+		forbidden(http.StatusForbidden)
+		pinned := 0
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh, TokenIndex: &pinned}); err != nil {
+			t.Fatalf("Admit() on key 0 before the third 403 error = %v", err)
+		}
+
+		forbidden(http.StatusForbidden)
+		for range 5 {
+			ticket, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh})
+			if err != nil {
+				t.Fatalf("Admit() error = %v", err)
+			}
+			if ticket.KeyIndex != 1 {
+				t.Fatalf("KeyIndex = %d, want disabled key 0 skipped", ticket.KeyIndex)
+			}
+		}
+		_, err = l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh, TokenIndex: &pinned})
+		var rejected *RejectedError
+		if !errors.As(err, &rejected) || rejected.Reason != "no_available_key" {
+			t.Fatalf("Admit() pinned to disabled key error = %v, want no_available_key", err)
+		}
+
+		if _, err := l.Reset(context.Background(), "", ""); err != nil {
+			t.Fatalf("Reset() error = %v", err)
+		}
+		if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh, TokenIndex: &pinned}); err != nil {
+			t.Fatalf("Admit() on key 0 after Reset() error = %v", err)
+		}
+	})
+}
+
+func TestLimiterReportsBucketLearnedOnce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "20:1",
+			Metrics:          sink,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		admission := Admission{Region: "europe", Bucket: bucket, Priority: PriorityHigh}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+
+		learnedAt := time.Now().Add(time.Second)
+		time.Sleep(time.Second)
+		for range 2 {
+			l.Observe(Observation{
+				Region:     "europe",
+				Bucket:     bucket,
+				StatusCode: http.StatusOK,
+				Header: http.Header{
+					"X-Method-Rate-Limit":       []string{"100:10"},
+					"X-Method-Rate-Limit-Count": []string{"1:10"},
+				},
+			})
+			synctest.Wait()
+			time.Sleep(time.Second)
+		}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+
+		got := sink.learned(bucket)
+		if len(got) != 1 || !got[0].Equal(learnedAt) {
+			t.Fatalf("learned timestamps = %v, want [%v]", got, learnedAt)
+		}
+		if got, want := sink.defaultsCount(bucket), 1; got != want {
+			t.Fatalf("using-defaults admissions = %d, want %d", got, want)
+		}
+	})
+}
+
+func TestLimiterRepublishesQueueDepth(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		clock := NewManualClock(time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC))
+		l, err := New(Config{
+			KeyCount:           1,
+			QueueCapacity:      8,
+			DefaultAppLimits:   "1:1",
+			Clock:              clock,
+			Metrics:            sink,
+			QueueDepthInterval: 5 * time.Second,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		bucket := "europe:riot/account/v1/accounts/me"
+		var wg sync.WaitGroup
+		for range 3 {
+			wg.Go(func() {
+				_, _ = l.Admit(context.Background(), Admission{Region: "europe", Bucket: bucket, Priority: PriorityNormal})
+			})
+		}
+		synctest.Wait()
+		if got := sink.queueDepth(bucket, PriorityNormal); got == 0 {
+			t.Fatal("queue depth = 0 while requests wait, want > 0")
 		}
 
-		time.Sleep(2 * time.Second)
+		// Only the manual clock moves: the waiters drain and the depth is
+		// republished without any bubble time passing.
+		for range 2 {
+			clock.Advance(time.Second)
+			synctest.Wait()
+		}
+		wg.Wait()
+		// Stand in for a depth a scrape would otherwise keep reporting.
+		sink.ObserveQueueDepth(bucket, PriorityNormal, 3)
+		clock.Advance(5 * time.Second)
 		synctest.Wait()
 
-		if err := <-done; err != nil {
-			t.Fatalf("Admit() after Retry-After error = %v", err)
+		if got := sink.queueDepth(bucket, PriorityNormal); got != 0 {
+			t.Fatalf("queue depth after drain = %d, want 0", got)
+		}
+	})
+}
+
+func TestLimiterObserveBufferSize(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		l, err := New(Config{
+			KeyCount:          1,
+			QueueCapacity:     1,
+			ObserveBufferSize: 8,
+			Metrics:           sink,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		if got, want := cap(l.observeCh), 8; got != want {
+			t.Fatalf("cap(observeCh) = %d, want %d", got, want)
+		}
+
+		l.Observe(Observation{
+			Region:     "europe",
+			Bucket:     "europe:riot/account/v1/accounts/me",
+			StatusCode: http.StatusOK,
+			Header:     http.Header{},
+		})
+		synctest.Wait()
+
+		length, capacity := sink.observeBuffer()
+		if got, want := capacity, 8; got != want {
+			t.Fatalf("reported capacity = %d, want %d", got, want)
+		}
+		if length < 1 || length > capacity {
+			t.Fatalf("reported length = %d, want within [1,%d]", length, capacity)
 		}
 	})
 }
 
+func TestNewRejectsNegativeObserveBufferSize(t *testing.T) {
+	t.Parallel()
+
+	l, err := New(Config{KeyCount: 1, QueueCapacity: 1, ObserveBufferSize: -1})
+	if err == nil {
+		_ = l.Close()
+		t.Fatal("New() error = nil, want non-nil")
+	}
+}
+
 func intPtr(v int) *int {
 	return &v
 }
@@ -430,3 +2588,276 @@ type mutableClock struct {
 func (c *mutableClock) Now() time.Time {
 	return c.now
 }
+
+func (c *mutableClock) NewTimer(d time.Duration) Timer {
+	return realClock{}.NewTimer(d)
+}
+
+type recordingMetrics struct {
+	mu                    sync.Mutex
+	observeBufferLength   int
+	observeBufferCapacity int
+	learnedAt             map[string][]time.Time
+	usingDefaults         map[string]int
+	queueDepths           map[string]int
+	pacingIntervals       map[string]time.Duration
+	activeBuckets         int
+	activeKeys            int
+}
+
+func (m *recordingMetrics) ObserveQueueDepth(bucket string, priority Priority, depth int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queueDepths == nil {
+		m.queueDepths = make(map[string]int)
+	}
+	m.queueDepths[bucket+"/"+priority.String()] = depth
+}
+
+func (m *recordingMetrics) queueDepth(bucket string, priority Priority) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queueDepths[bucket+"/"+priority.String()]
+}
+
+func (m *recordingMetrics) ObserveObservationBuffer(length, capacity int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observeBufferLength = length
+	m.observeBufferCapacity = capacity
+}
+
+func (m *recordingMetrics) ObserveBucketLearned(bucket string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.learnedAt == nil {
+		m.learnedAt = make(map[string][]time.Time)
+	}
+	m.learnedAt[bucket] = append(m.learnedAt[bucket], at)
+}
+
+func (m *recordingMetrics) ObserveBucketUsingDefaults(bucket string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.usingDefaults == nil {
+		m.usingDefaults = make(map[string]int)
+	}
+	m.usingDefaults[bucket]++
+}
+
+func (m *recordingMetrics) ObservePacingInterval(bucket string, interval time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pacingIntervals == nil {
+		m.pacingIntervals = make(map[string]time.Duration)
+	}
+	m.pacingIntervals[bucket] = interval
+}
+
+func (m *recordingMetrics) ObserveActiveBuckets(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeBuckets = count
+}
+
+func (m *recordingMetrics) ObserveActiveKeys(count int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.activeKeys = count
+}
+
+func (m *recordingMetrics) active() (buckets, keys int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.activeBuckets, m.activeKeys
+}
+
+func (m *recordingMetrics) pacingInterval(bucket string) (time.Duration, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	interval, ok := m.pacingIntervals[bucket]
+	return interval, ok
+}
+
+func (m *recordingMetrics) learned(bucket string) []time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]time.Time(nil), m.learnedAt[bucket]...)
+}
+
+func (m *recordingMetrics) defaultsCount(bucket string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.usingDefaults[bucket]
+}
+
+func (m *recordingMetrics) observeBuffer() (int, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.observeBufferLength, m.observeBufferCapacity
+}
+
+func TestLimiterReportsActiveBucketsAndKeys(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    1,
+			DefaultAppLimits: "20:1",
+			Metrics:          sink,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		for _, admission := range []Admission{
+			{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"},
+			{Region: "euw1", Bucket: "euw1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"},
+			{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data"},
+			{Region: "na1", Bucket: "na1:lol/status/v4/platform-data"},
+		} {
+			admission.Priority = PriorityHigh
+			if _, err := l.Admit(context.Background(), admission); err != nil {
+				t.Fatalf("Admit(%s) error = %v", admission.Bucket, err)
+			}
+		}
+		if buckets, keys := sink.active(); buckets != 3 || keys != 2 {
+			t.Fatalf("active buckets, keys = %d, %d, want 3, 2", buckets, keys)
+		}
+
+		if err := l.SetKeyCount(context.Background(), 3); err != nil {
+			t.Fatalf("SetKeyCount() error = %v", err)
+		}
+		if _, keys := sink.active(); keys != 3 {
+			t.Fatalf("active keys = %d, want 3", keys)
+		}
+	})
+}
+
+func TestLimiterReportsActiveBucketsWithoutLimits(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		sink := &recordingMetrics{}
+		l, err := New(Config{
+			KeyCount:      1,
+			QueueCapacity: 1,
+			Metrics:       sink,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		// Repeat admissions take the bucket's fast lane, but only the first
+		// of each bucket creates it.
+		for _, bucket := range []string{"euw1:lol/status/v4/platform-data", "euw1:lol/summoner/v4/summoners/me"} {
+			for range 3 {
+				if _, err := l.Admit(context.Background(), Admission{Region: "euw1", Bucket: bucket, Priority: PriorityHigh}); err != nil {
+					t.Fatalf("Admit(%s) error = %v", bucket, err)
+				}
+			}
+		}
+		if buckets, _ := sink.active(); buckets != 2 {
+			t.Fatalf("active buckets = %d, want 2", buckets)
+		}
+	})
+}
+
+func TestLimiterSetKeyCount(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         1,
+			QueueCapacity:    2,
+			DefaultAppLimits: "1:10",
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", Priority: PriorityHigh}
+		if ticket, err := l.Admit(context.Background(), admission); err != nil || ticket.KeyIndex != 0 {
+			t.Fatalf("first Admit() = (%+v, %v), want key 0", ticket, err)
+		}
+
+		// The only key has spent its window, so this one queues until the
+		// new key arrives instead of for the rest of the window.
+		type result struct {
+			ticket Ticket
+			err    error
+		}
+		queued := make(chan result, 1)
+		go func() {
+			ticket, err := l.Admit(context.Background(), admission)
+			queued <- result{ticket, err}
+		}()
+		synctest.Wait()
+
+		if err := l.SetKeyCount(context.Background(), 2); err != nil {
+			t.Fatalf("SetKeyCount(2) error = %v", err)
+		}
+		synctest.Wait()
+		select {
+		case got := <-queued:
+			if got.err != nil || got.ticket.KeyIndex != 1 {
+				t.Fatalf("queued Admit() = (%+v, %v), want key 1", got.ticket, got.err)
+			}
+		default:
+			t.Fatal("queued Admit() still waiting after a key was added")
+		}
+
+		if err := l.SetKeyCount(context.Background(), 1); err != nil {
+			t.Fatalf("SetKeyCount(1) error = %v", err)
+		}
+		removed := 1
+		pinned := admission
+		pinned.TokenIndex = &removed
+		var rejected *RejectedError
+		if _, err := l.Admit(context.Background(), pinned); !errors.As(err, &rejected) || rejected.Reason != "invalid_token_index" {
+			t.Fatalf("Admit() pinned to a removed key error = %v, want invalid_token_index", err)
+		}
+		if err := l.SetKeyCount(context.Background(), 0); err == nil {
+			t.Fatal("SetKeyCount(0) error = nil, want error")
+		}
+	})
+}
+
+func TestLimiterSetKeyCountResetsReplacedKeys(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := New(Config{
+			KeyCount:         2,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1:10",
+			DisablePacing:    true,
+		})
+		if err != nil {
+			t.Fatalf("New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admission := Admission{Region: "euw1", Bucket: "euw1:lol/status/v4/platform-data", NoWait: true}
+		for _, index := range []int{0, 1} {
+			pinned := admission
+			pinned.TokenIndex = &index
+			if _, err := l.Admit(context.Background(), pinned); err != nil {
+				t.Fatalf("Admit() on key %d error = %v", index, err)
+			}
+		}
+
+		// Key 1 got a new token, so its spent window belongs to the old one.
+		if err := l.SetKeyCount(context.Background(), 2, 1); err != nil {
+			t.Fatalf("SetKeyCount(2, 1) error = %v", err)
+		}
+		for index, wantErr := range []bool{true, false} {
+			pinned := admission
+			pinned.TokenIndex = &index
+			if _, err := l.Admit(context.Background(), pinned); (err != nil) != wantErr {
+				t.Fatalf("Admit() on key %d after replacing key 1 error = %v, want error %v", index, err, wantErr)
+			}
+		}
+
+		if err := l.SetKeyCount(context.Background(), 2, 2); err == nil {
+			t.Fatal("SetKeyCount(2, 2) error = nil, want error")
+		}
+	})
+}
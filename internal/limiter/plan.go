@@ -0,0 +1,141 @@
+package limiter
+
+import (
+	"context"
+	"time"
+)
+
+// BucketPlan is the admission state the limiter currently holds for one bucket.
+type BucketPlan struct {
+	Region string    `json:"region"`
+	Bucket string    `json:"bucket"`
+	Keys   []KeyPlan `json:"keys"`
+}
+
+// KeyPlan describes the app and method state of one API key for a bucket.
+type KeyPlan struct {
+	KeyIndex    int       `json:"key_index"`
+	App         StatePlan `json:"app"`
+	Method      StatePlan `json:"method"`
+	NextAllowed time.Time `json:"next_allowed"`
+}
+
+// StatePlan describes the windows and default-budget pacing of a rate state.
+type StatePlan struct {
+	Windows        []WindowPlan  `json:"windows"`
+	BlockedUntil   time.Time     `json:"blocked_until"`
+	PacingInterval time.Duration `json:"pacing_interval_ns"`
+	NextAllowed    time.Time     `json:"next_allowed"`
+}
+
+// WindowPlan is a single limit window as tracked by the limiter.
+type WindowPlan struct {
+	Limit   int           `json:"limit"`
+	Used    int           `json:"used"`
+	Window  time.Duration `json:"window_ns"`
+	ResetAt time.Time     `json:"reset_at"`
+}
+
+type planRequest struct {
+	region string
+	bucket string
+	resp   chan BucketPlan
+}
+
+// Plan returns the current windows, pacing and blocks for a bucket.
+func (l *Limiter) Plan(ctx context.Context, region, bucket string) (BucketPlan, error) {
+	req := planRequest{region: region, bucket: bucket, resp: make(chan BucketPlan, 1)}
+
+	select {
+	case l.planCh <- req:
+	case <-l.stopped:
+		return BucketPlan{}, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return BucketPlan{}, ctx.Err()
+	}
+
+	select {
+	case plan := <-req.resp:
+		return plan, nil
+	case <-l.stopped:
+		return BucketPlan{}, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return BucketPlan{}, ctx.Err()
+	}
+}
+
+func (l *Limiter) handlePlan(req planRequest, keys []keyState) {
+	now := l.cfg.Clock.Now()
+	plan := BucketPlan{
+		Region: req.region,
+		Bucket: req.bucket,
+		Keys:   make([]KeyPlan, len(keys)),
+	}
+	for i := range keys {
+		key := &keys[i]
+		// Reading the maps directly keeps a debug request for an unseen
+		// region or bucket from creating state for it.
+		appState, ok := key.appByRegion[req.region]
+		if !ok {
+			appState = &rateState{}
+			appState.apply(key.defaultAppLimits, nil, false, now, l.cfg.AdditionalWindow)
+		}
+		app := appState.plan(now)
+		var method StatePlan
+		if state, ok := key.methodByBucket[req.bucket]; ok {
+			method = state.plan(now)
+		} else {
+			method.NextAllowed = now
+		}
+
+		next := app.NextAllowed
+		if method.NextAllowed.After(next) {
+			next = method.NextAllowed
+		}
+		plan.Keys[i] = KeyPlan{KeyIndex: i, App: app, Method: method, NextAllowed: next}
+	}
+	req.resp <- plan
+}
+
+// plan mirrors nextAllowed for the default budget without mutating state.
+func (s *rateState) plan(now time.Time) StatePlan {
+	plan := StatePlan{
+		Windows:      make([]WindowPlan, 0, len(s.windows)),
+		BlockedUntil: s.blockedUntil,
+	}
+	next := now
+	if s.blockedUntil.After(next) {
+		next = s.blockedUntil
+	}
+
+	for _, w := range s.windows {
+		if !w.resetAt.After(now) {
+			w.rollover(now)
+		}
+		plan.Windows = append(plan.Windows, WindowPlan{
+			Limit:   w.limit,
+			Used:    w.used,
+			Window:  w.window,
+			ResetAt: w.resetAt,
+		})
+
+		requestsLeft := w.limit - w.used
+		if requestsLeft <= 0 {
+			if w.resetAt.After(next) {
+				next = w.resetAt
+			}
+			continue
+		}
+
+		interval := w.resetAt.Sub(now) / time.Duration(requestsLeft+1)
+		if interval > plan.PacingInterval {
+			plan.PacingInterval = interval
+		}
+		if last := s.defaultPacing.lastGranted; !last.IsZero() && last.Add(interval).After(next) {
+			next = last.Add(interval)
+		}
+	}
+
+	plan.NextAllowed = next
+	return plan
+}
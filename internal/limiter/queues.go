@@ -0,0 +1,84 @@
+package limiter
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// QueueSnapshot describes the admissions waiting in one bucket queue.
+type QueueSnapshot struct {
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	High   int    `json:"high"`
+	Normal int    `json:"normal"`
+	// Parked counts admissions waiting for room under QueueFullBlock.
+	Parked int `json:"parked"`
+	// OldestEnqueuedAt is when the longest-waiting admission arrived.
+	OldestEnqueuedAt time.Time `json:"oldest_enqueued_at"`
+	// WakeAt is when the loop next tries to grant from this bucket; zero when
+	// no wakeup is scheduled.
+	WakeAt time.Time `json:"wake_at"`
+}
+
+type queuesRequest struct {
+	resp chan []QueueSnapshot
+}
+
+// Queues returns every bucket with waiting admissions, sorted by bucket.
+// Admissions whose context has ended are not counted.
+func (l *Limiter) Queues(ctx context.Context) ([]QueueSnapshot, error) {
+	req := queuesRequest{resp: make(chan []QueueSnapshot, 1)}
+
+	select {
+	case l.queuesCh <- req:
+	case <-l.stopped:
+		return nil, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case queues := <-req.resp:
+		return queues, nil
+	case <-l.stopped:
+		return nil, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (l *Limiter) handleQueues(req queuesRequest, buckets map[string]*bucketQueue) {
+	queues := make([]QueueSnapshot, 0)
+	for _, bucket := range buckets {
+		snapshot := QueueSnapshot{
+			Region: bucket.region,
+			Bucket: bucket.bucket,
+			WakeAt: bucket.wakeAt,
+		}
+		countLive(bucket.high, &snapshot.High, &snapshot.OldestEnqueuedAt)
+		countLive(bucket.normal, &snapshot.Normal, &snapshot.OldestEnqueuedAt)
+		countLive(bucket.parked, &snapshot.Parked, &snapshot.OldestEnqueuedAt)
+		if snapshot.High+snapshot.Normal+snapshot.Parked == 0 {
+			continue
+		}
+		queues = append(queues, snapshot)
+	}
+	slices.SortFunc(queues, func(a, b QueueSnapshot) int {
+		return strings.Compare(a.Bucket, b.Bucket)
+	})
+	req.resp <- queues
+}
+
+func countLive(reqs []*admitRequest, count *int, oldest *time.Time) {
+	for _, req := range reqs {
+		if req.ctx.Err() != nil {
+			continue
+		}
+		*count++
+		if oldest.IsZero() || req.received.Before(*oldest) {
+			*oldest = req.received
+		}
+	}
+}
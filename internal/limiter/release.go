@@ -0,0 +1,83 @@
+package limiter
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// grant is what Release needs to undo a loop grant.
+type grant struct {
+	budgetID string
+	at       time.Time
+	priority Priority
+	// app and method are the pacing anchors the grant moved, as they were
+	// before it.
+	app, method anchors
+	// fast is set for a fast lane grant, which took a reserved slot and
+	// recorded nothing else.
+	fast bool
+	// cold is set for the grant that holds its bucket's coldInFlight.
+	cold     bool
+	released atomic.Bool
+}
+
+type releaseRequest struct {
+	ticket Ticket
+	region string
+	bucket string
+}
+
+// Release gives back the window slots ticket consumed, for an admission that
+// never reached upstream, e.g. because the client went away after the grant.
+// The slots must not have been used: Riot would count that request, and the
+// limiter would then admit one more than the window holds. Windows that have
+// rolled over since the grant are left alone. Releasing a ticket twice, or a
+// ticket that consumed nothing, does nothing.
+func (l *Limiter) Release(ticket Ticket, region, bucket string) {
+	if ticket.grant == nil || !ticket.grant.released.CompareAndSwap(false, true) {
+		return
+	}
+	select {
+	case l.releaseCh <- releaseRequest{ticket: ticket, region: region, bucket: bucket}:
+	case <-l.stopped:
+	}
+}
+
+func (l *Limiter) handleRelease(
+	req releaseRequest,
+	keys []keyState,
+	regionIndex map[string][]*bucketQueue,
+	wakeups *wakeHeap,
+) {
+	for _, bucket := range regionIndex[req.region] {
+		if bucket.bucket == req.bucket {
+			l.undoGrant(req.ticket, keys, bucket)
+			break
+		}
+	}
+	l.dispatchRegion(regionIndex[req.region], keys, wakeups)
+}
+
+// undoGrant reverses what dispatch did for ticket in bucket.
+func (l *Limiter) undoGrant(ticket Ticket, keys []keyState, bucket *bucketQueue) {
+	g := ticket.grant
+	if g.cold {
+		bucket.coldInFlight = false
+	}
+	if ticket.KeyIndex < 0 || ticket.KeyIndex >= len(keys) {
+		return
+	}
+	key := &keys[ticket.KeyIndex]
+	now := l.cfg.Clock.Now()
+	app := key.app(bucket.region, now, l.cfg.AdditionalWindow)
+	method := key.method(bucket.bucket, now, l.cfg.AdditionalWindow)
+	app.release(g.at, g.budgetID)
+	method.release(g.at, g.budgetID)
+	if g.fast {
+		return
+	}
+	app.restore(g.at, g.budgetID, g.app)
+	method.restore(g.at, g.budgetID, g.method)
+	key.unrecordGrant(g.at)
+	bucket.unrecordGrant(g.priority)
+}
@@ -0,0 +1,82 @@
+package limiter
+
+import (
+	"context"
+	"strings"
+)
+
+type resetRequest struct {
+	region string
+	bucket string
+	resp   chan int
+}
+
+// Reset forgets learned windows, pacing and Retry-After blocks so the next
+// observation re-seeds them from Riot's headers. A non-empty bucket clears
+// that bucket's method state; otherwise a non-empty region clears the region's
+// app state and the method state of its buckets; with neither, everything is
+// cleared, and keys disabled by DisableKeyAfterForbidden are enabled again.
+// It returns the number of rate states removed across all keys.
+func (l *Limiter) Reset(ctx context.Context, region, bucket string) (int, error) {
+	req := resetRequest{region: region, bucket: bucket, resp: make(chan int, 1)}
+
+	select {
+	case l.resetCh <- req:
+	case <-l.stopped:
+		return 0, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+
+	select {
+	case cleared := <-req.resp:
+		return cleared, nil
+	case <-l.stopped:
+		return 0, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (l *Limiter) handleReset(
+	req resetRequest,
+	keys []keyState,
+	regionIndex map[string][]*bucketQueue,
+	wakeups *wakeHeap,
+) {
+	l.closeAllLanes(regionIndex, keys)
+	cleared := 0
+	regions := make(map[string]struct{})
+	for i := range keys {
+		key := &keys[i]
+		if req.region == "" && req.bucket == "" {
+			key.disabled = false
+			key.forbiddenStreak = 0
+		}
+		if req.bucket == "" {
+			for region := range key.appByRegion {
+				if req.region == "" || region == req.region {
+					delete(key.appByRegion, region)
+					regions[region] = struct{}{}
+					cleared++
+				}
+			}
+		}
+		for bucket := range key.methodByBucket {
+			region, _, _ := strings.Cut(bucket, ":")
+			if req.bucket != "" && bucket != req.bucket || req.region != "" && region != req.region {
+				continue
+			}
+			delete(key.methodByBucket, bucket)
+			l.learned.Delete(bucket)
+			regions[region] = struct{}{}
+			cleared++
+		}
+	}
+	req.resp <- cleared
+
+	// Defaults may admit queued requests sooner than the cleared state did.
+	for region := range regions {
+		l.dispatchRegion(regionIndex[region], keys, wakeups)
+	}
+}
@@ -2,6 +2,7 @@ package limiter
 
 import (
 	"math"
+	"strings"
 	"time"
 )
 
@@ -26,11 +27,17 @@ type rateState struct {
 	blockedUntil  time.Time
 	defaultPacing pacingState
 	pacing        map[string]*pacingState
+	// minSpacing is the least time between paced grants of any budget, on top
+	// of the pacing the windows compute. lastConsumed anchors it.
+	minSpacing   time.Duration
+	lastConsumed time.Time
 }
 
 type pacingState struct {
 	lastGranted time.Time
-	windows     map[time.Duration]*pacingWindow
+	// jitter is the fraction of the paced interval added after lastGranted.
+	jitter  float64
+	windows map[time.Duration]*pacingWindow
 }
 
 type pacingWindow struct {
@@ -49,6 +56,11 @@ func (s *rateState) nextAllowed(now time.Time, budgetID string, share float64, b
 	if s.blockedUntil.After(next) {
 		next = s.blockedUntil
 	}
+	if !bypassPacing && s.minSpacing > 0 && !s.lastConsumed.IsZero() {
+		if floor := s.lastConsumed.Add(s.minSpacing); floor.After(next) {
+			next = floor
+		}
+	}
 
 	for i := range s.windows {
 		w := &s.windows[i]
@@ -74,7 +86,17 @@ func (s *rateState) nextAllowed(now time.Time, budgetID string, share float64, b
 
 		pacedAt := now
 		if !pacing.lastGranted.IsZero() {
-			nextSlot := pacing.lastGranted.Add(w.resetAt.Sub(now) / time.Duration(requestsLeft+1))
+			interval := w.resetAt.Sub(now) / time.Duration(requestsLeft+1)
+			nextSlot := pacing.lastGranted.Add(interval)
+			if pacing.jitter > 0 {
+				jittered := nextSlot.Add(time.Duration(float64(interval) * pacing.jitter))
+				if jittered.After(w.resetAt) {
+					jittered = w.resetAt
+				}
+				if jittered.After(nextSlot) {
+					nextSlot = jittered
+				}
+			}
 			if nextSlot.After(pacedAt) {
 				pacedAt = nextSlot
 			}
@@ -110,9 +132,129 @@ func (s *rateState) consume(now time.Time, budgetID string) bool {
 		pacing.windowFor(*w, now).used++
 	}
 	pacing.lastGranted = now
+	s.lastConsumed = now
 	return true
 }
 
+// release undoes a consume made at grantedAt in every window that has not
+// rolled over since.
+func (s *rateState) release(grantedAt time.Time, budgetID string) {
+	pacing := s.pacingFor(normalizeBudgetID(budgetID))
+	for i := range s.windows {
+		w := &s.windows[i]
+		if grantedAt.Before(w.resetAt.Add(-w.window)) || !w.resetAt.After(grantedAt) {
+			continue
+		}
+		if w.used > 0 {
+			w.used--
+		}
+		if current := pacing.windows[w.window]; current != nil && current.resetAt.Equal(w.resetAt) && current.used > 0 {
+			current.used--
+		}
+	}
+}
+
+// sameWindows reports whether applying windows would keep the limits and
+// sizes of s's windows.
+func (s *rateState) sameWindows(windows []parsedWindow, additionalWindow time.Duration) bool {
+	if len(windows) == 0 {
+		return true
+	}
+	i := 0
+	for _, parsed := range windows {
+		if parsed.limit <= 0 || parsed.window <= 0 {
+			continue
+		}
+		if i >= len(s.windows) || s.windows[i].limit != parsed.limit || s.windows[i].window != parsed.window+additionalWindow {
+			return false
+		}
+		i++
+	}
+	return i == len(s.windows)
+}
+
+// room returns how many more grants every window allows at now, or -1 when
+// there are no windows.
+func (s *rateState) room(now time.Time) int {
+	room := -1
+	for i := range s.windows {
+		w := &s.windows[i]
+		if !w.resetAt.After(now) {
+			w.rollover(now)
+		}
+		if left := max(w.limit-w.used, 0); room < 0 || left < room {
+			room = left
+		}
+	}
+	return room
+}
+
+// reserve counts n grants of the default budget at now in every window, like
+// n calls to consume but without moving the pacing anchors.
+func (s *rateState) reserve(n int, now time.Time) {
+	pacing := s.pacingFor(defaultBudgetID)
+	for i := range s.windows {
+		w := &s.windows[i]
+		w.used += n
+		pacing.windowFor(*w, now).used += n
+	}
+}
+
+// anchor moves the pacing anchors of the default budget to at, a grant made
+// outside consume, unless they are later already.
+func (s *rateState) anchor(at time.Time) {
+	if at.After(s.defaultPacing.lastGranted) {
+		s.defaultPacing.lastGranted = at
+	}
+	if at.After(s.lastConsumed) {
+		s.lastConsumed = at
+	}
+}
+
+// anchors are the pacing anchors consume moves for a budget.
+type anchors struct {
+	lastGranted  time.Time
+	lastConsumed time.Time
+}
+
+func (s *rateState) anchors(budgetID string) anchors {
+	return anchors{lastGranted: s.pacingFor(budgetID).lastGranted, lastConsumed: s.lastConsumed}
+}
+
+// restore puts back the pacing anchors a consume at grantedAt moved from
+// before, unless a later grant has moved them since.
+func (s *rateState) restore(grantedAt time.Time, budgetID string, before anchors) {
+	if pacing := s.pacingFor(budgetID); pacing.lastGranted.Equal(grantedAt) {
+		pacing.lastGranted = before.lastGranted
+	}
+	if s.lastConsumed.Equal(grantedAt) {
+		s.lastConsumed = before.lastConsumed
+	}
+}
+
+// pacingInterval is the spacing nextAllowed currently puts between grants of
+// budgetID: the largest interval over the windows with requests left.
+func (s *rateState) pacingInterval(now time.Time, budgetID string, share float64) time.Duration {
+	pacing := s.pacingFor(normalizeBudgetID(budgetID))
+	var interval time.Duration
+	for _, w := range s.windows {
+		if !w.resetAt.After(now) {
+			continue
+		}
+		requestsLeft := effectiveLimit(w.limit, share) - pacing.windowFor(w, now).used
+		if requestsLeft <= 0 {
+			continue
+		}
+		interval = max(interval, w.resetAt.Sub(now)/time.Duration(requestsLeft+1))
+	}
+	return max(interval, s.minSpacing)
+}
+
+// setJitter sets the jitter applied to the next paced slot of budgetID.
+func (s *rateState) setJitter(budgetID string, jitter float64) {
+	s.pacingFor(normalizeBudgetID(budgetID)).jitter = jitter
+}
+
 func (s *rateState) apply(
 	windows []parsedWindow,
 	retryAfter *time.Time,
@@ -240,16 +382,58 @@ func effectiveLimit(limit int, share float64) int {
 }
 
 type keyState struct {
+	// appByRegion is keyed by the exact routing value a request was sent to.
+	// Riot counts app limits per routing value, so a platform ("na1") and the
+	// regional route that covers it ("americas") have independent budgets.
 	appByRegion      map[string]*rateState
 	methodByBucket   map[string]*rateState
 	defaultAppLimits []parsedWindow
+	// defaultMethodLimits is keyed by route pattern without region, plus "*".
+	defaultMethodLimits map[string][]parsedWindow
+	// minSpacing returns the MinSpacing floor for a bucket; nil means none.
+	minSpacing func(bucket string) time.Duration
+	// granted counts grants in the keyWeightWindow starting at grantedSince,
+	// so KeyWeights balance recent traffic rather than the process lifetime.
+	granted      int
+	grantedSince time.Time
+	// forbiddenStreak counts consecutive 403 responses; disabled is set once
+	// it reaches DisableKeyAfterForbidden and keeps pickKey off the key.
+	forbiddenStreak int
+	disabled        bool
+}
+
+// keyWeightWindow is how far back KeyWeights look when comparing keys.
+const keyWeightWindow = 10 * time.Second
+
+// grants returns the key's grants in the keyWeightWindow containing now.
+func (k *keyState) grants(now time.Time) int {
+	if !k.grantedSince.Equal(now.Truncate(keyWeightWindow)) {
+		return 0
+	}
+	return k.granted
+}
+
+func (k *keyState) recordGrant(now time.Time) {
+	if since := now.Truncate(keyWeightWindow); !k.grantedSince.Equal(since) {
+		k.granted, k.grantedSince = 0, since
+	}
+	k.granted++
 }
 
-func newKeyState(defaultAppLimits []parsedWindow) keyState {
+// unrecordGrant takes back a grant recordGrant counted at grantedAt, if its
+// window is still the current one.
+func (k *keyState) unrecordGrant(grantedAt time.Time) {
+	if k.grantedSince.Equal(grantedAt.Truncate(keyWeightWindow)) && k.granted > 0 {
+		k.granted--
+	}
+}
+
+func newKeyState(defaultAppLimits []parsedWindow, defaultMethodLimits map[string][]parsedWindow) keyState {
 	return keyState{
-		appByRegion:      make(map[string]*rateState),
-		methodByBucket:   make(map[string]*rateState),
-		defaultAppLimits: defaultAppLimits,
+		appByRegion:         make(map[string]*rateState),
+		methodByBucket:      make(map[string]*rateState),
+		defaultAppLimits:    defaultAppLimits,
+		defaultMethodLimits: defaultMethodLimits,
 	}
 }
 
@@ -264,12 +448,27 @@ func (k *keyState) app(region string, now time.Time, additionalWindow time.Durat
 	return state
 }
 
-func (k *keyState) method(bucket string) *rateState {
+func (k *keyState) method(bucket string, now time.Time, additionalWindow time.Duration) *rateState {
 	state, ok := k.methodByBucket[bucket]
 	if ok {
 		return state
 	}
 	state = &rateState{}
+	state.apply(k.defaultMethodFor(bucket), nil, false, now, additionalWindow)
+	if k.minSpacing != nil {
+		state.minSpacing = k.minSpacing(bucket)
+	}
 	k.methodByBucket[bucket] = state
 	return state
 }
+
+func (k *keyState) defaultMethodFor(bucket string) []parsedWindow {
+	if len(k.defaultMethodLimits) == 0 {
+		return nil
+	}
+	_, pattern, _ := strings.Cut(bucket, ":")
+	if windows, ok := k.defaultMethodLimits[pattern]; ok {
+		return windows
+	}
+	return k.defaultMethodLimits["*"]
+}
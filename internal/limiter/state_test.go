@@ -19,6 +19,36 @@ func TestRateStateNextAllowed(t *testing.T) {
 		}
 	})
 
+	t.Run("jitter delays the paced slot within bounds", func(t *testing.T) {
+		t.Parallel()
+
+		newState := func(jitter float64) rateState {
+			return rateState{
+				windows: []limitWindow{
+					{limit: 4, used: 1, window: 4 * time.Second, resetAt: now.Add(4 * time.Second)},
+				},
+				defaultPacing: pacingState{
+					lastGranted: now,
+					jitter:      jitter,
+					windows: map[time.Duration]*pacingWindow{
+						4 * time.Second: {used: 1, resetAt: now.Add(4 * time.Second)},
+					},
+				},
+			}
+		}
+
+		// The unjittered slot is 1s out; 0.5 of that interval is added.
+		state := newState(0.5)
+		if got, want := state.nextAllowed(now, "", 1, false), now.Add(1500*time.Millisecond); !got.Equal(want) {
+			t.Fatalf("nextAllowed() = %v, want %v", got, want)
+		}
+		// Jitter never moves the slot past the window reset.
+		state = newState(10)
+		if got, want := state.nextAllowed(now, "", 1, false), now.Add(4*time.Second); !got.Equal(want) {
+			t.Fatalf("nextAllowed() with large jitter = %v, want window reset %v", got, want)
+		}
+	})
+
 	t.Run("paces when last grant exists", func(t *testing.T) {
 		t.Parallel()
 
@@ -0,0 +1,111 @@
+package limiter
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Tuning changes Config fields while the limiter runs. Nil fields are left as
+// they are. Changes apply to admissions and observations from then on; they
+// are not persisted and a restart reverts to Config.
+type Tuning struct {
+	QueueCapacity    *int
+	AdditionalWindow *time.Duration
+	MinSpacing       *time.Duration
+}
+
+// Validate reports the first field a running limiter would refuse.
+func (t Tuning) Validate() error {
+	if t.QueueCapacity != nil && *t.QueueCapacity <= 0 {
+		return fmt.Errorf("QueueCapacity must be > 0")
+	}
+	if t.AdditionalWindow != nil && *t.AdditionalWindow < 0 {
+		return fmt.Errorf("AdditionalWindow must be >= 0")
+	}
+	if t.MinSpacing != nil && *t.MinSpacing < 0 {
+		return fmt.Errorf("MinSpacing must be >= 0")
+	}
+	return nil
+}
+
+// Settings are the current values of the fields Tuning can change.
+type Settings struct {
+	QueueCapacity    int
+	AdditionalWindow time.Duration
+	MinSpacing       time.Duration
+}
+
+type tuneRequest struct {
+	tuning Tuning
+	resp   chan Settings
+}
+
+// Tune applies t and returns the settings in effect afterwards. An empty
+// Tuning only reads them.
+func (l *Limiter) Tune(ctx context.Context, t Tuning) (Settings, error) {
+	if err := t.Validate(); err != nil {
+		return Settings{}, err
+	}
+	req := tuneRequest{tuning: t, resp: make(chan Settings, 1)}
+
+	select {
+	case l.tuneCh <- req:
+	case <-l.stopped:
+		return Settings{}, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return Settings{}, ctx.Err()
+	}
+
+	select {
+	case settings := <-req.resp:
+		return settings, nil
+	case <-l.stopped:
+		return Settings{}, &RejectedError{Reason: "shutting_down"}
+	case <-ctx.Done():
+		return Settings{}, ctx.Err()
+	}
+}
+
+func (l *Limiter) handleTune(
+	req tuneRequest,
+	keys []keyState,
+	regionIndex map[string][]*bucketQueue,
+	wakeups *wakeHeap,
+) {
+	l.closeAllLanes(regionIndex, keys)
+	t := req.tuning
+	if t.QueueCapacity != nil {
+		l.cfg.QueueCapacity = *t.QueueCapacity
+	}
+	if t.AdditionalWindow != nil {
+		l.cfg.AdditionalWindow = *t.AdditionalWindow
+	}
+	if t.MinSpacing != nil {
+		l.cfg.MinSpacing = *t.MinSpacing
+		for i := range keys {
+			keys[i].minSpacing = nil
+			if l.cfg.MinSpacing > 0 || len(l.cfg.MinSpacingOverrides) > 0 {
+				keys[i].minSpacing = l.minSpacing
+			}
+			// Method states copy their floor when created, so update the
+			// ones that already exist as well.
+			for bucket, state := range keys[i].methodByBucket {
+				state.minSpacing = 0
+				if keys[i].minSpacing != nil {
+					state.minSpacing = keys[i].minSpacing(bucket)
+				}
+			}
+		}
+	}
+	req.resp <- Settings{
+		QueueCapacity:    l.cfg.QueueCapacity,
+		AdditionalWindow: l.cfg.AdditionalWindow,
+		MinSpacing:       l.cfg.MinSpacing,
+	}
+
+	// A larger queue or shorter spacing may let waiting admissions go now.
+	for _, buckets := range regionIndex {
+		l.dispatchRegion(buckets, keys, wakeups)
+	}
+}
@@ -3,6 +3,7 @@ package limiter
 import (
 	"context"
 	"net/http"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,10 +26,22 @@ type Admission struct {
 	BudgetID   string
 	Priority   Priority
 	TokenIndex *int
+	// NoWait rejects with reason "would_wait" instead of queueing when the
+	// admission cannot be granted immediately.
+	NoWait bool
 }
 
 type Ticket struct {
 	KeyIndex int
+	// Paced reports whether the grant was spread across the window rather
+	// than bypassing pacing (high priority or DisablePacing).
+	Paced bool
+	// QueuePosition is how many admissions of the same priority were ahead
+	// of this one in its bucket queue when it was enqueued; 0 for a grant
+	// that did not queue behind anyone.
+	QueuePosition int
+	// grant is set when the grant consumed window slots; see Release.
+	grant *grant
 }
 
 type Observation struct {
@@ -37,14 +50,42 @@ type Observation struct {
 	KeyIndex   int
 	StatusCode int
 	Header     http.Header
+
+	// applied, if set, is closed once the loop has applied the observation.
+	applied chan struct{}
 }
 
+// Clock supplies the limiter's notion of time. The loop sleeps on timers from
+// NewTimer, so a fake clock controls both reads and wakeups.
 type Clock interface {
 	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+// Timer is a one-shot wakeup created by Clock.NewTimer.
+type Timer interface {
+	C() <-chan time.Time
+	// Reset rearms the timer to fire after d, discarding any pending fire.
+	Reset(d time.Duration)
+	Stop()
 }
 
 type MetricsSink interface {
 	ObserveQueueDepth(bucket string, priority Priority, depth int)
+	ObserveObservationBuffer(length, capacity int)
+	// ObserveBucketLearned is called once per bucket when its first method limits arrive.
+	ObserveBucketLearned(bucket string, at time.Time)
+	// ObserveBucketUsingDefaults is called for each admission granted before that.
+	ObserveBucketUsingDefaults(bucket string)
+	// ObservePacingInterval is called after each paced grant with the spacing
+	// the tightest app or method window now enforces for bucket.
+	ObservePacingInterval(bucket string, interval time.Duration)
+	// ObserveActiveBuckets is called with the number of buckets the loop
+	// tracks each time that number changes.
+	ObserveActiveBuckets(count int)
+	// ObserveActiveKeys is called with the key count on start and after
+	// SetKeyCount.
+	ObserveActiveKeys(count int)
 }
 
 type Config struct {
@@ -54,9 +95,135 @@ type Config struct {
 	Clock            Clock
 	Metrics          MetricsSink
 	DefaultAppLimits string
-	RateBudgets      map[string]BudgetConfig
+	// DefaultMethodLimits seeds method windows for buckets not yet observed,
+	// keyed by route pattern without region (e.g. "lol/match/v5/matches/{matchId}")
+	// or "*" for every other bucket. Values use the DefaultAppLimits format.
+	DefaultMethodLimits map[string]string
+	RateBudgets         map[string]BudgetConfig
+	ObserveBufferSize   int
+	// DisablePacing grants every priority as soon as window budget exists,
+	// enforcing only hard window limits and Retry-After blocks.
+	DisablePacing bool
+	// LimitHeadroomFraction reserves this fraction of every advertised limit
+	// so the limiter never paces up to Riot's exact threshold.
+	LimitHeadroomFraction float64
+	// RejectWhenAllBlocked rejects with reason "all_keys_blocked" instead of
+	// queueing while every usable key is under a Retry-After block.
+	RejectWhenAllBlocked bool
+	// KeyWeights, when set, has one positive weight per key. Among keys that
+	// are ready now, admissions go to the key with the fewest grants per weight
+	// in the current 10s window.
+	KeyWeights []int
+	// QueueDepthInterval republishes every bucket's queue depth on this period
+	// so idle buckets do not keep reporting a stale depth. Zero disables it.
+	QueueDepthInterval time.Duration
+	// QueueFullPolicy decides what happens to an admission for a full bucket
+	// queue. The zero value rejects.
+	QueueFullPolicy QueueFullPolicy
+	// MaxEstimatedWait rejects with reason "estimated_wait_exceeded" an
+	// admission whose earliest possible grant is further away than this when
+	// it arrives. Zero disables the check.
+	MaxEstimatedWait time.Duration
+	// RejectPastDeadline rejects with reason "wait_exceeds_deadline" an
+	// admission whose earliest possible grant, e.g. the end of a long
+	// Retry-After block, is past its context deadline when it arrives, instead
+	// of queueing it only to time out.
+	RejectPastDeadline bool
+	// KeyAffinity pins buckets to one key index, keyed by exact bucket
+	// ("europe:lol/match/v5/matches/{matchId}") or route pattern without region
+	// ("lol/match/v5/matches/{matchId}"). X-Riot-Token-Index still wins.
+	KeyAffinity map[string]int
+	// KeyAffinityFallback lets a pinned bucket use any key while its own key
+	// is not ready, instead of waiting for it.
+	KeyAffinityFallback bool
+	// PacingJitterFraction stretches each paced interval by a random 0 to
+	// this fraction of itself, so buckets that share a window reset do not
+	// wake in lockstep. Jitter only delays grants and never past the window
+	// reset. Zero disables it.
+	PacingJitterFraction float64
+	// PacingJitterSeed seeds the jitter source for reproducible runs. Zero
+	// picks a random seed.
+	PacingJitterSeed uint64
+	// QueueOrder decides which queued admission of a priority is served next.
+	// The zero value is QueueOrderFIFO.
+	QueueOrder QueueOrder
+	// ColdStartPolicy decides how buckets whose method limits have not been
+	// observed yet are admitted. The zero value is ColdStartBurst.
+	ColdStartPolicy ColdStartPolicy
+	// PriorityWeights shares each bucket's grants between priorities while both
+	// have requests waiting. The zero value is strict priority.
+	PriorityWeights PriorityWeights
+	// DisableKeyAfterForbidden stops selecting a key after this many
+	// consecutive 403 responses on it, as a revoked key gets nothing else. A
+	// full Reset enables it again. Zero disables the check.
+	DisableKeyAfterForbidden int
+	// MinSpacing is the least time between normal-priority grants for one
+	// bucket on one key, even when its windows would allow tighter pacing.
+	// High priority and DisablePacing ignore it. Zero disables it.
+	MinSpacing time.Duration
+	// MinSpacingOverrides replaces MinSpacing per exact bucket or route pattern
+	// without region, keyed like KeyAffinity.
+	MinSpacingOverrides map[string]time.Duration
+	// DefaultRetryAfter blocks like a Retry-After of this length when a 429
+	// carries no usable Retry-After, as edge caches often send it bare. Zero
+	// leaves such a 429 to the learned windows alone.
+	DefaultRetryAfter time.Duration
+}
+
+// QueueFullPolicy is the behavior for admissions that find their bucket
+// queue at QueueCapacity.
+type QueueFullPolicy string
+
+const (
+	// QueueFullReject fails the admission with reason "queue_full".
+	QueueFullReject QueueFullPolicy = "reject"
+	// QueueFullBlock parks the admission until the queue has room or its
+	// context ends. At most QueueCapacity admissions are parked per bucket;
+	// beyond that they are rejected as with QueueFullReject.
+	QueueFullBlock QueueFullPolicy = "block"
+)
+
+// PriorityWeights serves up to High high-priority grants, then up to Normal
+// normal-priority grants, per round while both priorities are queued.
+//
+// Strict priority lets a steady stream of high-priority requests starve
+// normal ones for as long as it lasts. Weights bound that wait: with 3:1 a
+// queued normal request is at most three high grants away from its turn.
+// The cost is that high priority gives up part of a saturated bucket, and
+// normal grants are still paced while high ones are not, so a normal turn
+// can take longer than the high grants it follows. A normal request that
+// must wait for pacing does not hold back high priority behind it.
+type PriorityWeights struct {
+	High   int
+	Normal int
 }
 
+// QueueOrder is the order of admissions within one priority of a bucket queue.
+type QueueOrder string
+
+const (
+	// QueueOrderFIFO serves admissions in arrival order.
+	QueueOrderFIFO QueueOrder = "fifo"
+	// QueueOrderDeadline serves the admission whose context deadline is
+	// nearest first, so a short-timeout request is not left to expire behind
+	// a patient one. Admissions without a deadline queue behind those with
+	// one, in arrival order.
+	QueueOrderDeadline QueueOrder = "deadline"
+)
+
+// ColdStartPolicy is the admission behavior for buckets with no observed
+// method limits.
+type ColdStartPolicy string
+
+const (
+	// ColdStartBurst admits cold buckets as their default limits allow.
+	ColdStartBurst ColdStartPolicy = "burst"
+	// ColdStartSerialize admits one request at a time per cold bucket: each
+	// grant waits until the previous one has been observed. Once a response
+	// carries the bucket's method limits, normal pacing takes over.
+	ColdStartSerialize ColdStartPolicy = "serialize"
+)
+
 type BudgetConfig struct {
 	Share        float64
 	BucketShares map[string]float64
@@ -65,6 +232,8 @@ type BudgetConfig struct {
 type RejectedError struct {
 	Reason     string
 	RetryAfter time.Duration
+	// QueueDepth is the bucket queue depth for reason "queue_full".
+	QueueDepth int
 }
 
 func (e *RejectedError) Error() string {
@@ -76,7 +245,12 @@ type admitRequest struct {
 	admission   Admission
 	budgetShare float64
 	received    time.Time
-	resp        chan admitResponse
+	// queuePosition is set by enqueue; see Ticket.QueuePosition.
+	queuePosition int
+	resp          chan admitResponse
+	// abandoned is set by Admit when it stops waiting for resp, so a grant
+	// sent after that is undone by the loop instead of being leaked.
+	abandoned atomic.Bool
 }
 
 type admitResponse struct {
@@ -89,3 +263,23 @@ type realClock struct{}
 func (realClock) Now() time.Time {
 	return time.Now()
 }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	timer *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.timer.C
+}
+
+func (t realTimer) Reset(d time.Duration) {
+	resetTimer(t.timer, d)
+}
+
+func (t realTimer) Stop() {
+	t.timer.Stop()
+}
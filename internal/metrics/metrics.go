@@ -15,16 +15,30 @@ import (
 
 // Collector holds all Prometheus metrics for RiftRelay.
 type Collector struct {
-	totalRequests  *prometheus.CounterVec
-	inflight       *prometheus.GaugeVec
-	admissionTotal *prometheus.CounterVec
-	queueDepth     *prometheus.GaugeVec
-	upstreamTotal  *prometheus.CounterVec
+	totalRequests     *prometheus.CounterVec
+	inflight          *prometheus.GaugeVec
+	admissionTotal    *prometheus.CounterVec
+	admissionRejected *prometheus.CounterVec
+	queueDepth        *prometheus.GaugeVec
+	upstreamTotal     *prometheus.CounterVec
+
+	observeBufferUtilization prometheus.Gauge
+	bucketLearnedTimestamp   *prometheus.GaugeVec
+	bucketUsingDefaults      *prometheus.CounterVec
+	pacingInterval           *prometheus.GaugeVec
+	activeBuckets            prometheus.Gauge
+	activeKeys               prometheus.Gauge
+	panics                   prometheus.Counter
 
 	requestDuration  *prometheus.HistogramVec
 	queueWaitSeconds *prometheus.HistogramVec
 	upstreamDuration *prometheus.HistogramVec
 
+	retryAttempts    *prometheus.CounterVec
+	retryWaitSeconds prometheus.Histogram
+
+	admittedUnobserved *prometheus.CounterVec
+
 	handler http.Handler
 }
 
@@ -39,8 +53,36 @@ func (rr *responseRecorder) WriteHeader(code int) {
 	rr.ResponseWriter.WriteHeader(code)
 }
 
+type options struct {
+	durationBuckets []float64
+}
+
+// buckets returns the configured duration buckets, or def when none are set.
+func (o options) buckets(def []float64) []float64 {
+	if len(o.durationBuckets) == 0 {
+		return def
+	}
+	return o.durationBuckets
+}
+
+type Option func(*options)
+
+// WithDurationBuckets replaces the boundaries, in seconds, of the request,
+// queue wait and upstream duration histograms. They must be positive and
+// ascending; an empty list keeps each histogram's defaults.
+func WithDurationBuckets(buckets []float64) Option {
+	return func(o *options) {
+		o.durationBuckets = buckets
+	}
+}
+
 // NewCollector creates a new metrics collector with all Prometheus metrics registered.
-func NewCollector() *Collector {
+func NewCollector(opts ...Option) *Collector {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	registry := prometheus.NewRegistry()
 
 	registry.MustRegister(collectors.NewGoCollector())
@@ -59,6 +101,10 @@ func NewCollector() *Collector {
 			Name: "riftrelay_admission_total",
 			Help: "Total number of admission control decisions",
 		}, []string{"outcome", "region", "endpoint", "priority", "budget_id"}),
+		admissionRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "riftrelay_admission_rejected_total",
+			Help: "Admissions rejected by the limiter, by rejection reason",
+		}, []string{"reason", "priority"}),
 		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "riftrelay_queue_depth",
 			Help: "Current queue depth per bucket and priority",
@@ -67,32 +113,84 @@ func NewCollector() *Collector {
 			Name: "riftrelay_upstream_responses_total",
 			Help: "Total number of upstream responses by status code",
 		}, []string{"code", "region", "endpoint", "priority"}),
+		observeBufferUtilization: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "riftrelay_observe_buffer_utilization",
+			Help: "Fraction of the limiter observation buffer in use when last drained",
+		}),
+		bucketLearnedTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "riftrelay_bucket_learned_timestamp_seconds",
+			Help: "Unix time at which a bucket's method limits were first learned from Riot headers",
+		}, []string{"bucket"}),
+		bucketUsingDefaults: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "riftrelay_bucket_using_defaults_total",
+			Help: "Admissions granted while a bucket's method limits were still unknown",
+		}, []string{"bucket"}),
+		pacingInterval: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "riftrelay_pacing_interval_seconds",
+			Help: "Spacing the limiter enforces between paced grants, as of the latest grant",
+		}, []string{"bucket"}),
+		activeBuckets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "riftrelay_active_buckets",
+			Help: "Buckets the limiter tracks; steady growth suggests IDs are ending up in bucket names",
+		}),
+		activeKeys: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "riftrelay_active_keys",
+			Help: "Riot API keys the limiter schedules across",
+		}),
+		panics: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "riftrelay_panics_total",
+			Help: "Total number of panics recovered while handling proxy requests",
+		}),
 		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "riftrelay_request_duration_seconds",
 			Help:    "HTTP request duration in seconds",
-			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			Buckets: o.buckets([]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}),
 		}, []string{"region", "priority", "status_code"}),
 		queueWaitSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "riftrelay_queue_wait_seconds",
 			Help:    "Time spent waiting in admission queue",
-			Buckets: []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			Buckets: o.buckets([]float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}),
 		}, []string{"bucket", "priority", "budget_id"}),
 		upstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "riftrelay_upstream_duration_seconds",
 			Help:    "Upstream request duration in seconds",
-			Buckets: []float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			Buckets: o.buckets([]float64{.01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}),
 		}, []string{"region", "bucket"}),
+		retryAttempts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "riftrelay_retry_attempts_total",
+			Help: "Upstream 429 responses retried by the proxy after their Retry-After",
+		}, []string{"bucket"}),
+		retryWaitSeconds: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "riftrelay_retry_wait_seconds",
+			Help:    "Retry-After delay waited before retrying an upstream 429",
+			Buckets: []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120},
+		}),
+		admittedUnobserved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "riftrelay_admitted_unobserved_total",
+			Help: "Admitted requests that got no upstream response, so the limiter learned no rate-limit headers from them",
+		}, []string{"bucket"}),
 	}
 
 	registry.MustRegister(
 		c.totalRequests,
 		c.inflight,
 		c.admissionTotal,
+		c.admissionRejected,
 		c.queueDepth,
 		c.upstreamTotal,
+		c.observeBufferUtilization,
+		c.bucketLearnedTimestamp,
+		c.bucketUsingDefaults,
+		c.pacingInterval,
+		c.activeBuckets,
+		c.activeKeys,
+		c.panics,
 		c.requestDuration,
 		c.queueWaitSeconds,
 		c.upstreamDuration,
+		c.retryAttempts,
+		c.retryWaitSeconds,
+		c.admittedUnobserved,
 	)
 
 	c.handler = promhttp.HandlerFor(registry, promhttp.HandlerOpts{
@@ -138,6 +236,44 @@ func (c *Collector) ObserveQueueDepth(bucket string, priority limiter.Priority,
 	c.queueDepth.WithLabelValues(bucket, priority.String()).Set(float64(depth))
 }
 
+// ObserveObservationBuffer records how full the limiter observation buffer is.
+func (c *Collector) ObserveObservationBuffer(length, capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	c.observeBufferUtilization.Set(float64(length) / float64(capacity))
+}
+
+// ObserveBucketLearned records when a bucket switched from default to learned limits.
+func (c *Collector) ObserveBucketLearned(bucket string, at time.Time) {
+	c.bucketLearnedTimestamp.WithLabelValues(bucket).Set(float64(at.UnixNano()) / float64(time.Second))
+}
+
+// ObserveBucketUsingDefaults counts an admission granted before the bucket's limits were learned.
+func (c *Collector) ObserveBucketUsingDefaults(bucket string) {
+	c.bucketUsingDefaults.WithLabelValues(bucket).Inc()
+}
+
+// ObservePacingInterval records the spacing enforced between paced grants of a bucket.
+func (c *Collector) ObservePacingInterval(bucket string, interval time.Duration) {
+	c.pacingInterval.WithLabelValues(bucket).Set(interval.Seconds())
+}
+
+// ObserveActiveBuckets records how many buckets the limiter tracks.
+func (c *Collector) ObserveActiveBuckets(count int) {
+	c.activeBuckets.Set(float64(count))
+}
+
+// ObserveActiveKeys records how many API keys the limiter schedules across.
+func (c *Collector) ObserveActiveKeys(count int) {
+	c.activeKeys.Set(float64(count))
+}
+
+// ObservePanic counts a recovered handler panic.
+func (c *Collector) ObservePanic() {
+	c.panics.Inc()
+}
+
 // ObserveQueueWait records the time spent waiting for admission.
 func (c *Collector) ObserveQueueWait(bucket string, priority limiter.Priority, budgetID string, wait time.Duration) {
 	c.queueWaitSeconds.WithLabelValues(bucket, priority.String(), budgetID).Observe(wait.Seconds())
@@ -148,6 +284,12 @@ func (c *Collector) ObserveAdmissionResult(outcome, region, bucket, priority str
 	c.admissionTotal.WithLabelValues(outcome, region, endpointFromBucket(bucket), priority, budgetID).Inc()
 }
 
+// ObserveAdmissionRejected records a rejected admission with the limiter's
+// reason, e.g. "queue_full", or "timeout" when the queue wait timed out.
+func (c *Collector) ObserveAdmissionRejected(reason, priority string) {
+	c.admissionRejected.WithLabelValues(reason, priority).Inc()
+}
+
 // ObserveUpstream records upstream response metrics.
 func (c *Collector) ObserveUpstream(statusCode int, region, bucket, priority string) {
 	c.upstreamTotal.WithLabelValues(statusCodeStr(statusCode), region, endpointFromBucket(bucket), priority).Inc()
@@ -158,6 +300,18 @@ func (c *Collector) ObserveUpstreamDuration(region, bucket string, duration time
 	c.upstreamDuration.WithLabelValues(region, bucket).Observe(duration.Seconds())
 }
 
+// ObserveRetry records a retried upstream 429 and the delay before the retry.
+func (c *Collector) ObserveRetry(bucket string, wait time.Duration) {
+	c.retryAttempts.WithLabelValues(bucket).Inc()
+	c.retryWaitSeconds.Observe(wait.Seconds())
+}
+
+// ObserveAdmittedUnobserved counts an admitted request that failed before
+// any upstream response reached the limiter.
+func (c *Collector) ObserveAdmittedUnobserved(bucket string) {
+	c.admittedUnobserved.WithLabelValues(bucket).Inc()
+}
+
 // ServeHTTP implements http.Handler to expose metrics in Prometheus format.
 func (c *Collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	c.handler.ServeHTTP(w, r)
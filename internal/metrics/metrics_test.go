@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+)
+
+func TestCollectorDurationBuckets(t *testing.T) {
+	t.Parallel()
+
+	scrape := func(c *Collector) string {
+		c.ObserveQueueWait("euw1:lol/status/v4/platform-data", limiter.PriorityNormal, "default", 300*time.Millisecond)
+		c.ObserveUpstreamDuration("euw1", "euw1:lol/status/v4/platform-data", time.Second)
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		return rec.Body.String()
+	}
+
+	custom := scrape(NewCollector(WithDurationBuckets([]float64{0.2, 0.75, 3})))
+	for _, want := range []string{
+		`riftrelay_queue_wait_seconds_bucket{bucket="euw1:lol/status/v4/platform-data",budget_id="default",priority="normal",le="0.2"} 0`,
+		`riftrelay_queue_wait_seconds_bucket{bucket="euw1:lol/status/v4/platform-data",budget_id="default",priority="normal",le="0.75"} 1`,
+		`riftrelay_upstream_duration_seconds_bucket{bucket="euw1:lol/status/v4/platform-data",region="euw1",le="0.75"} 0`,
+		`riftrelay_upstream_duration_seconds_bucket{bucket="euw1:lol/status/v4/platform-data",region="euw1",le="3"} 1`,
+	} {
+		if !strings.Contains(custom, want) {
+			t.Fatalf("custom buckets exposition missing %q", want)
+		}
+	}
+	if strings.Contains(custom, `priority="normal",le="0.25"`) {
+		t.Fatal("custom buckets exposition still has default boundary 0.25")
+	}
+
+	defaults := scrape(NewCollector(WithDurationBuckets(nil)))
+	if !strings.Contains(defaults, `riftrelay_queue_wait_seconds_bucket{bucket="euw1:lol/status/v4/platform-data",budget_id="default",priority="normal",le="0.001"} 0`) {
+		t.Fatal("empty bucket list did not keep the default boundaries")
+	}
+}
@@ -4,22 +4,32 @@ import (
 	"context"
 	"log"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
+	"github.com/renja-g/RiftRelay/internal/config"
 	"github.com/renja-g/RiftRelay/internal/limiter"
 	"github.com/renja-g/RiftRelay/internal/metrics"
 	"github.com/renja-g/RiftRelay/internal/router"
+	"github.com/renja-g/RiftRelay/internal/transport"
 )
 
 type admissionContext struct {
-	Region    string
-	Bucket    string
-	BudgetID  string
-	KeyIndex  int
-	Priority  string
-	StartedAt time.Time
+	Region   string
+	Bucket   string
+	BudgetID string
+	KeyIndex int
+	// TokenIndex is the key the client pinned with X-Riot-Token-Index, if any.
+	TokenIndex *int
+	Priority   string
+	StartedAt  time.Time
+	QueueWait  time.Duration
+	Paced      bool
+	// QueuePosition is limiter.Ticket.QueuePosition.
+	QueuePosition int
 }
 
 type admissionContextKey struct{}
@@ -33,22 +43,70 @@ func admissionFromContext(ctx context.Context) (admissionContext, bool) {
 	return info, ok
 }
 
+type priorityContextKey struct{}
+
+// WithPriority fixes the admission priority of requests carrying ctx, in
+// place of X-Priority and even with AllowPriorityBypass off, e.g. for a
+// client whose priority comes with its credentials.
+func WithPriority(ctx context.Context, priority limiter.Priority) context.Context {
+	return context.WithValue(ctx, priorityContextKey{}, priority)
+}
+
+// admissionTimeouts bounds the queue wait per priority; zero means no timeout.
+type admissionTimeouts struct {
+	high   time.Duration
+	normal time.Duration
+}
+
+// newAdmissionTimeouts reads the per-priority timeouts from cfg. A Config
+// that sets neither, e.g. one built by hand rather than by config.Load, gets
+// AdmissionTimeout for both.
+func newAdmissionTimeouts(cfg config.Config) admissionTimeouts {
+	if cfg.AdmissionTimeoutHigh == 0 && cfg.AdmissionTimeoutNormal == 0 {
+		return admissionTimeouts{high: cfg.AdmissionTimeout, normal: cfg.AdmissionTimeout}
+	}
+	return admissionTimeouts{high: cfg.AdmissionTimeoutHigh, normal: cfg.AdmissionTimeoutNormal}
+}
+
+func (t admissionTimeouts) forPriority(priority limiter.Priority) time.Duration {
+	if priority == limiter.PriorityHigh {
+		return t.high
+	}
+	return t.normal
+}
+
 func admissionMiddleware(
 	l *limiter.Limiter,
 	m *metrics.Collector,
-	timeout time.Duration,
+	timeouts admissionTimeouts,
+	bypassPrefixes []string,
+	trusted clientip.Trusted,
+	allowPriority bool,
 ) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Bypassed paths are proxied with the first key without being
+			// counted, paced or observed.
+			for _, prefix := range bypassPrefixes {
+				if strings.HasPrefix(r.URL.Path, prefix) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
 			info, ok := router.PathFromContext(r.Context())
 			if !ok {
 				http.Error(w, "invalid route context", http.StatusBadRequest)
 				return
 			}
 
+			// Without allowPriority every request queues and paces as normal,
+			// so X-Priority cannot jump the queue.
 			priority := limiter.PriorityNormal
-			if strings.EqualFold(r.Header.Get("X-Priority"), "high") {
-				priority = limiter.PriorityHigh
+			if fixed, ok := r.Context().Value(priorityContextKey{}).(limiter.Priority); ok {
+				priority = fixed
+			} else if allowPriority {
+				priority = requestPriority(r)
 			}
 
 			budgetID := strings.TrimSpace(r.Header.Get("X-Rate-Budget"))
@@ -71,9 +129,13 @@ func admissionMiddleware(
 				tokenIndex = &parsed
 			}
 
+			// Passthrough clients handle 429s themselves: they are never
+			// queued and upstream 429s reach them without a retry.
+			passthrough := strings.EqualFold(r.Header.Get(passthrough429Header), "true")
+
 			admitCtx := r.Context()
 			cancel := func() {}
-			if timeout > 0 {
+			if timeout := timeouts.forPriority(priority); timeout > 0 {
 				admitCtx, cancel = context.WithTimeout(admitCtx, timeout)
 			}
 			defer cancel()
@@ -85,6 +147,7 @@ func admissionMiddleware(
 				BudgetID:   budgetID,
 				Priority:   priority,
 				TokenIndex: tokenIndex,
+				NoWait:     passthrough,
 			})
 			waitDuration := time.Since(start)
 
@@ -108,13 +171,20 @@ func admissionMiddleware(
 						} else {
 							reason = "rejected_" + rejected.Reason
 						}
+						m.ObserveAdmissionRejected(rejected.Reason, priority.String())
 					} else if err == context.DeadlineExceeded || err == context.Canceled {
 						reason = "rejected_timeout"
+						m.ObserveAdmissionRejected("timeout", priority.String())
 					}
 					m.ObserveAdmissionResult(reason, info.Region, info.Bucket, priority.String(), budgetLabel)
 					m.ObserveQueueWait(info.Bucket, priority, budgetLabel, waitDuration)
 				}
-				log.Printf("admission_reject region=%s bucket=%s priority=%s err=%v", info.Region, info.Bucket, priority.String(), err)
+				log.Printf("admission_reject region=%s bucket=%s priority=%s client=%s err=%v", info.Region, info.Bucket, priority.String(), clientip.FromRequest(r, trusted), err)
+
+				if totalLatencyExceeded(r.Context()) {
+					http.Error(w, totalLatencyMessage, http.StatusGatewayTimeout)
+					return
+				}
 
 				retryAfter := time.Second
 				if rejected, ok := err.(*limiter.RejectedError); ok && rejected.RetryAfter > 0 {
@@ -122,29 +192,94 @@ func admissionMiddleware(
 				}
 
 				w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+				if rejected, ok := err.(*limiter.RejectedError); ok && rejected.Reason == "queue_full" {
+					w.Header().Set(queuePositionHeader, strconv.Itoa(rejected.QueueDepth))
+				}
+				if rejected, ok := err.(*limiter.RejectedError); ok && rejected.Reason == "all_keys_blocked" {
+					http.Error(w, "all API keys are rate limited by upstream", http.StatusServiceUnavailable)
+					return
+				}
+				if rejected, ok := err.(*limiter.RejectedError); ok && rejected.Reason == "no_available_key" {
+					http.Error(w, "no enabled API key for this request", http.StatusServiceUnavailable)
+					return
+				}
 				http.Error(w, "request rejected by admission control", http.StatusTooManyRequests)
 				return
 			}
 
+			// The client went away as the grant arrived. Nothing reaches
+			// upstream, so hand the window slot to the next request.
+			if r.Context().Err() != nil {
+				l.Release(ticket, info.Region, info.Bucket)
+				return
+			}
+
 			if m != nil {
 				m.ObserveQueueWait(info.Bucket, priority, budgetLabel, waitDuration)
 				m.ObserveAdmissionResult("allowed", info.Region, info.Bucket, priority.String(), budgetLabel)
 			}
 
 			ctx := withKeyIndex(r.Context(), ticket.KeyIndex)
+			if passthrough {
+				ctx = transport.WithoutRetry(ctx)
+			}
 			ctx = withAdmission(ctx, admissionContext{
-				Region:    info.Region,
-				Bucket:    info.Bucket,
-				BudgetID:  budgetLabel,
-				KeyIndex:  ticket.KeyIndex,
-				Priority:  priority.String(),
-				StartedAt: time.Now(), // Captured after admission so upstream_duration excludes queue wait
+				Region:        info.Region,
+				Bucket:        info.Bucket,
+				BudgetID:      budgetLabel,
+				KeyIndex:      ticket.KeyIndex,
+				TokenIndex:    tokenIndex,
+				Priority:      priority.String(),
+				StartedAt:     time.Now(), // Captured after admission so upstream_duration excludes queue wait
+				QueueWait:     waitDuration,
+				Paced:         ticket.Paced,
+				QueuePosition: ticket.QueuePosition,
 			})
 			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
+// queuePositionHeader reports how many requests were queued ahead.
+const queuePositionHeader = "X-RiftRelay-Queue-Position"
+
+// passthrough429Header opts a request out of queueing and 429 retries.
+const passthrough429Header = "X-RiftRelay-Passthrough-429"
+
+// priorityQueryParam is the query-string fallback for X-Priority, for clients
+// that cannot set headers. It is stripped before forwarding upstream.
+const priorityQueryParam = "_priority"
+
+// requestPriority reads X-Priority, falling back to ?_priority= when the
+// header is absent.
+func requestPriority(r *http.Request) limiter.Priority {
+	value := r.Header.Get("X-Priority")
+	if value == "" {
+		value = r.URL.Query().Get(priorityQueryParam)
+	}
+	if strings.EqualFold(value, "high") {
+		return limiter.PriorityHigh
+	}
+	return limiter.PriorityNormal
+}
+
+// stripQueryParam removes every occurrence of name from rawQuery, leaving the
+// other parameters and their encoding untouched.
+func stripQueryParam(rawQuery, name string) string {
+	if !strings.Contains(rawQuery, name) {
+		return rawQuery
+	}
+	kept := make([]string, 0, strings.Count(rawQuery, "&")+1)
+	for part := range strings.SplitSeq(rawQuery, "&") {
+		key, _, _ := strings.Cut(part, "=")
+		if unescaped, err := url.QueryUnescape(key); err == nil && unescaped == name {
+			continue
+		}
+		kept = append(kept, part)
+	}
+	return strings.Join(kept, "&")
+}
+
 func admissionBudgetLabel(budgetID string) string {
 	budgetID = strings.TrimSpace(budgetID)
 	if budgetID == "" {
@@ -1,12 +1,18 @@
 package proxy
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"testing/synctest"
 	"time"
 
+	"github.com/renja-g/RiftRelay/internal/config"
 	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/metrics"
 	"github.com/renja-g/RiftRelay/internal/router"
 )
 
@@ -40,7 +46,7 @@ func TestAdmissionMiddleware(t *testing.T) {
 			Bucket:       "europe:riot/account/v1/accounts/me",
 		}
 
-		handler := admissionMiddleware(l, nil, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			if got, ok := keyIndexFromContext(r.Context()); !ok || got != 0 {
 				t.Fatalf("keyIndexFromContext() = (%d, %v), want (0, true)", got, ok)
 			}
@@ -70,7 +76,7 @@ func TestAdmissionMiddleware(t *testing.T) {
 		t.Parallel()
 
 		l := newLimiter(t)
-		handler := admissionMiddleware(l, nil, time.Second)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
 			t.Fatal("downstream handler should not be called")
 		}))
 
@@ -94,7 +100,7 @@ func TestAdmissionMiddleware(t *testing.T) {
 		t.Parallel()
 
 		l := newLimiter(t)
-		handler := admissionMiddleware(l, nil, time.Second)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
 			t.Fatal("downstream handler should not be called")
 		}))
 
@@ -132,7 +138,7 @@ func TestAdmissionMiddleware(t *testing.T) {
 			_ = l.Close()
 		})
 
-		handler := admissionMiddleware(l, nil, time.Second)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			info, ok := admissionFromContext(r.Context())
 			if !ok {
 				t.Fatal("admissionFromContext() ok = false, want true")
@@ -163,7 +169,7 @@ func TestAdmissionMiddleware(t *testing.T) {
 		t.Parallel()
 
 		l := newLimiter(t)
-		handler := admissionMiddleware(l, nil, time.Second)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
 			t.Fatal("downstream handler should not be called")
 		}))
 
@@ -183,3 +189,427 @@ func TestAdmissionMiddleware(t *testing.T) {
 		}
 	})
 }
+
+func TestAdmissionMiddlewareAllKeysBlocked(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:             1,
+			QueueCapacity:        2,
+			DefaultAppLimits:     "20:1",
+			RejectWhenAllBlocked: true,
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		l.Observe(limiter.Observation{
+			Region:     "europe",
+			Bucket:     "europe:riot/account/v1/accounts/me",
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"7"}},
+		})
+		synctest.Wait()
+
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Minute, normal: time.Minute}, nil, nil, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("downstream handler should not be called")
+		}))
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req = req.WithContext(router.WithPath(req.Context(), router.PathInfo{
+			Region:       "europe",
+			UpstreamPath: "/riot/account/v1/accounts/me",
+			Bucket:       "europe:riot/account/v1/accounts/me",
+		}))
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusServiceUnavailable; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Retry-After"), "7"; got != want {
+			t.Fatalf("Retry-After = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestAdmissionMiddlewareRejectsWaitPastTimeout(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:           1,
+			QueueCapacity:      2,
+			DefaultAppLimits:   "20:1",
+			RejectPastDeadline: true,
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		l.Observe(limiter.Observation{
+			Region:     "europe",
+			Bucket:     "europe:riot/account/v1/accounts/me",
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"30"}},
+		})
+		synctest.Wait()
+
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: 10 * time.Second, normal: time.Minute}, nil, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func(priority string) (*httptest.ResponseRecorder, time.Duration) {
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.Header.Set("X-Priority", priority)
+			req = req.WithContext(router.WithPath(req.Context(), router.PathInfo{
+				Region:       "europe",
+				UpstreamPath: "/riot/account/v1/accounts/me",
+				Bucket:       "europe:riot/account/v1/accounts/me",
+			}))
+			rec := httptest.NewRecorder()
+			start := time.Now()
+			handler.ServeHTTP(rec, req)
+			return rec, time.Since(start)
+		}
+
+		// The 30s block outlasts the 10s high-priority timeout.
+		rec, elapsed := serve("high")
+		if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if elapsed != 0 {
+			t.Fatalf("rejection took %v, want immediate", elapsed)
+		}
+		if got, want := rec.Header().Get("Retry-After"), "30"; got != want {
+			t.Fatalf("Retry-After = %q, want %q", got, want)
+		}
+
+		// A normal request may wait a minute, so it queues out the block.
+		rec, elapsed = serve("normal")
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("normal status = %d, want %d", got, want)
+		}
+		if elapsed != 30*time.Second {
+			t.Fatalf("normal waited %v, want 30s", elapsed)
+		}
+	})
+}
+
+func TestAdmissionMiddlewarePriorityBypassToggle(t *testing.T) {
+	for _, tc := range []struct {
+		allowPriority bool
+		wantWait      time.Duration
+	}{
+		{allowPriority: true, wantWait: 0},
+		{allowPriority: false, wantWait: 100 * time.Millisecond},
+	} {
+		t.Run(fmt.Sprintf("allow=%t", tc.allowPriority), func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := limiter.New(limiter.Config{
+					KeyCount:         1,
+					QueueCapacity:    2,
+					DefaultAppLimits: "20:1",
+					MinSpacing:       100 * time.Millisecond,
+				})
+				if err != nil {
+					t.Fatalf("limiter.New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				var gotPriority string
+				handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, tc.allowPriority)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					info, _ := admissionFromContext(r.Context())
+					gotPriority = info.Priority
+					w.WriteHeader(http.StatusNoContent)
+				}))
+				serve := func(priority string) time.Duration {
+					req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+					req.Header.Set("X-Priority", priority)
+					req = req.WithContext(router.WithPath(req.Context(), router.PathInfo{
+						Region:       "europe",
+						UpstreamPath: "/riot/account/v1/accounts/me",
+						Bucket:       "europe:riot/account/v1/accounts/me",
+					}))
+					start := time.Now()
+					handler.ServeHTTP(httptest.NewRecorder(), req)
+					return time.Since(start)
+				}
+
+				serve("normal")
+				// Right behind a grant, only a bypass skips MinSpacing.
+				if got := serve("high"); got != tc.wantWait {
+					t.Fatalf("high-priority wait = %v, want %v", got, tc.wantWait)
+				}
+				if want := map[bool]string{true: "high", false: "normal"}[tc.allowPriority]; gotPriority != want {
+					t.Fatalf("admitted priority = %q, want %q", gotPriority, want)
+				}
+			})
+		})
+	}
+}
+
+func TestAdmissionMiddlewareRejectionReasonMetric(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:             1,
+			QueueCapacity:        1,
+			DefaultAppLimits:     "1:60",
+			RejectWhenAllBlocked: true,
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		collector := metrics.NewCollector()
+		handler := admissionMiddleware(l, collector, admissionTimeouts{high: time.Minute, normal: time.Minute}, nil, nil, true)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("downstream handler should not be called")
+		}))
+		var queuePosition string
+		serve := func(info router.PathInfo) int {
+			req := httptest.NewRequest(http.MethodGet, "/"+info.Region+info.UpstreamPath, nil)
+			req = req.WithContext(router.WithPath(req.Context(), info))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			queuePosition = rec.Header().Get("X-RiftRelay-Queue-Position")
+			return rec.Code
+		}
+
+		// Fill europe's queue: one grant uses the window, one request waits.
+		account := router.PathInfo{
+			Region:       "europe",
+			UpstreamPath: "/riot/account/v1/accounts/me",
+			Bucket:       "europe:riot/account/v1/accounts/me",
+		}
+		admission := limiter.Admission{Region: account.Region, Bucket: account.Bucket}
+		if _, err := l.Admit(context.Background(), admission); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+		go func() { _, _ = l.Admit(context.Background(), admission) }()
+		synctest.Wait()
+		if got, want := serve(account), http.StatusTooManyRequests; got != want {
+			t.Fatalf("queue full status = %d, want %d", got, want)
+		}
+		if got, want := queuePosition, "1"; got != want {
+			t.Fatalf("queue full X-RiftRelay-Queue-Position = %q, want %q", got, want)
+		}
+
+		status := router.PathInfo{
+			Region:       "euw1",
+			UpstreamPath: "/lol/status/v4/platform-data",
+			Bucket:       "euw1:lol/status/v4/platform-data",
+		}
+		l.Observe(limiter.Observation{
+			Region:     status.Region,
+			Bucket:     status.Bucket,
+			StatusCode: http.StatusTooManyRequests,
+			Header:     http.Header{"Retry-After": []string{"7"}},
+		})
+		synctest.Wait()
+		if got, want := serve(status), http.StatusServiceUnavailable; got != want {
+			t.Fatalf("all keys blocked status = %d, want %d", got, want)
+		}
+
+		scrape := httptest.NewRecorder()
+		collector.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := scrape.Body.String()
+		for _, want := range []string{
+			`riftrelay_admission_rejected_total{priority="normal",reason="queue_full"} 1`,
+			`riftrelay_admission_rejected_total{priority="normal",reason="all_keys_blocked"} 1`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Fatalf("metrics missing %q:\n%s", want, body)
+			}
+		}
+	})
+}
+
+func TestAdmissionMiddlewarePriorityQueryParam(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name   string
+		query  string
+		header string
+		want   string
+	}{
+		{name: "param only", query: "?_priority=high", want: "high"},
+		{name: "header only", header: "high", want: "high"},
+		{name: "header wins over param", query: "?_priority=high", header: "normal", want: "normal"},
+		{name: "neither", want: "normal"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := limiter.New(limiter.Config{
+				KeyCount:         1,
+				QueueCapacity:    2,
+				DefaultAppLimits: "20:1",
+			})
+			if err != nil {
+				t.Fatalf("limiter.New() error = %v", err)
+			}
+			t.Cleanup(func() { _ = l.Close() })
+
+			var got string
+			handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second, normal: time.Second}, nil, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				info, _ := admissionFromContext(r.Context())
+				got = info.Priority
+				w.WriteHeader(http.StatusNoContent)
+			}))
+
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me"+tt.query, nil)
+			if tt.header != "" {
+				req.Header.Set("X-Priority", tt.header)
+			}
+			req = req.WithContext(router.WithPath(req.Context(), router.PathInfo{
+				Region:       "europe",
+				UpstreamPath: "/riot/account/v1/accounts/me",
+				Bucket:       "europe:riot/account/v1/accounts/me",
+			}))
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+
+			if got != tt.want {
+				t.Fatalf("priority = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdmissionMiddlewareBypassPrefixes(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		admitted := 0
+		handler := admissionMiddleware(l, nil, admissionTimeouts{normal: time.Second}, []string{"/euw1/lol/status/"}, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := admissionFromContext(r.Context()); ok {
+				admitted++
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func(path string) int {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			info, err := router.ParsePath(req.URL.Path)
+			if err != nil {
+				t.Fatalf("ParsePath(%q) error = %v", path, err)
+			}
+			req = req.WithContext(router.WithPath(req.Context(), info))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec.Code
+		}
+
+		if got, want := serve("/euw1/lol/summoner/v4/summoners/me"), http.StatusNoContent; got != want {
+			t.Fatalf("first status = %d, want %d", got, want)
+		}
+		// The only token is spent, but bypassed paths do not need one.
+		for range 3 {
+			if got, want := serve("/euw1/lol/status/v4/platform-data"), http.StatusNoContent; got != want {
+				t.Fatalf("bypassed status = %d, want %d", got, want)
+			}
+		}
+		if got, want := serve("/euw1/lol/summoner/v4/summoners/me"), http.StatusTooManyRequests; got != want {
+			t.Fatalf("non-bypassed status = %d, want %d", got, want)
+		}
+		if admitted != 1 {
+			t.Fatalf("admitted = %d, want 1", admitted)
+		}
+	})
+}
+
+func TestAdmissionMiddlewarePriorityTimeouts(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		pathInfo := router.PathInfo{
+			Region:       "europe",
+			UpstreamPath: "/riot/account/v1/accounts/me",
+			Bucket:       "europe:riot/account/v1/accounts/me",
+		}
+		handler := admissionMiddleware(l, nil, admissionTimeouts{high: time.Second}, nil, nil, true)(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}))
+		serve := func(priority string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.Header.Set("X-Priority", priority)
+			req = req.WithContext(router.WithPath(req.Context(), pathInfo))
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			return rec
+		}
+
+		if rec := serve("high"); rec.Code != http.StatusNoContent {
+			t.Fatalf("first status = %d, want %d", rec.Code, http.StatusNoContent)
+		}
+
+		normalDone := make(chan int, 1)
+		go func() { normalDone <- serve("normal").Code }()
+
+		start := time.Now()
+		if rec := serve("high"); rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("high status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+		}
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Fatalf("high rejected after %v, want 1s", elapsed)
+		}
+
+		synctest.Wait()
+		select {
+		case code := <-normalDone:
+			t.Fatalf("normal finished early with status %d, want still waiting", code)
+		default:
+		}
+
+		if code := <-normalDone; code != http.StatusNoContent {
+			t.Fatalf("normal status = %d, want %d", code, http.StatusNoContent)
+		}
+	})
+}
+
+func TestNewAdmissionTimeouts(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		cfg  config.Config
+		want admissionTimeouts
+	}{
+		{
+			name: "per priority",
+			cfg:  config.Config{AdmissionTimeout: time.Minute, AdmissionTimeoutHigh: time.Second},
+			want: admissionTimeouts{high: time.Second},
+		},
+		{
+			name: "shared fallback",
+			cfg:  config.Config{AdmissionTimeout: time.Minute},
+			want: admissionTimeouts{high: time.Minute, normal: time.Minute},
+		},
+		{
+			name: "none",
+			cfg:  config.Config{},
+			want: admissionTimeouts{},
+		},
+	}
+	for _, tt := range tests {
+		if got := newAdmissionTimeouts(tt.cfg); got != tt.want {
+			t.Fatalf("%s: newAdmissionTimeouts() = %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestMaxRequestBodyBytes(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name       string
+		body       string
+		chunked    bool
+		wantStatus int
+		wantCalls  int32
+	}{
+		{name: "under limit", body: "0123456789", wantStatus: http.StatusNoContent, wantCalls: 1},
+		{name: "over limit", body: "0123456789a", wantStatus: http.StatusRequestEntityTooLarge},
+		{name: "chunked under limit", body: "0123456789", chunked: true, wantStatus: http.StatusNoContent, wantCalls: 1},
+		{name: "chunked over limit", body: "0123456789a", chunked: true, wantStatus: http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			l, err := limiter.New(limiter.Config{
+				KeyCount:         1,
+				QueueCapacity:    1,
+				DefaultAppLimits: "1:60",
+			})
+			if err != nil {
+				t.Fatalf("limiter.New() error = %v", err)
+			}
+			t.Cleanup(func() { _ = l.Close() })
+
+			var calls atomic.Int32
+			var gotBody string
+			cfg := testutil.DummyConfig()
+			cfg.UpstreamTimeout = 0
+			cfg.MaxRequestBodyBytes = 10
+			handler := New(cfg,
+				WithLimiter(l),
+				WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					calls.Add(1)
+					body, _ := io.ReadAll(r.Body)
+					gotBody = string(body)
+					resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+					resp.Request = r
+					return resp, nil
+				})),
+			)
+
+			req := httptest.NewRequest(http.MethodPost, "/americas/lol/tournament/v5/codes", strings.NewReader(tt.body))
+			if tt.chunked {
+				req.ContentLength = -1
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got, want := rec.Code, tt.wantStatus; got != want {
+				t.Fatalf("status = %d, want %d", got, want)
+			}
+			if got, want := calls.Load(), tt.wantCalls; got != want {
+				t.Fatalf("upstream calls = %d, want %d", got, want)
+			}
+			if tt.wantCalls > 0 {
+				if gotBody != tt.body {
+					t.Fatalf("upstream body = %q, want %q", gotBody, tt.body)
+				}
+				return
+			}
+
+			// The rejected request must not have used the only 1:60 slot.
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			admission := limiter.Admission{Region: "americas", Bucket: "americas:lol/tournament/v5/codes", Priority: limiter.PriorityHigh}
+			if _, err := l.Admit(ctx, admission); err != nil {
+				t.Fatalf("Admit() after rejection error = %v, want slot still free", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/router"
+)
+
+// circuitBreaker stops forwarding to a bucket after threshold consecutive
+// upstream 5xx responses within window. While open it answers 503 without
+// spending rate-limit budget; after cooldown one probe request is let
+// through, and its outcome closes or reopens the circuit.
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+
+	mu      sync.Mutex
+	buckets map[string]*breakerState
+}
+
+type breakerState struct {
+	failures     int
+	firstFailure time.Time
+	// openUntil is zero while the circuit is closed. Once it has passed the
+	// circuit is half-open and probeAfter gates the next probe.
+	openUntil  time.Time
+	probeAfter time.Time
+}
+
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		buckets:   make(map[string]*breakerState),
+	}
+}
+
+// allow reports whether a request for bucket may go upstream, and otherwise
+// how long the client should wait.
+func (b *circuitBreaker) allow(bucket string, now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.buckets[bucket]
+	if state == nil || state.openUntil.IsZero() {
+		return true, 0
+	}
+	if now.Before(state.openUntil) {
+		return false, state.openUntil.Sub(now)
+	}
+	// Half-open: one probe per cooldown, so a probe that never reports back
+	// cannot wedge the circuit.
+	if now.Before(state.probeAfter) {
+		return false, state.probeAfter.Sub(now)
+	}
+	state.probeAfter = now.Add(b.cooldown)
+	return true, 0
+}
+
+// record feeds an upstream status for bucket into the breaker.
+func (b *circuitBreaker) record(bucket string, status int, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state := b.buckets[bucket]
+	if status < 500 {
+		if state != nil {
+			delete(b.buckets, bucket)
+		}
+		return
+	}
+	if state == nil {
+		state = &breakerState{}
+		b.buckets[bucket] = state
+	}
+
+	if !state.openUntil.IsZero() {
+		if !now.Before(state.openUntil) {
+			// The half-open probe failed.
+			state.openUntil = now.Add(b.cooldown)
+			state.probeAfter = time.Time{}
+		}
+		return
+	}
+	if state.failures == 0 || now.Sub(state.firstFailure) > b.window {
+		state.failures = 0
+		state.firstFailure = now
+	}
+	state.failures++
+	if state.failures >= b.threshold {
+		state.openUntil = now.Add(b.cooldown)
+	}
+}
+
+func breakerMiddleware(b *circuitBreaker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, ok := router.PathFromContext(r.Context())
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if ok, retryAfter := b.allow(info.Bucket, time.Now()); !ok {
+				seconds := int((retryAfter + time.Second - 1) / time.Second)
+				w.Header().Set("Retry-After", strconv.Itoa(max(seconds, 1)))
+				http.Error(w, "upstream failing, circuit open", http.StatusServiceUnavailable)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,97 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		upstreamStatus := http.StatusInternalServerError
+		calls := 0
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithCircuitBreaker(3, 10*time.Second, 5*time.Second),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls++
+				resp := testutil.HTTPResponse(upstreamStatus, "", nil)
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		get := func(wantStatus, wantCalls int) *httptest.ResponseRecorder {
+			t.Helper()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil))
+			if got := rec.Code; got != wantStatus {
+				t.Fatalf("status = %d, want %d", got, wantStatus)
+			}
+			if calls != wantCalls {
+				t.Fatalf("upstream calls = %d, want %d", calls, wantCalls)
+			}
+			return rec
+		}
+
+		// Closed: failures pass through until the threshold.
+		get(http.StatusInternalServerError, 1)
+		get(http.StatusInternalServerError, 2)
+		get(http.StatusInternalServerError, 3)
+
+		// Open: short-circuited without reaching upstream.
+		rec := get(http.StatusServiceUnavailable, 3)
+		if got, want := rec.Header().Get("Retry-After"), "5"; got != want {
+			t.Fatalf("Retry-After = %q, want %q", got, want)
+		}
+
+		// Half-open: the probe fails and the circuit reopens.
+		time.Sleep(5 * time.Second)
+		get(http.StatusInternalServerError, 4)
+		get(http.StatusServiceUnavailable, 4)
+
+		// Half-open: the probe succeeds and the circuit closes.
+		time.Sleep(5 * time.Second)
+		upstreamStatus = http.StatusOK
+		get(http.StatusOK, 5)
+		get(http.StatusOK, 6)
+	})
+}
+
+func TestCircuitBreakerHalfOpenAllowsOneProbe(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(1, time.Minute, 5*time.Second)
+	b.record("euw1:lol/status/v4/platform-data", http.StatusBadGateway, now)
+
+	now = now.Add(5 * time.Second)
+	if ok, _ := b.allow("euw1:lol/status/v4/platform-data", now); !ok {
+		t.Fatal("first half-open allow() = false, want probe")
+	}
+	if ok, retryAfter := b.allow("euw1:lol/status/v4/platform-data", now); ok || retryAfter != 5*time.Second {
+		t.Fatalf("second half-open allow() = (%v, %v), want (false, 5s)", ok, retryAfter)
+	}
+	if ok, _ := b.allow("euw1:lol/champion-rotations/v3/champion-rotations", now); !ok {
+		t.Fatal("allow() for another bucket = false, want true")
+	}
+}
+
+func TestCircuitBreakerFailuresOutsideWindowDoNotOpen(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2026, 3, 22, 12, 0, 0, 0, time.UTC)
+	b := newCircuitBreaker(2, 10*time.Second, 5*time.Second)
+	b.record("euw1:lol/status/v4/platform-data", http.StatusInternalServerError, now)
+	now = now.Add(11 * time.Second)
+	b.record("euw1:lol/status/v4/platform-data", http.StatusInternalServerError, now)
+
+	if ok, _ := b.allow("euw1:lol/status/v4/platform-data", now); !ok {
+		t.Fatal("allow() = false, want failures outside the window to keep the circuit closed")
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/router"
+)
+
+// responseCache is a size-capped LRU of successful GET responses. Entries
+// expire after the TTL configured for their route pattern. Bodies are kept as
+// received, still compressed, and replayed with their Content-Encoding.
+type responseCache struct {
+	ttls     map[string]time.Duration
+	maxBytes int64
+	// staleOnError holds the patterns whose expired entries are kept to
+	// answer upstream failures.
+	staleOnError map[string]struct{}
+
+	mu      sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+type cachedResponse struct {
+	key      string
+	status   int
+	header   http.Header
+	body     []byte
+	storedAt time.Time
+	expires  time.Time
+	// keepStale keeps the entry past expires for serveStale.
+	keepStale bool
+}
+
+// newResponseCache keys ttls by route pattern without the leading slash,
+// e.g. "lol/status/v4/platform-data".
+func newResponseCache(ttls map[string]time.Duration, maxBytes int64) *responseCache {
+	return &responseCache{
+		ttls:     ttls,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func (c *responseCache) ttl(info router.PathInfo) time.Duration {
+	if info.Pattern == "" {
+		return 0
+	}
+	return c.ttls[strings.TrimPrefix(info.Pattern, "/")]
+}
+
+func (c *responseCache) keepsStale(info router.PathInfo) bool {
+	_, ok := c.staleOnError[strings.TrimPrefix(info.Pattern, "/")]
+	return ok
+}
+
+func (c *responseCache) get(key string, now time.Time) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cachedResponse)
+	if !now.Before(entry.expires) {
+		if !entry.keepStale {
+			c.removeLocked(elem)
+		}
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry, true
+}
+
+// getStale returns the entry for key whether or not it has expired.
+func (c *responseCache) getStale(key string) (*cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return elem.Value.(*cachedResponse), true
+}
+
+func (c *responseCache) put(entry *cachedResponse) {
+	size := int64(len(entry.body))
+	if size > c.maxBytes {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[entry.key]; ok {
+		c.removeLocked(elem)
+	}
+	for c.size+size > c.maxBytes {
+		c.removeLocked(c.lru.Back())
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	c.size += size
+}
+
+func (c *responseCache) removeLocked(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cachedResponse)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.body))
+}
+
+// cacheMiddleware serves fresh cached responses before admission, so hits
+// cost no rate-limit token. Cache-Control: no-cache from the client skips the
+// lookup and refreshes the entry; no-store bypasses the cache entirely. For
+// stale-on-error patterns, a 5xx is replaced by the last cached success, even
+// an expired one, marked with Warning: 110 and X-RiftRelay-Stale: true.
+func cacheMiddleware(cache *responseCache) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, ok := router.PathFromContext(r.Context())
+			if !ok || r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ttl := cache.ttl(info)
+			directives := strings.ToLower(r.Header.Get("Cache-Control"))
+			if ttl <= 0 || strings.Contains(directives, "no-store") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := info.Region + info.UpstreamPath + "?" + r.URL.RawQuery
+			now := time.Now()
+			if !strings.Contains(directives, "no-cache") {
+				if entry, ok := cache.get(key, now); ok {
+					writeCached(w, entry, now)
+					return
+				}
+			}
+
+			// Headers set by outer middleware (CORS, ...) belong to this
+			// request only and are left out of the entry.
+			outer := w.Header().Clone()
+			keepStale := cache.keepsStale(info)
+			var stale *cachedResponse
+			var guard *staleGuardWriter
+			dst := w
+			if keepStale {
+				if entry, ok := cache.getStale(key); ok {
+					stale = entry
+					guard = &staleGuardWriter{ResponseWriter: w}
+					dst = guard
+				}
+			}
+			// The cache never holds a body over maxBytes, so there is no
+			// point recording one.
+			capture := &captureWriter{ResponseWriter: dst, limit: cache.maxBytes, status: http.StatusOK}
+			next.ServeHTTP(capture, r)
+			if guard != nil && guard.failed {
+				serveStale(w, outer, stale, time.Now())
+				return
+			}
+			if capture.status < 200 || capture.status > 299 || capture.overflow || r.Context().Err() != nil {
+				return
+			}
+			header := headerDiff(capture.header, outer)
+			// Timings describe the request that filled the entry, not hits.
+			delete(header, "Server-Timing")
+			cache.put(&cachedResponse{
+				key:       key,
+				status:    capture.status,
+				header:    header,
+				body:      capture.body.Bytes(),
+				storedAt:  now,
+				expires:   now.Add(ttl),
+				keepStale: keepStale,
+			})
+		})
+	}
+}
+
+func writeCached(w http.ResponseWriter, entry *cachedResponse, now time.Time) {
+	for name, values := range entry.header {
+		w.Header()[name] = append([]string(nil), values...)
+	}
+	w.Header().Set("Age", strconv.Itoa(int(now.Sub(entry.storedAt).Seconds())))
+	w.WriteHeader(entry.status)
+	_, _ = w.Write(entry.body)
+}
+
+// serveStale answers with entry in place of a held-back upstream failure,
+// dropping the headers the failed attempt set.
+func serveStale(w http.ResponseWriter, outer http.Header, entry *cachedResponse, now time.Time) {
+	clear(w.Header())
+	for name, values := range outer {
+		w.Header()[name] = values
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("X-RiftRelay-Stale", "true")
+	writeCached(w, entry, now)
+}
+
+// staleGuardWriter passes a response through unless it is a 5xx, which it
+// swallows so a stale entry can be served instead.
+type staleGuardWriter struct {
+	http.ResponseWriter
+	failed      bool
+	wroteHeader bool
+}
+
+func (g *staleGuardWriter) WriteHeader(status int) {
+	if g.wroteHeader {
+		return
+	}
+	g.wroteHeader = true
+	if status >= 500 {
+		g.failed = true
+		return
+	}
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *staleGuardWriter) Write(b []byte) (int, error) {
+	if !g.wroteHeader {
+		g.WriteHeader(http.StatusOK)
+	}
+	if g.failed {
+		return len(b), nil
+	}
+	return g.ResponseWriter.Write(b)
+}
+
+func (g *staleGuardWriter) Flush() {
+	if flusher, ok := g.ResponseWriter.(http.Flusher); !g.failed && ok {
+		flusher.Flush()
+	}
+}
+
+// headerDiff returns the headers of h that base does not already carry.
+func headerDiff(h, base http.Header) http.Header {
+	out := make(http.Header, len(h))
+	for name, values := range h {
+		if strings.Join(base[name], "\x00") == strings.Join(values, "\x00") {
+			continue
+		}
+		out[name] = values
+	}
+	return out
+}
@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestResponseCache(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		// One token per minute: anything past the first request that reached
+		// admission would have to wait for the next window.
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var calls atomic.Int32
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.AdmissionTimeoutNormal = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithResponseCache(map[string]time.Duration{"lol/status/v4/platform-data": 30 * time.Second}, 1<<20),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				resp := testutil.HTTPResponse(http.StatusOK, "status", nil)
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		get := func(header http.Header) *httptest.ResponseRecorder {
+			t.Helper()
+			req := httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("status = %d, want %d", got, want)
+			}
+			if got, want := rec.Body.String(), "status"; got != want {
+				t.Fatalf("body = %q, want %q", got, want)
+			}
+			return rec
+		}
+
+		start := time.Now()
+		get(nil)
+		if got, want := calls.Load(), int32(1); got != want {
+			t.Fatalf("upstream calls after miss = %d, want %d", got, want)
+		}
+
+		time.Sleep(10 * time.Second)
+		rec := get(nil)
+		if got, want := calls.Load(), int32(1); got != want {
+			t.Fatalf("upstream calls after hit = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Age"), "10"; got != want {
+			t.Fatalf("Age = %q, want %q", got, want)
+		}
+		if elapsed := time.Since(start); elapsed != 10*time.Second {
+			t.Fatalf("elapsed = %v, want the hit served without admission", elapsed)
+		}
+
+		// no-cache goes upstream and therefore waits for the next token.
+		get(http.Header{"Cache-Control": []string{"no-cache"}})
+		if got, want := calls.Load(), int32(2); got != want {
+			t.Fatalf("upstream calls after no-cache = %d, want %d", got, want)
+		}
+
+		// The refreshed entry expires 30s after it was stored.
+		time.Sleep(31 * time.Second)
+		get(nil)
+		if got, want := calls.Load(), int32(3); got != want {
+			t.Fatalf("upstream calls after expiry = %d, want %d", got, want)
+		}
+	})
+}
+
+func TestResponseCacheKeepsBodiesOverSharedLimit(t *testing.T) {
+	t.Parallel()
+
+	body := strings.Repeat("x", maxSharedBody+1)
+	var calls atomic.Int32
+	cfg := testutil.DummyConfig()
+	handler := New(cfg,
+		WithResponseCache(map[string]time.Duration{"lol/status/v4/platform-data": time.Minute}, 2*maxSharedBody),
+		WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			resp := testutil.HTTPResponse(http.StatusOK, body, http.Header{"Content-Length": []string{strconv.Itoa(len(body))}})
+			resp.Request = r
+			return resp, nil
+		})),
+	)
+
+	for range 2 {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Body.Len(), len(body); got != want {
+			t.Fatalf("body length = %d, want %d", got, want)
+		}
+	}
+	if got, want := calls.Load(), int32(1); got != want {
+		t.Fatalf("upstream calls = %d, want %d", got, want)
+	}
+
+	// Over the cache's own limit the body is not stored, rather than stored
+	// empty.
+	small := New(cfg,
+		WithResponseCache(map[string]time.Duration{"lol/status/v4/platform-data": time.Minute}, int64(len(body)-1)),
+		WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			calls.Add(1)
+			resp := testutil.HTTPResponse(http.StatusOK, body, nil)
+			resp.Request = r
+			return resp, nil
+		})),
+	)
+	for range 2 {
+		rec := httptest.NewRecorder()
+		small.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil))
+		if got, want := rec.Body.Len(), len(body); got != want {
+			t.Fatalf("body length over the cache limit = %d, want %d", got, want)
+		}
+	}
+	if got, want := calls.Load(), int32(3); got != want {
+		t.Fatalf("upstream calls = %d, want %d", got, want)
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	t.Parallel()
+
+	cache := newResponseCache(map[string]time.Duration{"*": time.Minute}, 10)
+	now := time.Now()
+	put := func(key, body string) {
+		cache.put(&cachedResponse{key: key, status: http.StatusOK, body: []byte(body), storedAt: now, expires: now.Add(time.Minute)})
+	}
+
+	put("a", "aaaa")
+	put("b", "bbbb")
+	if _, ok := cache.get("a", now); !ok {
+		t.Fatal("get(a) miss, want hit")
+	}
+	put("c", "cccc")
+
+	if _, ok := cache.get("b", now); ok {
+		t.Fatal("get(b) hit, want least recently used entry evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := cache.get(key, now); !ok {
+			t.Fatalf("get(%s) miss, want hit", key)
+		}
+	}
+	put("huge", "01234567890")
+	if _, ok := cache.get("huge", now); ok {
+		t.Fatal("get(huge) hit, want bodies larger than the cache skipped")
+	}
+}
+
+func TestResponseCacheStaleOnError(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var upstreamErr error
+		upstreamStatus := http.StatusOK
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithResponseCache(map[string]time.Duration{
+				"lol/status/v4/platform-data":        30 * time.Second,
+				"lol/platform/v3/champion-rotations": 30 * time.Second,
+			}, 1<<20),
+			WithStaleOnError("/lol/status/v4/platform-data"),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if upstreamErr != nil {
+					return nil, upstreamErr
+				}
+				resp := testutil.HTTPResponse(upstreamStatus, "status", http.Header{"Content-Type": []string{"application/json"}})
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		get := func(path string) *httptest.ResponseRecorder {
+			t.Helper()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+			return rec
+		}
+
+		const stalePath = "/euw1/lol/status/v4/platform-data"
+		const plainPath = "/euw1/lol/platform/v3/champion-rotations"
+		get(stalePath)
+		get(plainPath)
+		time.Sleep(31 * time.Second)
+
+		for _, failure := range []struct {
+			name   string
+			err    error
+			status int
+		}{
+			{"connection error", errors.New("connection reset"), 0},
+			{"upstream 503", nil, http.StatusServiceUnavailable},
+		} {
+			upstreamErr, upstreamStatus = failure.err, failure.status
+
+			rec := get(stalePath)
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("%s: status = %d, want %d", failure.name, got, want)
+			}
+			if got, want := rec.Body.String(), "status"; got != want {
+				t.Fatalf("%s: body = %q, want %q", failure.name, got, want)
+			}
+			if got, want := rec.Header().Get("Warning"), `110 - "Response is Stale"`; got != want {
+				t.Fatalf("%s: Warning = %q, want %q", failure.name, got, want)
+			}
+			if got := rec.Header().Get("X-RiftRelay-Stale"); got != "true" {
+				t.Fatalf("%s: X-RiftRelay-Stale = %q, want true", failure.name, got)
+			}
+			if got, want := rec.Header().Get("Content-Type"), "application/json"; got != want {
+				t.Fatalf("%s: Content-Type = %q, want %q", failure.name, got, want)
+			}
+
+			// Patterns without stale-on-error still see the failure.
+			if rec := get(plainPath); rec.Code < 500 {
+				t.Fatalf("%s: status without stale-on-error = %d, want 5xx", failure.name, rec.Code)
+			}
+		}
+	})
+}
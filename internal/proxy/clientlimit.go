@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"hash/maphash"
+	"net/http"
+	"sync"
+
+	"github.com/renja-g/RiftRelay/internal/clientip"
+)
+
+const clientLimitShards = 32
+
+// clientLimiter caps in-flight requests per client IP so one client cannot
+// fill the admission queue. Counts are spread over shards to keep unrelated
+// clients off each other's lock.
+type clientLimiter struct {
+	limit   int
+	trusted clientip.Trusted
+	seed    maphash.Seed
+	shards  [clientLimitShards]clientShard
+}
+
+type clientShard struct {
+	mu       sync.Mutex
+	inflight map[string]int
+}
+
+func newClientLimiter(limit int, trusted clientip.Trusted) *clientLimiter {
+	c := &clientLimiter{
+		limit:   limit,
+		trusted: trusted,
+		seed:    maphash.MakeSeed(),
+	}
+	for i := range c.shards {
+		c.shards[i].inflight = make(map[string]int)
+	}
+	return c
+}
+
+func (c *clientLimiter) shard(ip string) *clientShard {
+	return &c.shards[maphash.String(c.seed, ip)%clientLimitShards]
+}
+
+// acquire reserves a slot for ip, reporting false when it already has limit
+// requests in flight.
+func (c *clientLimiter) acquire(ip string) bool {
+	shard := c.shard(ip)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.inflight[ip] >= c.limit {
+		return false
+	}
+	shard.inflight[ip]++
+	return true
+}
+
+func (c *clientLimiter) release(ip string) {
+	shard := c.shard(ip)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if shard.inflight[ip] <= 1 {
+		delete(shard.inflight, ip)
+		return
+	}
+	shard.inflight[ip]--
+}
+
+// clientLimitMiddleware answers 429 before admission for clients that already
+// have their share of requests in flight.
+func clientLimitMiddleware(c *clientLimiter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientip.FromRequest(r, c.trusted)
+			if !c.acquire(ip) {
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "too many concurrent requests from client", http.StatusTooManyRequests)
+				return
+			}
+			defer c.release(ip)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestClientConcurrencyLimit(t *testing.T) {
+	t.Parallel()
+
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+	handler := New(cfg,
+		WithClientConcurrencyLimit(2),
+		WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			started <- struct{}{}
+			<-release
+			resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+			resp.Request = r
+			return resp, nil
+		})),
+	)
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/na1/lol/status/v4/platform-data", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	var wg sync.WaitGroup
+	statuses := make(chan int, 3)
+	for _, addr := range []string{"192.0.2.1:1000", "192.0.2.1:1001", "192.0.2.2:1000"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses <- serve(addr).Code
+		}()
+	}
+	for range 3 {
+		<-started
+	}
+
+	// Both of 192.0.2.1's slots are taken; 192.0.2.2 has its own.
+	rec := serve("192.0.2.1:1002")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("over-limit status = %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("Retry-After = %q, want 1", got)
+	}
+
+	close(release)
+	wg.Wait()
+	close(statuses)
+	for status := range statuses {
+		if status != http.StatusNoContent {
+			t.Fatalf("within-limit status = %d, want %d", status, http.StatusNoContent)
+		}
+	}
+
+	// Finished requests give their slots back.
+	if rec := serve("192.0.2.1:1003"); rec.Code != http.StatusNoContent {
+		t.Fatalf("status after release = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+}
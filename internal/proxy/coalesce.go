@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/router"
+)
+
+// flightGroup tracks in-flight upstream calls so identical concurrent
+// requests can share one admission and one response.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+	// abandoned is set when the leader's client went away, so the response
+	// may be truncated, or when the body outgrew maxSharedBody; either way
+	// waiters must make their own call.
+	abandoned bool
+}
+
+// maxSharedBody caps the response a leader keeps for its waiters. Larger
+// responses still reach the leader's client but are not replayed.
+const maxSharedBody = 8 << 20
+
+// flightKey identifies requests that may share an upstream call: besides the
+// URL, everything that changes how the call is admitted or which key pays for
+// it has to match.
+func flightKey(r *http.Request, info router.PathInfo) string {
+	priority := r.Header.Get("X-Priority")
+	if fixed, ok := r.Context().Value(priorityContextKey{}).(limiter.Priority); ok {
+		priority = "fixed:" + fixed.String()
+	}
+	return strings.Join([]string{
+		r.Method + " " + info.Region + info.UpstreamPath + "?" + r.URL.RawQuery,
+		priority,
+		r.Header.Get("X-Rate-Budget"),
+		r.Header.Get("X-Riot-Token-Index"),
+		r.Header.Get(passthrough429Header),
+	}, "\x00")
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{calls: make(map[string]*flightCall)}
+}
+
+// join returns the call for key and whether the caller leads it.
+func (g *flightGroup) join(key string) (*flightCall, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if call, ok := g.calls[key]; ok {
+		return call, false
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	return call, true
+}
+
+func (g *flightGroup) finish(key string, call *flightCall) {
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	close(call.done)
+}
+
+// coalesceMiddleware lets one identical GET go through admission while the
+// others wait for its response. shouldCoalesce decides per route whether
+// sharing is worthwhile, e.g. only while a bucket's limits are unknown.
+// Whatever the leader gets, including an upstream error, is replayed to every
+// waiter; a panicking leader turns into a 500 for them.
+func coalesceMiddleware(group *flightGroup, shouldCoalesce func(router.PathInfo) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			info, ok := router.PathFromContext(r.Context())
+			if !ok || r.Method != http.MethodGet || !shouldCoalesce(info) {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := flightKey(r, info)
+			call, leader := group.join(key)
+			if leader {
+				capture := &captureWriter{ResponseWriter: w, limit: maxSharedBody, status: http.StatusOK}
+				panicked := true
+				defer func() {
+					switch {
+					case panicked:
+						call.status = http.StatusInternalServerError
+						call.header = http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}}
+						call.body = []byte("internal server error\n")
+					case r.Context().Err() != nil, capture.overflow:
+						call.abandoned = true
+					default:
+						call.status = capture.status
+						call.header = capture.header
+						call.body = capture.body.Bytes()
+					}
+					group.finish(key, call)
+				}()
+				next.ServeHTTP(capture, r)
+				panicked = false
+				return
+			}
+
+			select {
+			case <-call.done:
+			case <-r.Context().Done():
+				return
+			}
+			if call.abandoned {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for name, values := range call.header {
+				w.Header()[name] = append([]string(nil), values...)
+			}
+			w.WriteHeader(call.status)
+			_, _ = w.Write(call.body)
+		})
+	}
+}
+
+// captureWriter forwards to the leader's client while recording the response
+// for the waiters. A body longer than limit is not kept and sets overflow.
+type captureWriter struct {
+	http.ResponseWriter
+	limit       int64
+	status      int
+	header      http.Header
+	body        bytes.Buffer
+	overflow    bool
+	wroteHeader bool
+}
+
+func (c *captureWriter) WriteHeader(status int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.status = status
+		c.header = c.ResponseWriter.Header().Clone()
+	}
+	c.ResponseWriter.WriteHeader(status)
+}
+
+func (c *captureWriter) Write(b []byte) (int, error) {
+	if !c.wroteHeader {
+		c.WriteHeader(http.StatusOK)
+	}
+	if !c.overflow {
+		if int64(c.body.Len()+len(b)) > c.limit {
+			c.overflow = true
+			c.body = bytes.Buffer{}
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+func (c *captureWriter) Flush() {
+	if flusher, ok := c.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
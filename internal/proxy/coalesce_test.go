@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestColdStartCoalescing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    8,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var calls atomic.Int32
+		release := make(chan struct{})
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithColdStartCoalescing(),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				<-release
+				resp := testutil.HTTPResponse(http.StatusOK, "summoner", http.Header{"X-Test": []string{"shared"}})
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		const n = 4
+		start := time.Now()
+		recs := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := range recs {
+			recs[i] = httptest.NewRecorder()
+			wg.Go(func() {
+				req := httptest.NewRequest(http.MethodGet, "/euw1/lol/summoner/v4/summoners/by-puuid/abc", nil)
+				handler.ServeHTTP(recs[i], req)
+			})
+		}
+		synctest.Wait()
+		close(release)
+		wg.Wait()
+
+		if got, want := calls.Load(), int32(1); got != want {
+			t.Fatalf("upstream calls = %d, want %d", got, want)
+		}
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("elapsed = %v, want duplicates served without waiting for another slot", elapsed)
+		}
+		for i, rec := range recs {
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("response %d status = %d, want %d", i, got, want)
+			}
+			if got, want := rec.Body.String(), "summoner"; got != want {
+				t.Fatalf("response %d body = %q, want %q", i, got, want)
+			}
+			if got, want := rec.Header().Get("X-Test"), "shared"; got != want {
+				t.Fatalf("response %d X-Test = %q, want %q", i, got, want)
+			}
+		}
+	})
+}
+
+func TestRequestCoalescing(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    16,
+			DefaultAppLimits: "100:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var calls atomic.Int32
+		release := make(chan struct{})
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithRequestCoalescing(),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				<-release
+				return nil, errors.New("upstream down")
+			})),
+		)
+
+		const n = 8
+		recs := make([]*httptest.ResponseRecorder, n)
+		var wg sync.WaitGroup
+		for i := range recs {
+			recs[i] = httptest.NewRecorder()
+			wg.Go(func() {
+				req := httptest.NewRequest(http.MethodGet, "/euw1/lol/summoner/v4/summoners/by-puuid/abc", nil)
+				handler.ServeHTTP(recs[i], req)
+			})
+		}
+		synctest.Wait()
+		close(release)
+		wg.Wait()
+
+		if got, want := calls.Load(), int32(1); got != want {
+			t.Fatalf("upstream calls = %d, want %d", got, want)
+		}
+		for i, rec := range recs {
+			if got, want := rec.Code, http.StatusBadGateway; got != want {
+				t.Fatalf("response %d status = %d, want %d", i, got, want)
+			}
+		}
+	})
+}
+
+func TestRequestCoalescingKeepsPinnedRequestsApart(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         2,
+			QueueCapacity:    16,
+			DefaultAppLimits: "100:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var calls atomic.Int32
+		release := make(chan struct{})
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.Tokens = []string{"key-a", "key-b"}
+		handler := New(cfg,
+			WithLimiter(l),
+			WithRequestCoalescing(),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				<-release
+				resp := testutil.HTTPResponse(http.StatusOK, r.Header.Get("X-Riot-Token"), nil)
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		headers := []http.Header{
+			{"X-Riot-Token-Index": {"0"}},
+			{"X-Riot-Token-Index": {"1"}},
+			{"X-Riot-Token-Index": {"1"}},
+			{"X-Priority": {"high"}},
+			{"X-Priority": {"high"}, "X-Riftrelay-Passthrough-429": {"true"}},
+		}
+		recs := make([]*httptest.ResponseRecorder, len(headers))
+		var wg sync.WaitGroup
+		for i := range recs {
+			recs[i] = httptest.NewRecorder()
+			wg.Go(func() {
+				req := httptest.NewRequest(http.MethodGet, "/euw1/lol/summoner/v4/summoners/by-puuid/abc", nil)
+				req.Header = headers[i]
+				handler.ServeHTTP(recs[i], req)
+			})
+		}
+		synctest.Wait()
+		close(release)
+		wg.Wait()
+
+		if got, want := calls.Load(), int32(len(headers)-1); got != want {
+			t.Fatalf("upstream calls = %d, want %d", got, want)
+		}
+		for i, want := range []string{"key-a", "key-b", "key-b"} {
+			if got := recs[i].Body.String(); got != want {
+				t.Fatalf("response %d served with %q, want %q", i, got, want)
+			}
+		}
+	})
+}
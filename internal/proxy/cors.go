@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete}
+	defaultCORSHeaders = []string{"Content-Type", "X-Priority", "X-Rate-Budget", "X-Riot-Token-Index", "X-RiftRelay-Passthrough-429", "Authorization", "X-RiftRelay-Key"}
+)
+
+// CORSConfig configures cross-origin access for browser clients.
+type CORSConfig struct {
+	// AllowedOrigins lists exact origins, or "*" to allow any origin.
+	AllowedOrigins []string
+	AllowedMethods []string
+	AllowedHeaders []string
+	MaxAge         time.Duration
+}
+
+func corsMiddleware(cfg CORSConfig) func(http.Handler) http.Handler {
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+
+	allowAny := false
+	origins := make(map[string]struct{}, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		origin = strings.TrimSpace(origin)
+		if origin == "*" {
+			allowAny = true
+		}
+		origins[origin] = struct{}{}
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			_, allowed := origins[origin]
+			allowed = allowed || allowAny
+			preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+			w.Header().Add("Vary", "Origin")
+			if allowed {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			// Preflights never reach admission, so they cost no rate-limit budget.
+			if preflight {
+				if !allowed {
+					w.WriteHeader(http.StatusForbidden)
+					return
+				}
+				w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+				if cfg.MaxAge > 0 {
+					w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(cfg.MaxAge.Seconds())))
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
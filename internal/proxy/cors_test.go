@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestCORS(t *testing.T) {
+	t.Parallel()
+
+	newHandler := func(t *testing.T, calls *atomic.Int32) http.Handler {
+		t.Helper()
+
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    1,
+			DefaultAppLimits: "1:60",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		t.Cleanup(func() { _ = l.Close() })
+
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		return New(cfg,
+			WithLimiter(l),
+			WithCORS(CORSConfig{AllowedOrigins: []string{"https://dash.example"}}),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+	}
+
+	t.Run("answers preflight without admission or upstream", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		handler := newHandler(t, &calls)
+
+		req := httptest.NewRequest(http.MethodOptions, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("Origin", "https://dash.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		req.Header.Set("Access-Control-Request-Headers", "X-Priority")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Access-Control-Allow-Origin"), "https://dash.example"; got != want {
+			t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, want)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Headers"); !strings.Contains(got, "X-Priority") {
+			t.Fatalf("Access-Control-Allow-Headers = %q, want X-Priority", got)
+		}
+		if got := calls.Load(); got != 0 {
+			t.Fatalf("upstream calls = %d, want 0", got)
+		}
+
+		// The single 1:60 slot must still be available after the preflight.
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		get := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil).WithContext(ctx)
+		getRec := httptest.NewRecorder()
+		handler.ServeHTTP(getRec, get)
+		if got, want := getRec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status after preflight = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("sets allow origin on actual request", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		handler := newHandler(t, &calls)
+
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("Origin", "https://dash.example")
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Access-Control-Allow-Origin"), "https://dash.example"; got != want {
+			t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, want)
+		}
+		if got, want := calls.Load(), int32(1); got != want {
+			t.Fatalf("upstream calls = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("rejects preflight from unknown origin", func(t *testing.T) {
+		t.Parallel()
+
+		var calls atomic.Int32
+		handler := newHandler(t, &calls)
+
+		req := httptest.NewRequest(http.MethodOptions, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("Origin", "https://evil.example")
+		req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusForbidden; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Fatalf("Access-Control-Allow-Origin = %q, want empty", got)
+		}
+	})
+}
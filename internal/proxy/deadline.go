@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+)
+
+const totalLatencyMessage = "request exceeded MAX_TOTAL_LATENCY"
+
+var errTotalLatencyExceeded = errors.New("max total latency exceeded")
+
+// totalLatencyMiddleware gives each request one deadline covering admission,
+// the upstream call and every retry, so queueing and 429 retries cannot add up
+// past maxLatency.
+func totalLatencyMiddleware(maxLatency time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeoutCause(r.Context(), maxLatency, errTotalLatencyExceeded)
+			defer cancel()
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// totalLatencyExceeded reports whether ctx ended on the MAX_TOTAL_LATENCY
+// deadline rather than a stage's own timeout or the client going away.
+func totalLatencyExceeded(ctx context.Context) bool {
+	return errors.Is(context.Cause(ctx), errTotalLatencyExceeded)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/renja-g/RiftRelay/internal/testutil"
+)
+
+func TestReadResponseBody(t *testing.T) {
+	t.Parallel()
+
+	const plain = `{"id":"EUW1","name":"EU West"}`
+	compress := func(newWriter func(io.Writer) io.WriteCloser) []byte {
+		var buf bytes.Buffer
+		w := newWriter(&buf)
+		_, _ = w.Write([]byte(plain))
+		_ = w.Close()
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "identity", body: []byte(plain)},
+		{name: "gzip", encoding: "gzip", body: compress(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) })},
+		{name: "zlib deflate", encoding: "deflate", body: compress(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) })},
+		{name: "raw deflate", encoding: "deflate", body: compress(func(w io.Writer) io.WriteCloser {
+			fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+			return fw
+		})},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			resp := testutil.HTTPResponseBytes(http.StatusOK, tt.body, http.Header{"Content-Encoding": []string{tt.encoding}})
+			got, err := readResponseBody(resp)
+			if err != nil {
+				t.Fatalf("readResponseBody() error = %v", err)
+			}
+			if string(got) != plain {
+				t.Fatalf("readResponseBody() = %q, want %q", got, plain)
+			}
+			forwarded, _ := io.ReadAll(resp.Body)
+			if !bytes.Equal(forwarded, tt.body) {
+				t.Fatal("resp.Body no longer holds the original encoded bytes")
+			}
+		})
+	}
+
+	t.Run("unsupported encoding", func(t *testing.T) {
+		t.Parallel()
+
+		resp := testutil.HTTPResponse(http.StatusOK, "data", http.Header{"Content-Encoding": []string{"br"}})
+		if _, err := readResponseBody(resp); err == nil {
+			t.Fatal("readResponseBody() error = nil, want unsupported encoding")
+		}
+	})
+}
+
+func TestProxyPassesGzipBodyThrough(t *testing.T) {
+	t.Parallel()
+
+	const plain = `{"id":"EUW1","name":"EU West"}`
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, _ = zw.Write([]byte(plain))
+	_ = zw.Close()
+	compressed := buf.Bytes()
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+	handler := New(cfg, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		resp := testutil.HTTPResponseBytes(http.StatusOK, compressed, http.Header{
+			"Content-Encoding": []string{"gzip"},
+			"Content-Type":     []string{"application/json;charset=utf-8"},
+		})
+		resp.Request = r
+		return resp, nil
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Encoding"), "gzip"; got != want {
+		t.Fatalf("Content-Encoding = %q, want %q", got, want)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), compressed) {
+		t.Fatal("client body differs from the upstream gzip bytes")
+	}
+	decoded, err := readResponseBody(&http.Response{Header: rec.Header(), Body: io.NopCloser(bytes.NewReader(rec.Body.Bytes()))})
+	if err != nil {
+		t.Fatalf("readResponseBody() error = %v", err)
+	}
+	if string(decoded) != plain {
+		t.Fatalf("decoded body = %q, want %q", decoded, plain)
+	}
+}
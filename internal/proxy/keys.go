@@ -0,0 +1,25 @@
+package proxy
+
+import "sync/atomic"
+
+// Keys holds the Riot API keys requests are sent with, indexed like the
+// limiter's keys. Store swaps them while serving, e.g. after a rotation.
+type Keys struct {
+	tokens atomic.Pointer[[]string]
+}
+
+func NewKeys(tokens []string) *Keys {
+	k := &Keys{}
+	k.Store(tokens)
+	return k
+}
+
+// Load returns the current keys. The slice must not be modified.
+func (k *Keys) Load() []string {
+	return *k.tokens.Load()
+}
+
+func (k *Keys) Store(tokens []string) {
+	tokens = append([]string(nil), tokens...)
+	k.tokens.Store(&tokens)
+}
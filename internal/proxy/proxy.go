@@ -4,12 +4,16 @@ import (
 	"context"
 	"errors"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
 	"github.com/renja-g/RiftRelay/internal/config"
 	"github.com/renja-g/RiftRelay/internal/limiter"
 	"github.com/renja-g/RiftRelay/internal/metrics"
@@ -30,11 +34,29 @@ func (p bufferPool) Put(b []byte) {
 }
 
 type options struct {
-	baseTransport http.RoundTripper
-	limiter       *limiter.Limiter
-	metrics       *metrics.Collector
-	admitTimeout  time.Duration
-	apiTokens     []string
+	baseTransport   http.RoundTripper
+	limiter         *limiter.Limiter
+	metrics         *metrics.Collector
+	admitTimeouts   admissionTimeouts
+	keys            *Keys
+	cors            *CORSConfig
+	coalesceCold    bool
+	coalesceAll     bool
+	stripHeaders    []string
+	stripResponse   []string
+	allowResponse   map[string]struct{}
+	maxBodyBytes    int64
+	maxTotalLatency time.Duration
+	minRetryDelay   time.Duration
+	regionHosts     map[string]string
+	cache           *responseCache
+	staleOnError    []string
+	pacingHeaders   bool
+	breaker         *circuitBreaker
+	admitBypass     []string
+	clientLimit     int
+	trusted         clientip.Trusted
+	forwardClientIP bool
 }
 
 type Option func(*options)
@@ -47,6 +69,14 @@ func WithBaseTransport(rt http.RoundTripper) Option {
 	}
 }
 
+// WithKeys sends requests with keys instead of a fixed copy of cfg.Tokens, so
+// that storing new ones takes effect immediately.
+func WithKeys(keys *Keys) Option {
+	return func(o *options) {
+		o.keys = keys
+	}
+}
+
 func WithLimiter(l *limiter.Limiter) Option {
 	return func(o *options) {
 		o.limiter = l
@@ -59,34 +89,278 @@ func WithMetrics(m *metrics.Collector) Option {
 	}
 }
 
+// WithCORS answers browser preflight requests and sets CORS headers for the
+// configured origins.
+func WithCORS(cfg CORSConfig) Option {
+	return func(o *options) {
+		o.cors = &cfg
+	}
+}
+
+// WithColdStartCoalescing shares one admission and upstream call between
+// identical concurrent GETs while the bucket's limits are still unknown.
+func WithColdStartCoalescing() Option {
+	return func(o *options) {
+		o.coalesceCold = true
+	}
+}
+
+// WithRequestCoalescing shares one admission and upstream call between all
+// identical concurrent GETs, keyed by method, region, path and query.
+func WithRequestCoalescing() Option {
+	return func(o *options) {
+		o.coalesceAll = true
+	}
+}
+
+// WithStrippedHeaders removes the named client headers, e.g. Authorization,
+// before the request is forwarded. X-Riot-Token is always replaced.
+func WithStrippedHeaders(names ...string) Option {
+	return func(o *options) {
+		o.stripHeaders = append(o.stripHeaders, names...)
+	}
+}
+
+// WithStrippedResponseHeaders removes the named upstream headers, e.g. Riot's
+// X-App-Rate-Limit, from responses. The limiter still observes them.
+func WithStrippedResponseHeaders(names ...string) Option {
+	return func(o *options) {
+		o.stripResponse = append(o.stripResponse, names...)
+	}
+}
+
+// WithAllowedResponseHeaders passes only the named upstream headers, plus
+// those needed to read the body and Retry-After, on to clients. It takes
+// precedence over WithStrippedResponseHeaders. The limiter still observes every
+// header, and RiftRelay's own headers are always sent.
+func WithAllowedResponseHeaders(names ...string) Option {
+	return func(o *options) {
+		if o.allowResponse == nil {
+			o.allowResponse = make(map[string]struct{}, len(names)+len(requiredResponseHeaders))
+			for _, name := range requiredResponseHeaders {
+				o.allowResponse[name] = struct{}{}
+			}
+		}
+		for _, name := range names {
+			o.allowResponse[http.CanonicalHeaderKey(name)] = struct{}{}
+		}
+	}
+}
+
+// requiredResponseHeaders survive WithAllowedResponseHeaders.
+var requiredResponseHeaders = []string{"Content-Type", "Content-Length", "Content-Encoding", "Retry-After"}
+
+// clientHeader returns the upstream headers the client may see. The upstream
+// map itself is left alone for the limiter.
+func (o *options) clientHeader(upstream http.Header) http.Header {
+	switch {
+	case o.allowResponse != nil:
+		out := make(http.Header, len(o.allowResponse))
+		for name, values := range upstream {
+			if _, ok := o.allowResponse[name]; ok {
+				out[name] = values
+			}
+		}
+		return out
+	case len(o.stripResponse) > 0:
+		out := upstream.Clone()
+		for _, name := range o.stripResponse {
+			out.Del(name)
+		}
+		return out
+	}
+	return upstream
+}
+
+// WithResponseCache caches successful GET responses for the route patterns in
+// ttls (keyed without the leading slash) in front of admission, holding at
+// most maxBytes of response bodies.
+func WithResponseCache(ttls map[string]time.Duration, maxBytes int64) Option {
+	return func(o *options) {
+		if len(ttls) > 0 && maxBytes > 0 {
+			o.cache = newResponseCache(ttls, maxBytes)
+		}
+	}
+}
+
+// WithStaleOnError answers a 5xx or failed upstream call for these route
+// patterns with the last cached success, even an expired one. Patterns need a
+// WithResponseCache TTL.
+func WithStaleOnError(patterns ...string) Option {
+	return func(o *options) {
+		o.staleOnError = append(o.staleOnError, patterns...)
+	}
+}
+
+// WithPacingHeaders adds X-RiftRelay-* headers describing the admission
+// decision to proxied responses.
+func WithPacingHeaders() Option {
+	return func(o *options) {
+		o.pacingHeaders = true
+	}
+}
+
+// WithCircuitBreaker stops forwarding to a bucket for cooldown after threshold
+// consecutive upstream 5xx responses within window, answering 503 instead.
+func WithCircuitBreaker(threshold int, window, cooldown time.Duration) Option {
+	return func(o *options) {
+		if threshold > 0 && cooldown > 0 {
+			o.breaker = newCircuitBreaker(threshold, window, cooldown)
+		}
+	}
+}
+
+// WithAdmissionBypass forwards requests whose path starts with one of prefixes
+// without admission, so they consume no rate-limit token.
+func WithAdmissionBypass(prefixes ...string) Option {
+	return func(o *options) {
+		for _, prefix := range prefixes {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				o.admitBypass = append(o.admitBypass, "/"+strings.TrimPrefix(prefix, "/"))
+			}
+		}
+	}
+}
+
+// WithClientConcurrencyLimit answers 429 before admission once a client IP has
+// limit requests in flight.
+func WithClientConcurrencyLimit(limit int) Option {
+	return func(o *options) {
+		o.clientLimit = limit
+	}
+}
+
+// WithTrustedProxies identifies clients by X-Forwarded-For when the request
+// comes from one of trusted, for per-client limits and logs.
+func WithTrustedProxies(trusted clientip.Trusted) Option {
+	return func(o *options) {
+		o.trusted = trusted
+	}
+}
+
+// WithClientIPForwarding sets X-Forwarded-For and X-Real-IP on upstream
+// requests, for deployments that chain RiftRelay in front of their own
+// service. An X-Forwarded-For chain is kept only from a trusted proxy.
+// Without it the client address never leaves the relay.
+func WithClientIPForwarding() Option {
+	return func(o *options) {
+		o.forwardClientIP = true
+	}
+}
+
 // New constructs the reverse proxy handler.
 func New(cfg config.Config, opts ...Option) http.Handler {
 	o := options{
-		baseTransport: transport.New(),
-		admitTimeout:  cfg.AdmissionTimeout,
-		apiTokens:     cfg.Tokens,
+		baseTransport:   transport.New(cfg.Upstream),
+		admitTimeouts:   newAdmissionTimeouts(cfg),
+		maxBodyBytes:    int64(cfg.MaxRequestBodyBytes),
+		maxTotalLatency: cfg.MaxTotalLatency,
+		minRetryDelay:   cfg.MinRetryDelay,
+		regionHosts:     cfg.RegionHostOverrides,
 	}
 	for _, opt := range opts {
 		opt(&o)
 	}
+	if o.keys == nil {
+		o.keys = NewKeys(cfg.Tokens)
+	}
 
 	o.baseTransport = transport.WithRequestTimeout(o.baseTransport, cfg.UpstreamTimeout)
-	o.baseTransport = transport.WithRetryAfter429(o.baseTransport, 3)
+	var retryObserver transport.RetryObserver
+	if o.metrics != nil {
+		retryObserver = retryMetrics{collector: o.metrics}
+	}
+	var retryGate transport.RetryGate
+	if o.limiter != nil {
+		retryGate = o.readmitRetry
+	}
+	o.baseTransport = transport.WithRetryAfter429(o.baseTransport, 3, o.minRetryDelay, o.observeRetry, retryObserver, retryGate)
+	if o.limiter != nil {
+		o.baseTransport = currentKeyTransport{keys: o.keys, readmit: o.readmitRetry, next: o.baseTransport}
+	}
 
 	rp := newReverseProxy(o)
 	handler := http.Handler(rp)
 
 	if o.limiter != nil {
-		handler = admissionMiddleware(o.limiter, o.metrics, o.admitTimeout)(handler)
+		handler = admissionMiddleware(o.limiter, o.metrics, o.admitTimeouts, o.admitBypass, o.trusted, cfg.AllowPriorityBypass)(handler)
+	}
+	if o.breaker != nil {
+		// Ahead of admission so short-circuited requests cost no budget.
+		handler = breakerMiddleware(o.breaker)(handler)
+	}
+	if o.limiter != nil {
+		switch {
+		case o.coalesceAll:
+			always := func(router.PathInfo) bool { return true }
+			handler = coalesceMiddleware(newFlightGroup(), always)(handler)
+		case o.coalesceCold:
+			coldStart := func(info router.PathInfo) bool { return o.limiter.ColdStart(info.Bucket) }
+			handler = coalesceMiddleware(newFlightGroup(), coldStart)(handler)
+		}
+	}
+	if o.cache != nil {
+		for _, pattern := range o.staleOnError {
+			if o.cache.staleOnError == nil {
+				o.cache.staleOnError = make(map[string]struct{}, len(o.staleOnError))
+			}
+			o.cache.staleOnError[strings.TrimPrefix(pattern, "/")] = struct{}{}
+		}
+		handler = cacheMiddleware(o.cache)(handler)
+	}
+	if o.clientLimit > 0 {
+		handler = clientLimitMiddleware(newClientLimiter(o.clientLimit, o.trusted))(handler)
+	}
+	if o.maxBodyBytes > 0 {
+		handler = bodyLimitMiddleware(o.maxBodyBytes)(handler)
+	}
+	if o.maxTotalLatency > 0 {
+		handler = totalLatencyMiddleware(o.maxTotalLatency)(handler)
 	}
 	if o.metrics != nil {
 		handler = o.metrics.Middleware(handler)
 	}
-	handler = router.ProxyHandler(handler) // Outermost — parse path first
+	routerOpts := []router.Option{router.WithMatchRegionPolicy(router.MatchRegionPolicy(cfg.MatchRegionPolicy))}
+	if cfg.ValidateRoutingGroup {
+		routerOpts = append(routerOpts, router.WithRoutingValidation())
+	}
+	if cfg.DefaultRegion != "" {
+		routerOpts = append(routerOpts, router.WithDefaultRegion(cfg.DefaultRegion))
+	}
+	if cfg.MaxPathBytes > 0 || cfg.MaxPathSegments > 0 {
+		routerOpts = append(routerOpts, router.WithPathLimits(cfg.MaxPathBytes, cfg.MaxPathSegments))
+	}
+	if cfg.ForwardOptions {
+		routerOpts = append(routerOpts, router.WithOptionsForwarding())
+	}
+	if cfg.ValidateMethods {
+		routerOpts = append(routerOpts, router.WithMethodValidation())
+	}
+	if len(cfg.DisabledPatterns) > 0 {
+		routerOpts = append(routerOpts, router.WithDisabledPatterns(cfg.DisabledPatterns...))
+	}
+	handler = router.ProxyHandler(handler, routerOpts...) // Parse path before anything that needs the route
+	if o.cors != nil {
+		handler = corsMiddleware(*o.cors)(handler)
+	}
+	handler = recoverMiddleware(o.metrics)(handler)
 
 	return handler
 }
 
+// setForwardedClient appends the peer to the X-Forwarded-For chain received
+// from a trusted proxy, or starts a new chain, and names the resolved client
+// in X-Real-IP.
+func setForwardedClient(preq *httputil.ProxyRequest, trusted clientip.Trusted) {
+	prior := preq.In.Header.Values("X-Forwarded-For")
+	preq.SetXForwarded()
+	if len(prior) > 0 && trusted.TrustsPeer(preq.In) {
+		chain := strings.Join(prior, ", ")
+		preq.Out.Header.Set("X-Forwarded-For", chain+", "+preq.Out.Header.Get("X-Forwarded-For"))
+	}
+	preq.Out.Header.Set("X-Real-IP", clientip.FromRequest(preq.In, trusted))
+}
+
 func newReverseProxy(o options) *httputil.ReverseProxy {
 	pool := &sync.Pool{
 		New: func() any {
@@ -102,28 +376,55 @@ func newReverseProxy(o options) *httputil.ReverseProxy {
 		}
 
 		host := info.Region + ".api.riotgames.com"
+		if override, ok := o.regionHosts[info.Region]; ok {
+			host = override
+		}
 
 		preq.Out.URL.Scheme = "https"
 		preq.Out.URL.Host = host
 		preq.Out.Host = host
 		preq.Out.URL.Path = info.UpstreamPath
+		preq.Out.URL.RawQuery = stripQueryParam(preq.Out.URL.RawQuery, priorityQueryParam)
+
+		// Never forward a client's own token or other configured secrets.
+		preq.Out.Header.Del("X-Riot-Token")
+		preq.Out.Header.Del(passthrough429Header)
+		preq.Out.Header.Del("X-Real-IP")
+		for _, name := range o.stripHeaders {
+			preq.Out.Header.Del(name)
+		}
 
+		// A key removed since admission gets no token here: the request is
+		// re-admitted before it is sent, see currentKeyTransport.
+		tokens := o.keys.Load()
 		keyIndex := 0
-		if value, ok := keyIndexFromContext(preq.In.Context()); ok && value >= 0 && value < len(o.apiTokens) {
+		if value, ok := keyIndexFromContext(preq.In.Context()); ok {
 			keyIndex = value
 		}
-		if len(o.apiTokens) > 0 {
-			preq.Out.Header.Set("X-Riot-Token", o.apiTokens[keyIndex])
+		if keyIndex >= 0 && keyIndex < len(tokens) {
+			preq.Out.Header.Set("X-Riot-Token", tokens[keyIndex])
 		}
 		preq.Out.Header.Set("Accept-Encoding", "gzip")
-		preq.SetXForwarded()
+		if o.forwardClientIP {
+			setForwardedClient(preq, o.trusted)
+		}
 	}
 
 	return &httputil.ReverseProxy{
 		Rewrite:    rewrite,
 		Transport:  o.baseTransport,
 		BufferPool: bufferPool{pool: pool},
+		// ModifyResponse must only look at headers: the body is still being
+		// streamed to the client after it returns, and is usually gzipped.
+		// Code that needs the body must decode it with readResponseBody.
 		ModifyResponse: func(resp *http.Response) error {
+			upstreamHeader := resp.Header
+			resp.Header = o.clientHeader(upstreamHeader)
+			if o.breaker != nil {
+				if path, ok := router.PathFromContext(resp.Request.Context()); ok {
+					o.breaker.record(path.Bucket, resp.StatusCode, time.Now())
+				}
+			}
 			if o.limiter == nil {
 				return nil
 			}
@@ -132,55 +433,71 @@ func newReverseProxy(o options) *httputil.ReverseProxy {
 			if !ok {
 				return nil
 			}
+			// StartedAt is taken after admission and moved past any retry's
+			// re-admission wait, so this is the upstream time of every attempt.
+			duration := time.Since(info.StartedAt)
+			setServerTiming(resp.Header, info.QueueWait, duration)
+			if o.pacingHeaders {
+				setPacingHeaders(resp.Header, info)
+			}
 
 			o.limiter.Observe(limiter.Observation{
 				Region:     info.Region,
 				Bucket:     info.Bucket,
 				KeyIndex:   info.KeyIndex,
 				StatusCode: resp.StatusCode,
-				Header:     resp.Header.Clone(),
+				Header:     upstreamHeader.Clone(),
 			})
 
 			if o.metrics != nil {
-				duration := time.Since(info.StartedAt)
 				o.metrics.ObserveUpstream(resp.StatusCode, info.Region, info.Bucket, info.Priority)
 				o.metrics.ObserveUpstreamDuration(info.Region, info.Bucket, duration)
 			}
 			return nil
 		},
 		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
-			log.Printf("proxy error: %v", err)
+			info, admitted := admissionFromContext(r.Context())
+			admitted = admitted && o.limiter != nil
+			if admitted {
+				log.Printf("proxy error: %v region=%s bucket=%s key_index=%d", err, info.Region, info.Bucket, info.KeyIndex)
+			} else {
+				log.Printf("proxy error: %v", err)
+			}
 			prio := "normal"
 			region := "unknown"
 			bucket := "unknown"
 
-			var statusCode int
-			var msg string
-			var retryAfter time.Duration
-			switch {
-			case errors.Is(err, context.Canceled):
-				statusCode = 499
-				msg = "client closed request"
-			case errors.Is(err, context.DeadlineExceeded):
-				statusCode = http.StatusRequestTimeout
-				msg = "request timed out"
-				retryAfter = time.Second
-			default:
-				statusCode = http.StatusBadGateway
-				msg = "upstream unavailable"
+			statusCode, msg, retryAfter := classifyProxyError(err)
+			if totalLatencyExceeded(r.Context()) {
+				statusCode, msg = http.StatusGatewayTimeout, totalLatencyMessage
+			}
+			if o.breaker != nil && statusCode >= 500 {
+				if path, ok := router.PathFromContext(r.Context()); ok {
+					o.breaker.record(path.Bucket, statusCode, time.Now())
+				}
 			}
 
-			if info, ok := admissionFromContext(r.Context()); ok && o.limiter != nil {
+			if admitted {
 				prio = info.Priority
 				region = info.Region
 				bucket = info.Bucket
-				o.limiter.Observe(limiter.Observation{
-					Region:     info.Region,
-					Bucket:     info.Bucket,
-					KeyIndex:   info.KeyIndex,
-					StatusCode: statusCode,
-					Header:     http.Header{},
-				})
+				// A rejected retry admission sent nothing upstream to observe.
+				var rejected *limiter.RejectedError
+				if !errors.As(err, &rejected) {
+					// No headers to learn from: the limiter only sees the
+					// status, so count how often that happens. A client that
+					// went away says nothing about upstream.
+					if o.metrics != nil && !errors.Is(err, context.Canceled) {
+						o.metrics.ObserveAdmittedUnobserved(info.Bucket)
+					}
+					o.limiter.Observe(limiter.Observation{
+						Region:     info.Region,
+						Bucket:     info.Bucket,
+						KeyIndex:   info.KeyIndex,
+						StatusCode: statusCode,
+						Header:     http.Header{},
+					})
+				}
 			}
 			if o.metrics != nil {
 				o.metrics.ObserveUpstream(statusCode, region, bucket, prio)
@@ -193,6 +510,150 @@ func newReverseProxy(o options) *httputil.ReverseProxy {
 	}
 }
 
+func setPacingHeaders(h http.Header, info admissionContext) {
+	h.Set("X-RiftRelay-Queue-Wait-Ms", strconv.FormatInt(info.QueueWait.Milliseconds(), 10))
+	h.Set("X-RiftRelay-Key-Index", strconv.Itoa(info.KeyIndex))
+	h.Set("X-RiftRelay-Priority", info.Priority)
+	h.Set("X-RiftRelay-Paced", strconv.FormatBool(info.Paced))
+	h.Set(queuePositionHeader, strconv.Itoa(info.QueuePosition))
+}
+
+// setServerTiming reports the queue wait and upstream time in milliseconds,
+// e.g. "admission;dur=12.0, upstream;dur=85.4".
+func setServerTiming(h http.Header, admission, upstream time.Duration) {
+	h.Set("Server-Timing", "admission;dur="+formatMillis(admission)+", upstream;dur="+formatMillis(upstream))
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 1, 64)
+}
+
+// classifyProxyError maps a transport error to the status and body the client
+// sees, so a timeout, an unreachable host and a hang-up can be told apart.
+func classifyProxyError(err error) (statusCode int, msg string, retryAfter time.Duration) {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var rejected *limiter.RejectedError
+	switch {
+	case errors.As(err, &rejected):
+		return http.StatusTooManyRequests, "request rejected by admission control", max(rejected.RetryAfter, time.Second)
+	case errors.Is(err, context.Canceled):
+		return 499, "client closed request", 0
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, os.ErrDeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "upstream timed out", time.Second
+	case errors.As(err, &dnsErr):
+		return http.StatusBadGateway, "upstream host lookup failed", 0
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return http.StatusBadGateway, "upstream connection failed", 0
+	default:
+		return http.StatusBadGateway, "upstream unavailable", 0
+	}
+}
+
+// observeRetry feeds a 429 that the transport is about to retry into the
+// limiter, so other requests for the bucket wait out the same Retry-After
+// instead of discovering it with their own 429. The observation is applied
+// before the retry is re-admitted, so readmitRetry cannot be granted on the
+// key the 429 just blocked.
+func (o *options) observeRetry(resp *http.Response) {
+	if o.limiter == nil || resp.Request == nil {
+		return
+	}
+	info, ok := admissionFromContext(resp.Request.Context())
+	if !ok {
+		return
+	}
+	o.limiter.ObserveSync(resp.Request.Context(), limiter.Observation{
+		Region:     info.Region,
+		Bucket:     info.Bucket,
+		KeyIndex:   info.KeyIndex,
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header.Clone(),
+	})
+}
+
+// readmitRetry makes a 429 retry wait for a fresh grant from the limiter
+// instead of sleeping through Retry-After on its own. The retry is then paced
+// with every other request for the bucket and may move to another key. Requests
+// that skipped admission fall back to the sleep.
+func (o *options) readmitRetry(req *http.Request) (*http.Request, error) {
+	info, ok := admissionFromContext(req.Context())
+	if !ok {
+		return nil, nil
+	}
+	budgetID := info.BudgetID
+	if budgetID == admissionBudgetLabel("") {
+		budgetID = ""
+	}
+	priority := limiter.PriorityNormal
+	if info.Priority == limiter.PriorityHigh.String() {
+		priority = limiter.PriorityHigh
+	}
+
+	start := time.Now()
+	ticket, err := o.limiter.Admit(req.Context(), limiter.Admission{
+		Region:     info.Region,
+		Bucket:     info.Bucket,
+		BudgetID:   budgetID,
+		Priority:   priority,
+		TokenIndex: info.TokenIndex,
+	})
+	if err != nil {
+		return nil, err
+	}
+	wait := time.Since(start)
+
+	info.KeyIndex = ticket.KeyIndex
+	info.Paced = ticket.Paced
+	// The wait counts as admission, not upstream time.
+	info.QueueWait += wait
+	info.StartedAt = info.StartedAt.Add(wait)
+	req = req.WithContext(withAdmission(withKeyIndex(req.Context(), ticket.KeyIndex), info))
+	if tokens := o.keys.Load(); ticket.KeyIndex < len(tokens) {
+		req.Header.Set("X-Riot-Token", tokens[ticket.KeyIndex])
+	}
+	return req, nil
+}
+
+// currentKeyTransport re-admits a request whose key was removed by a reload
+// after it was admitted. Sending it on another key would spend a slot that
+// key's limiter never counted.
+type currentKeyTransport struct {
+	keys    *Keys
+	readmit transport.RetryGate
+	next    http.RoundTripper
+}
+
+func (t currentKeyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if index, ok := keyIndexFromContext(req.Context()); ok && index >= len(t.keys.Load()) {
+		readmitted, err := t.readmit(req)
+		if err != nil {
+			return nil, err
+		}
+		if readmitted == nil {
+			return nil, &limiter.RejectedError{Reason: "no_available_key"}
+		}
+		req = readmitted
+	}
+	return t.next.RoundTrip(req)
+}
+
+// retryMetrics labels transport retries with the bucket of the request.
+type retryMetrics struct {
+	collector *metrics.Collector
+}
+
+func (m retryMetrics) ObserveRetry(req *http.Request, wait time.Duration) {
+	bucket := "unknown"
+	if info, ok := router.PathFromContext(req.Context()); ok {
+		bucket = info.Bucket
+	}
+	m.collector.ObserveRetry(bucket, wait)
+}
+
 type keyIndexContextKey struct{}
 
 func withKeyIndex(ctx context.Context, keyIndex int) context.Context {
@@ -1,12 +1,29 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"testing/synctest"
+	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
+	"github.com/renja-g/RiftRelay/internal/limiter"
+	"github.com/renja-g/RiftRelay/internal/metrics"
+	"github.com/renja-g/RiftRelay/internal/router"
 	"github.com/renja-g/RiftRelay/internal/testutil"
 )
 
@@ -46,6 +63,226 @@ func TestProxyNewRewritesRequestAndInjectsToken(t *testing.T) {
 	}
 }
 
+func TestProxyNewRoutesRegionalClusters(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+	cfg.ValidateRoutingGroup = true
+
+	var gotHost, gotBucket string
+	handler := New(cfg, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		gotHost = r.URL.Host
+		info, _ := router.PathFromContext(r.Context())
+		gotBucket = info.Bucket
+		return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+	})))
+
+	for _, cluster := range []string{"americas", "europe", "asia", "sea"} {
+		for path, pattern := range map[string]string{
+			"/riot/account/v1/accounts/me":          "riot/account/v1/accounts/me",
+			"/lol/match/v5/matches/EUW1_1234567890": "lol/match/v5/matches/{matchId}",
+		} {
+			// The cluster name is case-insensitive and always keyed lowercase.
+			for _, region := range []string{cluster, strings.ToUpper(cluster)} {
+				gotHost, gotBucket = "", ""
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+region+path, nil))
+
+				if got, want := rec.Code, http.StatusNoContent; got != want {
+					t.Fatalf("%s%s status = %d, want %d", region, path, got, want)
+				}
+				if got, want := gotHost, cluster+".api.riotgames.com"; got != want {
+					t.Fatalf("%s%s host = %q, want %q", region, path, got, want)
+				}
+				if got, want := gotBucket, cluster+":"+pattern; got != want {
+					t.Fatalf("%s%s bucket = %q, want %q", region, path, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestProxyRegionHostOverrides(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+	cfg.RegionHostOverrides = map[string]string{"na1": "localhost:8080"}
+
+	var gotURL *url.URL
+	var gotHost string
+	handler := New(cfg, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		gotURL, gotHost = r.URL, r.Host
+		return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+	})))
+
+	for region, want := range map[string]string{
+		"na1":  "localhost:8080",
+		"NA1":  "localhost:8080",
+		"euw1": "euw1.api.riotgames.com",
+	} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/"+region+"/lol/status/v4/platform-data", nil))
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("%s status = %d, want %d", region, got, want)
+		}
+		if gotURL.Host != want || gotHost != want {
+			t.Fatalf("%s URL host = %q, Host = %q, want %q", region, gotURL.Host, gotHost, want)
+		}
+		if got, want := gotURL.Path, "/lol/status/v4/platform-data"; got != want {
+			t.Fatalf("%s path = %q, want %q", region, got, want)
+		}
+	}
+}
+
+func TestProxyNewStripsPriorityQueryParam(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+
+	var gotQuery string
+	handler := New(cfg, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		gotQuery = r.URL.RawQuery
+		return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+	})))
+
+	req := httptest.NewRequest(http.MethodGet, "/europe/lol/match/v5/matches/by-puuid/abc/ids?start=0&_priority=high&count=20", nil)
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	if got, want := gotQuery, "start=0&count=20"; got != want {
+		t.Fatalf("upstream query = %q, want %q", got, want)
+	}
+}
+
+func TestProxyNewStripsClientSecrets(t *testing.T) {
+	t.Parallel()
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 0
+
+	var gotHeader http.Header
+	handler := New(cfg,
+		WithStrippedHeaders("Authorization"),
+		WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			gotHeader = r.Header.Clone()
+			return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+		})),
+	)
+
+	req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+	req.Header.Add("X-Riot-Token", "client-token")
+	req.Header.Add("X-Riot-Token", "another-client-token")
+	req.Header.Set("Authorization", "Bearer client-secret")
+	req.Header.Set("X-Trace-Id", "keep-me")
+	rec := httptest.NewRecorder()
+
+	handler.ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	if got := gotHeader.Values("X-Riot-Token"); len(got) != 1 || got[0] != cfg.Tokens[0] {
+		t.Fatalf("X-Riot-Token = %v, want [%s]", got, cfg.Tokens[0])
+	}
+	if got := gotHeader.Get("Authorization"); got != "" {
+		t.Fatalf("Authorization = %q, want stripped", got)
+	}
+	if got, want := gotHeader.Get("X-Trace-Id"), "keep-me"; got != want {
+		t.Fatalf("X-Trace-Id = %q, want %q", got, want)
+	}
+}
+
+func TestProxyClientIPForwarding(t *testing.T) {
+	t.Parallel()
+
+	trusted, err := clientip.ParseTrusted([]string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatalf("ParseTrusted() error = %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		opts       []Option
+		remoteAddr string
+		forwarded  string
+		wantXFF    string
+		wantRealIP string
+	}{
+		{
+			name:       "disabled",
+			remoteAddr: "198.51.100.7:4000",
+			forwarded:  "203.0.113.9",
+		},
+		{
+			name:       "direct client",
+			opts:       []Option{WithClientIPForwarding()},
+			remoteAddr: "198.51.100.7:4000",
+			wantXFF:    "198.51.100.7",
+			wantRealIP: "198.51.100.7",
+		},
+		{
+			name:       "untrusted chain is replaced",
+			opts:       []Option{WithClientIPForwarding(), WithTrustedProxies(trusted)},
+			remoteAddr: "198.51.100.7:4000",
+			forwarded:  "203.0.113.9",
+			wantXFF:    "198.51.100.7",
+			wantRealIP: "198.51.100.7",
+		},
+		{
+			name:       "trusted chain is appended",
+			opts:       []Option{WithClientIPForwarding(), WithTrustedProxies(trusted)},
+			remoteAddr: "192.0.2.10:4000",
+			forwarded:  "203.0.113.9",
+			wantXFF:    "203.0.113.9, 192.0.2.10",
+			wantRealIP: "203.0.113.9",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			cfg := testutil.DummyConfig()
+			cfg.UpstreamTimeout = 0
+
+			var gotHeader http.Header
+			opts := append(tt.opts, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				gotHeader = r.Header.Clone()
+				return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+			})))
+			handler := New(cfg, opts...)
+
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Real-IP", "10.9.9.9")
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Fatalf("status = %d, want %d", got, want)
+			}
+			if got := gotHeader.Get("X-Forwarded-For"); got != tt.wantXFF {
+				t.Fatalf("X-Forwarded-For = %q, want %q", got, tt.wantXFF)
+			}
+			if got := gotHeader.Get("X-Real-IP"); got != tt.wantRealIP {
+				t.Fatalf("X-Real-IP = %q, want %q", got, tt.wantRealIP)
+			}
+		})
+	}
+}
+
 func TestProxyNewMapsTransportErrors(t *testing.T) {
 	t.Parallel()
 
@@ -54,12 +291,40 @@ func TestProxyNewMapsTransportErrors(t *testing.T) {
 		err        error
 		wantStatus int
 		wantRetry  string
+		wantBody   string
 	}{
 		{
 			name:       "deadline exceeded",
 			err:        context.DeadlineExceeded,
-			wantStatus: http.StatusRequestTimeout,
+			wantStatus: http.StatusGatewayTimeout,
 			wantRetry:  "1",
+			wantBody:   "upstream timed out",
+		},
+		{
+			name:       "os deadline exceeded",
+			err:        fmt.Errorf("read: %w", os.ErrDeadlineExceeded),
+			wantStatus: http.StatusGatewayTimeout,
+			wantRetry:  "1",
+			wantBody:   "upstream timed out",
+		},
+		{
+			name:       "net timeout",
+			err:        &net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}},
+			wantStatus: http.StatusGatewayTimeout,
+			wantRetry:  "1",
+			wantBody:   "upstream timed out",
+		},
+		{
+			name:       "dns failure",
+			err:        &net.DNSError{Err: "no such host", Name: "europe.api.riotgames.com", IsNotFound: true},
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "upstream host lookup failed",
+		},
+		{
+			name:       "connection refused",
+			err:        &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+			wantStatus: http.StatusBadGateway,
+			wantBody:   "upstream connection failed",
 		},
 		{
 			name:       "context canceled",
@@ -95,6 +360,786 @@ func TestProxyNewMapsTransportErrors(t *testing.T) {
 			if got := rec.Header().Get("Retry-After"); got != tt.wantRetry {
 				t.Fatalf("Retry-After = %q, want %q", got, tt.wantRetry)
 			}
+			if got := strings.TrimSpace(rec.Body.String()); tt.wantBody != "" && got != tt.wantBody {
+				t.Fatalf("body = %q, want %q", got, tt.wantBody)
+			}
 		})
 	}
 }
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestProxyRetryAppliesRetryAfterOnce(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		start := time.Now()
+		var calls atomic.Int32
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.AdmissionTimeoutHigh = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				if time.Since(start) < 2*time.Second {
+					resp = testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+						"Retry-After":       []string{"2"},
+						"X-Rate-Limit-Type": []string{"method"},
+					})
+				}
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		serve := func() time.Duration {
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.Header.Set("X-Priority", "high")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Errorf("status = %d, want %d", got, want)
+			}
+			return time.Since(start)
+		}
+
+		first := make(chan time.Duration, 1)
+		go func() { first <- serve() }()
+		synctest.Wait()
+
+		// The retrying request has reported its 429, so this one waits in the
+		// limiter rather than hitting upstream and sleeping through its own 429.
+		if got, want := serve(), 2*time.Second; got != want {
+			t.Fatalf("second request finished after %v, want %v", got, want)
+		}
+		if got, want := <-first, 2*time.Second; got != want {
+			t.Fatalf("retried request finished after %v, want %v", got, want)
+		}
+		if got, want := calls.Load(), int32(3); got != want {
+			t.Fatalf("upstream calls = %d, want %d", got, want)
+		}
+	})
+}
+
+func TestProxyRetryReadmitsThroughLimiter(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         2,
+			QueueCapacity:    4,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		var tokens []string
+		handler := New(cfg,
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tokens = append(tokens, r.Header.Get("X-Riot-Token"))
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				if len(tokens) == 1 {
+					resp = testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+						"Retry-After":       []string{"10"},
+						"X-Rate-Limit-Type": []string{"application"},
+					})
+				}
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		start := time.Now()
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("X-Priority", "high")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		// The limiter moved the retry to the unblocked key at once instead of
+		// the transport sleeping through the first key's Retry-After.
+		if elapsed := time.Since(start); elapsed != 0 {
+			t.Fatalf("retried request finished after %v, want 0s", elapsed)
+		}
+		if want := []string{cfg.Tokens[0], cfg.Tokens[1]}; !slices.Equal(tokens, want) {
+			t.Fatalf("upstream tokens = %v, want %v", tokens, want)
+		}
+	})
+}
+
+func TestCurrentKeyTransportReadmitsRemovedKey(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         2,
+			QueueCapacity:    4,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		// Key 1 is removed between admission and sending.
+		if err := l.SetKeyCount(context.Background(), 1); err != nil {
+			t.Fatalf("SetKeyCount() error = %v", err)
+		}
+		o := &options{limiter: l, keys: NewKeys([]string{"key-a"})}
+		var tokens []string
+		rt := currentKeyTransport{
+			keys:    o.keys,
+			readmit: o.readmitRetry,
+			next: testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tokens = append(tokens, r.Header.Get("X-Riot-Token"))
+				return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+			}),
+		}
+
+		send := func(tokenIndex *int) error {
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			ctx := withAdmission(withKeyIndex(req.Context(), 1), admissionContext{
+				Region:     "europe",
+				Bucket:     "europe:riot/account/v1/accounts/me",
+				KeyIndex:   1,
+				TokenIndex: tokenIndex,
+				Priority:   limiter.PriorityHigh.String(),
+			})
+			_, err := rt.RoundTrip(req.WithContext(ctx))
+			return err
+		}
+
+		if err := send(nil); err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		if want := []string{"key-a"}; !slices.Equal(tokens, want) {
+			t.Fatalf("upstream tokens = %v, want %v", tokens, want)
+		}
+
+		pinned := 1
+		var rejected *limiter.RejectedError
+		if err := send(&pinned); !errors.As(err, &rejected) || rejected.Reason != "invalid_token_index" {
+			t.Fatalf("RoundTrip() pinned to the removed key error = %v, want invalid_token_index", err)
+		}
+		if len(tokens) != 1 {
+			t.Fatalf("upstream requests = %d, want 1", len(tokens))
+		}
+	})
+}
+
+func TestProxyMaxTotalLatency(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:2",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		// Someone else spent the window: admission waits 2s.
+		if _, err := l.Admit(context.Background(), limiter.Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: limiter.PriorityHigh,
+		}); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.AdmissionTimeoutHigh = 0
+		cfg.MaxTotalLatency = 3 * time.Second
+		handler := New(cfg,
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				// Retrying would take another 2s.
+				resp := testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+					"Retry-After":       []string{"2"},
+					"X-Rate-Limit-Type": []string{"method"},
+				})
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		start := time.Now()
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("X-Priority", "high")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusGatewayTimeout; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := strings.TrimSpace(rec.Body.String()), "request exceeded MAX_TOTAL_LATENCY"; got != want {
+			t.Fatalf("body = %q, want %q", got, want)
+		}
+		if got, want := time.Since(start), 3*time.Second; got != want {
+			t.Fatalf("answered after %v, want %v", got, want)
+		}
+	})
+}
+
+func TestProxyUpstreamDurationMetric(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "1:2",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		// Spend the window so the request queues for 2s first.
+		if _, err := l.Admit(context.Background(), limiter.Admission{
+			Region:   "europe",
+			Bucket:   "europe:riot/account/v1/accounts/me",
+			Priority: limiter.PriorityHigh,
+		}); err != nil {
+			t.Fatalf("Admit() error = %v", err)
+		}
+
+		collector := metrics.NewCollector()
+		var calls atomic.Int32
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.AdmissionTimeoutHigh = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithMetrics(collector),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				time.Sleep(300 * time.Millisecond)
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				if calls.Add(1) == 1 {
+					resp = testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+						"Retry-After":       []string{"1"},
+						"X-Rate-Limit-Type": []string{"method"},
+					})
+				}
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+		req.Header.Set("X-Priority", "high")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+
+		// Two 300ms attempts; neither the initial queue wait nor the retry's
+		// wait for re-admission counts.
+		scrape := httptest.NewRecorder()
+		collector.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := scrape.Body.String()
+		for _, want := range []string{
+			`riftrelay_upstream_duration_seconds_sum{bucket="europe:riot/account/v1/accounts/me",region="europe"} 0.6`,
+			`riftrelay_upstream_duration_seconds_count{bucket="europe:riot/account/v1/accounts/me",region="europe"} 1`,
+			`riftrelay_upstream_duration_seconds_bucket{bucket="europe:riot/account/v1/accounts/me",region="europe",le="0.5"} 0`,
+			`riftrelay_upstream_duration_seconds_bucket{bucket="europe:riot/account/v1/accounts/me",region="europe",le="1"} 1`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Fatalf("metrics missing %q:\n%s", want, body)
+			}
+		}
+	})
+}
+
+func TestProxyAdmittedUnobservedMetric(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "20:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		collector := metrics.NewCollector()
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithMetrics(collector),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				if r.URL.Query().Has("cancel") {
+					return nil, context.Canceled
+				}
+				return nil, errors.New("connection reset by peer")
+			})),
+		)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil))
+		if got, want := rec.Code, http.StatusBadGateway; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		// Client cancellations are not counted.
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me?cancel=1", nil))
+
+		scrape := httptest.NewRecorder()
+		collector.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		if want := `riftrelay_admitted_unobserved_total{bucket="europe:riot/account/v1/accounts/me"} 1`; !strings.Contains(scrape.Body.String(), want) {
+			t.Fatalf("metrics missing %q:\n%s", want, scrape.Body.String())
+		}
+	})
+}
+
+func TestProxyResponseHeaderFilter(t *testing.T) {
+	upstreamHeader := func() http.Header {
+		return http.Header{
+			"Content-Type":              {"application/json"},
+			"Retry-After":               {"3"},
+			"X-App-Rate-Limit":          {"100:120"},
+			"X-App-Rate-Limit-Count":    {"1:120"},
+			"X-Method-Rate-Limit":       {"50:10"},
+			"X-Method-Rate-Limit-Count": {"1:10"},
+			"X-Rate-Limit-Type":         {"application"},
+			"X-Riot-Edge-Trace-Id":      {"trace"},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		option Option
+		want   []string
+		absent []string
+	}{
+		{
+			name:   "strip",
+			option: WithStrippedResponseHeaders("X-App-Rate-Limit", "X-App-Rate-Limit-Count", "x-method-rate-limit", "X-Method-Rate-Limit-Count"),
+			want:   []string{"Content-Type", "Retry-After", "X-Rate-Limit-Type", "X-Riot-Edge-Trace-Id"},
+			absent: []string{"X-App-Rate-Limit", "X-App-Rate-Limit-Count", "X-Method-Rate-Limit", "X-Method-Rate-Limit-Count"},
+		},
+		{
+			name:   "allow",
+			option: WithAllowedResponseHeaders("x-rate-limit-type"),
+			want:   []string{"Content-Type", "Retry-After", "X-Rate-Limit-Type"},
+			absent: []string{"X-App-Rate-Limit", "X-App-Rate-Limit-Count", "X-Method-Rate-Limit", "X-Method-Rate-Limit-Count", "X-Riot-Edge-Trace-Id"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				l, err := limiter.New(limiter.Config{KeyCount: 1, QueueCapacity: 4})
+				if err != nil {
+					t.Fatalf("limiter.New() error = %v", err)
+				}
+				defer func() { _ = l.Close() }()
+
+				cfg := testutil.DummyConfig()
+				cfg.UpstreamTimeout = 0
+				handler := New(cfg,
+					WithLimiter(l),
+					tt.option,
+					WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+						resp := testutil.HTTPResponse(http.StatusOK, "{}", upstreamHeader())
+						resp.Request = r
+						return resp, nil
+					})),
+				)
+
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil))
+				if got, want := rec.Code, http.StatusOK; got != want {
+					t.Fatalf("status = %d, want %d", got, want)
+				}
+				for _, name := range tt.want {
+					if rec.Header().Get(name) == "" {
+						t.Fatalf("client response is missing %s: %v", name, rec.Header())
+					}
+				}
+				for _, name := range tt.absent {
+					if got := rec.Header().Get(name); got != "" {
+						t.Fatalf("client response has %s = %q, want it filtered", name, got)
+					}
+				}
+				if rec.Header().Get("Server-Timing") == "" {
+					t.Fatal("client response is missing RiftRelay's own Server-Timing")
+				}
+
+				// The limiter learned the limits from the headers the client
+				// never saw.
+				synctest.Wait()
+				plan, err := l.Plan(context.Background(), "europe", "europe:riot/account/v1/accounts/me")
+				if err != nil {
+					t.Fatalf("Plan() error = %v", err)
+				}
+				app, method := plan.Keys[0].App.Windows, plan.Keys[0].Method.Windows
+				if len(app) != 1 || app[0].Limit != 100 || len(method) != 1 || method[0].Limit != 50 {
+					t.Fatalf("learned windows app = %+v, method = %+v, want 100 and 50", app, method)
+				}
+			})
+		})
+	}
+}
+
+func TestProxyRetryMetrics(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		collector := metrics.NewCollector()
+		var calls atomic.Int32
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithMetrics(collector),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+				if calls.Add(1) <= 2 {
+					resp = testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{"Retry-After": []string{"1"}})
+				}
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil))
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+
+		scrape := httptest.NewRecorder()
+		collector.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+		body := scrape.Body.String()
+		for _, want := range []string{
+			`riftrelay_retry_attempts_total{bucket="euw1:lol/status/v4/platform-data"} 2`,
+			"riftrelay_retry_wait_seconds_count 2",
+			"riftrelay_retry_wait_seconds_sum 2",
+		} {
+			if !strings.Contains(body, want) {
+				t.Fatalf("metrics missing %q:\n%s", want, body)
+			}
+		}
+	})
+}
+
+func TestProxyPassthrough429(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "100:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var calls atomic.Int32
+		var forwarded string
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				calls.Add(1)
+				forwarded = r.Header.Get("X-RiftRelay-Passthrough-429")
+				resp := testutil.HTTPResponse(http.StatusTooManyRequests, `{"status":{"status_code":429}}`, http.Header{
+					"Retry-After":               []string{"7"},
+					"X-Rate-Limit-Type":         []string{"method"},
+					"X-Method-Rate-Limit":       []string{"20:10"},
+					"X-Method-Rate-Limit-Count": []string{"21:10"},
+				})
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		req := httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil)
+		req.Header.Set("X-RiftRelay-Passthrough-429", "true")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusTooManyRequests; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got := calls.Load(); got != 1 {
+			t.Fatalf("upstream calls = %d, want 1", got)
+		}
+		if forwarded != "" {
+			t.Fatalf("upstream received X-RiftRelay-Passthrough-429 = %q", forwarded)
+		}
+		for name, want := range map[string]string{
+			"Retry-After":               "7",
+			"X-Rate-Limit-Type":         "method",
+			"X-Method-Rate-Limit":       "20:10",
+			"X-Method-Rate-Limit-Count": "21:10",
+		} {
+			if got := rec.Header().Get(name); got != want {
+				t.Fatalf("%s = %q, want %q", name, got, want)
+			}
+		}
+		if got, want := rec.Body.String(), `{"status":{"status_code":429}}`; got != want {
+			t.Fatalf("body = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestProxyHeadSharesGetBucket(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{
+			KeyCount:         1,
+			QueueCapacity:    4,
+			DefaultAppLimits: "100:1",
+		})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		var methods []string
+		cfg := testutil.DummyConfig()
+		cfg.UpstreamTimeout = 0
+		cfg.AdmissionTimeoutNormal = 0
+		handler := New(cfg,
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				methods = append(methods, r.Method)
+				resp := testutil.HTTPResponse(http.StatusOK, "", http.Header{
+					"X-Method-Rate-Limit":       []string{"1:60"},
+					"X-Method-Rate-Limit-Count": []string{"1:60"},
+				})
+				resp.Request = r
+				return resp, nil
+			})),
+		)
+
+		const path = "/euw1/lol/summoner/v4/summoners/by-puuid/abc"
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodHead, path, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("HEAD status = %d, want %d", got, want)
+		}
+		synctest.Wait()
+		if l.ColdStart("euw1:lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}") {
+			t.Fatal("ColdStart() = true, want limits learned from the HEAD response")
+		}
+
+		// The GET lands in the same bucket, so it waits out the window the HEAD used.
+		start := time.Now()
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("GET status = %d, want %d", got, want)
+		}
+		if elapsed := time.Since(start); elapsed < 60*time.Second {
+			t.Fatalf("GET admitted after %v, want it to share the HEAD's method bucket", elapsed)
+		}
+		if got, want := strings.Join(methods, ","), "HEAD,GET"; got != want {
+			t.Fatalf("upstream methods = %q, want %q", got, want)
+		}
+	})
+}
+
+func TestProxyUpstreamTimeout(t *testing.T) {
+	t.Parallel()
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(backend.Close)
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatalf("url.Parse() error = %v", err)
+	}
+
+	cfg := testutil.DummyConfig()
+	cfg.UpstreamTimeout = 50 * time.Millisecond
+	handler := New(cfg, WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		r.URL.Scheme = backendURL.Scheme
+		r.URL.Host = backendURL.Host
+		return backend.Client().Transport.RoundTrip(r)
+	})))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil))
+
+	if got, want := rec.Code, http.StatusGatewayTimeout; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+}
+
+func TestProxyServerTiming(t *testing.T) {
+	t.Parallel()
+
+	l, err := limiter.New(limiter.Config{KeyCount: 1, QueueCapacity: 1, DefaultAppLimits: "100:1"})
+	if err != nil {
+		t.Fatalf("limiter.New() error = %v", err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	handler := New(testutil.DummyConfig(),
+		WithLimiter(l),
+		WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+			resp.Request = r
+			return resp, nil
+		})),
+	)
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil))
+	if got, want := rec.Code, http.StatusNoContent; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+
+	header := rec.Header().Get("Server-Timing")
+	metrics := strings.Split(header, ", ")
+	if len(metrics) != 2 {
+		t.Fatalf("Server-Timing = %q, want two metrics", header)
+	}
+	for i, name := range []string{"admission", "upstream"} {
+		got, dur, ok := strings.Cut(metrics[i], ";dur=")
+		if !ok || got != name {
+			t.Fatalf("Server-Timing metric %d = %q, want %s;dur=<ms>", i, metrics[i], name)
+		}
+		if ms, err := strconv.ParseFloat(dur, 64); err != nil || ms < 0 {
+			t.Fatalf("Server-Timing %s dur = %q, want a non-negative number", name, dur)
+		}
+	}
+}
+
+func TestProxyPacingHeaders(t *testing.T) {
+	t.Parallel()
+
+	headers := []string{"X-RiftRelay-Queue-Wait-Ms", "X-RiftRelay-Key-Index", "X-RiftRelay-Priority", "X-RiftRelay-Paced", "X-RiftRelay-Queue-Position"}
+
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enabled=%t", enabled), func(t *testing.T) {
+			t.Parallel()
+
+			l, err := limiter.New(limiter.Config{KeyCount: 2, QueueCapacity: 1, DefaultAppLimits: "100:1"})
+			if err != nil {
+				t.Fatalf("limiter.New() error = %v", err)
+			}
+			t.Cleanup(func() { _ = l.Close() })
+
+			opts := []Option{
+				WithLimiter(l),
+				WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+					resp := testutil.HTTPResponse(http.StatusNoContent, "", nil)
+					resp.Request = r
+					return resp, nil
+				})),
+			}
+			if enabled {
+				opts = append(opts, WithPacingHeaders())
+			}
+			handler := New(testutil.DummyConfig(), opts...)
+
+			req := httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil)
+			req.Header.Set("X-Riot-Token-Index", "1")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Fatalf("status = %d, want %d", got, want)
+			}
+			if !enabled {
+				for _, name := range headers {
+					if got := rec.Header().Get(name); got != "" {
+						t.Fatalf("%s = %q, want absent", name, got)
+					}
+				}
+				return
+			}
+			if _, err := strconv.Atoi(rec.Header().Get("X-RiftRelay-Queue-Wait-Ms")); err != nil {
+				t.Fatalf("X-RiftRelay-Queue-Wait-Ms = %q, want a number", rec.Header().Get("X-RiftRelay-Queue-Wait-Ms"))
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Key-Index"), "1"; got != want {
+				t.Fatalf("X-RiftRelay-Key-Index = %q, want %q", got, want)
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Priority"), "normal"; got != want {
+				t.Fatalf("X-RiftRelay-Priority = %q, want %q", got, want)
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Paced"), "true"; got != want {
+				t.Fatalf("X-RiftRelay-Paced = %q, want %q", got, want)
+			}
+			if got, want := rec.Header().Get("X-RiftRelay-Queue-Position"), "0"; got != want {
+				t.Fatalf("X-RiftRelay-Queue-Position = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestProxyStreamsLargeBodyWhileObserving(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		l, err := limiter.New(limiter.Config{KeyCount: 1, QueueCapacity: 1, DefaultAppLimits: "100:1"})
+		if err != nil {
+			t.Fatalf("limiter.New() error = %v", err)
+		}
+		defer func() { _ = l.Close() }()
+
+		payload := make([]byte, 4<<20)
+		for i := range payload {
+			payload[i] = byte(i % 251)
+		}
+		handler := New(testutil.DummyConfig(),
+			WithLimiter(l),
+			WithBaseTransport(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				body, writer := io.Pipe()
+				go func() {
+					// Stream in chunks smaller than the proxy's copy buffer.
+					for chunk := range slices.Chunk(payload, 7000) {
+						if _, err := writer.Write(chunk); err != nil {
+							return
+						}
+					}
+					_ = writer.Close()
+				}()
+				return &http.Response{
+					StatusCode:    http.StatusOK,
+					Header:        http.Header{"X-Method-Rate-Limit": []string{"2000:10"}, "X-Method-Rate-Limit-Count": []string{"1:10"}},
+					Body:          body,
+					ContentLength: -1,
+					Request:       r,
+				}, nil
+			})),
+		)
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/lol/match/v5/matches/EUW1_1/timeline", nil))
+
+		if got, want := rec.Code, http.StatusOK; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if !bytes.Equal(rec.Body.Bytes(), payload) {
+			t.Fatalf("body differs from upstream: got %d bytes, want %d", rec.Body.Len(), len(payload))
+		}
+		// Observations are processed asynchronously by the limiter loop.
+		synctest.Wait()
+		if l.ColdStart("europe:lol/match/v5/matches/{matchId}/timeline") {
+			t.Fatal("ColdStart() = true, want method limits learned from the streamed response")
+		}
+	})
+}
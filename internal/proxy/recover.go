@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/renja-g/RiftRelay/internal/metrics"
+)
+
+// recoverMiddleware turns a panic anywhere below it into a JSON 500 instead of
+// an aborted connection.
+func recoverMiddleware(m *metrics.Collector) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				rec := recover()
+				if rec == nil {
+					return
+				}
+				// ReverseProxy aborts on purpose when the client goes away mid-copy.
+				if err, ok := rec.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+					panic(rec)
+				}
+
+				log.Printf("panic_recovered method=%s path=%s err=%v\n%s", r.Method, r.URL.Path, rec, debug.Stack())
+				if m != nil {
+					m.ObservePanic()
+				}
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+				w.WriteHeader(http.StatusInternalServerError)
+				_, _ = w.Write([]byte(`{"error":"internal server error"}` + "\n"))
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
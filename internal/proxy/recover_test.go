@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/renja-g/RiftRelay/internal/metrics"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	t.Parallel()
+
+	collector := metrics.NewCollector()
+	handler := recoverMiddleware(collector)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("middleware exploded")
+	}))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/europe/riot/account/v1/accounts/me", nil))
+
+	if got, want := rec.Code, http.StatusInternalServerError; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	if got, want := rec.Header().Get("Content-Type"), "application/json; charset=utf-8"; got != want {
+		t.Fatalf("Content-Type = %q, want %q", got, want)
+	}
+	if got, want := rec.Body.String(), "{\"error\":\"internal server error\"}\n"; got != want {
+		t.Fatalf("body = %q, want %q", got, want)
+	}
+
+	scrape := httptest.NewRecorder()
+	collector.ServeHTTP(scrape, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.Contains(scrape.Body.String(), "riftrelay_panics_total 1") {
+		t.Fatalf("metrics missing riftrelay_panics_total 1:\n%s", scrape.Body.String())
+	}
+}
@@ -6,14 +6,18 @@ import (
 	"net/http"
 	"path"
 	"regexp"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 type PathInfo struct {
 	Region       string
 	UpstreamPath string
 	Bucket       string
+	// Pattern is the matched route template, or empty when no pattern matched.
+	Pattern string
 }
 
 var regionPattern = regexp.MustCompile(`^[a-z0-9-]+$`)
@@ -24,14 +28,125 @@ type pathPatternNode struct {
 	wildcard *pathPatternNode
 }
 
+// patternTable is an immutable set of route templates and the trie used to
+// match paths against them.
+type patternTable struct {
+	patterns []string
+	root     *pathPatternNode
+}
+
 var (
-	pathPatternRoot     *pathPatternNode
-	pathPatternRootOnce sync.Once
+	activePatterns  atomic.Pointer[patternTable]
+	builtinPatterns = sync.OnceValue(func() *patternTable { return newPatternTable(PathPatterns) })
 )
 
 type pathContextKey struct{}
 
+type options struct {
+	matchRegionPolicy MatchRegionPolicy
+	validateRouting   bool
+	disabledPatterns  map[string]struct{}
+	defaultRegion     string
+	forwardOptions    bool
+	maxPathBytes      int
+	maxPathSegments   int
+	validateMethods   bool
+}
+
+// Option configures ProxyHandler.
+type Option func(*options)
+
+// WithMatchRegionPolicy validates or corrects the region of matchId lookups.
+func WithMatchRegionPolicy(policy MatchRegionPolicy) Option {
+	return func(o *options) {
+		o.matchRegionPolicy = policy
+	}
+}
+
+// WithRoutingValidation rejects known routes requested on the wrong routing
+// group, such as a regional API on a platform region.
+func WithRoutingValidation() Option {
+	return func(o *options) {
+		o.validateRouting = true
+	}
+}
+
+// WithDisabledPatterns answers 410 Gone for the given route templates, e.g.
+// deprecated endpoints, instead of forwarding them. The leading slash is
+// optional.
+func WithDisabledPatterns(patterns ...string) Option {
+	return func(o *options) {
+		if o.disabledPatterns == nil {
+			o.disabledPatterns = make(map[string]struct{}, len(patterns))
+		}
+		for _, pattern := range patterns {
+			o.disabledPatterns["/"+strings.TrimPrefix(pattern, "/")] = struct{}{}
+		}
+	}
+}
+
+// WithDefaultRegion routes paths whose first segment is not a known region,
+// such as "/lol/status/v4/platform-data", to region. Paths that start with a
+// region are unchanged.
+func WithDefaultRegion(region string) Option {
+	return func(o *options) {
+		o.defaultRegion = strings.ToLower(strings.TrimSpace(region))
+	}
+}
+
+// WithOptionsForwarding proxies OPTIONS requests like any other method instead
+// of answering them locally.
+func WithOptionsForwarding() Option {
+	return func(o *options) {
+		o.forwardOptions = true
+	}
+}
+
+// WithPathLimits answers 414 for paths longer than maxBytes or with more than
+// maxSegments segments, region included, before any pattern matching. Zero
+// leaves that dimension unchecked.
+func WithPathLimits(maxBytes, maxSegments int) Option {
+	return func(o *options) {
+		o.maxPathBytes = maxBytes
+		o.maxPathSegments = maxSegments
+	}
+}
+
+// WithMethodValidation answers 405 with an Allow header, instead of forwarding,
+// requests whose method the matched route does not accept according to
+// UsePathMethods. Riot would spend a rate-limit token on the same answer.
+// OPTIONS is not validated.
+func WithMethodValidation() Option {
+	return func(o *options) {
+		o.validateMethods = true
+	}
+}
+
+// allowedMethods is the Allow header sent for OPTIONS answered locally on a
+// pattern without methods from UsePathMethods.
+const allowedMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+
+// optionsAllow returns the Allow header for an OPTIONS on pattern answered
+// locally: the methods the spec lists for it, or allowedMethods when unknown.
+func optionsAllow(pattern string) string {
+	allowed := allowedFor(pattern)
+	if allowed == nil {
+		return allowedMethods
+	}
+	return strings.Join(allowed, ", ") + ", " + http.MethodOptions
+}
+
+func (o options) pathTooLong(path string) bool {
+	if o.maxPathBytes > 0 && len(path) > o.maxPathBytes {
+		return true
+	}
+	return o.maxPathSegments > 0 && strings.Count(strings.Trim(path, "/"), "/")+1 > o.maxPathSegments
+}
+
 // ParsePath converts "/region/rest/of/path" into validated, canonical routing info.
+// The region is lowercased and a trailing slash on the upstream path is
+// dropped, so "/NA1/lol/status/v4/platform-data/" routes like its canonical
+// form. A region with nothing after it is still rejected.
 func ParsePath(rawPath string) (PathInfo, error) {
 	trimmed := strings.TrimSpace(rawPath)
 	trimmed = strings.TrimPrefix(trimmed, "/")
@@ -63,21 +178,42 @@ func ParsePath(rawPath string) (PathInfo, error) {
 	return PathInfo{
 		Region:       region,
 		UpstreamPath: upstreamPath,
-		Bucket:       region + ":" + strings.TrimPrefix(bucketPath, "/"),
+		Bucket:       bucketKey(region, bucketPath),
+		Pattern:      pattern,
 	}, nil
 }
 
-func ensurePathPatternRoot() {
-	pathPatternRootOnce.Do(func() {
-		pathPatternRoot = &pathPatternNode{children: make(map[string]*pathPatternNode)}
-		for _, p := range PathPatterns {
-			insertPathPattern(p)
-		}
-	})
+func firstSegment(rawPath string) string {
+	segment, _, _ := strings.Cut(strings.TrimPrefix(rawPath, "/"), "/")
+	return strings.ToLower(segment)
+}
+
+func bucketKey(region, bucketPath string) string {
+	return region + ":" + strings.TrimPrefix(bucketPath, "/")
+}
+
+// currentPatterns returns the table installed by UsePathPatterns, or the
+// generated PathPatterns.
+func currentPatterns() *patternTable {
+	if table := activePatterns.Load(); table != nil {
+		return table
+	}
+	return builtinPatterns()
+}
+
+func newPatternTable(patterns []string) *patternTable {
+	table := &patternTable{
+		patterns: patterns,
+		root:     &pathPatternNode{children: make(map[string]*pathPatternNode)},
+	}
+	for _, p := range patterns {
+		table.root.insert(p)
+	}
+	return table
 }
 
-func insertPathPattern(pattern string) {
-	current := pathPatternRoot
+func (n *pathPatternNode) insert(pattern string) {
+	current := n
 	cleanPattern := strings.TrimPrefix(pattern, "/")
 	segments := strings.Split(cleanPattern, "/")
 
@@ -101,9 +237,11 @@ func insertPathPattern(pattern string) {
 }
 
 func matchPathPattern(upstreamPath string) string {
-	ensurePathPatternRoot()
+	return currentPatterns().match(upstreamPath)
+}
 
-	current := pathPatternRoot
+func (t *patternTable) match(upstreamPath string) string {
+	current := t.root
 	pathWithoutPrefix := strings.TrimPrefix(upstreamPath, "/")
 	if pathWithoutPrefix == "" {
 		return ""
@@ -139,14 +277,59 @@ func PathFromContext(ctx context.Context) (info PathInfo, ok bool) {
 }
 
 // ProxyHandler validates the incoming path and injects path info for the proxy director.
-func ProxyHandler(proxy http.Handler) http.Handler {
+func ProxyHandler(proxy http.Handler, opts ...Option) http.Handler {
+	o := options{matchRegionPolicy: MatchRegionOff}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		info, err := ParsePath(r.URL.Path)
+		rawPath := r.URL.Path
+		if o.pathTooLong(rawPath) {
+			http.Error(w, "request path too long", http.StatusRequestURITooLong)
+			return
+		}
+		if o.defaultRegion != "" && !knownRegion(firstSegment(rawPath)) {
+			rawPath = "/" + o.defaultRegion + "/" + strings.TrimPrefix(rawPath, "/")
+		}
+		info, err := ParsePath(rawPath)
 		if err != nil {
 			http.Error(w, "expected path /{region}/riot/...", http.StatusBadRequest)
 			return
 		}
 
+		info, err = applyMatchRegionPolicy(info, o.matchRegionPolicy)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if o.validateRouting {
+			if err := validateRoutingGroup(info); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if _, disabled := o.disabledPatterns[info.Pattern]; disabled {
+			http.Error(w, "endpoint disabled: "+info.Pattern, http.StatusGone)
+			return
+		}
+		// Riot does not implement OPTIONS; forwarding one would spend a
+		// rate-limit token on an error.
+		if r.Method == http.MethodOptions && !o.forwardOptions {
+			w.Header().Set("Allow", optionsAllow(info.Pattern))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		// A forwarded OPTIONS is a preflight or capability probe, which the
+		// spec's method lists do not describe.
+		if o.validateMethods && r.Method != http.MethodOptions {
+			if allowed := allowedFor(info.Pattern); allowed != nil && !slices.Contains(allowed, r.Method) {
+				w.Header().Set("Allow", strings.Join(allowed, ", "))
+				http.Error(w, "method not allowed for "+info.Pattern, http.StatusMethodNotAllowed)
+				return
+			}
+		}
+
 		r = r.WithContext(WithPath(r.Context(), info))
 		proxy.ServeHTTP(w, r)
 	})
@@ -3,6 +3,7 @@ package router
 import (
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 )
 
@@ -22,6 +23,7 @@ func TestParsePath(t *testing.T) {
 				Region:       "europe",
 				UpstreamPath: "/riot/account/v1/accounts/by-riot-id/Someone/EUW1",
 				Bucket:       "europe:riot/account/v1/accounts/by-riot-id/{gameName}/{tagLine}",
+				Pattern:      "/riot/account/v1/accounts/by-riot-id/{gameName}/{tagLine}",
 			},
 		},
 		{
@@ -40,10 +42,32 @@ func TestParsePath(t *testing.T) {
 				Region:       "na1",
 				UpstreamPath: "/riot/account/v1/accounts/me",
 				Bucket:       "na1:riot/account/v1/accounts/me",
+				Pattern:      "/riot/account/v1/accounts/me",
+			},
+		},
+		{
+			name:    "lowercases mixed-case region",
+			rawPath: "/NA1/lol/status/v4/platform-data",
+			want: PathInfo{
+				Region:       "na1",
+				UpstreamPath: "/lol/status/v4/platform-data",
+				Bucket:       "na1:lol/status/v4/platform-data",
+				Pattern:      "/lol/status/v4/platform-data",
+			},
+		},
+		{
+			name:    "drops trailing slash",
+			rawPath: "/na1/lol/status/v4/platform-data/",
+			want: PathInfo{
+				Region:       "na1",
+				UpstreamPath: "/lol/status/v4/platform-data",
+				Bucket:       "na1:lol/status/v4/platform-data",
+				Pattern:      "/lol/status/v4/platform-data",
 			},
 		},
 		{name: "missing region", rawPath: "/", wantErr: true},
 		{name: "missing upstream path", rawPath: "/europe", wantErr: true},
+		{name: "region with trailing slash only", rawPath: "/na1/", wantErr: true},
 		{name: "invalid region", rawPath: "/EU West/riot/account/v1/accounts/me", wantErr: true},
 	}
 
@@ -98,6 +122,326 @@ func TestProxyHandler(t *testing.T) {
 		}
 	})
 
+	t.Run("rejects matchId from another region", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("inner handler should not be called")
+		}), WithMatchRegionPolicy(MatchRegionReject))
+
+		req := httptest.NewRequest(http.MethodGet, "/americas/lol/match/v5/matches/EUW1_1234567890", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusBadRequest; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("corrects matchId region", func(t *testing.T) {
+		t.Parallel()
+
+		var got PathInfo
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = PathFromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}), WithMatchRegionPolicy(MatchRegionCorrect))
+
+		req := httptest.NewRequest(http.MethodGet, "/americas/lol/match/v5/matches/EUW1_1234567890/timeline", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got.Region != "europe" || got.Bucket != "europe:lol/match/v5/matches/{matchId}/timeline" {
+			t.Fatalf("got PathInfo = %#v", got)
+		}
+	})
+
+	t.Run("passes matching matchId region", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), WithMatchRegionPolicy(MatchRegionReject))
+
+		req := httptest.NewRequest(http.MethodGet, "/europe/lol/match/v5/matches/EUW1_1234567890", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("rejects platform region for regional route", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("inner handler should not be called")
+		}), WithRoutingValidation())
+
+		req := httptest.NewRequest(http.MethodGet, "/na1/lol/match/v5/matches/NA1_1234567890", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusBadRequest; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Body.String(), "match-v5 requires a regional route (americas/europe/asia/sea/esports)\n"; got != want {
+			t.Fatalf("body = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("passes matching routing groups", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), WithRoutingValidation())
+
+		for _, path := range []string{
+			"/americas/lol/match/v5/matches/NA1_1234567890",
+			"/na1/lol/summoner/v4/summoners/by-puuid/abc",
+			"/europe/tft/match/v1/matches/EUW1_1",
+			"/americas/lol/tournament/v5/codes/CODE-1",
+			"/americas/lol/tournament-stub/v5/providers",
+			"/eu/val/content/v1/contents",
+		} {
+			req := httptest.NewRequest(http.MethodGet, path, nil)
+			rec := httptest.NewRecorder()
+
+			handler.ServeHTTP(rec, req)
+
+			if got, want := rec.Code, http.StatusNoContent; got != want {
+				t.Fatalf("%s status = %d, want %d", path, got, want)
+			}
+		}
+	})
+
+	t.Run("answers disabled patterns with gone", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), WithDisabledPatterns("lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}"))
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/summoner/v4/summoners/by-puuid/abc", nil))
+		if got, want := rec.Code, http.StatusGone; got != want {
+			t.Fatalf("disabled status = %d, want %d", got, want)
+		}
+		if got, want := rec.Body.String(), "endpoint disabled: /lol/summoner/v4/summoners/by-puuid/{encryptedPUUID}\n"; got != want {
+			t.Fatalf("disabled body = %q, want %q", got, want)
+		}
+
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/euw1/lol/status/v4/platform-data", nil))
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("enabled status = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("prepends default region", func(t *testing.T) {
+		t.Parallel()
+
+		var got PathInfo
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = PathFromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}), WithDefaultRegion("euw1"))
+
+		for path, want := range map[string]PathInfo{
+			"/lol/status/v4/platform-data": {
+				Region:       "euw1",
+				UpstreamPath: "/lol/status/v4/platform-data",
+				Bucket:       "euw1:lol/status/v4/platform-data",
+				Pattern:      "/lol/status/v4/platform-data",
+			},
+			"/na1/lol/status/v4/platform-data": {
+				Region:       "na1",
+				UpstreamPath: "/lol/status/v4/platform-data",
+				Bucket:       "na1:lol/status/v4/platform-data",
+				Pattern:      "/lol/status/v4/platform-data",
+			},
+			"/europe/riot/account/v1/accounts/me": {
+				Region:       "europe",
+				UpstreamPath: "/riot/account/v1/accounts/me",
+				Bucket:       "europe:riot/account/v1/accounts/me",
+				Pattern:      "/riot/account/v1/accounts/me",
+			},
+		} {
+			got = PathInfo{}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if code := rec.Code; code != http.StatusNoContent {
+				t.Fatalf("%s status = %d, want %d", path, code, http.StatusNoContent)
+			}
+			if got != want {
+				t.Fatalf("%s PathInfo = %#v, want %#v", path, got, want)
+			}
+		}
+	})
+
+	t.Run("answers OPTIONS without proxying", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("inner handler should not be called")
+		}))
+
+		req := httptest.NewRequest(http.MethodOptions, "/europe/riot/account/v1/accounts/me", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Allow"), "GET, HEAD, POST, PUT, DELETE, OPTIONS"; got != want {
+			t.Fatalf("Allow = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("forwards OPTIONS when enabled", func(t *testing.T) {
+		t.Parallel()
+
+		called := false
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			called = true
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}), WithOptionsForwarding())
+
+		req := httptest.NewRequest(http.MethodOptions, "/europe/riot/account/v1/accounts/me", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if !called {
+			t.Fatal("inner handler was not called")
+		}
+		if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got := rec.Header().Get("Allow"); got != "" {
+			t.Fatalf("Allow = %q, want unset", got)
+		}
+	})
+
+	t.Run("answers disallowed methods locally", func(t *testing.T) {
+		methods, err := MethodsFromSpec([]byte(`{
+			"paths": {
+				"/lol/tournament/v5/codes": {"post": {}, "parameters": []},
+				"/riot/account/v1/accounts/me": {"get": {}}
+			}
+		}`))
+		if err != nil {
+			t.Fatalf("MethodsFromSpec() error = %v", err)
+		}
+		UsePathMethods(methods)
+		t.Cleanup(func() { UsePathMethods(nil) })
+
+		var calls int
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusOK)
+		}), WithMethodValidation(), WithOptionsForwarding())
+		serve := func(method, path string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+			return rec
+		}
+
+		rec := serve(http.MethodGet, "/americas/lol/tournament/v5/codes")
+		if got, want := rec.Code, http.StatusMethodNotAllowed; got != want {
+			t.Fatalf("GET status = %d, want %d", got, want)
+		}
+		if got, want := rec.Header().Get("Allow"), "POST"; got != want {
+			t.Fatalf("Allow = %q, want %q", got, want)
+		}
+		rec = serve(http.MethodPost, "/europe/riot/account/v1/accounts/me")
+		if got, want := rec.Header().Get("Allow"), "GET, HEAD"; rec.Code != http.StatusMethodNotAllowed || got != want {
+			t.Fatalf("POST status, Allow = %d, %q, want %d, %q", rec.Code, got, http.StatusMethodNotAllowed, want)
+		}
+		if calls != 0 {
+			t.Fatalf("inner handler called %d times for disallowed methods", calls)
+		}
+
+		for _, req := range []struct{ method, path string }{
+			{http.MethodPost, "/americas/lol/tournament/v5/codes"},
+			{http.MethodHead, "/europe/riot/account/v1/accounts/me"},
+			{http.MethodOptions, "/europe/riot/account/v1/accounts/me"},
+			// Patterns the spec does not cover are forwarded as before.
+			{http.MethodDelete, "/euw1/lol/status/v4/platform-data"},
+		} {
+			if rec := serve(req.method, req.path); rec.Code != http.StatusOK {
+				t.Fatalf("%s %s status = %d, want %d", req.method, req.path, rec.Code, http.StatusOK)
+			}
+		}
+
+		// OPTIONS answered locally lists the same methods.
+		local := ProxyHandler(http.NotFoundHandler(), WithMethodValidation())
+		for _, tt := range []struct{ path, want string }{
+			{"/americas/lol/tournament/v5/codes", "POST, OPTIONS"},
+			{"/europe/riot/account/v1/accounts/me", "GET, HEAD, OPTIONS"},
+			{"/euw1/lol/status/v4/platform-data", "GET, HEAD, POST, PUT, DELETE, OPTIONS"},
+		} {
+			rec := httptest.NewRecorder()
+			local.ServeHTTP(rec, httptest.NewRequest(http.MethodOptions, tt.path, nil))
+			if got := rec.Header().Get("Allow"); rec.Code != http.StatusNoContent || got != tt.want {
+				t.Fatalf("OPTIONS %s status, Allow = %d, %q, want %d, %q", tt.path, rec.Code, got, http.StatusNoContent, tt.want)
+			}
+		}
+	})
+
+	t.Run("rejects overlong paths", func(t *testing.T) {
+		t.Parallel()
+
+		handler := ProxyHandler(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+			t.Fatal("inner handler should not be called")
+		}), WithPathLimits(256, 16))
+
+		for _, path := range []string{
+			"/europe/riot/account/v1/accounts/by-riot-id/" + strings.Repeat("a", 256) + "/tag",
+			"/na1" + strings.Repeat("/x", 16),
+		} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+			if got, want := rec.Code, http.StatusRequestURITooLong; got != want {
+				t.Fatalf("status for %d-byte path = %d, want %d", len(path), got, want)
+			}
+		}
+	})
+
+	t.Run("passes deep paths within limits", func(t *testing.T) {
+		t.Parallel()
+
+		var got PathInfo
+		handler := ProxyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, _ = PathFromContext(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}), WithPathLimits(256, 16))
+
+		req := httptest.NewRequest(http.MethodGet, "/na1/lol/challenges/v1/challenges/101000/leaderboards/by-level/MASTER", nil)
+		rec := httptest.NewRecorder()
+
+		handler.ServeHTTP(rec, req)
+
+		if got, want := rec.Code, http.StatusNoContent; got != want {
+			t.Fatalf("status = %d, want %d", got, want)
+		}
+		if got, want := got.Pattern, "/lol/challenges/v1/challenges/{challengeId}/leaderboards/by-level/{level}"; got != want {
+			t.Fatalf("Pattern = %q, want %q", got, want)
+		}
+	})
+
 	t.Run("rejects invalid paths", func(t *testing.T) {
 		t.Parallel()
 
@@ -115,3 +459,61 @@ func TestProxyHandler(t *testing.T) {
 		}
 	})
 }
+
+func TestPatternsFromSpec(t *testing.T) {
+	t.Parallel()
+
+	patterns, err := PatternsFromSpec([]byte(`{
+		"openapi": "3.0.0",
+		"paths": {
+			"/lol/new-feature/v1/things/{thingId}": {"get": {"operationId": "new-feature-v1.getThing"}},
+			"/lol/new-feature/v1/things/{thingId}/parts": {"get": {"operationId": "new-feature-v1.getParts"}}
+		}
+	}`))
+	if err != nil {
+		t.Fatalf("PatternsFromSpec() error = %v", err)
+	}
+
+	table := newPatternTable(patterns)
+	if got, want := table.match("/lol/new-feature/v1/things/42"), "/lol/new-feature/v1/things/{thingId}"; got != want {
+		t.Fatalf("match() = %q, want %q", got, want)
+	}
+	if got, want := table.match("/lol/new-feature/v1/things/42/parts"), "/lol/new-feature/v1/things/{thingId}/parts"; got != want {
+		t.Fatalf("match() = %q, want %q", got, want)
+	}
+	if got := table.match("/lol/summoner/v4/summoners/by-puuid/abc"); got != "" {
+		t.Fatalf("match() = %q, want no match outside the loaded spec", got)
+	}
+
+	if _, err := PatternsFromSpec([]byte(`{"paths":{}}`)); err == nil {
+		t.Fatal("PatternsFromSpec() error = nil for a spec without paths")
+	}
+}
+
+func TestRegisterPattern(t *testing.T) {
+	t.Parallel()
+
+	if err := RegisterPattern("/acme/stats/v1/players/{playerId}/matches"); err != nil {
+		t.Fatalf("RegisterPattern() error = %v", err)
+	}
+
+	got, err := ParsePath("/americas/acme/stats/v1/players/p-42/matches")
+	if err != nil {
+		t.Fatalf("ParsePath() error = %v", err)
+	}
+	if want := "/acme/stats/v1/players/{playerId}/matches"; got.Pattern != want {
+		t.Fatalf("Pattern = %q, want %q", got.Pattern, want)
+	}
+	if want := "americas:acme/stats/v1/players/{playerId}/matches"; got.Bucket != want {
+		t.Fatalf("Bucket = %q, want %q", got.Bucket, want)
+	}
+	if got, err := ParsePath("/na1/lol/status/v4/platform-data"); err != nil || got.Pattern != "/lol/status/v4/platform-data" {
+		t.Fatalf("built-in pattern after RegisterPattern() = %q, %v", got.Pattern, err)
+	}
+
+	for _, pattern := range []string{"acme/no-slash", "/", "/acme//double", "/acme/{bad", "/acme/{}", "/acme/pre{id}"} {
+		if err := RegisterPattern(pattern); err == nil {
+			t.Fatalf("RegisterPattern(%q) error = nil, want non-nil", pattern)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatchRegionPolicy controls how a matchId whose platform prefix disagrees
+// with the requested routing region is handled.
+type MatchRegionPolicy string
+
+const (
+	MatchRegionOff     MatchRegionPolicy = "off"
+	MatchRegionReject  MatchRegionPolicy = "reject"
+	MatchRegionCorrect MatchRegionPolicy = "correct"
+)
+
+// platformClusters maps platform routing values to the regional cluster that
+// serves their match history.
+var platformClusters = map[string]string{
+	"na1":  "americas",
+	"br1":  "americas",
+	"la1":  "americas",
+	"la2":  "americas",
+	"euw1": "europe",
+	"eun1": "europe",
+	"tr1":  "europe",
+	"ru":   "europe",
+	"me1":  "europe",
+	"kr":   "asia",
+	"jp1":  "asia",
+	"oc1":  "sea",
+	"ph2":  "sea",
+	"sg2":  "sea",
+	"th2":  "sea",
+	"tw2":  "sea",
+	"vn2":  "sea",
+}
+
+// platformPrefixedMatchPatterns are the routes whose matchId starts with the
+// platform it was played on (e.g. "EUW1_1234567890").
+var platformPrefixedMatchPatterns = map[string]struct{}{
+	"/lol/match/v5/matches/{matchId}":          {},
+	"/lol/match/v5/matches/{matchId}/timeline": {},
+	"/tft/match/v1/matches/{matchId}":          {},
+}
+
+// matchIDCluster returns the regional cluster encoded in the request's matchId.
+func matchIDCluster(info PathInfo) (string, bool) {
+	if _, ok := platformPrefixedMatchPatterns[info.Pattern]; !ok {
+		return "", false
+	}
+
+	patternSegments := strings.Split(strings.TrimPrefix(info.Pattern, "/"), "/")
+	pathSegments := strings.Split(strings.TrimPrefix(info.UpstreamPath, "/"), "/")
+	for i, segment := range patternSegments {
+		if segment != "{matchId}" || i >= len(pathSegments) {
+			continue
+		}
+		platform, _, ok := strings.Cut(pathSegments[i], "_")
+		if !ok {
+			return "", false
+		}
+		cluster, ok := platformClusters[strings.ToLower(platform)]
+		return cluster, ok
+	}
+	return "", false
+}
+
+func applyMatchRegionPolicy(info PathInfo, policy MatchRegionPolicy) (PathInfo, error) {
+	if policy != MatchRegionReject && policy != MatchRegionCorrect {
+		return info, nil
+	}
+
+	cluster, ok := matchIDCluster(info)
+	if !ok || cluster == info.Region {
+		return info, nil
+	}
+	if policy == MatchRegionReject {
+		return info, fmt.Errorf("matchId belongs to region %s, not %s", cluster, info.Region)
+	}
+
+	info.Region = cluster
+	info.Bucket = bucketKey(cluster, info.Pattern)
+	return info, nil
+}
@@ -0,0 +1,61 @@
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// RouteGroup lists the recognized patterns of one game/service pair, e.g. "lol/match".
+type RouteGroup struct {
+	Service  string   `json:"service"`
+	Patterns []string `json:"patterns"`
+}
+
+// RouteTable describes how request paths map to limiter buckets.
+type RouteTable struct {
+	BucketFormat string       `json:"bucket_format"`
+	Groups       []RouteGroup `json:"groups"`
+}
+
+// Routes groups the active path patterns by their first two path segments.
+func Routes() RouteTable {
+	byService := make(map[string][]string)
+	for _, pattern := range currentPatterns().patterns {
+		service := routeService(pattern)
+		byService[service] = append(byService[service], pattern)
+	}
+
+	groups := make([]RouteGroup, 0, len(byService))
+	for service, patterns := range byService {
+		sort.Strings(patterns)
+		groups = append(groups, RouteGroup{Service: service, Patterns: patterns})
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Service < groups[j].Service })
+
+	return RouteTable{
+		BucketFormat: "{region}:{pattern without leading slash}; unmatched paths use the raw upstream path",
+		Groups:       groups,
+	}
+}
+
+func routeService(pattern string) string {
+	parts := strings.SplitN(strings.TrimPrefix(pattern, "/"), "/", 3)
+	if len(parts) < 2 {
+		return parts[0]
+	}
+	return parts[0] + "/" + parts[1]
+}
+
+// RoutesHandler serves Routes as JSON.
+func RoutesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		encoder := json.NewEncoder(w)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(Routes()); err != nil {
+			http.Error(w, "cannot encode routes", http.StatusInternalServerError)
+		}
+	})
+}
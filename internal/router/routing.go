@@ -0,0 +1,100 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+)
+
+type routingGroup struct {
+	name    string
+	regions []string
+}
+
+var (
+	platformRouting = routingGroup{
+		name:    "platform",
+		regions: []string{"br1", "eun1", "euw1", "jp1", "kr", "la1", "la2", "me1", "na1", "oc1", "ph2", "ru", "sg2", "th2", "tr1", "tw2", "vn2"},
+	}
+	// Regional clusters have their own rate limits, so buckets keep the
+	// cluster the client asked for ("americas:lol/match/v5/...").
+	regionalRouting = routingGroup{
+		name:    "regional",
+		regions: []string{"americas", "europe", "asia", "sea", "esports"},
+	}
+	valorantRouting = routingGroup{
+		name:    "VALORANT shard",
+		regions: []string{"na", "eu", "ap", "kr", "br", "latam", "esports"},
+	}
+)
+
+// regionalPrefixes are the APIs served from regional clusters instead of platforms.
+var regionalPrefixes = []string{
+	"/lol/match/",
+	"/lol/rso-match/",
+	"/lol/tournament/",
+	"/lol/tournament-stub/",
+	"/riot/account/",
+	"/tft/match/",
+	"/lor/",
+	"/riftbound/",
+}
+
+// requiredRoutingGroup returns the routing group a route template must be called on.
+func requiredRoutingGroup(pattern string) routingGroup {
+	if strings.HasPrefix(pattern, "/val/") {
+		return valorantRouting
+	}
+	for _, prefix := range regionalPrefixes {
+		if strings.HasPrefix(pattern, prefix) {
+			return regionalRouting
+		}
+	}
+	return platformRouting
+}
+
+func (g routingGroup) contains(region string) bool {
+	for _, r := range g.regions {
+		if r == region {
+			return true
+		}
+	}
+	return false
+}
+
+// knownRegion reports whether region belongs to any routing group.
+func knownRegion(region string) bool {
+	return platformRouting.contains(region) || regionalRouting.contains(region) || valorantRouting.contains(region)
+}
+
+// KnownRegion reports whether region is a routing value Riot serves, such as
+// "euw1", "europe" or "eu".
+func KnownRegion(region string) bool {
+	return knownRegion(region)
+}
+
+// PlatformRegion reports whether region is a platform, such as "euw1".
+func PlatformRegion(region string) bool {
+	return platformRouting.contains(region)
+}
+
+// validateRoutingGroup rejects a known route requested on the wrong kind of
+// region, e.g. match-v5 on na1. Unmatched paths are not checked.
+func validateRoutingGroup(info PathInfo) error {
+	if info.Pattern == "" {
+		return nil
+	}
+	group := requiredRoutingGroup(info.Pattern)
+	if group.contains(info.Region) {
+		return nil
+	}
+	return fmt.Errorf("%s requires a %s route (%s)", apiName(info.Pattern), group.name, strings.Join(group.regions, "/"))
+}
+
+// apiName turns "/lol/match/v5/..." into "match-v5".
+func apiName(pattern string) string {
+	parts := strings.Split(strings.TrimPrefix(pattern, "/"), "/")
+	if len(parts) < 3 {
+		return pattern
+	}
+	return parts[1] + "-" + parts[2]
+}
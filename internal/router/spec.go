@@ -0,0 +1,150 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// PatternsFromSpec extracts the route templates from the paths of an OpenAPI
+// document, the same way scripts/generate_path_patterns.go does.
+func PatternsFromSpec(spec []byte) ([]string, error) {
+	var doc struct {
+		Paths map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("decode openapi spec: %w", err)
+	}
+
+	patterns := make([]string, 0, len(doc.Paths))
+	for p := range doc.Paths {
+		if strings.HasPrefix(p, "/") && len(p) > 1 {
+			patterns = append(patterns, p)
+		}
+	}
+	if len(patterns) == 0 {
+		return nil, errors.New("openapi spec has no paths")
+	}
+	sort.Strings(patterns)
+	return patterns, nil
+}
+
+// specMethods are the OpenAPI operation keys that name HTTP methods, in the
+// order an Allow header lists them.
+var specMethods = []string{"get", "head", "post", "put", "patch", "delete"}
+
+// MethodsFromSpec returns the HTTP methods each path of an OpenAPI document
+// accepts, keyed by route template. A path that accepts GET also accepts
+// HEAD.
+func MethodsFromSpec(spec []byte) (map[string][]string, error) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("decode openapi spec: %w", err)
+	}
+
+	methods := make(map[string][]string, len(doc.Paths))
+	for p, operations := range doc.Paths {
+		if !strings.HasPrefix(p, "/") || len(p) == 1 {
+			continue
+		}
+		var allowed []string
+		for _, method := range specMethods {
+			_, ok := operations[method]
+			if method == "head" {
+				_, ok = operations["get"]
+			}
+			if ok {
+				allowed = append(allowed, strings.ToUpper(method))
+			}
+		}
+		if len(allowed) > 0 {
+			methods[p] = allowed
+		}
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("openapi spec has no operations")
+	}
+	return methods, nil
+}
+
+// UsePathMethods sets the methods WithMethodValidation allows per route
+// template, as returned by MethodsFromSpec. Like UsePathPatterns it must be
+// called at startup, before serving traffic. Patterns missing from methods,
+// or every pattern while it was never called, accept any method.
+func UsePathMethods(methods map[string][]string) {
+	activeMethods.Store(&methods)
+}
+
+// activeMethods holds the table installed by UsePathMethods.
+var activeMethods atomic.Pointer[map[string][]string]
+
+// allowedFor returns the methods pattern accepts, or nil when unknown.
+func allowedFor(pattern string) []string {
+	methods := activeMethods.Load()
+	if methods == nil || pattern == "" {
+		return nil
+	}
+	return (*methods)[pattern]
+}
+
+// UsePathPatterns replaces the built-in PathPatterns for bucketing and
+// /debug/routes. Call it at startup, before serving traffic; requests already
+// in flight keep the table they matched against.
+func UsePathPatterns(patterns []string) {
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	activePatterns.Store(newPatternTable(append([]string(nil), patterns...)))
+}
+
+// registerMu serializes table replacements so concurrent registrations at
+// startup do not drop each other's patterns.
+var registerMu sync.Mutex
+
+var paramSegment = regexp.MustCompile(`^\{[A-Za-z][A-Za-z0-9_]*\}$`)
+
+// RegisterPattern adds a route template such as
+// "/acme/stats/v1/players/{playerId}" to the active patterns, for services
+// that are not in the built-in table. Like UsePathPatterns it must be called
+// at startup, before serving traffic, and after UsePathPatterns, which would
+// replace it.
+func RegisterPattern(pattern string) error {
+	if err := validatePattern(pattern); err != nil {
+		return err
+	}
+
+	registerMu.Lock()
+	defer registerMu.Unlock()
+	current := currentPatterns().patterns
+	if slices.Contains(current, pattern) {
+		return nil
+	}
+	patterns := append(slices.Clip(current), pattern)
+	sort.Strings(patterns)
+	activePatterns.Store(newPatternTable(patterns))
+	return nil
+}
+
+// validatePattern requires a leading slash, no empty segments, and braces
+// only as whole "{param}" segments.
+func validatePattern(pattern string) error {
+	if !strings.HasPrefix(pattern, "/") || len(pattern) == 1 {
+		return fmt.Errorf("pattern %q must start with / and name a path", pattern)
+	}
+	for _, segment := range strings.Split(pattern[1:], "/") {
+		if segment == "" {
+			return fmt.Errorf("pattern %q has an empty segment", pattern)
+		}
+		if strings.ContainsAny(segment, "{}") && !paramSegment.MatchString(segment) {
+			return fmt.Errorf("pattern %q has malformed parameter segment %q", pattern, segment)
+		}
+	}
+	return nil
+}
@@ -1,11 +1,18 @@
 package swagger
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/renja-g/RiftRelay/internal/clientip"
 )
 
 const (
@@ -16,15 +23,25 @@ const (
 
 // Handler serves a lightweight Swagger UI and an OpenAPI spec proxy.
 type Handler struct {
-	client  *http.Client
-	specURL string
+	client   *http.Client
+	specURLs []string
+	cacheTTL time.Duration
+	trusted  clientip.Trusted
+	basePath string
+
+	mu        sync.Mutex
+	cached    []byte
+	fetchedAt time.Time
 }
 
-func NewHandler() *Handler {
-	return NewHandlerWithClient(defaultSpecURL, &http.Client{Timeout: 15 * time.Second})
+// NewHandler fetches the spec from specURL (the public Riot schema when
+// empty) and keeps it in memory for cacheTTL. A zero TTL refetches on every
+// request.
+func NewHandler(specURL string, cacheTTL time.Duration) *Handler {
+	return NewHandlerWithClient(specURL, cacheTTL, &http.Client{Timeout: 15 * time.Second})
 }
 
-func NewHandlerWithClient(specURL string, client *http.Client) *Handler {
+func NewHandlerWithClient(specURL string, cacheTTL time.Duration, client *http.Client) *Handler {
 	if strings.TrimSpace(specURL) == "" {
 		specURL = defaultSpecURL
 	}
@@ -32,11 +49,35 @@ func NewHandlerWithClient(specURL string, client *http.Client) *Handler {
 		client = &http.Client{Timeout: 15 * time.Second}
 	}
 	return &Handler{
-		client:  client,
-		specURL: specURL,
+		client:   client,
+		specURLs: []string{specURL},
+		cacheTTL: cacheTTL,
 	}
 }
 
+// SetTrustedProxies makes the rewritten server URL follow X-Forwarded-Proto
+// and X-Forwarded-Host, but only for requests from trusted. Call it before
+// serving.
+func (h *Handler) SetTrustedProxies(trusted clientip.Trusted) {
+	h.trusted = trusted
+}
+
+// SetBasePath tells the handler it is mounted under prefix, so the UI loads
+// the spec and the rewritten server URL points at the proxy through it. The
+// handler still expects requests with the prefix already stripped. Call it
+// before serving.
+func (h *Handler) SetBasePath(prefix string) {
+	h.basePath = prefix
+}
+
+// AddSpecURLs adds documents, such as a companion API's, whose paths and
+// servers are merged into the spec from specURL. A path that is already
+// taken is served under /specN, N being the document's position counting the
+// primary as 1. Call it before serving.
+func (h *Handler) AddSpecURLs(urls ...string) {
+	h.specURLs = append(h.specURLs, urls...)
+}
+
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	switch r.URL.Path {
 	case uiPath, "/swagger/index.html":
@@ -50,36 +91,25 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 func (h *Handler) serveUI(w http.ResponseWriter) {
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	_, _ = fmt.Fprintf(w, swaggerUIHTML, specPath)
+	_, _ = fmt.Fprintf(w, swaggerUIHTML, h.basePath+specPath)
 }
 
 func (h *Handler) serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
-	upstreamReq, err := http.NewRequestWithContext(r.Context(), http.MethodGet, h.specURL, nil)
+	raw, err := h.Spec(r.Context())
 	if err != nil {
-		http.Error(w, "cannot build swagger spec request", http.StatusBadGateway)
-		return
-	}
-
-	resp, err := h.client.Do(upstreamReq)
-	if err != nil {
-		http.Error(w, "cannot load swagger spec upstream", http.StatusBadGateway)
-		return
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		http.Error(w, fmt.Sprintf("swagger spec upstream returned status %d", resp.StatusCode), http.StatusBadGateway)
+		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
 
+	// The server URL depends on the request, so the transformations run on a
+	// fresh copy of the cached upstream document every time.
 	var doc map[string]any
-	decoder := json.NewDecoder(resp.Body)
-	if err := decoder.Decode(&doc); err != nil {
+	if err := json.Unmarshal(raw, &doc); err != nil {
 		http.Error(w, "invalid swagger spec payload", http.StatusBadGateway)
 		return
 	}
 
-	rewriteServers(doc, r)
+	rewriteServers(doc, r, h.trusted, h.basePath)
 	stripSecurity(doc)
 	addProxyHeaderParameters(doc)
 	simplifyInfoDescription(doc)
@@ -92,8 +122,89 @@ func (h *Handler) serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func rewriteServers(doc map[string]any, r *http.Request) {
-	host := strings.TrimSpace(r.Host)
+// Spec returns the raw upstream document, merged with any added ones,
+// refetching it once the cache expires. A document that fails to load is
+// logged and left out; Spec fails only when none loads.
+func (h *Handler) Spec(ctx context.Context) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.cached != nil && time.Since(h.fetchedAt) < h.cacheTTL {
+		return h.cached, nil
+	}
+
+	raw, err := h.fetchSpecs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	h.cached = raw
+	h.fetchedAt = time.Now()
+	return raw, nil
+}
+
+// PrimarySpec returns the document at the URL NewHandler was given, without
+// the added ones, which describe other APIs than Riot's. It is not cached.
+func (h *Handler) PrimarySpec(ctx context.Context) ([]byte, error) {
+	return h.fetchSpec(ctx, h.specURLs[0])
+}
+
+func (h *Handler) fetchSpecs(ctx context.Context) ([]byte, error) {
+	if len(h.specURLs) == 1 {
+		return h.fetchSpec(ctx, h.specURLs[0])
+	}
+
+	var (
+		docs     []map[string]any
+		firstErr error
+	)
+	for i, specURL := range h.specURLs {
+		raw, err := h.fetchSpec(ctx, specURL)
+		var doc map[string]any
+		if err == nil && json.Unmarshal(raw, &doc) != nil {
+			err = errors.New("invalid swagger spec payload")
+		}
+		if err != nil {
+			log.Printf("swagger: spec %d (%s): %v; serving without it", i+1, specURL, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			docs = append(docs, nil)
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	merged := mergeSpecs(docs)
+	if merged == nil {
+		return nil, firstErr
+	}
+	return json.Marshal(merged)
+}
+
+func (h *Handler) fetchSpec(ctx context.Context, specURL string) ([]byte, error) {
+	upstreamReq, err := http.NewRequestWithContext(ctx, http.MethodGet, specURL, nil)
+	if err != nil {
+		return nil, errors.New("cannot build swagger spec request")
+	}
+
+	resp, err := h.client.Do(upstreamReq)
+	if err != nil {
+		return nil, errors.New("cannot load swagger spec upstream")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("swagger spec upstream returned status %d", resp.StatusCode)
+	}
+
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil || !json.Valid(raw) {
+		return nil, errors.New("invalid swagger spec payload")
+	}
+	return raw, nil
+}
+
+func rewriteServers(doc map[string]any, r *http.Request, trusted clientip.Trusted, basePath string) {
+	host := requestHost(r, trusted)
 	if host == "" {
 		host = "localhost"
 	}
@@ -110,7 +221,7 @@ func rewriteServers(doc map[string]any, r *http.Request) {
 
 	doc["servers"] = []any{
 		map[string]any{
-			"url": fmt.Sprintf("%s://%s/{region}", requestScheme(r), host),
+			"url": fmt.Sprintf("%s://%s%s/{region}", requestScheme(r, trusted), host, basePath),
 			"variables": map[string]any{
 				"region": regionVariable,
 			},
@@ -252,12 +363,17 @@ func simplifyInfoDescription(doc map[string]any) {
 	info["description"] = "Riot Games API documentation proxied through [RiftRelay](https://github.com/renja-g/RiftRelay).\n\nThis OpenAPI specification is based on [riotapi-schema](https://github.com/MingweiSamuel/riotapi-schema), automatically generated daily from the Riot Games API Reference."
 }
 
+// extractPlatformEnum unions the routing values of every upstream server, so
+// platform and regional routes both end up selectable. Order follows the
+// first appearance of each value.
 func extractPlatformEnum(doc map[string]any) []any {
 	servers, ok := doc["servers"].([]any)
 	if !ok {
 		return nil
 	}
 
+	var out []any
+	seen := make(map[any]struct{})
 	for _, rawServer := range servers {
 		server, ok := rawServer.(map[string]any)
 		if !ok {
@@ -269,33 +385,38 @@ func extractPlatformEnum(doc map[string]any) []any {
 			continue
 		}
 
-		platform, ok := variables["platform"].(map[string]any)
-		if !ok {
-			continue
-		}
-
-		enumValues, ok := platform["enum"].([]any)
-		if !ok || len(enumValues) == 0 {
-			continue
+		for _, name := range routingVariableNames {
+			variable, ok := variables[name].(map[string]any)
+			if !ok {
+				continue
+			}
+			enumValues, _ := variable["enum"].([]any)
+			for _, value := range enumValues {
+				if _, dup := seen[value]; dup {
+					continue
+				}
+				seen[value] = struct{}{}
+				out = append(out, value)
+			}
 		}
-
-		out := make([]any, len(enumValues))
-		copy(out, enumValues)
-		return out
 	}
 
-	return nil
+	return out
 }
 
-func requestScheme(r *http.Request) string {
-	if forwardedProto := strings.TrimSpace(r.Header.Get("X-Forwarded-Proto")); forwardedProto != "" {
-		parts := strings.Split(forwardedProto, ",")
-		if len(parts) > 0 {
-			value := strings.TrimSpace(parts[0])
-			if value != "" {
-				return value
-			}
-		}
+// routingVariableNames are the server variables the upstream spec uses for
+// the routing value.
+var routingVariableNames = []string{"platform", "region"}
+
+// requestScheme prefers the scheme the client used in front of a trusted
+// reverse proxy. Proxies may append their own hop, so only the first value
+// counts, and anything but http/https is ignored.
+func requestScheme(r *http.Request, trusted clientip.Trusted) string {
+	switch strings.ToLower(clientip.ForwardedValue(r, "X-Forwarded-Proto", trusted)) {
+	case "https":
+		return "https"
+	case "http":
+		return "http"
 	}
 	if r.TLS != nil {
 		return "https"
@@ -303,6 +424,15 @@ func requestScheme(r *http.Request) string {
 	return "http"
 }
 
+// requestHost prefers the client-facing host from X-Forwarded-Host sent by a
+// trusted proxy.
+func requestHost(r *http.Request, trusted clientip.Trusted) string {
+	if host := clientip.ForwardedValue(r, "X-Forwarded-Host", trusted); host != "" {
+		return host
+	}
+	return strings.TrimSpace(r.Host)
+}
+
 const (
 	priorityHeaderName   = "X-Priority"
 	rateBudgetHeaderName = "X-Rate-Budget"
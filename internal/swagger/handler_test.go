@@ -1,14 +1,20 @@
 package swagger
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"testing/synctest"
+	"time"
 
+	"github.com/renja-g/RiftRelay/internal/clientip"
 	"github.com/renja-g/RiftRelay/internal/testutil"
 )
 
@@ -24,7 +30,7 @@ func TestHandlerServeHTTP(t *testing.T) {
 	t.Run("serves swagger ui", func(t *testing.T) {
 		t.Parallel()
 
-		handler := NewHandlerWithClient("https://example.invalid/openapi.json", &http.Client{
+		handler := NewHandlerWithClient("https://example.invalid/openapi.json", 0, &http.Client{
 			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
 				t.Fatal("spec client should not be used for UI route")
 				return nil, nil
@@ -47,7 +53,7 @@ func TestHandlerServeHTTP(t *testing.T) {
 	t.Run("rewrites upstream spec offline", func(t *testing.T) {
 		t.Parallel()
 
-		handler := NewHandlerWithClient("https://example.invalid/openapi.json", &http.Client{
+		handler := NewHandlerWithClient("https://example.invalid/openapi.json", 0, &http.Client{
 			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
 				return testutil.HTTPResponseBytes(http.StatusOK, fixture, http.Header{
 					"Content-Type": []string{"application/json"},
@@ -55,7 +61,14 @@ func TestHandlerServeHTTP(t *testing.T) {
 			}),
 		})
 
+		trusted, err := clientip.ParseTrusted([]string{"192.0.2.0/24"})
+		if err != nil {
+			t.Fatalf("ParseTrusted() error = %v", err)
+		}
+		handler.SetTrustedProxies(trusted)
+
 		req := httptest.NewRequest(http.MethodGet, "/swagger/openapi.json", nil)
+		req.RemoteAddr = "192.0.2.10:4000"
 		req.Host = "relay.local"
 		req.Header.Set("X-Forwarded-Proto", "https")
 		rec := httptest.NewRecorder()
@@ -108,10 +121,41 @@ func TestHandlerServeHTTP(t *testing.T) {
 		}
 	})
 
+	t.Run("points ui and servers through base path", func(t *testing.T) {
+		t.Parallel()
+
+		handler := NewHandlerWithClient("https://example.invalid/openapi.json", 0, &http.Client{
+			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return testutil.HTTPResponseBytes(http.StatusOK, fixture, nil), nil
+			}),
+		})
+		handler.SetBasePath("/riot")
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger/", nil))
+		if !strings.Contains(rec.Body.String(), `url: "/riot/swagger/openapi.json"`) {
+			t.Fatalf("UI body = %q, want spec path under base path", rec.Body.String())
+		}
+
+		req := httptest.NewRequest(http.MethodGet, "/swagger/openapi.json", nil)
+		req.Host = "relay.local"
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		var doc map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("json.Unmarshal() error = %v", err)
+		}
+		server := doc["servers"].([]any)[0].(map[string]any)
+		if got, want := server["url"], "http://relay.local/riot/{region}"; got != want {
+			t.Fatalf("server url = %v, want %v", got, want)
+		}
+	})
+
 	t.Run("maps bad upstream payloads to bad gateway", func(t *testing.T) {
 		t.Parallel()
 
-		handler := NewHandlerWithClient("https://example.invalid/openapi.json", &http.Client{
+		handler := NewHandlerWithClient("https://example.invalid/openapi.json", 0, &http.Client{
 			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
 				return testutil.HTTPResponse(http.StatusOK, "{not json", nil), nil
 			}),
@@ -127,3 +171,143 @@ func TestHandlerServeHTTP(t *testing.T) {
 		}
 	})
 }
+
+func TestHandlerCachesSpec(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		var fetches atomic.Int32
+		handler := NewHandlerWithClient("https://example.invalid/openapi.json", time.Minute, &http.Client{
+			Transport: testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+				fetches.Add(1)
+				return testutil.HTTPResponse(http.StatusOK, `{"openapi":"3.0.0","paths":{}}`, nil), nil
+			}),
+		})
+
+		get := func() {
+			t.Helper()
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger/openapi.json", nil))
+			if got, want := rec.Code, http.StatusOK; got != want {
+				t.Fatalf("status = %d, want %d", got, want)
+			}
+		}
+
+		get()
+		time.Sleep(30 * time.Second)
+		get()
+		if got, want := fetches.Load(), int32(1); got != want {
+			t.Fatalf("upstream fetches within TTL = %d, want %d", got, want)
+		}
+
+		time.Sleep(31 * time.Second)
+		get()
+		if got, want := fetches.Load(), int32(2); got != want {
+			t.Fatalf("upstream fetches after TTL = %d, want %d", got, want)
+		}
+	})
+}
+
+func TestHandlerMergesSpecs(t *testing.T) {
+	t.Parallel()
+
+	specs := map[string]string{
+		"https://riot.example/openapi.json": `{
+			"openapi": "3.0.0",
+			"servers": [{"url": "https://{platform}.api.riotgames.com", "variables": {"platform": {"enum": ["na1", "euw1"]}}}],
+			"paths": {
+				"/lol/status/v4/platform-data": {"get": {"operationId": "riot-status"}},
+				"/shared/v1/ping": {"get": {"operationId": "riot-ping"}}
+			}
+		}`,
+		"https://internal.example/openapi.json": `{
+			"openapi": "3.0.0",
+			"servers": [{"url": "https://{platform}.internal.example", "variables": {"platform": {"enum": ["euw1", "kr"]}}}],
+			"paths": {
+				"/internal/v1/players": {"get": {"operationId": "internal-players"}},
+				"/shared/v1/ping": {"get": {"operationId": "internal-ping"}}
+			}
+		}`,
+	}
+	handler := NewHandlerWithClient("https://riot.example/openapi.json", 0, &http.Client{
+		Transport: testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			body, ok := specs[r.URL.String()]
+			if !ok {
+				return testutil.HTTPResponse(http.StatusServiceUnavailable, "", nil), nil
+			}
+			return testutil.HTTPResponse(http.StatusOK, body, nil), nil
+		}),
+	})
+	handler.AddSpecURLs("https://internal.example/openapi.json", "https://down.example/openapi.json")
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/swagger/openapi.json", nil))
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+
+	var doc map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+	paths := doc["paths"].(map[string]any)
+	for path, operationID := range map[string]string{
+		"/lol/status/v4/platform-data": "riot-status",
+		"/shared/v1/ping":              "riot-ping",
+		"/internal/v1/players":         "internal-players",
+		"/spec2/shared/v1/ping":        "internal-ping",
+	} {
+		item, ok := paths[path].(map[string]any)
+		if !ok {
+			t.Fatalf("merged spec is missing path %q", path)
+		}
+		if got := item["get"].(map[string]any)["operationId"]; got != operationID {
+			t.Fatalf("%s operationId = %v, want %q", path, got, operationID)
+		}
+	}
+
+	server := doc["servers"].([]any)[0].(map[string]any)
+	region := server["variables"].(map[string]any)["region"].(map[string]any)
+	if got, want := fmt.Sprint(region["enum"]), "[na1 euw1 kr]"; got != want {
+		t.Fatalf("region enum = %s, want %s", got, want)
+	}
+
+	primary, err := handler.PrimarySpec(context.Background())
+	if err != nil {
+		t.Fatalf("PrimarySpec() error = %v", err)
+	}
+	if !strings.Contains(string(primary), "riot-status") || strings.Contains(string(primary), "internal-players") {
+		t.Fatalf("PrimarySpec() = %s, want the Riot document alone", primary)
+	}
+
+	// Added documents do not stand in for a primary that fails.
+	down := NewHandlerWithClient("https://down.example/openapi.json", 0, handler.client)
+	down.AddSpecURLs("https://internal.example/openapi.json")
+	if _, err := down.PrimarySpec(context.Background()); err == nil {
+		t.Fatal("PrimarySpec() error = nil with the primary down")
+	}
+}
+
+func TestExtractPlatformEnumUnionsServers(t *testing.T) {
+	t.Parallel()
+
+	var doc map[string]any
+	err := json.Unmarshal([]byte(`{
+		"servers": [
+			{"url": "https://{platform}.api.riotgames.com", "variables": {"platform": {"enum": ["na1", "euw1"]}}},
+			{"url": "https://{platform}.api.riotgames.com", "variables": {"platform": {"enum": ["americas", "europe", "na1"]}}}
+		]
+	}`), &doc)
+	if err != nil {
+		t.Fatalf("json.Unmarshal() error = %v", err)
+	}
+
+	got := extractPlatformEnum(doc)
+	want := []any{"na1", "euw1", "americas", "europe"}
+	if len(got) != len(want) {
+		t.Fatalf("enum = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("enum = %v, want %v", got, want)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package swagger
+
+import "fmt"
+
+// mergeSpecs folds docs into the first one that loaded, nil entries being
+// documents that failed. Paths are added as they come, a path another
+// document already has moving under /specN with N its 1-based position.
+// Servers are concatenated, so the region enum becomes the union of all
+// documents' routing values, and components are added unless the name is
+// taken. It returns nil when no document loaded.
+func mergeSpecs(docs []map[string]any) map[string]any {
+	var merged map[string]any
+	for i, doc := range docs {
+		if doc == nil {
+			continue
+		}
+		if merged == nil {
+			merged = doc
+			continue
+		}
+
+		paths, _ := merged["paths"].(map[string]any)
+		if paths == nil {
+			paths = make(map[string]any)
+			merged["paths"] = paths
+		}
+		extraPaths, _ := doc["paths"].(map[string]any)
+		for path, item := range extraPaths {
+			if _, taken := paths[path]; taken {
+				path = fmt.Sprintf("/spec%d%s", i+1, path)
+			}
+			paths[path] = item
+		}
+
+		servers, _ := merged["servers"].([]any)
+		extraServers, _ := doc["servers"].([]any)
+		if len(extraServers) > 0 {
+			merged["servers"] = append(servers, extraServers...)
+		}
+
+		mergeComponents(merged, doc)
+	}
+	return merged
+}
+
+func mergeComponents(dst, src map[string]any) {
+	srcComponents, ok := src["components"].(map[string]any)
+	if !ok {
+		return
+	}
+	dstComponents, _ := dst["components"].(map[string]any)
+	if dstComponents == nil {
+		dstComponents = make(map[string]any)
+		dst["components"] = dstComponents
+	}
+	for section, rawEntries := range srcComponents {
+		entries, ok := rawEntries.(map[string]any)
+		if !ok {
+			continue
+		}
+		dstEntries, _ := dstComponents[section].(map[string]any)
+		if dstEntries == nil {
+			dstEntries = make(map[string]any, len(entries))
+			dstComponents[section] = dstEntries
+		}
+		for name, entry := range entries {
+			if _, taken := dstEntries[name]; !taken {
+				dstEntries[name] = entry
+			}
+		}
+	}
+}
@@ -18,17 +18,20 @@ func (fn RoundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
 
 func DummyConfig() config.Config {
 	return config.Config{
-		Tokens:           []string{"test-token-a", "test-token-b"},
-		Port:             8985,
-		QueueCapacity:    8,
-		AdmissionTimeout: 2 * time.Second,
-		AdditionalWindow: 150 * time.Millisecond,
-		ShutdownTimeout:  time.Second,
-		MetricsEnabled:   true,
-		PprofEnabled:     false,
-		SwaggerEnabled:   true,
-		UpstreamTimeout:  250 * time.Millisecond,
-		DefaultAppLimits: "20:1,100:120",
+		Tokens:                 []string{"test-token-a", "test-token-b"},
+		Port:                   8985,
+		QueueCapacity:          8,
+		AdmissionTimeout:       2 * time.Second,
+		AdmissionTimeoutHigh:   2 * time.Second,
+		AdmissionTimeoutNormal: 2 * time.Second,
+		AdditionalWindow:       150 * time.Millisecond,
+		ShutdownTimeout:        time.Second,
+		MetricsEnabled:         true,
+		PprofEnabled:           false,
+		SwaggerEnabled:         true,
+		AllowPriorityBypass:    true,
+		UpstreamTimeout:        250 * time.Millisecond,
+		DefaultAppLimits:       "20:1,100:120",
 		Server: config.ServerConfig{
 			ReadHeaderTimeout: 10 * time.Second,
 			ReadTimeout:       10 * time.Second,
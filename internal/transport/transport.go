@@ -1,59 +1,164 @@
 package transport
 
 import (
+	"cmp"
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/renja-g/RiftRelay/internal/httputil"
 )
 
+// Pool defaults used for zero Options fields.
+const (
+	DefaultMaxIdleConns        = 512
+	DefaultMaxIdleConnsPerHost = 256
+	DefaultIdleConnTimeout     = 90 * time.Second
+)
+
 const (
 	defaultDialTimeout           = 5 * time.Second
 	defaultDialKeepAlive         = 30 * time.Second
-	defaultMaxIdleConns          = 512
-	defaultMaxIdleConnsPerHost   = 256
-	defaultIdleConnTimeout       = 90 * time.Second
 	defaultTLSHandshakeTimeout   = 10 * time.Second
 	defaultExpectContinueTimeout = 1 * time.Second
 	defaultResponseHeaderTimeout = 15 * time.Second
 )
 
-func New() *http.Transport {
+// Options sizes the connection pool to Riot. Zero values fall back to the
+// package defaults; MaxConnsPerHost zero means unlimited.
+type Options struct {
+	MaxIdleConns        int
+	MaxIdleConnsPerHost int
+	MaxConnsPerHost     int
+	IdleConnTimeout     time.Duration
+	// HTTP2 is "auto" (negotiate via ALPN), "force" (HTTP/2 only, with prior
+	// knowledge for plain-http targets) or "disable" (HTTP/1.1 only). Empty
+	// means auto.
+	HTTP2 string
+}
+
+// New builds the upstream transport with the pool sized by cfg. cfg.HTTP2
+// selects how HTTP/2 is negotiated.
+func New(cfg Options) *http.Transport {
 	dialer := &net.Dialer{
 		Timeout:   defaultDialTimeout,
 		KeepAlive: defaultDialKeepAlive,
 	}
 
-	return &http.Transport{
+	t := &http.Transport{
 		Proxy:                 http.ProxyFromEnvironment,
 		DialContext:           dialer.DialContext,
 		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          defaultMaxIdleConns,
-		MaxIdleConnsPerHost:   defaultMaxIdleConnsPerHost,
-		MaxConnsPerHost:       0,
-		IdleConnTimeout:       defaultIdleConnTimeout,
+		MaxIdleConns:          cmp.Or(cfg.MaxIdleConns, DefaultMaxIdleConns),
+		MaxIdleConnsPerHost:   cmp.Or(cfg.MaxIdleConnsPerHost, DefaultMaxIdleConnsPerHost),
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       cmp.Or(cfg.IdleConnTimeout, DefaultIdleConnTimeout),
 		TLSHandshakeTimeout:   defaultTLSHandshakeTimeout,
 		ExpectContinueTimeout: defaultExpectContinueTimeout,
 		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
 	}
+	switch cfg.HTTP2 {
+	case "force":
+		// HTTP/2 only: required via ALPN over TLS, prior knowledge (h2c)
+		// for plain-http targets.
+		protocols := new(http.Protocols)
+		protocols.SetHTTP2(true)
+		protocols.SetUnencryptedHTTP2(true)
+		t.Protocols = protocols
+	case "disable":
+		// A non-nil, empty TLSNextProto keeps the transport on HTTP/1.1.
+		t.ForceAttemptHTTP2 = false
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t
 }
 
+// WithEgressProxy sends t's traffic through the proxy at rawURL instead of the
+// one from HTTP_PROXY/HTTPS_PROXY. http, https and socks5 proxies are
+// supported; credentials may be given in the URL.
+func WithEgressProxy(t *http.Transport, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("parse egress proxy URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("unsupported egress proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("egress proxy URL has no host")
+	}
+	t.Proxy = http.ProxyURL(u)
+	return nil
+}
+
+// WithRequestTimeout bounds the whole upstream exchange, including reading the
+// response body, to timeout.
 func WithRequestTimeout(base http.RoundTripper, timeout time.Duration) http.RoundTripper {
 	if timeout <= 0 {
 		return base
 	}
 	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
 		ctx, cancel := context.WithTimeout(r.Context(), timeout)
-		defer cancel()
-		return base.RoundTrip(r.Clone(ctx))
+		resp, err := base.RoundTrip(r.Clone(ctx))
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+		return resp, nil
 	})
 }
 
-func WithRetryAfter429(base http.RoundTripper, maxRetries int) http.RoundTripper {
+// cancelOnClose releases the request context once the body is consumed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// RetryObserver is told about every 429 retry WithRetryAfter429 performs and
+// how long it waits before it.
+type RetryObserver interface {
+	ObserveRetry(req *http.Request, wait time.Duration)
+}
+
+type noRetryKey struct{}
+
+// WithoutRetry marks ctx so WithRetryAfter429 returns the first 429 as is.
+func WithoutRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey{}, true)
+}
+
+func retryDisabled(ctx context.Context) bool {
+	disabled, _ := ctx.Value(noRetryKey{}).(bool)
+	return disabled
+}
+
+// RetryGate holds a 429 retry until it may be sent, in place of sleeping
+// through Retry-After. It receives the request about to be retried and returns
+// the request to send instead, or nil to fall back to the Retry-After sleep.
+type RetryGate func(req *http.Request) (*http.Request, error)
+
+// WithRetryAfter429 retries 429 responses after their Retry-After delay, or
+// after minDelay when that is longer, so "Retry-After: 0" does not retry
+// straight into the same limit. onRetry, if set, receives each 429 that is
+// about to be retried so the caller can record the block once instead of
+// waiting on it a second time. observer, if set, is told about each retry for
+// metrics. gate, if set, decides when each retry goes out instead of the
+// Retry-After delay.
+func WithRetryAfter429(base http.RoundTripper, maxRetries int, minDelay time.Duration, onRetry func(*http.Response), observer RetryObserver, gate RetryGate) http.RoundTripper {
 	if maxRetries <= 0 {
 		return base
 	}
@@ -61,21 +166,13 @@ func WithRetryAfter429(base http.RoundTripper, maxRetries int) http.RoundTripper
 	return roundTripperFunc(func(r *http.Request) (*http.Response, error) {
 		canRetryBody := canReplayRequestBody(r)
 
+		req := r
 		for attempt := 0; ; attempt++ {
-			req := r
-			if attempt > 0 {
-				clonedReq, err := cloneRequestForRetry(r)
-				if err != nil {
-					return nil, err
-				}
-				req = clonedReq
-			}
-
 			resp, err := base.RoundTrip(req)
 			if err != nil {
 				return nil, err
 			}
-			if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxRetries || !canRetryBody {
+			if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxRetries || !canRetryBody || retryDisabled(r.Context()) {
 				return resp, nil
 			}
 
@@ -83,32 +180,70 @@ func WithRetryAfter429(base http.RoundTripper, maxRetries int) http.RoundTripper
 			if !ok {
 				return resp, nil
 			}
+			if onRetry != nil {
+				onRetry(resp)
+			}
+			// The gate only knows the header's delay, so a gated retry
+			// sleeps out a delay raised to minDelay itself.
+			raised := waitFor < minDelay
+			waitFor = max(waitFor, minDelay)
+			if observer != nil {
+				observer.ObserveRetry(r, max(waitFor, 0))
+			}
 
 			if resp.Body != nil {
 				_, _ = io.Copy(io.Discard, resp.Body)
 				_ = resp.Body.Close()
 			}
 
-			if waitFor <= 0 {
-				continue
+			if req, err = cloneRequestForRetry(r); err != nil {
+				return nil, err
 			}
-
-			timer := time.NewTimer(waitFor)
-			select {
-			case <-timer.C:
-			case <-r.Context().Done():
-				if !timer.Stop() {
-					select {
-					case <-timer.C:
-					default:
+			var slept time.Duration
+			if gate != nil {
+				if raised {
+					if err := sleepContext(r.Context(), waitFor); err != nil {
+						return nil, err
 					}
+					slept = waitFor
+				}
+				gated, err := gate(req)
+				if err != nil {
+					return nil, err
 				}
-				return nil, r.Context().Err()
+				if gated != nil {
+					req = gated
+					continue
+				}
+			}
+
+			if err := sleepContext(r.Context(), waitFor-slept); err != nil {
+				return nil, err
 			}
 		}
 	})
 }
 
+// sleepContext waits for d, or returns ctx's error if it ends first.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		return ctx.Err()
+	}
+}
+
 func canReplayRequestBody(r *http.Request) bool {
 	return r.Body == nil || r.Body == http.NoBody || r.GetBody != nil
 }
@@ -2,12 +2,15 @@ package transport
 
 import (
 	"context"
+	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"sync/atomic"
 	"testing"
 	"testing/synctest"
 	"time"
-
-	"github.com/renja-g/RiftRelay/internal/testutil"
 )
 
 func TestWithRequestTimeout(t *testing.T) {
@@ -15,7 +18,7 @@ func TestWithRequestTimeout(t *testing.T) {
 
 	const timeout = 250 * time.Millisecond
 
-	rt := WithRequestTimeout(testutil.RoundTripperFunc(func(r *http.Request) (*http.Response, error) {
+	rt := WithRequestTimeout(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
 		deadline, ok := r.Context().Deadline()
 		if !ok {
 			t.Fatal("Context().Deadline() ok = false, want true")
@@ -23,7 +26,7 @@ func TestWithRequestTimeout(t *testing.T) {
 		if got := time.Until(deadline); got <= 0 || got > timeout {
 			t.Fatalf("time.Until(deadline) = %v, want (0,%v]", got, timeout)
 		}
-		return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
+		return httpResponse(http.StatusNoContent, nil), nil
 	}), timeout)
 
 	resp, err := rt.RoundTrip(httptestRequest(t))
@@ -33,19 +36,124 @@ func TestWithRequestTimeout(t *testing.T) {
 	_ = resp.Body.Close()
 }
 
+func TestNewSizesConnectionPool(t *testing.T) {
+	t.Parallel()
+
+	rt := New(Options{
+		MaxIdleConns:        64,
+		MaxIdleConnsPerHost: 16,
+		MaxConnsPerHost:     32,
+		IdleConnTimeout:     45 * time.Second,
+	})
+	if rt.MaxIdleConns != 64 || rt.MaxIdleConnsPerHost != 16 || rt.MaxConnsPerHost != 32 || rt.IdleConnTimeout != 45*time.Second {
+		t.Fatalf("pool = (%d, %d, %d, %v), want (64, 16, 32, 45s)", rt.MaxIdleConns, rt.MaxIdleConnsPerHost, rt.MaxConnsPerHost, rt.IdleConnTimeout)
+	}
+
+	rt = New(Options{})
+	if rt.MaxIdleConns != DefaultMaxIdleConns || rt.MaxIdleConnsPerHost != DefaultMaxIdleConnsPerHost || rt.MaxConnsPerHost != 0 || rt.IdleConnTimeout != DefaultIdleConnTimeout {
+		t.Fatalf("default pool = (%d, %d, %d, %v), want package defaults", rt.MaxIdleConns, rt.MaxIdleConnsPerHost, rt.MaxConnsPerHost, rt.IdleConnTimeout)
+	}
+}
+
+func TestNewHTTP2Modes(t *testing.T) {
+	t.Parallel()
+
+	for _, mode := range []string{"", "auto"} {
+		rt := New(Options{HTTP2: mode})
+		if !rt.ForceAttemptHTTP2 || rt.TLSNextProto != nil || rt.Protocols != nil {
+			t.Fatalf("HTTP2=%q: ForceAttemptHTTP2 = %v, TLSNextProto = %v, Protocols = %v, want ALPN negotiation", mode, rt.ForceAttemptHTTP2, rt.TLSNextProto, rt.Protocols)
+		}
+	}
+
+	rt := New(Options{HTTP2: "force"})
+	if rt.Protocols == nil || !rt.Protocols.HTTP2() || !rt.Protocols.UnencryptedHTTP2() || rt.Protocols.HTTP1() {
+		t.Fatalf("HTTP2=force: Protocols = %v, want HTTP2 and UnencryptedHTTP2 only", rt.Protocols)
+	}
+
+	rt = New(Options{HTTP2: "disable"})
+	if rt.ForceAttemptHTTP2 || rt.TLSNextProto == nil || len(rt.TLSNextProto) != 0 {
+		t.Fatalf("HTTP2=disable: ForceAttemptHTTP2 = %v, TLSNextProto = %v, want false and an empty map", rt.ForceAttemptHTTP2, rt.TLSNextProto)
+	}
+}
+
+func TestNewForceHTTP2UsesPriorKnowledge(t *testing.T) {
+	t.Parallel()
+
+	var proto atomic.Value
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proto.Store(r.Proto)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	defer server.Close()
+
+	client := &http.Client{Transport: New(Options{HTTP2: "force"})}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("Get() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if got, want := proto.Load(), "HTTP/2.0"; got != want {
+		t.Fatalf("server saw %v, want %s", got, want)
+	}
+}
+
+func TestWithEgressProxy(t *testing.T) {
+	t.Parallel()
+
+	var proxied atomic.Value
+	stub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy receives the absolute target URL.
+		proxied.Store(r.URL.String())
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer stub.Close()
+
+	rt := New(Options{})
+	if err := WithEgressProxy(rt, stub.URL); err != nil {
+		t.Fatalf("WithEgressProxy() error = %v", err)
+	}
+	req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, "http://example.invalid/test", nil)
+	if err != nil {
+		t.Fatalf("http.NewRequestWithContext() error = %v", err)
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("RoundTrip() error = %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if got, want := resp.StatusCode, http.StatusNoContent; got != want {
+		t.Fatalf("status = %d, want %d", got, want)
+	}
+	if got, want := proxied.Load(), "http://example.invalid/test"; got != want {
+		t.Fatalf("proxied URL = %v, want %q", got, want)
+	}
+}
+
+func TestWithEgressProxyRejectsUnsupportedScheme(t *testing.T) {
+	t.Parallel()
+
+	if err := WithEgressProxy(New(Options{}), "ftp://proxy.internal:21"); err == nil {
+		t.Fatal("WithEgressProxy() error = nil, want unsupported scheme")
+	}
+}
+
 func TestWithRetryAfter429(t *testing.T) {
 	t.Run("retries after retry-after response", func(t *testing.T) {
 		synctest.Test(t, func(t *testing.T) {
 			attempts := 0
-			rt := WithRetryAfter429(testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
+			rt := WithRetryAfter429(roundTripperFunc(func(*http.Request) (*http.Response, error) {
 				attempts++
 				if attempts == 1 {
-					return testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+					return httpResponse(http.StatusTooManyRequests, http.Header{
 						"Retry-After": []string{"2"},
 					}), nil
 				}
-				return testutil.HTTPResponse(http.StatusNoContent, "", nil), nil
-			}), 2)
+				return httpResponse(http.StatusNoContent, nil), nil
+			}), 2, 0, nil, nil, nil)
 
 			done := make(chan error, 1)
 			go func() {
@@ -69,13 +177,83 @@ func TestWithRetryAfter429(t *testing.T) {
 		})
 	})
 
+	t.Run("raises a short retry-after to the minimum delay", func(t *testing.T) {
+		for _, gated := range []bool{false, true} {
+			t.Run(fmt.Sprintf("gated=%t", gated), func(t *testing.T) {
+				synctest.Test(t, func(t *testing.T) {
+					var sent []time.Time
+					var gate RetryGate
+					if gated {
+						gate = func(req *http.Request) (*http.Request, error) { return req, nil }
+					}
+					rt := WithRetryAfter429(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+						sent = append(sent, time.Now())
+						if len(sent) == 1 {
+							return httpResponse(http.StatusTooManyRequests, http.Header{
+								"Retry-After": []string{"0"},
+							}), nil
+						}
+						return httpResponse(http.StatusNoContent, nil), nil
+					}), 2, 500*time.Millisecond, nil, nil, gate)
+
+					resp, err := rt.RoundTrip(httptestRequest(t))
+					if err != nil {
+						t.Fatalf("RoundTrip() error = %v", err)
+					}
+					_ = resp.Body.Close()
+					if len(sent) != 2 {
+						t.Fatalf("attempts = %d, want 2", len(sent))
+					}
+					if got, want := sent[1].Sub(sent[0]), 500*time.Millisecond; got != want {
+						t.Fatalf("retry delay = %v, want %v", got, want)
+					}
+				})
+			})
+		}
+	})
+
+	t.Run("gate replaces the retry-after sleep", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			var tokens []string
+			rt := WithRetryAfter429(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+				tokens = append(tokens, r.Header.Get("X-Riot-Token"))
+				if len(tokens) == 1 {
+					return httpResponse(http.StatusTooManyRequests, http.Header{
+						"Retry-After": []string{"10"},
+					}), nil
+				}
+				return httpResponse(http.StatusNoContent, nil), nil
+			}), 2, 0, nil, nil, func(req *http.Request) (*http.Request, error) {
+				time.Sleep(time.Second)
+				req.Header.Set("X-Riot-Token", "other")
+				return req, nil
+			})
+
+			start := time.Now()
+			req := httptestRequest(t)
+			req.Header.Set("X-Riot-Token", "first")
+			resp, err := rt.RoundTrip(req)
+			if err != nil {
+				t.Fatalf("RoundTrip() error = %v", err)
+			}
+			_ = resp.Body.Close()
+
+			if got, want := time.Since(start), time.Second; got != want {
+				t.Fatalf("retry sent after %v, want %v", got, want)
+			}
+			if want := []string{"first", "other"}; !slices.Equal(tokens, want) {
+				t.Fatalf("tokens = %v, want %v", tokens, want)
+			}
+		})
+	})
+
 	t.Run("honors context cancellation while waiting", func(t *testing.T) {
 		synctest.Test(t, func(t *testing.T) {
-			rt := WithRetryAfter429(testutil.RoundTripperFunc(func(*http.Request) (*http.Response, error) {
-				return testutil.HTTPResponse(http.StatusTooManyRequests, "", http.Header{
+			rt := WithRetryAfter429(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+				return httpResponse(http.StatusTooManyRequests, http.Header{
 					"Retry-After": []string{"10"},
 				}), nil
-			}), 2)
+			}), 2, 0, nil, nil, nil)
 
 			ctx, cancel := context.WithCancel(context.Background())
 			req := httptestRequest(t).Clone(ctx)
@@ -97,6 +275,47 @@ func TestWithRetryAfter429(t *testing.T) {
 	})
 }
 
+type recordingRetryObserver struct {
+	waits []time.Duration
+}
+
+func (o *recordingRetryObserver) ObserveRetry(_ *http.Request, wait time.Duration) {
+	o.waits = append(o.waits, wait)
+}
+
+func TestWithRetryAfter429ObservesRetries(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		attempts := 0
+		observer := &recordingRetryObserver{}
+		rt := WithRetryAfter429(roundTripperFunc(func(*http.Request) (*http.Response, error) {
+			attempts++
+			if attempts <= 2 {
+				return httpResponse(http.StatusTooManyRequests, http.Header{
+					"Retry-After": []string{strconv.Itoa(attempts)},
+				}), nil
+			}
+			return httpResponse(http.StatusNoContent, nil), nil
+		}), 3, 0, nil, observer, nil)
+
+		resp, err := rt.RoundTrip(httptestRequest(t))
+		if err != nil {
+			t.Fatalf("RoundTrip() error = %v", err)
+		}
+		_ = resp.Body.Close()
+
+		if got, want := observer.waits, []time.Duration{time.Second, 2 * time.Second}; !slices.Equal(got, want) {
+			t.Fatalf("observed waits = %v, want %v", got, want)
+		}
+	})
+}
+
+func httpResponse(statusCode int, header http.Header) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{StatusCode: statusCode, Header: header, Body: http.NoBody}
+}
+
 func httptestRequest(t *testing.T) *http.Request {
 	t.Helper()
 
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"log"
+	"os"
 	"os/signal"
 	"syscall"
 
@@ -24,6 +25,22 @@ func main() {
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	// SIGHUP re-reads RIOT_TOKEN_FILE (or RIOT_TOKEN) and swaps the keys in
+	// place, so a rotation does not drop in-flight requests.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			tokens, err := config.LoadTokens()
+			if err == nil {
+				err = server.ReloadKeys(ctx, tokens)
+			}
+			if err != nil {
+				log.Printf("key reload failed, keeping the current keys: %v", err)
+			}
+		}
+	}()
+
 	if err := server.Start(ctx); err != nil {
 		log.Fatalf("server exited with error: %v", err)
 	}